@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ACL_EVERYONE     = "*"
+	ACL_GROUP_PREFIX = "@"
+)
+
+// aclRule restricts a library path prefix. A user may access paths below
+// Path when Allow is empty or names them, and Deny does not. Principals are
+// user names, "@group" or "*" for everyone, including anonymous requests.
+type aclRule struct {
+	Path  string   `json:"path"`
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// aclRules are loaded from ACL_RULES and sorted longest path first, so the
+// most specific rule for a path decides.
+var aclRules []aclRule
+
+// initACL loads ACL_RULES, given as inline JSON or a file path:
+//
+//	[{"path": "Private/", "allow": ["alice"]}, {"path": "Kids/", "allow": ["@kids", "@parents"]}]
+func initACL() error {
+	raw := strings.TrimSpace(os.Getenv("ACL_RULES"))
+	if raw == "" {
+		return nil
+	}
+	if !strings.HasPrefix(raw, "[") {
+		b, err := os.ReadFile(raw)
+		if err != nil {
+			return fmt.Errorf("read ACL_RULES: %w", err)
+		}
+		raw = string(b)
+	}
+	rules, err := parseACLRules([]byte(raw))
+	if err != nil {
+		return err
+	}
+	aclRules = rules
+	if !authEnabled() {
+		log.Printf("Warning: ACL_RULES without AUTH_USERS; only rules for %q apply", ACL_EVERYONE)
+	}
+	log.Printf("Access control rules configured: %d", len(rules))
+	return nil
+}
+
+func parseACLRules(b []byte) ([]aclRule, error) {
+	var rules []aclRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("parse ACL_RULES: %w", err)
+	}
+	for i := range rules {
+		p := strings.Trim(rules[i].Path, "/")
+		if p == "" || strings.Contains(p, "..") {
+			return nil, fmt.Errorf("ACL rule %d: path must be a library directory", i+1)
+		}
+		rules[i].Path = p + "/"
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].Path) > len(rules[j].Path) })
+	return rules, nil
+}
+
+// aclAccess answers access questions for one user. A nil *aclAccess, used
+// when no rules are configured, allows everything.
+type aclAccess struct {
+	user *authUser
+}
+
+// accessFor returns the access checker for the request's user; requests on
+// routes without sign-in are checked as anonymous.
+func accessFor(c *gin.Context) *aclAccess {
+	if len(aclRules) == 0 {
+		return nil
+	}
+	return &aclAccess{user: currentUser(c)}
+}
+
+type aclContextKey struct{}
+
+// withAccess stores a for code that only receives a context.Context, such
+// as the WebDAV file system.
+func withAccess(ctx context.Context, a *aclAccess) context.Context {
+	return context.WithValue(ctx, aclContextKey{}, a)
+}
+
+func accessFromContext(ctx context.Context) *aclAccess {
+	a, _ := ctx.Value(aclContextKey{}).(*aclAccess)
+	return a
+}
+
+// userName is the signed-in user's name, or "" for anonymous access and when
+// no rules are configured.
+func (a *aclAccess) userName() string {
+	if a == nil || a.user == nil {
+		return ""
+	}
+	return a.user.Name
+}
+
+func (a *aclAccess) matches(principals []string) bool {
+	for _, p := range principals {
+		switch {
+		case p == ACL_EVERYONE:
+			return true
+		case a.user == nil:
+			continue
+		case strings.HasPrefix(p, ACL_GROUP_PREFIX):
+			for _, g := range a.user.Groups {
+				if g == p[len(ACL_GROUP_PREFIX):] {
+					return true
+				}
+			}
+		case p == a.user.Name:
+			return true
+		}
+	}
+	return false
+}
+
+func (a *aclAccess) permits(rule aclRule) bool {
+	return (len(rule.Allow) == 0 || a.matches(rule.Allow)) && !a.matches(rule.Deny)
+}
+
+// aclKey cleans key like localAbsPath does, so "./" and "a/../" segments
+// cannot step around a rule. Keys that leave the library are rejected and
+// a trailing slash is kept.
+func aclKey(key string) (string, bool) {
+	key = strings.TrimPrefix(strings.ReplaceAll(key, `\`, "/"), "/")
+	if key == "" {
+		return "", true
+	}
+	dir := strings.HasSuffix(key, "/")
+	key = path.Clean(key)
+	switch {
+	case key == ".." || strings.HasPrefix(key, "../"):
+		return "", false
+	case key == ".":
+		return "", true
+	case dir:
+		key += "/"
+	}
+	return key, true
+}
+
+// allowed reports whether the user may access the file or directory key.
+// Directory keys end in "/".
+func (a *aclAccess) allowed(key string) bool {
+	if a == nil {
+		return true
+	}
+	key, ok := aclKey(key)
+	if !ok {
+		return false
+	}
+	for _, rule := range aclRules {
+		if strings.HasPrefix(key, rule.Path) || key+"/" == rule.Path {
+			return a.permits(rule)
+		}
+	}
+	return true
+}
+
+// dirVisible reports whether dir should be listed: either it is allowed or
+// a rule below it grants access, so the user can navigate to that subtree.
+func (a *aclAccess) dirVisible(dir string) bool {
+	if a == nil {
+		return true
+	}
+	dir, ok := aclKey(dir)
+	if !ok {
+		return false
+	}
+	dir = strings.Trim(dir, "/")
+	if dir == "" || a.allowed(dir+"/") {
+		return true
+	}
+	for _, rule := range aclRules {
+		if strings.HasPrefix(rule.Path, dir+"/") && a.permits(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterFiles drops the files the user may not access.
+func (a *aclAccess) filterFiles(keys []string) []string {
+	if a == nil {
+		return keys
+	}
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if a.allowed(k) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// filterDirs drops the directories the user may not see.
+func (a *aclAccess) filterDirs(dirs []string) []string {
+	if a == nil {
+		return dirs
+	}
+	out := make([]string, 0, len(dirs))
+	for _, d := range dirs {
+		if a.dirVisible(d) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// filterListing applies the rules to a listing of prefix, whose entries are
+// names relative to it.
+func (a *aclAccess) filterListing(prefix string, l dirListing) dirListing {
+	if a == nil {
+		return l
+	}
+	keep := func(names []string, ok func(string) bool) []string {
+		var out []string
+		for _, n := range names {
+			if ok(path.Join(prefix, n)) {
+				out = append(out, n)
+			}
+		}
+		return out
+	}
+	l.Dirs = keep(l.Dirs, a.dirVisible)
+	l.Files = keep(l.Files, a.allowed)
+	l.Playlists = keep(l.Playlists, a.allowed)
+	l.Images = keep(l.Images, a.allowed)
+	return l
+}
+
+// aclDenied answers 404 for keys the user may not access, so restricted
+// files are indistinguishable from missing ones.
+func aclDenied(c *gin.Context, key string) bool {
+	if accessFor(c).allowed(key) {
+		return false
+	}
+	c.String(http.StatusNotFound, "Audio not found")
+	c.Abort()
+	return true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withACLRules installs rules for the duration of a test
+func withACLRules(t *testing.T, raw string) {
+	t.Helper()
+	orig := aclRules
+	t.Cleanup(func() { aclRules = orig })
+	rules, err := parseACLRules([]byte(raw))
+	assert.NoError(t, err)
+	aclRules = rules
+}
+
+// TestACLRules checks rule parsing, precedence and directory visibility
+func TestACLRules(t *testing.T) {
+	_, err := parseACLRules([]byte(`[{"path":"/"}]`))
+	assert.Error(t, err)
+	_, err = parseACLRules([]byte(`[{"path":"a/../b"}]`))
+	assert.Error(t, err)
+
+	withACLRules(t, `[
+		{"path":"Private","allow":["alice"]},
+		{"path":"Private/Shared/","allow":["@family"]},
+		{"path":"Kids/","deny":["bob"]}
+	]`)
+	alice := &aclAccess{user: &authUser{Name: "alice"}}
+	bob := &aclAccess{user: &authUser{Name: "bob", Groups: []string{"family"}}}
+	anon := &aclAccess{}
+
+	assert.True(t, alice.allowed("Private/song.mp3"))
+	assert.False(t, bob.allowed("Private/song.mp3"))
+	assert.False(t, anon.allowed("Private/"))
+	assert.True(t, bob.allowed("Private/Shared/song.mp3"), "the longest rule decides")
+	assert.False(t, alice.allowed("Private/Shared/song.mp3"))
+	assert.False(t, bob.allowed("Kids/song.mp3"))
+	assert.True(t, anon.allowed("Kids/song.mp3"))
+	assert.True(t, anon.allowed("PrivateEye/song.mp3"), "rules match whole directories")
+	assert.False(t, bob.allowed("./Private/song.mp3"))
+	assert.False(t, bob.allowed("Kids/../Private/song.mp3"))
+	assert.False(t, bob.allowed("/./Private//song.mp3"))
+	assert.False(t, anon.allowed("../Private/song.mp3"))
+	assert.False(t, anon.dirVisible("./Private/"))
+
+	assert.True(t, bob.dirVisible("Private"), "a granted subdirectory keeps its parent navigable")
+	assert.False(t, anon.dirVisible("Private"))
+	assert.True(t, anon.dirVisible(""))
+
+	var none *aclAccess
+	assert.True(t, none.allowed("Private/song.mp3"))
+	assert.Equal(t, []string{"Private/"}, bob.filterDirs([]string{"Private/", "Private/Other/", "Kids/"}))
+}
+
+// TestACLEnforcement checks listings, searches and file access through the router
+func TestACLEnforcement(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	origLocalMusicDir := localMusicDir
+	defer func() { localMusicDir = origLocalMusicDir }()
+	localMusicDir = tmpDir
+
+	for _, f := range []string{"Public/song.mp3", "Private/secret song.mp3", "Private/mix.m3u"} {
+		os.MkdirAll(filepath.Join(tmpDir, filepath.Dir(f)), 0755)
+		os.WriteFile(filepath.Join(tmpDir, f), []byte("data"), 0644)
+	}
+	os.WriteFile(filepath.Join(tmpDir, "Private", "mix.m3u"), []byte("secret song.mp3\n"), 0644)
+
+	withAuthUsers(t, map[string]*authUser{
+		"alice": {Password: bcryptHash(t, "sesame")},
+		"bob":   {Password: bcryptHash(t, "sesame")},
+	})
+	withACLRules(t, `[{"path":"Private/","allow":["alice"]}]`)
+
+	api := func(user, function, data string) map[string]any {
+		body, _ := json.Marshal(map[string]string{"function": function, "data": data})
+		req := httptest.NewRequest("POST", "/api", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth(user, "sesame")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp map[string]any
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+	get := func(user, target string) int {
+		req := httptest.NewRequest("GET", target, nil)
+		req.SetBasicAuth(user, "sesame")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Len(t, api("alice", "searchTitle", "song")["titles"], 2)
+	assert.Len(t, api("bob", "searchTitle", "song")["titles"], 1)
+	assert.Len(t, api("bob", "getAllMp3", "")["files"], 1)
+	assert.Len(t, api("bob", "searchDir", "Priv")["dirs"], 0)
+	assert.Len(t, api("bob", "dir", "")["dirs"], 1)
+	assert.Equal(t, "error", api("bob", "dir", "Private/")["status"])
+	assert.Equal(t, "error", api("bob", "resolvePlaylist", "Private/mix.m3u")["status"])
+	assert.Len(t, api("alice", "resolvePlaylist", "Private/mix.m3u")["files"], 1)
+
+	assert.Equal(t, http.StatusOK, get("alice", "/localdisk/Private/secret%20song.mp3"))
+	assert.Equal(t, http.StatusNotFound, get("bob", "/localdisk/Private/secret%20song.mp3"))
+	assert.Equal(t, http.StatusNotFound, get("bob", "/audio/Private/secret%20song.mp3"))
+	assert.Equal(t, http.StatusNotFound, get("bob", "/download/Private/"))
+	assert.Equal(t, http.StatusOK, get("bob", "/localdisk/Public/song.mp3"))
+	for _, route := range []string{"/localdisk/", "/audio/", "/stream/", "/preview/", "/download/"} {
+		assert.NotEqual(t, http.StatusOK, get("bob", route+"./Private/secret%20song.mp3"), route)
+		assert.NotEqual(t, http.StatusOK, get("bob", route+"Public/../Private/secret%20song.mp3"), route)
+	}
+
+	// Tokenised feeds skip sign-in and use the rules of the user who copied them.
+	origSecret := feedSecret
+	defer func() { feedSecret = origSecret }()
+	feedSecret = "s3cret"
+	assert.Equal(t, "error", api("bob", "feedUrl", "Private")["status"])
+	feed, err := url.Parse(api("alice", "feedUrl", "Private")["url"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", feed.Query().Get(FEED_OWNER_PARAM))
+	assert.Equal(t, http.StatusOK, get("", feed.RequestURI()))
+	assert.Equal(t, http.StatusForbidden, get("", strings.Replace(feed.RequestURI(), "u=alice", "u=bob", 1)))
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	API_KEY_PREFIX         = "gmk_"
+	API_KEY_CTX            = "apiKey" // gin context key of the request's *apiKey
+	API_KEYS_FILE          = "apikeys.json"
+	API_KEY_TOUCH_INTERVAL = time.Minute
+
+	SCOPE_READ     = "read"
+	SCOPE_STREAM   = "stream"
+	SCOPE_DOWNLOAD = "download"
+	SCOPE_ADMIN    = "admin"
+)
+
+var apiKeyScopes = []string{SCOPE_READ, SCOPE_STREAM, SCOPE_DOWNLOAD, SCOPE_ADMIN}
+
+// apiFunctionScopes maps every /api function to the scope it needs.
+// Functions missing from it need the admin scope.
+var apiFunctionScopes = map[string]string{
+	"dir":                 SCOPE_READ,
+	"searchInDir":         SCOPE_READ,
+	"searchTitle":         SCOPE_READ,
+	"searchDir":           SCOPE_READ,
+	"getAllMp3":           SCOPE_READ,
+	"getAllMp3InDir":      SCOPE_READ,
+	"getAllDirs":          SCOPE_READ,
+	"getAllMp3InDirs":     SCOPE_READ,
+	"importPlaylist":      SCOPE_READ,
+	"resolvePlaylist":     SCOPE_READ,
+	"listPlaylists":       SCOPE_READ,
+	"getPlaylist":         SCOPE_READ,
+	"listSmartPlaylists":  SCOPE_READ,
+	"smartPlaylistTracks": SCOPE_READ,
+	"stats":               SCOPE_READ,
+	"getPlayState":        SCOPE_READ,
+	"getRatings":          SCOPE_READ,
+	"starred":             SCOPE_READ,
+	"scrobbleSettings":    SCOPE_READ,
+
+	// Feed URLs carry tokens that stream media.
+	"feedUrl": SCOPE_STREAM,
+
+	"createShare":  SCOPE_ADMIN,
+	"listShares":   SCOPE_ADMIN,
+	"revokeShare":  SCOPE_ADMIN,
+	"createApiKey": SCOPE_ADMIN,
+	"listApiKeys":  SCOPE_ADMIN,
+	"revokeApiKey": SCOPE_ADMIN,
+
+	"createPlaylist":       SCOPE_ADMIN,
+	"renamePlaylist":       SCOPE_ADMIN,
+	"deletePlaylist":       SCOPE_ADMIN,
+	"duplicatePlaylist":    SCOPE_ADMIN,
+	"addPlaylistTracks":    SCOPE_ADMIN,
+	"removePlaylistTracks": SCOPE_ADMIN,
+	"movePlaylistTrack":    SCOPE_ADMIN,
+	"setPlaylistTracks":    SCOPE_ADMIN,
+	"saveSmartPlaylist":    SCOPE_ADMIN,
+	"deleteSmartPlaylist":  SCOPE_ADMIN,
+
+	"playEvent":     SCOPE_STREAM,
+	"savePlayState": SCOPE_STREAM,
+
+	"star":      SCOPE_ADMIN,
+	"unstar":    SCOPE_ADMIN,
+	"setRating": SCOPE_ADMIN,
+
+	"setListenBrainzToken": SCOPE_ADMIN,
+	"disconnectLastfm":     SCOPE_ADMIN,
+}
+
+// apiKey is a credential for scripts. Only a SHA-256 hash of the secret is
+// stored; secrets are long random strings, so a slow hash adds nothing. A key
+// acts as User, when set, for access control.
+type apiKey struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Hash     string    `json:"hash"`
+	Scopes   []string  `json:"scopes"`
+	User     string    `json:"user,omitempty"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires,omitzero"`
+	LastUsed time.Time `json:"lastUsed,omitzero"`
+}
+
+func (k *apiKey) expired(now time.Time) bool {
+	return !k.Expires.IsZero() && !now.Before(k.Expires)
+}
+
+// allows reports whether the key grants scope; admin grants every scope.
+func (k *apiKey) allows(scope string) bool {
+	return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, SCOPE_ADMIN)
+}
+
+var apiKeys = newAPIKeyStore()
+
+// apiKeyStore keeps the keys in the apikeys.json state document. Last-used
+// times are written at most once per API_KEY_TOUCH_INTERVAL per key.
+type apiKeyStore struct {
+	doc *stateDoc[[]*apiKey]
+}
+
+func newAPIKeyStore() *apiKeyStore {
+	return &apiKeyStore{doc: &stateDoc[[]*apiKey]{name: API_KEYS_FILE}}
+}
+
+func initAPIKeys() error {
+	_, err := apiKeys.doc.get()
+	return err
+}
+
+func (s *apiKeyStore) add(k *apiKey) error {
+	_, err := s.doc.update(func(keys *[]*apiKey) error {
+		*keys = append(slices.DeleteFunc(*keys, func(old *apiKey) bool { return old.ID == k.ID }), k)
+		return nil
+	})
+	return err
+}
+
+func (s *apiKeyStore) remove(id string) (bool, error) {
+	if s.find(id) == nil {
+		return false, nil
+	}
+	_, err := s.doc.update(func(keys *[]*apiKey) error {
+		*keys = slices.DeleteFunc(*keys, func(k *apiKey) bool { return k.ID == id })
+		return nil
+	})
+	return err == nil, err
+}
+
+// find looks id up, reading the keys again if it is not cached.
+func (s *apiKeyStore) find(id string) *apiKey {
+	keys, err := s.doc.get()
+	if i := slices.IndexFunc(keys, func(k *apiKey) bool { return k.ID == id }); i >= 0 {
+		return keys[i]
+	}
+	if keys, err = s.doc.refresh(); err != nil {
+		log.Printf("API key load error: %v", err)
+	}
+	if i := slices.IndexFunc(keys, func(k *apiKey) bool { return k.ID == id }); i >= 0 {
+		return keys[i]
+	}
+	return nil
+}
+
+// list returns copies of all keys, newest first.
+func (s *apiKeyStore) list() []apiKey {
+	keys, err := s.doc.get()
+	if err != nil {
+		log.Printf("API key load error: %v", err)
+	}
+	out := make([]apiKey, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, *k)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out
+}
+
+// verify checks a presented key and records its use.
+func (s *apiKeyStore) verify(token string, now time.Time) (*apiKey, bool) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, API_KEY_PREFIX), "_")
+	if !ok {
+		return nil, false
+	}
+	k := s.find(id)
+	if k == nil || k.expired(now) || subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hashAPIKey(secret))) != 1 {
+		return nil, false
+	}
+	if now.Sub(k.LastUsed) >= API_KEY_TOUCH_INTERVAL {
+		s.touch(id, now)
+	}
+	return k, true
+}
+
+func (s *apiKeyStore) touch(id string, now time.Time) {
+	_, err := s.doc.update(func(keys *[]*apiKey) error {
+		for _, k := range *keys {
+			if k.ID == id {
+				k.LastUsed = now.UTC()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("API key save error: %v", err)
+	}
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey returns a key and the secret to hand to the client, in the form
+// gmk_<id>_<secret>.
+func newAPIKey() (*apiKey, string, error) {
+	id := make([]byte, 6)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	k := &apiKey{ID: hex.EncodeToString(id), Created: time.Now().UTC()}
+	s := base64.RawURLEncoding.EncodeToString(secret)
+	k.Hash = hashAPIKey(s)
+	return k, API_KEY_PREFIX + k.ID + "_" + s, nil
+}
+
+// --- Middleware ---
+
+// presentedAPIKey returns the key sent as "Authorization: Bearer gmk_..." or
+// "Authorization: ApiKey gmk_...".
+func presentedAPIKey(c *gin.Context) (string, bool) {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !(strings.EqualFold(scheme, "Bearer") || strings.EqualFold(scheme, "ApiKey")) {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, strings.HasPrefix(token, API_KEY_PREFIX)
+}
+
+// apiKeyMiddleware authenticates requests that carry an API key and checks
+// the key's scope for the route. It runs ahead of authMiddleware, which
+// lets key-authenticated requests through.
+func apiKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := presentedAPIKey(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		k, ok := apiKeys.verify(token, time.Now())
+		if ok && k.User != "" {
+			// Keys stop working when their user's account is removed.
+			var u *authUser
+			u, ok = authUsers[k.User]
+			c.Set(AUTH_USER_KEY, u)
+		}
+		if !ok {
+			time.Sleep(AUTH_FAILURE_DELAY)
+			apiKeyFail(c, http.StatusUnauthorized, V2_UNAUTHORIZED, "Invalid API key")
+			return
+		}
+		if scope := requiredScope(c); !k.allows(scope) {
+			apiKeyFail(c, http.StatusForbidden, V2_FORBIDDEN, "API key lacks the "+scope+" scope")
+			return
+		}
+		c.Set(API_KEY_CTX, k)
+		c.Next()
+	}
+}
+
+// apiKeyFail refuses a key, with a typed error on API v2.
+func apiKeyFail(c *gin.Context, status int, code, message string) {
+	if isAPIv2(c) {
+		v2Fail(c, status, code, message)
+		return
+	}
+	c.AbortWithStatusJSON(status, gin.H{"status": "error", "message": message})
+}
+
+func currentAPIKey(c *gin.Context) *apiKey {
+	if k, ok := c.Get(API_KEY_CTX); ok {
+		return k.(*apiKey)
+	}
+	return nil
+}
+
+// requiredScope maps a request to the scope it needs.
+func requiredScope(c *gin.Context) string {
+	p := c.Request.URL.Path
+	switch {
+	case p == "/api":
+		return apiFunctionScope(c)
+	case p == "/download" || strings.HasPrefix(p, "/download/") || strings.HasPrefix(p, "/playlist/export"):
+		return SCOPE_DOWNLOAD
+	case strings.HasPrefix(p, "/dav/") && (c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead):
+		return SCOPE_STREAM
+	case strings.HasPrefix(p, "/scrobble/") || p == EVENTS_S3_PATH:
+		return SCOPE_ADMIN
+	}
+	for _, prefix := range []string{"/audio/", "/stream/", "/localdisk/", "/preview/", "/radio", "/feed/", REMOTE_PATH} {
+		if strings.HasPrefix(p, prefix) {
+			return SCOPE_STREAM
+		}
+	}
+	return SCOPE_READ
+}
+
+// apiFunctionScope looks up the scope of a POST /api request's function,
+// bound exactly as handleRequest will see it.
+func apiFunctionScope(c *gin.Context) string {
+	req, err := bindAPIRequest(c)
+	if err != nil {
+		return SCOPE_ADMIN
+	}
+	if scope, ok := apiFunctionScopes[req.Function]; ok {
+		return scope
+	}
+	return SCOPE_ADMIN
+}
+
+// --- Admin API functions ---
+
+// handleCreateApiKey creates a key. The secret is only returned here.
+func handleCreateApiKey(c *gin.Context, raw string) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Admin access required"})
+		return
+	}
+	var req struct {
+		Name    string   `json:"name"`
+		Scopes  []string `json:"scopes"`
+		User    string   `json:"user"`
+		Expires string   `json:"expires"`
+	}
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid request"})
+		return
+	}
+	if msg := validateAPIKeyRequest(req.Scopes, req.User); msg != "" {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": msg})
+		return
+	}
+	k, secret, err := newAPIKey()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to create API key"})
+		return
+	}
+	if req.Expires != "" {
+		ttl, ok := parseLifetime(req.Expires)
+		if !ok {
+			c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid expiry"})
+			return
+		}
+		k.Expires = k.Created.Add(ttl)
+	}
+	k.Name, k.Scopes, k.User = playlistName(req.Name, "API key"), req.Scopes, req.User
+	if err := apiKeys.add(k); err != nil {
+		log.Printf("API key save error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to save API key"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "key": secret, "apiKey": newAPIKeyInfo(*k)})
+}
+
+func validateAPIKeyRequest(scopes []string, user string) string {
+	if len(scopes) == 0 {
+		return "At least one scope is required"
+	}
+	for _, s := range scopes {
+		if !slices.Contains(apiKeyScopes, s) {
+			return "Unknown scope: " + s
+		}
+	}
+	if _, ok := authUsers[user]; user != "" && !ok {
+		return "Unknown user: " + user
+	}
+	return ""
+}
+
+// apiKeyInfo is a key as listed by the API, without its hash.
+type apiKeyInfo struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Prefix   string     `json:"prefix"`
+	Scopes   []string   `json:"scopes"`
+	User     string     `json:"user,omitempty"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	Expired  bool       `json:"expired"`
+}
+
+func newAPIKeyInfo(k apiKey) apiKeyInfo {
+	info := apiKeyInfo{
+		ID:      k.ID,
+		Name:    k.Name,
+		Prefix:  API_KEY_PREFIX + k.ID,
+		Scopes:  k.Scopes,
+		User:    k.User,
+		Created: k.Created,
+		Expired: k.expired(time.Now()),
+	}
+	if !k.Expires.IsZero() {
+		info.Expires = &k.Expires
+	}
+	if !k.LastUsed.IsZero() {
+		info.LastUsed = &k.LastUsed
+	}
+	return info
+}
+
+func handleListApiKeys(c *gin.Context) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Admin access required"})
+		return
+	}
+	list := []apiKeyInfo{}
+	for _, k := range apiKeys.list() {
+		list = append(list, newAPIKeyInfo(k))
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "apiKeys": list})
+}
+
+func handleRevokeApiKey(c *gin.Context, id string) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Admin access required"})
+		return
+	}
+	ok, err := apiKeys.remove(strings.TrimPrefix(strings.TrimSpace(id), API_KEY_PREFIX))
+	if err != nil {
+		log.Printf("API key save error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to save API keys"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "API key not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
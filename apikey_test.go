@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withAPIKeys gives a test its own key store
+func withAPIKeys(t *testing.T) {
+	t.Helper()
+	origKeys := apiKeys
+	t.Cleanup(func() { apiKeys = origKeys })
+	apiKeys = newAPIKeyStore()
+	withStateDir(t)
+}
+
+func keyRequest(method, target, key, function, data string) *httptest.ResponseRecorder {
+	var req *http.Request
+	if function != "" {
+		body, _ := json.Marshal(map[string]string{"function": function, "data": data})
+		req = httptest.NewRequest(method, target, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// TestAPIKeys checks key management, scopes, expiry and last-used tracking
+func TestAPIKeys(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	origLocalMusicDir := localMusicDir
+	defer func() { localMusicDir = origLocalMusicDir }()
+	localMusicDir = tmpDir
+	os.WriteFile(filepath.Join(tmpDir, "song.mp3"), []byte("song"), 0644)
+
+	withAPIKeys(t)
+	withAuthUsers(t, map[string]*authUser{
+		"root":  {Password: bcryptHash(t, "sesame"), Groups: []string{ADMIN_GROUP}},
+		"alice": {Password: bcryptHash(t, "sesame")},
+	})
+
+	create := func(user, data string) (string, string) {
+		body, _ := json.Marshal(map[string]string{"function": "createApiKey", "data": data})
+		req := httptest.NewRequest("POST", "/api", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth(user, "sesame")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+			Key     string `json:"key"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Status, resp.Key
+	}
+
+	status, _ := create("alice", `{"scopes":["read"]}`)
+	assert.Equal(t, "error", status, "only admins manage keys")
+	status, _ = create("root", `{"scopes":["write"]}`)
+	assert.Equal(t, "error", status)
+
+	_, readKey := create("root", `{"name":"cron","scopes":["read"]}`)
+	_, streamKey := create("root", `{"scopes":["stream"],"user":"alice","expires":"1h"}`)
+	assert.Regexp(t, `^gmk_[0-9a-f]{12}_`, readKey)
+
+	t.Run("Scopes", func(t *testing.T) {
+		assert.Contains(t, keyRequest("POST", "/api", readKey, "getAllMp3", "").Body.String(), "song.mp3")
+		assert.Equal(t, http.StatusForbidden, keyRequest("GET", "/localdisk/song.mp3", readKey, "", "").Code)
+		assert.Equal(t, http.StatusForbidden, keyRequest("POST", "/api", readKey, "listApiKeys", "").Code)
+		assert.Equal(t, http.StatusForbidden, keyRequest("POST", "/api", streamKey, "getAllMp3", "").Code)
+		assert.Equal(t, http.StatusOK, keyRequest("GET", "/localdisk/song.mp3", streamKey, "", "").Code)
+		assert.Equal(t, http.StatusForbidden, keyRequest("GET", "/download/", streamKey, "", "").Code)
+		assert.Equal(t, http.StatusUnauthorized, keyRequest("GET", "/localdisk/song.mp3", readKey+"x", "", "").Code)
+		assert.Equal(t, http.StatusForbidden, keyRequest("POST", "/api", readKey, "noSuchFunction", "").Code, "unknown functions need admin")
+		assert.Equal(t, http.StatusForbidden, keyRequest("POST", "/api", readKey, "feedUrl", "").Code, "feed URLs stream")
+
+		// The function is read the way handleRequest reads it, from the
+		// query string or a multipart form too.
+		req := httptest.NewRequest("POST", "/api?dffunc=createPlaylist&dfdata=%7B%22name%22%3A%22x%22%7D", strings.NewReader(""))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+readKey)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		_ = mw.WriteField("dffunc", "createPlaylist")
+		_ = mw.WriteField("dfdata", `{"name":"x"}`)
+		mw.Close()
+		req = httptest.NewRequest("POST", "/api", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+readKey)
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Listing and last use", func(t *testing.T) {
+		_, adminKey := create("root", `{"scopes":["admin"]}`)
+		w := keyRequest("POST", "/api", adminKey, "listApiKeys", "")
+		var resp struct {
+			APIKeys []map[string]any `json:"apiKeys"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Len(t, resp.APIKeys, 3)
+		assert.NotContains(t, w.Body.String(), "hash")
+		for _, k := range resp.APIKeys {
+			if k["name"] == "cron" {
+				assert.NotNil(t, k["lastUsed"])
+			}
+		}
+
+		reloaded := apiKeys
+		apiKeys = newAPIKeyStore()
+		assert.NoError(t, initAPIKeys())
+		assert.Len(t, apiKeys.list(), 3, "keys persist in the state store")
+		apiKeys = reloaded
+	})
+
+	t.Run("Expiry and revocation", func(t *testing.T) {
+		_, ok := apiKeys.verify(streamKey, time.Now().Add(2*time.Hour))
+		assert.False(t, ok)
+
+		id := readKey[len(API_KEY_PREFIX) : len(API_KEY_PREFIX)+12]
+		body, _ := json.Marshal(map[string]string{"function": "revokeApiKey", "data": id})
+		req := httptest.NewRequest("POST", "/api", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth("root", "sesame")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Contains(t, w.Body.String(), `"ok"`)
+		assert.Equal(t, http.StatusUnauthorized, keyRequest("POST", "/api", readKey, "getAllMp3", "").Code)
+	})
+}
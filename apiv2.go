@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API v2 is a read-only REST view of the library: resources are addressed
+// by path, errors use HTTP status codes with a typed body, and responses
+// carry an ETag so clients and proxies can revalidate them. The POST /api
+// functions are unchanged.
+//
+//	GET /api/v2/dirs                     the root directory
+//	GET /api/v2/dirs/{path}              a directory's subdirectories, tracks, playlists and images
+//	GET /api/v2/dirs/{path}?recursive=true  every directory below path
+//	GET /api/v2/tracks/{path}            a track's size, tags, rating and stream URL
+//	GET /api/v2/search?q=blue&type=tracks&minRating=3
+
+const API_V2_PREFIX = "/api/v2"
+
+// Error codes of API v2.
+const (
+	V2_INVALID_PATH  = "invalid_path"
+	V2_INVALID_QUERY = "invalid_query"
+	V2_NOT_FOUND     = "not_found"
+	V2_UNAUTHORIZED  = "unauthorized"
+	V2_FORBIDDEN     = "forbidden"
+	V2_INTERNAL      = "internal"
+)
+
+// v2Error is the body of every API v2 error response.
+type v2Error struct {
+	Error v2ErrorDetail `json:"error"`
+}
+
+type v2ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// v2Entry is a directory, playlist or image in a listing.
+type v2Entry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// v2Track is a track in a listing or search result.
+type v2Track struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size,omitempty"`
+	Modified time.Time `json:"modified,omitzero"`
+}
+
+type v2Dir struct {
+	Path      string    `json:"path"`
+	Dirs      []v2Entry `json:"dirs"`
+	Tracks    []v2Track `json:"tracks"`
+	Playlists []v2Entry `json:"playlists"`
+	Images    []v2Entry `json:"images"`
+}
+
+type v2TrackDetail struct {
+	v2Track
+	Dir     string    `json:"dir"`
+	Tags    trackTags `json:"tags"`
+	Rating  *int      `json:"rating"`
+	Starred bool      `json:"starred"`
+	URL     string    `json:"url"`
+}
+
+type v2SearchResult struct {
+	Query     string    `json:"query"`
+	Tracks    []v2Track `json:"tracks"`
+	Dirs      []v2Entry `json:"dirs"`
+	Truncated bool      `json:"truncated"`
+}
+
+func registerAPIv2Routes(r *gin.Engine) {
+	g := r.Group(API_V2_PREFIX)
+	g.GET("/dirs", v2DirHandler)
+	g.GET("/dirs/*path", v2DirHandler)
+	g.GET("/tracks/*path", v2TrackHandler)
+	g.GET("/search", v2SearchHandler)
+}
+
+// isAPIv2 reports whether the request is for API v2, whose errors use
+// v2Fail wherever they are raised.
+func isAPIv2(c *gin.Context) bool {
+	p := c.Request.URL.Path
+	return p == API_V2_PREFIX || strings.HasPrefix(p, API_V2_PREFIX+"/")
+}
+
+func v2Fail(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, v2Error{Error: v2ErrorDetail{Code: code, Message: message}})
+}
+
+// v2JSON writes body with an ETag of its content, answering 304 when the
+// client already has it.
+func v2JSON(c *gin.Context, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		v2Fail(c, http.StatusInternalServerError, V2_INTERNAL, "Failed to encode response")
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+// v2Path reads the path parameter: "" for the root, else a clean key
+// without a trailing slash.
+func v2Path(c *gin.Context) (string, bool) {
+	raw := strings.Trim(c.Param("path"), "/")
+	if raw == "" {
+		return "", true
+	}
+	return cleanKey(raw)
+}
+
+// --- Directories ---
+
+func v2DirHandler(c *gin.Context) {
+	dir, ok := v2Path(c)
+	if !ok {
+		v2Fail(c, http.StatusBadRequest, V2_INVALID_PATH, "Invalid path")
+		return
+	}
+	if !accessFor(c).dirVisible(dir) {
+		v2Fail(c, http.StatusNotFound, V2_NOT_FOUND, "Directory not found")
+		return
+	}
+	recursive, err := strconv.ParseBool(c.DefaultQuery("recursive", "false"))
+	if err != nil {
+		v2Fail(c, http.StatusBadRequest, V2_INVALID_QUERY, "recursive must be true or false")
+		return
+	}
+	if recursive {
+		v2DirTree(c, dir)
+		return
+	}
+	v2DirListing(c, dir)
+}
+
+func v2DirListing(c *gin.Context, dir string) {
+	prefix := dir
+	if prefix != "" {
+		prefix += "/"
+	}
+	listing, err := listDirEntries(prefix)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) || (err == nil && dir != "" && !usingLocal() && listing.empty()) {
+		v2Fail(c, http.StatusNotFound, V2_NOT_FOUND, "Directory not found")
+		return
+	}
+	if err != nil {
+		log.Printf("API v2 list error: %v", err)
+		v2Fail(c, http.StatusInternalServerError, V2_INTERNAL, "Failed to list directory")
+		return
+	}
+	listing = accessFor(c).filterListing(prefix, listing)
+	out := v2Dir{Path: dir, Dirs: v2Entries(prefix, listing.Dirs), Tracks: []v2Track{},
+		Playlists: v2Entries(prefix, listing.Playlists), Images: v2Entries(prefix, listing.Images)}
+	sort.Strings(listing.Files)
+	for _, name := range listing.Files {
+		meta := listing.Meta[name]
+		out.Tracks = append(out.Tracks, v2Track{Name: name, Path: prefix + name, Size: meta.Size, Modified: meta.ModTime})
+	}
+	v2JSON(c, out)
+}
+
+// empty reports whether a listing has no entries, which for S3 means the
+// prefix does not exist.
+func (l dirListing) empty() bool {
+	return len(l.Dirs)+len(l.Files)+len(l.Playlists)+len(l.Images) == 0
+}
+
+func v2Entries(prefix string, names []string) []v2Entry {
+	sort.Strings(names)
+	out := make([]v2Entry, 0, len(names))
+	for _, name := range names {
+		out = append(out, v2Entry{Name: name, Path: prefix + name})
+	}
+	return out
+}
+
+// v2DirTree lists every directory below dir.
+func v2DirTree(c *gin.Context, dir string) {
+	all, err := listAllDirs()
+	if err != nil {
+		log.Printf("API v2 list error: %v", err)
+		v2Fail(c, http.StatusInternalServerError, V2_INTERNAL, "Failed to list directories")
+		return
+	}
+	acc := accessFor(c)
+	found := dir == ""
+	out := v2Dir{Path: dir, Dirs: []v2Entry{}, Tracks: []v2Track{}, Playlists: []v2Entry{}, Images: []v2Entry{}}
+	for _, d := range all {
+		if d = strings.Trim(d, "/"); d == "." {
+			d = ""
+		}
+		found = found || d == dir
+		if d == "" || (dir != "" && !strings.HasPrefix(d, dir+"/")) || !acc.dirVisible(d) {
+			continue
+		}
+		out.Dirs = append(out.Dirs, v2Entry{Name: path.Base(d), Path: d})
+	}
+	if !found {
+		v2Fail(c, http.StatusNotFound, V2_NOT_FOUND, "Directory not found")
+		return
+	}
+	sort.Slice(out.Dirs, func(i, j int) bool { return out.Dirs[i].Path < out.Dirs[j].Path })
+	v2JSON(c, out)
+}
+
+// --- Tracks ---
+
+func v2TrackHandler(c *gin.Context) {
+	key, ok := v2Path(c)
+	if !ok || key == "" {
+		v2Fail(c, http.StatusBadRequest, V2_INVALID_PATH, "Invalid path")
+		return
+	}
+	if !isAudioFile(key) || !accessFor(c).allowed(key) {
+		v2Fail(c, http.StatusNotFound, V2_NOT_FOUND, "Track not found")
+		return
+	}
+	ctx := c.Request.Context()
+	info, err := davStatFile(ctx, key)
+	if err != nil {
+		v2Fail(c, http.StatusNotFound, V2_NOT_FOUND, "Track not found")
+		return
+	}
+	rr, err := newRatingReader(ctx, currentUserName(c))
+	if err != nil {
+		log.Printf("API v2 ratings error: %v", err)
+	}
+	v2JSON(c, v2TrackDetail{
+		v2Track: v2Track{Name: path.Base(key), Path: key, Size: info.Size(), Modified: info.ModTime()},
+		Dir:     strings.TrimSuffix(eventDir(key), "/"),
+		Tags:    trackMeta(ctx, key),
+		Rating:  rr.info(key).Rating,
+		Starred: rr.starred(key),
+		URL:     trackURL("", "/stream/", key),
+	})
+}
+
+// --- Search ---
+
+// v2SearchHandler searches track paths and directory names. type is
+// tracks, dirs or all (the default); minRating, maxRating and starred
+// filter as in searchTitle.
+func v2SearchHandler(c *gin.Context) {
+	q := strings.TrimSpace(c.Query("q"))
+	if len(q) < MIN_SEARCH_STR {
+		v2Fail(c, http.StatusBadRequest, V2_INVALID_QUERY, TXT_MIN_SEARCH+strconv.Itoa(MIN_SEARCH_STR))
+		return
+	}
+	typ := c.DefaultQuery("type", "all")
+	filter, err := v2RatingFilter(c)
+	if err != nil || (typ != "all" && typ != "tracks" && typ != "dirs") {
+		v2Fail(c, http.StatusBadRequest, V2_INVALID_QUERY, "Invalid search parameters")
+		return
+	}
+	out := v2SearchResult{Query: q, Tracks: []v2Track{}, Dirs: []v2Entry{}}
+	if typ != "dirs" {
+		err = v2SearchTracks(c, q, filter, &out)
+	}
+	if err == nil && typ != "tracks" {
+		err = v2SearchDirs(c, q, filter, &out)
+	}
+	if err != nil {
+		log.Printf("API v2 search error: %v", err)
+		v2Fail(c, http.StatusInternalServerError, V2_INTERNAL, "Search failed")
+		return
+	}
+	v2JSON(c, out)
+}
+
+func v2RatingFilter(c *gin.Context) (ratingFilter, error) {
+	var f ratingFilter
+	var err error
+	num := func(name string) int {
+		v := c.Query(name)
+		if v == "" || err != nil {
+			return 0
+		}
+		var n int
+		if n, err = strconv.Atoi(v); err == nil && (n < 0 || n > MAX_RATING) {
+			err = errors.New(name + " out of range")
+		}
+		return n
+	}
+	f.MinRating, f.MaxRating = num("minRating"), num("maxRating")
+	if v := c.Query("starred"); v != "" && err == nil {
+		f.Starred, err = strconv.ParseBool(v)
+	}
+	return f, err
+}
+
+func v2SearchTracks(c *gin.Context, q string, filter ratingFilter, out *v2SearchResult) error {
+	files, err := searchFiles(q)
+	if err != nil {
+		return err
+	}
+	files = accessFor(c).filterFiles(files)
+	sort.Strings(files)
+	files, truncated, err := filter.apply(c, files, MAX_SEARCH_RESULT)
+	if err != nil {
+		return err
+	}
+	out.Truncated = out.Truncated || truncated
+	for _, f := range files {
+		out.Tracks = append(out.Tracks, v2Track{Name: path.Base(f), Path: f})
+	}
+	return nil
+}
+
+func v2SearchDirs(c *gin.Context, q string, filter ratingFilter, out *v2SearchResult) error {
+	dirs, err := searchDirs(q)
+	if err != nil {
+		return err
+	}
+	dirs = accessFor(c).filterDirs(dirs)
+	sort.Strings(dirs)
+	dirs, truncated, err := filter.apply(c, dirs, MAX_SEARCH_RESULT)
+	if err != nil {
+		return err
+	}
+	out.Truncated = out.Truncated || truncated
+	for _, d := range dirs {
+		d = strings.Trim(d, "/")
+		out.Dirs = append(out.Dirs, v2Entry{Name: path.Base(d), Path: d})
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// getV2 requests an API v2 path as user and decodes the JSON body
+func getV2(t *testing.T, user, target string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest("GET", target, nil)
+	if user != "" {
+		req.SetBasicAuth(user, "sesame")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var resp map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), target)
+	return w.Code, resp
+}
+
+// v2Paths collects the path fields of a list in a response
+func v2Paths(resp map[string]any, field string) []string {
+	var out []string
+	for _, e := range resp[field].([]any) {
+		out = append(out, e.(map[string]any)["path"].(string))
+	}
+	return out
+}
+
+// TestAPIv2 checks directories, tracks, search and error responses
+func TestAPIv2(t *testing.T) {
+	tmpDir := t.TempDir()
+	withLibrary(t, tmpDir)
+	withRatings(t)
+	os.MkdirAll(filepath.Join(tmpDir, "Jazz", "Blue Train"), 0755)
+	os.MkdirAll(filepath.Join(tmpDir, "Private"), 0755)
+	os.MkdirAll(filepath.Join(tmpDir, "Empty"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "Blue Train", "01 Blue Train.mp3"), []byte("audio"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "So What.mp3"), []byte("audio"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "best.m3u"), []byte("So What.mp3\n"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Private", "secret.mp3"), []byte("audio"), 0644)
+	withAuthUsers(t, map[string]*authUser{"alice": {Password: bcryptHash(t, "sesame")}})
+	withACLRules(t, `[{"path":"Private/","allow":["bob"]}]`)
+
+	code, resp := getV2(t, "alice", "/api/v2/dirs")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []string{"Empty", "Jazz"}, v2Paths(resp, "dirs"))
+
+	code, resp = getV2(t, "alice", "/api/v2/dirs/Empty")
+	assert.Equal(t, 200, code, "an empty local directory exists")
+	assert.Empty(t, resp["tracks"])
+
+	code, resp = getV2(t, "alice", "/api/v2/dirs/Jazz/")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "Jazz", resp["path"])
+	assert.Equal(t, []string{"Jazz/Blue Train"}, v2Paths(resp, "dirs"))
+	assert.Equal(t, []string{"Jazz/So What.mp3"}, v2Paths(resp, "tracks"))
+	assert.Equal(t, 5.0, resp["tracks"].([]any)[0].(map[string]any)["size"])
+	assert.Equal(t, []string{"Jazz/best.m3u"}, v2Paths(resp, "playlists"))
+
+	code, resp = getV2(t, "alice", "/api/v2/dirs?recursive=true")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []string{"Empty", "Jazz", "Jazz/Blue Train"}, v2Paths(resp, "dirs"))
+
+	assert.Equal(t, "ok", historyAPI(t, "alice", "setRating", map[string]any{"path": "Jazz/So What.mp3", "rating": 4})["status"])
+	code, resp = getV2(t, "alice", "/api/v2/tracks/Jazz/So%20What.mp3")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "Jazz", resp["dir"])
+	assert.Equal(t, 4.0, resp["rating"])
+	assert.Equal(t, "So What", resp["tags"].(map[string]any)["title"])
+	assert.Equal(t, "/stream/Jazz/So%20What.mp3", resp["url"])
+	req := httptest.NewRequest("GET", resp["url"].(string), nil)
+	req.SetBasicAuth("alice", "sesame")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "audio", w.Body.String(), "the track URL streams the file")
+
+	code, resp = getV2(t, "alice", "/api/v2/search?q=blue")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []string{"Jazz/Blue Train/01 Blue Train.mp3"}, v2Paths(resp, "tracks"))
+	assert.Equal(t, []string{"Jazz/Blue Train"}, v2Paths(resp, "dirs"))
+	_, resp = getV2(t, "alice", "/api/v2/search?q=mp3&type=tracks&minRating=4")
+	assert.Equal(t, []string{"Jazz/So What.mp3"}, v2Paths(resp, "tracks"))
+	assert.Empty(t, resp["dirs"])
+
+	cases := map[string]struct {
+		status int
+		code   string
+	}{
+		"/api/v2/dirs/Nowhere":                 {404, V2_NOT_FOUND},
+		"/api/v2/dirs/Private":                 {404, V2_NOT_FOUND},
+		"/api/v2/dirs/Nowhere?recursive=true":  {404, V2_NOT_FOUND},
+		"/api/v2/dirs/Jazz?recursive=maybe":    {400, V2_INVALID_QUERY},
+		"/api/v2/dirs/Jazz/..%2F..%2Fetc":      {400, V2_INVALID_PATH},
+		"/api/v2/tracks/Private/secret.mp3":    {404, V2_NOT_FOUND},
+		"/api/v2/tracks/Jazz/missing.mp3":      {404, V2_NOT_FOUND},
+		"/api/v2/tracks/Jazz/best.m3u":         {404, V2_NOT_FOUND},
+		"/api/v2/search":                       {400, V2_INVALID_QUERY},
+		"/api/v2/search?q=a&type=albums":       {400, V2_INVALID_QUERY},
+		"/api/v2/search?q=a&minRating=9":       {400, V2_INVALID_QUERY},
+		"/api/v2/playlists":                    {404, V2_NOT_FOUND},
+		"/api/v2/search?q=secret&starred=nope": {400, V2_INVALID_QUERY},
+	}
+	for target, want := range cases {
+		code, resp = getV2(t, "alice", target)
+		assert.Equal(t, want.status, code, target)
+		assert.Equal(t, want.code, resp["error"].(map[string]any)["code"], target)
+	}
+	_, resp = getV2(t, "alice", "/api/v2/search?q=secret")
+	assert.Empty(t, resp["tracks"], "ACL applies to search")
+}
+
+// TestAPIv2ETag checks conditional requests
+func TestAPIv2ETag(t *testing.T) {
+	tmpDir := t.TempDir()
+	withLibrary(t, tmpDir)
+	os.WriteFile(filepath.Join(tmpDir, "a.mp3"), []byte("a"), 0644)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/dirs", nil))
+	assert.Equal(t, 200, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	req := httptest.NewRequest("GET", "/api/v2/dirs", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 304, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	os.WriteFile(filepath.Join(tmpDir, "b.mp3"), []byte("b"), 0644)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+}
+
+// TestAPIv2Auth checks that authentication and API key errors are typed
+func TestAPIv2Auth(t *testing.T) {
+	withLibrary(t, t.TempDir())
+	withAPIKeys(t)
+	withAuthUsers(t, map[string]*authUser{"alice": {Password: bcryptHash(t, "sesame")}})
+	k, token, err := newAPIKey()
+	assert.NoError(t, err)
+	k.Scopes = []string{SCOPE_STREAM}
+	assert.NoError(t, apiKeys.add(k))
+
+	cases := []struct {
+		name, auth string
+		status     int
+		code       string
+	}{
+		{"no credentials", "", 401, V2_UNAUTHORIZED},
+		{"invalid key", "Bearer " + API_KEY_PREFIX + "nope_nope", 401, V2_UNAUTHORIZED},
+		{"key without the read scope", "Bearer " + token, 403, V2_FORBIDDEN},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "/api/v2/dirs", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, tc.status, w.Code, tc.name)
+		var resp v2Error
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), tc.name)
+		assert.Equal(t, tc.code, resp.Error.Code, tc.name)
+	}
+}
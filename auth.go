@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	SESSION_COOKIE     = "gomusic_session"
+	AUTH_USER_KEY      = "authUser" // gin context key of the authenticated *authUser
+	AUTH_REALM         = "go-music"
+	AUTH_FAILURE_DELAY = 500 * time.Millisecond
+	DEFAULT_SESSION    = 7 * 24 * time.Hour
+	ADMIN_GROUP        = "admin"
+	REVOKED_FILE       = "revoked-sessions.json"
+)
+
+// authUser is an account from AUTH_USERS. Password holds a bcrypt
+// ($2a$/$2b$/$2y$) or argon2id ($argon2id$) hash, never the password itself.
+type authUser struct {
+	Name     string   `json:"-"`
+	Password string   `json:"password"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// Authentication is enabled when AUTH_USERS defines at least one user.
+// Sessions are signed with AUTH_SECRET; without it a random secret is used
+// and sessions end when the process restarts.
+var (
+	authUsers  map[string]*authUser
+	authSecret []byte
+	sessionTTL = envDuration("SESSION_TTL", DEFAULT_SESSION)
+	loginTmpl  *template.Template
+)
+
+// dummyHash is compared against when the user does not exist, so a login
+// takes the same time for unknown and known users.
+var dummyHash = sync.OnceValue(func() []byte {
+	h, _ := bcrypt.GenerateFromPassword([]byte("go-music"), bcrypt.DefaultCost)
+	return h
+})
+
+// initAuth loads users from AUTH_USERS, given as inline JSON or a file path:
+//
+//	{"alice": {"password": "$2a$10$...", "groups": ["family"]}}
+func initAuth() error {
+	raw := strings.TrimSpace(os.Getenv("AUTH_USERS"))
+	if raw == "" {
+		return nil
+	}
+	if !strings.HasPrefix(raw, "{") {
+		b, err := os.ReadFile(raw)
+		if err != nil {
+			return fmt.Errorf("read AUTH_USERS: %w", err)
+		}
+		raw = string(b)
+	}
+	users, err := parseAuthUsers([]byte(raw))
+	if err != nil {
+		return err
+	}
+	authUsers = users
+	if secret := os.Getenv("AUTH_SECRET"); secret != "" {
+		authSecret = []byte(secret)
+	} else {
+		authSecret = make([]byte, 32)
+		if _, err := rand.Read(authSecret); err != nil {
+			return err
+		}
+		log.Printf("AUTH_SECRET not set; sessions will not survive a restart")
+	}
+	log.Printf("Authentication enabled for %d users", len(users))
+	return nil
+}
+
+func parseAuthUsers(b []byte) (map[string]*authUser, error) {
+	var users map[string]*authUser
+	if err := json.Unmarshal(b, &users); err != nil {
+		return nil, fmt.Errorf("parse AUTH_USERS: %w", err)
+	}
+	for name, u := range users {
+		if name == "" || strings.Contains(name, ":") {
+			return nil, fmt.Errorf("user %q: names must not be empty or contain ':'", name)
+		}
+		if u == nil || !isPasswordHash(u.Password) {
+			return nil, fmt.Errorf("user %q: password must be a bcrypt or argon2id hash", name)
+		}
+		u.Name = name
+	}
+	return users, nil
+}
+
+func authEnabled() bool { return len(authUsers) > 0 }
+
+// currentUser returns the authenticated user of the request, or nil when
+// authentication is disabled.
+func currentUser(c *gin.Context) *authUser {
+	if u, ok := c.Get(AUTH_USER_KEY); ok {
+		return u.(*authUser)
+	}
+	return nil
+}
+
+// currentUserName names the owner of per-user state: the signed-in user, or
+// "" when there is none.
+func currentUserName(c *gin.Context) string {
+	if u := currentUser(c); u != nil {
+		return u.Name
+	}
+	return ""
+}
+
+// isAdmin reports whether the request may use the admin API functions:
+// members of the admin group, API keys with the admin scope, and everyone
+// when authentication is disabled.
+func isAdmin(c *gin.Context) bool {
+	if k := currentAPIKey(c); k != nil {
+		return k.allows(SCOPE_ADMIN)
+	}
+	if !authEnabled() {
+		return true
+	}
+	u := currentUser(c)
+	return u != nil && slices.Contains(u.Groups, ADMIN_GROUP)
+}
+
+// --- Passwords ---
+
+func isPasswordHash(h string) bool {
+	for _, p := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$"} {
+		if strings.HasPrefix(h, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return checkArgon2id(hash, password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// checkArgon2id verifies a PHC-formatted hash:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key> (unpadded base64).
+func checkArgon2id(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != "v=19" {
+		return false
+	}
+	var mem, iter uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &mem, &iter, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	got := argon2.IDKey([]byte(password), salt, iter, mem, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(got, key) == 1
+}
+
+// lookupUser checks a name and password, spending the same work on unknown
+// names as on known ones.
+func lookupUser(name, password string) (*authUser, bool) {
+	u, ok := authUsers[name]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil, false
+	}
+	if !checkPassword(u.Password, password) {
+		return nil, false
+	}
+	return u, true
+}
+
+// runHashPassword implements "go-music hash-password": it reads a password
+// from stdin and prints a bcrypt hash for AUTH_USERS.
+func runHashPassword() {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalf("read password: %v", err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(line, "\r\n")), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatalf("hash password: %v", err)
+	}
+	fmt.Println(string(hash))
+}
+
+// --- Sessions ---
+
+// newSession returns a signed session token for u, used both as the session
+// cookie and as a Bearer token. The signature covers the password hash, so
+// changing a password ends existing sessions.
+func newSession(u *authUser, now time.Time) (string, time.Time) {
+	expires := now.Add(sessionTTL)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(u.Name)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + sessionMAC(payload, u), expires
+}
+
+func sessionMAC(payload string, u *authUser) string {
+	mac := hmac.New(sha256.New, authSecret)
+	mac.Write([]byte(payload + "\x00" + u.Password))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func parseSession(token string, now time.Time) (*authUser, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() > expires {
+		return nil, false
+	}
+	u, ok := authUsers[string(name)]
+	if !ok || !hmac.Equal([]byte(parts[2]), []byte(sessionMAC(parts[0]+"."+parts[1], u))) {
+		return nil, false
+	}
+	return u, !sessionRevoked(token)
+}
+
+// revokedSessions maps the IDs of signed-out sessions to their expiry, so
+// a token stops working at logout rather than when it expires.
+var revokedSessions = &stateDoc[map[string]int64]{name: REVOKED_FILE}
+
+// sessionID identifies a token without storing it.
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+func sessionRevoked(token string) bool {
+	revoked, err := revokedSessions.get()
+	if err != nil {
+		log.Printf("Session revocation list error: %v", err)
+	}
+	_, ok := revoked[sessionID(token)]
+	return ok
+}
+
+// revokeSession ends a valid session token and drops expired entries.
+func revokeSession(token string) error {
+	expires, _ := strconv.ParseInt(strings.Split(token, ".")[1], 10, 64)
+	_, err := revokedSessions.update(func(m *map[string]int64) error {
+		if *m == nil {
+			*m = map[string]int64{}
+		}
+		now := time.Now().Unix()
+		for id, exp := range *m {
+			if exp < now {
+				delete(*m, id)
+			}
+		}
+		(*m)[sessionID(token)] = expires
+		return nil
+	})
+	return err
+}
+
+// sessionToken returns the session cookie or Bearer token of a request.
+func sessionToken(c *gin.Context) string {
+	if cookie, err := c.Cookie(SESSION_COOKIE); err == nil && cookie != "" {
+		return cookie
+	}
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return strings.TrimSpace(token)
+}
+
+// authenticate checks the session cookie, then HTTP Basic or Bearer
+// credentials.
+func authenticate(c *gin.Context) (*authUser, bool) {
+	if cookie, err := c.Cookie(SESSION_COOKIE); err == nil {
+		if u, ok := parseSession(cookie, time.Now()); ok {
+			return u, true
+		}
+	}
+	if name, password, ok := c.Request.BasicAuth(); ok {
+		return lookupUser(name, password)
+	}
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return parseSession(strings.TrimSpace(token), time.Now())
+	}
+	return nil, false
+}
+
+// --- Middleware ---
+
+// authMiddleware requires a signed-in user for every route registered after
+// it. Routes with their own credentials are passed through: signed feed
+// URLs, the Subsonic API when SUBSONIC_USER is set, DLNA from the local
+// network, whose clients cannot authenticate, and requests already checked
+// by apiKeyMiddleware.
+func authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authEnabled() || authExempt(c) || currentAPIKey(c) != nil {
+			c.Next()
+			return
+		}
+		u, ok := authenticate(c)
+		if !ok {
+			authChallenge(c)
+			return
+		}
+		c.Set(AUTH_USER_KEY, u)
+		c.Next()
+	}
+}
+
+func authExempt(c *gin.Context) bool {
+	p := c.Request.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/feed/"):
+		return feedSecret != ""
+	case strings.HasPrefix(p, "/rest/"):
+		return subsonicUser != ""
+	case strings.HasPrefix(p, "/dlna/"):
+		return dlnaEnabled && dlnaLocalClient(c)
+	}
+	return false
+}
+
+// authChallenge answers an unauthenticated request: browsers are sent to the
+// login page, the web player's API gets a JSON error and everything else a
+// Basic challenge.
+func authChallenge(c *gin.Context) {
+	switch {
+	case c.Request.URL.Path == "/api":
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "error", "message": "Authentication required"})
+	case isAPIv2(c):
+		c.Header("WWW-Authenticate", `Basic realm="`+AUTH_REALM+`", charset="UTF-8"`)
+		v2Fail(c, http.StatusUnauthorized, V2_UNAUTHORIZED, "Authentication required")
+	case c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html"):
+		c.Redirect(http.StatusFound, "/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+		c.Abort()
+	default:
+		c.Header("WWW-Authenticate", `Basic realm="`+AUTH_REALM+`", charset="UTF-8"`)
+		c.String(http.StatusUnauthorized, "Authentication required")
+		c.Abort()
+	}
+}
+
+// --- Login ---
+
+type loginPage struct {
+	Version string
+	Next    string
+	Error   string
+}
+
+func loginPageHandler(c *gin.Context) {
+	renderLogin(c, http.StatusOK, loginPage{Version: Version, Next: safeNext(c.Query("next"))})
+}
+
+func renderLogin(c *gin.Context, status int, page loginPage) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+	if err := loginTmpl.Execute(c.Writer, page); err != nil {
+		log.Printf("failed to render login template: %v", err)
+	}
+}
+
+// loginHandler signs a user in. Form posts from the login page get a session
+// cookie and a redirect; JSON posts get the token for use as a Bearer token.
+func loginHandler(c *gin.Context) {
+	var req struct {
+		Username string `json:"username" form:"username"`
+		Password string `json:"password" form:"password"`
+		Next     string `json:"next" form:"next"`
+	}
+	jsonReq := strings.Contains(c.GetHeader("Content-Type"), "application/json")
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid request"})
+		return
+	}
+	u, ok := lookupUser(req.Username, req.Password)
+	if !ok || !authEnabled() {
+		time.Sleep(AUTH_FAILURE_DELAY)
+		if jsonReq {
+			c.JSON(http.StatusUnauthorized, gin.H{"status": "error", "message": "Invalid username or password"})
+			return
+		}
+		renderLogin(c, http.StatusUnauthorized, loginPage{Version: Version, Next: safeNext(req.Next), Error: "Invalid username or password"})
+		return
+	}
+	token, expires := newSession(u, time.Now())
+	if jsonReq {
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "token": token, "expires": expires.UTC().Format(time.RFC3339)})
+		return
+	}
+	setSessionCookie(c, token, int(sessionTTL.Seconds()))
+	c.Redirect(http.StatusFound, safeNext(req.Next))
+}
+
+// logoutHandler revokes the request's session token, so copies of it stop
+// working too, and clears the cookie.
+func logoutHandler(c *gin.Context) {
+	if token := sessionToken(c); token != "" {
+		if _, ok := parseSession(token, time.Now()); ok {
+			if err := revokeSession(token); err != nil {
+				log.Printf("Logout error: %v", err)
+			}
+		}
+	}
+	setSessionCookie(c, "", -1)
+	c.Redirect(http.StatusFound, "/login")
+}
+
+func setSessionCookie(c *gin.Context, value string, maxAge int) {
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(SESSION_COOKIE, value, maxAge, "/", "", secure, true)
+}
+
+// safeNext only allows local redirect targets after login.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") || strings.HasPrefix(next, "/login") {
+		return "/"
+	}
+	return next
+}
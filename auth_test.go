@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// withAuthUsers enables authentication for the duration of a test
+func withAuthUsers(t *testing.T, users map[string]*authUser) {
+	t.Helper()
+	origUsers, origSecret := authUsers, authSecret
+	t.Cleanup(func() { authUsers, authSecret = origUsers, origSecret })
+	for name, u := range users {
+		u.Name = name
+	}
+	authUsers = users
+	authSecret = []byte("test-secret")
+}
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	assert.NoError(t, err)
+	return string(h)
+}
+
+// TestPasswordHashes checks bcrypt and argon2id verification
+func TestPasswordHashes(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("sesame"), salt, 1, 1024, 1, 32)
+	argonHash := "$argon2id$v=19$m=1024,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key)
+
+	assert.True(t, checkPassword(bcryptHash(t, "sesame"), "sesame"))
+	assert.False(t, checkPassword(bcryptHash(t, "sesame"), "wrong"))
+	assert.True(t, checkPassword(argonHash, "sesame"))
+	assert.False(t, checkPassword(argonHash, "wrong"))
+	assert.False(t, checkPassword("$argon2id$v=19$broken", "sesame"))
+
+	users, err := parseAuthUsers([]byte(`{"alice":{"password":"` + argonHash + `","groups":["family"]}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", users["alice"].Name)
+	_, err = parseAuthUsers([]byte(`{"bob":{"password":"plaintext"}}`))
+	assert.Error(t, err)
+	_, err = parseAuthUsers([]byte(`{"a:b":{"password":"$2a$10$x"}}`))
+	assert.Error(t, err)
+}
+
+// TestSessions checks token signing, expiry and invalidation
+func TestSessions(t *testing.T) {
+	withAuthUsers(t, map[string]*authUser{"alice": {Password: bcryptHash(t, "sesame")}})
+	now := time.Now()
+	token, expires := newSession(authUsers["alice"], now)
+	assert.Equal(t, now.Add(sessionTTL).Unix(), expires.Unix())
+
+	u, ok := parseSession(token, now)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", u.Name)
+
+	_, ok = parseSession(token, expires.Add(time.Second))
+	assert.False(t, ok, "expired")
+	_, ok = parseSession(token+"x", now)
+	assert.False(t, ok, "tampered")
+
+	authUsers["alice"].Password = bcryptHash(t, "changed")
+	_, ok = parseSession(token, now)
+	assert.False(t, ok, "password change ends sessions")
+}
+
+// TestAuthMiddleware checks protected routes, login, logout and exemptions
+func TestAuthMiddleware(t *testing.T) {
+	withAuthUsers(t, map[string]*authUser{"alice": {Password: bcryptHash(t, "sesame")}})
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	apiReq := func() *http.Request {
+		req := httptest.NewRequest("POST", "/api", strings.NewReader(`{"function":"unknown"}`))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		w := serve(apiReq())
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "Authentication required")
+		assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", "text/html")
+		w = serve(req)
+		assert.Equal(t, http.StatusFound, w.Code)
+		assert.Equal(t, "/login?next=%2F", w.Header().Get("Location"))
+
+		w = serve(httptest.NewRequest("GET", "/audio/song.mp3", nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+
+		assert.Equal(t, http.StatusOK, serve(httptest.NewRequest("GET", "/login", nil)).Code)
+		assert.NotEqual(t, http.StatusUnauthorized, serve(httptest.NewRequest("GET", "/static/style.css", nil)).Code)
+	})
+
+	t.Run("Basic and Bearer", func(t *testing.T) {
+		req := apiReq()
+		req.SetBasicAuth("alice", "sesame")
+		assert.Equal(t, http.StatusOK, serve(req).Code)
+
+		req = apiReq()
+		req.SetBasicAuth("alice", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, serve(req).Code)
+
+		req = httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"alice","password":"sesame"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := serve(req)
+		var resp struct {
+			Status string `json:"status"`
+			Token  string `json:"token"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "ok", resp.Status)
+
+		req = apiReq()
+		req.Header.Set("Authorization", "Bearer "+resp.Token)
+		assert.Equal(t, http.StatusOK, serve(req).Code)
+	})
+
+	t.Run("Login form and logout", func(t *testing.T) {
+		form := url.Values{"username": {"alice"}, "password": {"sesame"}, "next": {"//evil.example"}}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := serve(req)
+		assert.Equal(t, http.StatusFound, w.Code)
+		assert.Equal(t, "/", w.Header().Get("Location"), "external redirects are refused")
+		cookies := w.Result().Cookies()
+		assert.Len(t, cookies, 1)
+		assert.True(t, cookies[0].HttpOnly)
+
+		req = httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(cookies[0])
+		w = serve(req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "Sign out")
+
+		withStateDir(t)
+		req = httptest.NewRequest("POST", "/logout", nil)
+		req.AddCookie(cookies[0])
+		w = serve(req)
+		assert.Equal(t, http.StatusFound, w.Code)
+		assert.Equal(t, -1, w.Result().Cookies()[0].MaxAge)
+
+		req = httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", "text/html")
+		req.AddCookie(cookies[0])
+		assert.Equal(t, http.StatusFound, serve(req).Code, "the session ends at logout, not when it expires")
+
+		form.Set("password", "wrong")
+		req = httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w = serve(req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "Invalid username or password")
+	})
+
+	t.Run("Exemptions", func(t *testing.T) {
+		origFeed, origSubsonic := feedSecret, subsonicUser
+		defer func() { feedSecret, subsonicUser = origFeed, origSubsonic }()
+
+		feedSecret, subsonicUser = "", ""
+		assert.Equal(t, http.StatusUnauthorized, serve(httptest.NewRequest("GET", "/feed/Books.rss", nil)).Code)
+		assert.Equal(t, http.StatusUnauthorized, serve(httptest.NewRequest("GET", "/rest/ping", nil)).Code)
+
+		feedSecret, subsonicUser = "s3cret", "alice"
+		assert.Equal(t, http.StatusForbidden, serve(httptest.NewRequest("GET", "/feed/Books.rss", nil)).Code)
+		assert.Equal(t, http.StatusOK, serve(httptest.NewRequest("GET", "/rest/ping", nil)).Code)
+
+		origDLNA, origNets := dlnaEnabled, dlnaAllowedNets
+		defer func() { dlnaEnabled, dlnaAllowedNets = origDLNA, origNets }()
+		dlnaEnabled = true
+		dlna := func(remote, forwarded string) int {
+			req := httptest.NewRequest("GET", "/dlna/device.xml", nil)
+			req.RemoteAddr = remote
+			if forwarded != "" {
+				req.Header.Set("X-Forwarded-For", forwarded)
+			}
+			return serve(req).Code
+		}
+		assert.Equal(t, http.StatusOK, dlna("192.168.1.20:5000", ""), "renderers on the LAN")
+		assert.Equal(t, http.StatusUnauthorized, dlna("203.0.113.7:5000", ""))
+		assert.Equal(t, http.StatusUnauthorized, dlna("127.0.0.1:5000", "203.0.113.7"), "requests through a proxy")
+		_, n, _ := net.ParseCIDR("203.0.113.0/24")
+		dlnaAllowedNets = []*net.IPNet{n}
+		assert.Equal(t, http.StatusOK, dlna("203.0.113.7:5000", ""))
+		assert.Equal(t, http.StatusUnauthorized, dlna("192.168.1.20:5000", ""))
+	})
+}
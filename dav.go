@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/webdav"
+)
+
+const DAV_PREFIX = "/dav"
+
+// davEnabled turns on the read-only WebDAV view of the library (DAV_ENABLED).
+var davEnabled = envBool("DAV_ENABLED")
+
+// davHandler serves PROPFIND from the library listing. Writes are refused by
+// davFS, so the lock system only exists to satisfy webdav.Handler.
+var davHandler = &webdav.Handler{
+	Prefix:     DAV_PREFIX,
+	FileSystem: davFS{},
+	LockSystem: webdav.NewMemLS(),
+}
+
+// registerDAVRoutes adds the read-only WebDAV methods below /dav/. Write
+// methods answer 405 so clients mount the share read-only.
+func registerDAVRoutes(r *gin.Engine) {
+	g := r.Group(DAV_PREFIX, func(c *gin.Context) {
+		if !davEnabled {
+			c.String(http.StatusNotFound, "Not found")
+			c.Abort()
+		}
+	})
+	for _, m := range []string{"OPTIONS", "PROPFIND"} {
+		g.Handle(m, "/*path", davServe)
+	}
+	g.GET("/*path", davGet)
+	g.HEAD("/*path", davGet)
+	for _, m := range []string{"PUT", "DELETE", "MKCOL", "COPY", "MOVE", "PROPPATCH", "LOCK", "UNLOCK", "POST"} {
+		g.Handle(m, "/*path", davReadOnly)
+	}
+}
+
+func davServe(c *gin.Context) {
+	switch c.Request.Method {
+	case "OPTIONS":
+		c.Header("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+		c.Header("DAV", "1")
+		c.Header("MS-Author-Via", "DAV")
+		c.Status(http.StatusOK)
+	case "PROPFIND":
+		// Depth: infinity would walk the whole bucket; RFC 4918 lets servers
+		// refuse it with propfind-finite-depth.
+		if strings.EqualFold(strings.TrimSpace(c.GetHeader("Depth")), "infinity") {
+			c.Data(http.StatusForbidden, "application/xml; charset=utf-8",
+				[]byte(`<?xml version="1.0" encoding="utf-8"?><D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`))
+			return
+		}
+		ctx := withAccess(c.Request.Context(), accessFor(c))
+		davHandler.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+	}
+}
+
+// davGet serves files through serveAudio, so S3 objects are proxied or
+// redirected to a signed URL like everywhere else.
+func davGet(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("path"), "/")
+	if key == "" || strings.HasSuffix(key, "/") {
+		c.String(http.StatusMethodNotAllowed, "Directories cannot be downloaded")
+		return
+	}
+	key, ok := cleanKey(key)
+	if !ok || !davListed(key) {
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+	serveAudio(c, key)
+}
+
+func davReadOnly(c *gin.Context) {
+	c.Header("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+	c.String(http.StatusMethodNotAllowed, "Read-only WebDAV share")
+}
+
+// davListed reports whether name is a file kind shown in library listings.
+func davListed(name string) bool {
+	return isAudioFile(name) || isPlaylistFile(name) || isImageFile(name)
+}
+
+// --- webdav.FileSystem ---
+
+// davFS is a read-only webdav.FileSystem over listDirEntries.
+type davFS struct{}
+
+func (davFS) Mkdir(context.Context, string, os.FileMode) error { return os.ErrPermission }
+func (davFS) RemoveAll(context.Context, string) error          { return os.ErrPermission }
+func (davFS) Rename(context.Context, string, string) error     { return os.ErrPermission }
+
+func (fsys davFS) OpenFile(ctx context.Context, name string, flag int, _ os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	info, err := fsys.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{name: name, info: info, access: accessFromContext(ctx)}, nil
+}
+
+// Stat resolves name as a listed file first and as a directory otherwise.
+// S3 has no directory objects, so a prefix counts as a directory when it has
+// any listed entries. Paths the user may not access do not exist.
+func (davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	key := strings.Trim(name, "/")
+	if key == "" {
+		return davInfo{name: "/", dir: true}, nil
+	}
+	if strings.Contains(key, "..") {
+		return nil, os.ErrNotExist
+	}
+	access := accessFromContext(ctx)
+	if davListed(key) {
+		if !access.allowed(key) {
+			return nil, os.ErrNotExist
+		}
+		return davStatFile(ctx, key)
+	}
+	if !access.dirVisible(key) {
+		return nil, os.ErrNotExist
+	}
+	listing, err := listDirEntries(key + "/")
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	if !usingLocal() && len(listing.Dirs)+len(listing.Files)+len(listing.Playlists)+len(listing.Images) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return davInfo{name: path.Base(key), dir: true}, nil
+}
+
+func davStatFile(ctx context.Context, key string) (os.FileInfo, error) {
+	if usingLocal() {
+		absPath, err := localAbsPath(key)
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+		fi, err := os.Stat(absPath)
+		if err != nil || fi.IsDir() {
+			return nil, os.ErrNotExist
+		}
+		return davInfo{name: fi.Name(), size: fi.Size(), mod: fi.ModTime()}, nil
+	}
+	head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s3Bucket), Key: aws.String(s3Prefix + key)})
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	return davInfo{name: path.Base(key), size: aws.ToInt64(head.ContentLength), mod: aws.ToTime(head.LastModified)}, nil
+}
+
+// davFile is a directory or file handle for PROPFIND. Content is never read
+// through it; GET is served by davGet.
+type davFile struct {
+	name   string
+	info   os.FileInfo
+	access *aclAccess
+	read   bool
+}
+
+func (f *davFile) Close() error                   { return nil }
+func (f *davFile) Read([]byte) (int, error)       { return 0, io.EOF }
+func (f *davFile) Seek(int64, int) (int64, error) { return 0, nil }
+func (f *davFile) Write([]byte) (int, error)      { return 0, os.ErrPermission }
+func (f *davFile) Stat() (os.FileInfo, error)     { return f.info, nil }
+
+// Readdir lists the directory once; webdav.Handler reads it with count 0.
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !f.info.IsDir() {
+		return nil, errors.New("not a directory")
+	}
+	if f.read {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	f.read = true
+	prefix := strings.Trim(f.name, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	listing, err := listDirEntries(prefix)
+	if err != nil {
+		return nil, err
+	}
+	listing = f.access.filterListing(prefix, listing)
+	infos := make([]fs.FileInfo, 0, len(listing.Dirs)+len(listing.Files)+len(listing.Playlists)+len(listing.Images))
+	for _, d := range listing.Dirs {
+		infos = append(infos, davInfo{name: d, dir: true})
+	}
+	for _, group := range [][]string{listing.Files, listing.Playlists, listing.Images} {
+		for _, name := range group {
+			meta := listing.Meta[name]
+			infos = append(infos, davInfo{name: name, size: meta.Size, mod: meta.ModTime})
+		}
+	}
+	return infos, nil
+}
+
+// davInfo describes a library entry. It implements webdav.ContentTyper so
+// PROPFIND never opens files to sniff their type.
+type davInfo struct {
+	name string
+	size int64
+	mod  time.Time
+	dir  bool
+}
+
+func (i davInfo) Name() string       { return i.name }
+func (i davInfo) Size() int64        { return i.size }
+func (i davInfo) ModTime() time.Time { return i.mod }
+func (i davInfo) IsDir() bool        { return i.dir }
+func (i davInfo) Sys() any           { return nil }
+
+func (i davInfo) Mode() os.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (i davInfo) ContentType(context.Context) (string, error) { return davContentType(i) }
+
+func davContentType(fi os.FileInfo) (string, error) {
+	if fi.IsDir() {
+		return "", webdav.ErrNotImplemented
+	}
+	return s3ContentType(fi.Name(), ""), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testMultistatus decodes a PROPFIND response
+type testMultistatus struct {
+	Responses []struct {
+		Href        string    `xml:"href"`
+		Collection  *struct{} `xml:"propstat>prop>resourcetype>collection"`
+		Length      int64     `xml:"propstat>prop>getcontentlength"`
+		ContentType string    `xml:"propstat>prop>getcontenttype"`
+	} `xml:"response"`
+}
+
+func davRequest(method, target, depth string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if depth != "" {
+		req.Header.Set("Depth", depth)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func propfind(t *testing.T, target string) map[string]int64 {
+	t.Helper()
+	w := davRequest("PROPFIND", target, "1")
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	var ms testMultistatus
+	assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &ms))
+	entries := map[string]int64{}
+	for _, resp := range ms.Responses {
+		size := resp.Length
+		if resp.Collection != nil {
+			size = -1
+		}
+		entries[resp.Href] = size
+	}
+	return entries
+}
+
+// TestDAV checks read-only WebDAV browsing of a local library
+func TestDAV(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origLocalMusicDir, origEnabled := localMusicDir, davEnabled
+	defer func() {
+		localMusicDir, davEnabled = origLocalMusicDir, origEnabled
+	}()
+	localMusicDir = tmpDir
+	davEnabled = true
+
+	os.MkdirAll(filepath.Join(tmpDir, "Rock"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Rock", "song.mp3"), []byte("rock!"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Rock", "notes.txt"), []byte("hidden"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "top.mp3"), []byte("top"), 0644)
+
+	t.Run("PROPFIND", func(t *testing.T) {
+		entries := propfind(t, "/dav/")
+		assert.Equal(t, map[string]int64{"/dav/": -1, "/dav/Rock/": -1, "/dav/top.mp3": 3}, entries)
+
+		entries = propfind(t, "/dav/Rock/")
+		assert.Equal(t, int64(5), entries["/dav/Rock/song.mp3"])
+		assert.NotContains(t, entries, "/dav/Rock/notes.txt")
+
+		w := davRequest("PROPFIND", "/dav/Rock/song.mp3", "0")
+		assert.Equal(t, http.StatusMultiStatus, w.Code)
+		assert.Contains(t, w.Body.String(), "audio/mpeg")
+
+		assert.Equal(t, http.StatusNotFound, davRequest("PROPFIND", "/dav/Missing/", "1").Code)
+		assert.Equal(t, http.StatusForbidden, davRequest("PROPFIND", "/dav/", "infinity").Code)
+	})
+
+	t.Run("GET and read-only methods", func(t *testing.T) {
+		w := davRequest("GET", "/dav/Rock/song.mp3", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "rock!", w.Body.String())
+
+		assert.Equal(t, http.StatusNotFound, davRequest("GET", "/dav/Rock/notes.txt", "").Code)
+		assert.Equal(t, http.StatusMethodNotAllowed, davRequest("PUT", "/dav/Rock/new.mp3", "").Code)
+		assert.Equal(t, http.StatusMethodNotAllowed, davRequest("DELETE", "/dav/Rock/song.mp3", "").Code)
+		assert.Equal(t, http.StatusMethodNotAllowed, davRequest("MKCOL", "/dav/New/", "").Code)
+
+		w = davRequest("OPTIONS", "/dav/", "")
+		assert.Equal(t, "1", w.Header().Get("DAV"))
+		assert.NotContains(t, w.Header().Get("Allow"), "PUT")
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		davEnabled = false
+		defer func() { davEnabled = true }()
+		assert.Equal(t, http.StatusNotFound, davRequest("PROPFIND", "/dav/", "1").Code)
+	})
+}
+
+// TestDAVS3 checks prefixes map to folders and GETs redirect to signed URLs
+func TestDAVS3(t *testing.T) {
+	newFakeS3(t, map[string][]byte{"Jazz/take5.mp3": []byte("abcd"), "readme.txt": []byte("x")})
+	origEnabled, origCache := davEnabled, signedURLs
+	defer func() { davEnabled, signedURLs = origEnabled, origCache }()
+	davEnabled = true
+	signedURLs = newURLCache(SIGNED_URL_CACHE_SIZE)
+
+	entries := propfind(t, "/dav/")
+	assert.Equal(t, int64(-1), entries["/dav/Jazz/"])
+	assert.Len(t, entries, 2)
+	assert.Equal(t, int64(4), propfind(t, "/dav/Jazz/")["/dav/Jazz/take5.mp3"])
+	assert.Equal(t, http.StatusNotFound, davRequest("PROPFIND", "/dav/Blues/", "1").Code)
+
+	w := davRequest("GET", "/dav/Jazz/take5.mp3", "")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.True(t, strings.Contains(w.Header().Get("Location"), "/music/Jazz/take5.mp3"))
+}
@@ -0,0 +1,844 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	SSDP_ADDR         = "239.255.255.250:1900"
+	SSDP_MAX_AGE      = 1800
+	DLNA_HTTP_PORT    = 8080 // matches the port main() listens on
+	DLNA_MAX_BODY     = 64 * 1024
+	DLNA_ROOT_ID      = "0"
+	DLNA_MEDIA_SERVER = "urn:schemas-upnp-org:device:MediaServer:1"
+	DLNA_CONTENT_DIR  = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	DLNA_CONN_MANAGER = "urn:schemas-upnp-org:service:ConnectionManager:1"
+
+	// UPnP error codes
+	UPNP_ERR_INVALID_ACTION = 401
+	UPNP_ERR_INVALID_ARGS   = 402
+	UPNP_ERR_NO_SUCH_OBJECT = 701
+)
+
+// DLNA configuration (DLNA_ENABLED, DLNA_FRIENDLY_NAME, DLNA_BASE_URL,
+// DLNA_INTERFACE).
+var (
+	dlnaEnabled      = envBool("DLNA_ENABLED")
+	dlnaFriendlyName = envDefault("DLNA_FRIENDLY_NAME", "go-music")
+	dlnaBaseURL      = strings.TrimSuffix(os.Getenv("DLNA_BASE_URL"), "/")
+	dlnaUUID         = dlnaDeviceUUID(dlnaFriendlyName)
+	dlnaAllowedNets  = parseNets("DLNA_ALLOWED_NETS")
+)
+
+// dlnaSearchTerm extracts the quoted operands of "contains" and "=" clauses
+// from a UPnP SearchCriteria string.
+var dlnaSearchTerm = regexp.MustCompile(`(?i)(?:dc:title|upnp:artist|upnp:album|dc:creator|upnp:genre)\s+(?:contains|=)\s+"((?:[^"\\]|\\.)*)"`)
+
+func envDefault(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// parseNets reads a comma-separated list of CIDR networks from the
+// environment variable name.
+func parseNets(name string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(os.Getenv(name), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Printf("Invalid %s entry %q, ignoring it", name, s)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// dlnaLocalClient reports whether a request may use /dlna without signing
+// in: it must come straight from DLNA_ALLOWED_NETS, by default loopback,
+// private and link-local addresses. Proxied requests never qualify, as
+// behind a reverse proxy every client would look local.
+func dlnaLocalClient(c *gin.Context) bool {
+	for _, h := range []string{"X-Forwarded-For", "X-Real-IP", "Forwarded"} {
+		if c.GetHeader(h) != "" {
+			return false
+		}
+	}
+	ip := net.ParseIP(c.RemoteIP())
+	if ip == nil {
+		return false
+	}
+	if len(dlnaAllowedNets) == 0 {
+		return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+	}
+	for _, n := range dlnaAllowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dlnaDeviceUUID derives a stable device UUID so renderers keep recognising
+// the server across restarts.
+func dlnaDeviceUUID(name string) string {
+	host, _ := os.Hostname()
+	sum := sha1.Sum([]byte("go-music:" + host + ":" + name))
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// registerDLNARoutes adds the UPnP description, control and media routes.
+// They answer 404 unless DLNA_ENABLED is set.
+func registerDLNARoutes(r *gin.Engine) {
+	g := r.Group("/dlna", func(c *gin.Context) {
+		if !dlnaEnabled {
+			c.String(http.StatusNotFound, "Not found")
+			c.Abort()
+		}
+	})
+	g.GET("/device.xml", dlnaDeviceHandler)
+	g.GET("/ContentDirectory.xml", dlnaSCPDHandler(contentDirectorySCPD))
+	g.GET("/ConnectionManager.xml", dlnaSCPDHandler(connectionManagerSCPD))
+	g.POST("/control/ContentDirectory", dlnaContentDirectoryHandler)
+	g.POST("/control/ConnectionManager", dlnaConnectionManagerHandler)
+	g.Handle("SUBSCRIBE", "/event/:service", dlnaSubscribeHandler)
+	g.Handle("UNSUBSCRIBE", "/event/:service", func(c *gin.Context) { c.Status(http.StatusOK) })
+	g.GET("/media/*path", dlnaMediaHandler)
+	g.HEAD("/media/*path", dlnaMediaHandler)
+}
+
+func dlnaDeviceHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "text/xml; charset=utf-8", []byte(fmt.Sprintf(deviceDescription,
+		xmlEscape(dlnaFriendlyName), xmlEscape(Version), dlnaUUID,
+		DLNA_CONTENT_DIR, DLNA_CONN_MANAGER)))
+}
+
+func dlnaSCPDHandler(scpd string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/xml; charset=utf-8", []byte(scpd))
+	}
+}
+
+// dlnaSubscribeHandler accepts GENA subscriptions so renderers that insist on
+// subscribing keep working. No events are sent; the library is read-only.
+func dlnaSubscribeHandler(c *gin.Context) {
+	sid := c.GetHeader("SID")
+	if sid == "" {
+		sid = fmt.Sprintf("uuid:%s-%d", dlnaUUID, time.Now().UnixNano())
+	}
+	c.Header("SID", sid)
+	c.Header("TIMEOUT", "Second-"+strconv.Itoa(SSDP_MAX_AGE))
+	c.Status(http.StatusOK)
+}
+
+// dlnaMediaHandler serves tracks and cover art to renderers with the DLNA
+// transfer headers they expect. S3 objects are always proxied because many
+// renderers cannot follow redirects to signed URLs.
+func dlnaMediaHandler(c *gin.Context) {
+	key, ok := cleanKey(c.Param("path"))
+	if !ok {
+		c.String(http.StatusBadRequest, "Invalid path")
+		return
+	}
+	if aclDenied(c, key) {
+		return
+	}
+	c.Header("transferMode.dlna.org", "Streaming")
+	if c.GetHeader("getcontentFeatures.dlna.org") == "1" {
+		c.Header("contentFeatures.dlna.org", dlnaContentFeatures(key))
+	}
+	if usingLocal() {
+		absPath, err := localAbsPath(key)
+		if err != nil {
+			localPathError(c, err)
+			return
+		}
+		c.File(absPath)
+		return
+	}
+	s3StreamHandler(c, key)
+}
+
+func dlnaContentFeatures(key string) string {
+	flags := "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+	if strings.EqualFold(path.Ext(key), ".mp3") {
+		return "DLNA.ORG_PN=MP3;" + flags
+	}
+	return flags
+}
+
+// --- SOAP ---
+
+type soapEnvelope struct {
+	Body struct {
+		Action struct {
+			XMLName xml.Name
+			Inner   []byte `xml:",innerxml"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+// soapArg is an ordered output argument of a SOAP response.
+type soapArg struct {
+	Name  string
+	Value string
+}
+
+// upnpError is returned as a SOAP fault.
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+func (e *upnpError) Error() string { return e.Description }
+
+// readSOAPAction parses the action name and its arguments from the request.
+func readSOAPAction(c *gin.Context) (string, map[string]string, error) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, DLNA_MAX_BODY))
+	if err != nil {
+		return "", nil, err
+	}
+	var env soapEnvelope
+	if err := xml.Unmarshal(body, &env); err != nil {
+		return "", nil, err
+	}
+	args := map[string]string{}
+	dec := xml.NewDecoder(bytes.NewReader(env.Body.Action.Inner))
+	var name string
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+		case xml.CharData:
+			if name != "" {
+				args[name] += string(t)
+			}
+		case xml.EndElement:
+			name = ""
+		}
+	}
+	return env.Body.Action.XMLName.Local, args, nil
+}
+
+func writeSOAPResponse(c *gin.Context, service, action string, args []soapArg) {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&b, `<u:%sResponse xmlns:u="%s">`, action, service)
+	for _, a := range args {
+		fmt.Fprintf(&b, "<%s>%s</%s>", a.Name, xmlEscape(a.Value), a.Name)
+	}
+	fmt.Fprintf(&b, `</u:%sResponse></s:Body></s:Envelope>`, action)
+	c.Header("EXT", "")
+	c.Data(http.StatusOK, `text/xml; charset="utf-8"`, []byte(b.String()))
+}
+
+func writeSOAPFault(c *gin.Context, err *upnpError) {
+	c.Data(http.StatusInternalServerError, `text/xml; charset="utf-8"`, []byte(fmt.Sprintf(soapFault, err.Code, xmlEscape(err.Description))))
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func dlnaConnectionManagerHandler(c *gin.Context) {
+	action, _, err := readSOAPAction(c)
+	if err != nil {
+		writeSOAPFault(c, &upnpError{UPNP_ERR_INVALID_ACTION, "Invalid action"})
+		return
+	}
+	switch action {
+	case "GetProtocolInfo":
+		source := "http-get:*:audio/mpeg:*,http-get:*:audio/wav:*,http-get:*:audio/ogg:*,http-get:*:audio/mp4:*"
+		writeSOAPResponse(c, DLNA_CONN_MANAGER, action, []soapArg{{"Source", source}, {"Sink", ""}})
+	case "GetCurrentConnectionIDs":
+		writeSOAPResponse(c, DLNA_CONN_MANAGER, action, []soapArg{{"ConnectionIDs", "0"}})
+	case "GetCurrentConnectionInfo":
+		writeSOAPResponse(c, DLNA_CONN_MANAGER, action, []soapArg{
+			{"RcsID", "-1"}, {"AVTransportID", "-1"}, {"ProtocolInfo", ""},
+			{"PeerConnectionManager", ""}, {"PeerConnectionID", "-1"},
+			{"Direction", "Output"}, {"Status", "OK"},
+		})
+	default:
+		writeSOAPFault(c, &upnpError{UPNP_ERR_INVALID_ACTION, "Invalid action"})
+	}
+}
+
+func dlnaContentDirectoryHandler(c *gin.Context) {
+	action, args, err := readSOAPAction(c)
+	if err != nil {
+		writeSOAPFault(c, &upnpError{UPNP_ERR_INVALID_ACTION, "Invalid action"})
+		return
+	}
+	var out []soapArg
+	switch action {
+	case "Browse":
+		out, err = dlnaBrowse(c, args)
+	case "Search":
+		out, err = dlnaSearch(c, args)
+	case "GetSearchCapabilities":
+		out = []soapArg{{"SearchCaps", "dc:title,upnp:artist,upnp:album,upnp:class"}}
+	case "GetSortCapabilities":
+		out = []soapArg{{"SortCaps", ""}}
+	case "GetSystemUpdateID":
+		out = []soapArg{{"Id", "1"}}
+	default:
+		err = &upnpError{UPNP_ERR_INVALID_ACTION, "Invalid action"}
+	}
+	if err != nil {
+		ue, ok := err.(*upnpError)
+		if !ok {
+			log.Printf("DLNA %s error: %v", action, err)
+			ue = &upnpError{UPNP_ERR_NO_SUCH_OBJECT, "No such object"}
+		}
+		writeSOAPFault(c, ue)
+		return
+	}
+	writeSOAPResponse(c, DLNA_CONTENT_DIR, action, out)
+}
+
+// --- ContentDirectory ---
+
+// DIDL-Lite object ids are "0" for the library root and "0/<path>" below it.
+func dlnaObjectID(p string) string {
+	if p == "" {
+		return DLNA_ROOT_ID
+	}
+	return DLNA_ROOT_ID + "/" + p
+}
+
+func dlnaObjectPath(id string) (string, bool) {
+	if id == DLNA_ROOT_ID {
+		return "", true
+	}
+	p, ok := strings.CutPrefix(id, DLNA_ROOT_ID+"/")
+	if !ok || p == "" || strings.Contains(p, "..") || strings.HasPrefix(p, "/") {
+		return "", false
+	}
+	return p, true
+}
+
+func dlnaParentID(p string) string {
+	if p == "" {
+		return "-1"
+	}
+	if dir := path.Dir(p); dir != "." {
+		return dlnaObjectID(dir)
+	}
+	return DLNA_ROOT_ID
+}
+
+type didlLite struct {
+	XMLName    xml.Name        `xml:"DIDL-Lite"`
+	Xmlns      string          `xml:"xmlns,attr"`
+	XmlnsDC    string          `xml:"xmlns:dc,attr"`
+	XmlnsUPnP  string          `xml:"xmlns:upnp,attr"`
+	XmlnsDLNA  string          `xml:"xmlns:dlna,attr"`
+	Containers []didlContainer `xml:"container"`
+	Items      []didlItem      `xml:"item"`
+}
+
+type didlContainer struct {
+	ID         string `xml:"id,attr"`
+	ParentID   string `xml:"parentID,attr"`
+	Restricted string `xml:"restricted,attr"`
+	Searchable string `xml:"searchable,attr"`
+	Title      string `xml:"dc:title"`
+	Class      string `xml:"upnp:class"`
+}
+
+type didlItem struct {
+	ID          string  `xml:"id,attr"`
+	ParentID    string  `xml:"parentID,attr"`
+	Restricted  string  `xml:"restricted,attr"`
+	Title       string  `xml:"dc:title"`
+	Creator     string  `xml:"dc:creator,omitempty"`
+	Artist      string  `xml:"upnp:artist,omitempty"`
+	Album       string  `xml:"upnp:album,omitempty"`
+	AlbumArtURI string  `xml:"upnp:albumArtURI,omitempty"`
+	Class       string  `xml:"upnp:class"`
+	Res         didlRes `xml:"res"`
+}
+
+type didlRes struct {
+	ProtocolInfo string `xml:"protocolInfo,attr"`
+	URL          string `xml:",chardata"`
+}
+
+func newDIDL() *didlLite {
+	return &didlLite{
+		Xmlns:     "urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/",
+		XmlnsDC:   "http://purl.org/dc/elements/1.1/",
+		XmlnsUPnP: "urn:schemas-upnp-org:metadata-1-0/upnp/",
+		XmlnsDLNA: "urn:schemas-dlna-org:metadata-1-0/",
+	}
+}
+
+func (d *didlLite) String() string {
+	out, err := xml.Marshal(d)
+	if err != nil {
+		log.Printf("DIDL encode error: %v", err)
+		return ""
+	}
+	return string(out)
+}
+
+func dlnaContainer(p string) didlContainer {
+	title := path.Base(p)
+	if p == "" {
+		title = dlnaFriendlyName
+	}
+	return didlContainer{
+		ID: dlnaObjectID(p), ParentID: dlnaParentID(p), Restricted: "1", Searchable: "1",
+		Title: title, Class: "object.container.storageFolder",
+	}
+}
+
+// dlnaTrack describes a track with a stream URL below base. Artist and
+// title come from "Artist - Title" file names, the album from the directory.
+func dlnaTrack(base, key, art string) didlItem {
+	item := didlItem{
+		ID: dlnaObjectID(key), ParentID: dlnaParentID(key), Restricted: "1",
+		Title: trackTitle(key), Class: "object.item.audioItem.musicTrack",
+		Res: didlRes{
+			ProtocolInfo: "http-get:*:" + s3ContentType(key, "") + ":" + dlnaContentFeatures(key),
+			URL:          trackURL(base, "/dlna/media/", key),
+		},
+	}
+	if artist, title, found := strings.Cut(item.Title, " - "); found {
+		item.Artist, item.Creator, item.Title = strings.TrimSpace(artist), strings.TrimSpace(artist), strings.TrimSpace(title)
+	}
+	if dir := path.Dir(key); dir != "." {
+		item.Album = path.Base(dir)
+	}
+	if art != "" {
+		item.AlbumArtURI = trackURL(base, "/dlna/media/", art)
+	}
+	return item
+}
+
+// dlnaBrowse implements ContentDirectory Browse over the folder tree.
+func dlnaBrowse(c *gin.Context, args map[string]string) ([]soapArg, error) {
+	p, ok := dlnaObjectPath(args["ObjectID"])
+	access := accessFor(c)
+	if !ok || !(access.allowed(p) || access.dirVisible(p)) {
+		return nil, &upnpError{UPNP_ERR_NO_SUCH_OBJECT, "No such object"}
+	}
+	base := dlnaRequestBase(c)
+	didl := newDIDL()
+	if args["BrowseFlag"] == "BrowseMetadata" {
+		if p != "" && isAudioFile(p) {
+			didl.Items = append(didl.Items, dlnaTrack(base, p, ""))
+		} else {
+			didl.Containers = append(didl.Containers, dlnaContainer(p))
+		}
+		return dlnaResult(didl, 1, 1), nil
+	}
+	if args["BrowseFlag"] != "BrowseDirectChildren" {
+		return nil, &upnpError{UPNP_ERR_INVALID_ARGS, "Invalid BrowseFlag"}
+	}
+
+	prefix := ""
+	if p != "" {
+		prefix = p + "/"
+	}
+	listing, err := listDirEntries(prefix)
+	if err != nil {
+		return nil, &upnpError{UPNP_ERR_NO_SUCH_OBJECT, "No such object"}
+	}
+	listing = access.filterListing(p, listing)
+	sort.Strings(listing.Dirs)
+	sort.Strings(listing.Files)
+	art := ""
+	if key, found := findCoverArt(p); found && access.allowed(key) {
+		art = key
+	}
+
+	children := make([]string, 0, len(listing.Dirs)+len(listing.Files))
+	for _, d := range listing.Dirs {
+		children = append(children, prefix+d+"/")
+	}
+	for _, f := range listing.Files {
+		children = append(children, prefix+f)
+	}
+	total := len(children)
+	for _, child := range dlnaPage(children, args) {
+		if dir, isDir := strings.CutSuffix(child, "/"); isDir {
+			didl.Containers = append(didl.Containers, dlnaContainer(dir))
+		} else {
+			didl.Items = append(didl.Items, dlnaTrack(base, child, art))
+		}
+	}
+	return dlnaResult(didl, len(didl.Containers)+len(didl.Items), total), nil
+}
+
+// dlnaSearch matches tracks below ContainerID against the quoted terms of
+// the search criteria; criteria without terms (e.g. "*" or a class filter)
+// match every track.
+func dlnaSearch(c *gin.Context, args map[string]string) ([]soapArg, error) {
+	p, ok := dlnaObjectPath(args["ContainerID"])
+	if !ok {
+		return nil, &upnpError{UPNP_ERR_NO_SUCH_OBJECT, "No such object"}
+	}
+	prefix := ""
+	if p != "" {
+		prefix = p + "/"
+	}
+	files, err := listAllAudioFiles(prefix)
+	if err != nil {
+		return nil, err
+	}
+	files = accessFor(c).filterFiles(files)
+	var terms []string
+	for _, m := range dlnaSearchTerm.FindAllStringSubmatch(args["SearchCriteria"], -1) {
+		terms = append(terms, strings.ToLower(strings.ReplaceAll(m[1], `\"`, `"`)))
+	}
+
+	var matches []string
+	for _, f := range files {
+		f = strings.ReplaceAll(f, `\`, "/")
+		if dlnaMatches(strings.ToLower(f), terms) {
+			matches = append(matches, f)
+		}
+	}
+	sort.Strings(matches)
+	base := dlnaRequestBase(c)
+	didl := newDIDL()
+	for _, f := range dlnaPage(matches, args) {
+		didl.Items = append(didl.Items, dlnaTrack(base, f, ""))
+	}
+	return dlnaResult(didl, len(didl.Items), len(matches)), nil
+}
+
+func dlnaMatches(p string, terms []string) bool {
+	for _, t := range terms {
+		if !strings.Contains(p, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// dlnaPage applies StartingIndex and RequestedCount (0 = all).
+func dlnaPage(items []string, args map[string]string) []string {
+	start, _ := strconv.Atoi(args["StartingIndex"])
+	count, _ := strconv.Atoi(args["RequestedCount"])
+	if start < 0 || start >= len(items) {
+		return nil
+	}
+	items = items[start:]
+	if count > 0 && count < len(items) {
+		items = items[:count]
+	}
+	return items
+}
+
+func dlnaResult(didl *didlLite, returned, total int) []soapArg {
+	return []soapArg{
+		{"Result", didl.String()},
+		{"NumberReturned", strconv.Itoa(returned)},
+		{"TotalMatches", strconv.Itoa(total)},
+		{"UpdateID", "1"},
+	}
+}
+
+// dlnaRequestBase is the URL renderers should use to reach this server: the
+// configured DLNA_BASE_URL, otherwise the host the control request used.
+func dlnaRequestBase(c *gin.Context) string {
+	if dlnaBaseURL != "" {
+		return dlnaBaseURL
+	}
+	return requestBaseURL(c)
+}
+
+// --- SSDP ---
+
+// ssdpServer answers M-SEARCH discovery requests and periodically announces
+// the device on the SSDP multicast group.
+type ssdpServer struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+	port  int // HTTP port used in LOCATION
+}
+
+// startSSDP joins the SSDP group on DLNA_INTERFACE (or the default
+// interface) and serves discovery in the background.
+func startSSDP() error {
+	var iface *net.Interface
+	if name := os.Getenv("DLNA_INTERFACE"); name != "" {
+		var err error
+		if iface, err = net.InterfaceByName(name); err != nil {
+			return fmt.Errorf("DLNA interface %s: %w", name, err)
+		}
+	}
+	s, err := newSSDPServer(iface, SSDP_ADDR, DLNA_HTTP_PORT)
+	if err != nil {
+		return err
+	}
+	go s.serve()
+	go s.advertise(SSDP_MAX_AGE / 2 * time.Second)
+	log.Printf("DLNA media server %q announced via SSDP (uuid:%s)", dlnaFriendlyName, dlnaUUID)
+	return nil
+}
+
+func newSSDPServer(iface *net.Interface, groupAddr string, httpPort int) (*ssdpServer, error) {
+	group, err := net.ResolveUDPAddr("udp4", groupAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", iface, group)
+	if err != nil {
+		return nil, fmt.Errorf("SSDP listen: %w", err)
+	}
+	pc := ipv4.NewPacketConn(conn)
+	if iface != nil {
+		_ = pc.SetMulticastInterface(iface)
+	}
+	_ = pc.SetMulticastLoopback(true)
+	return &ssdpServer{conn: conn, group: group, port: httpPort}, nil
+}
+
+func (s *ssdpServer) close() error { return s.conn.Close() }
+
+// ssdpTargets are the notification types this device answers for.
+func ssdpTargets() []string {
+	return []string{"upnp:rootdevice", "uuid:" + dlnaUUID, DLNA_MEDIA_SERVER, DLNA_CONTENT_DIR, DLNA_CONN_MANAGER}
+}
+
+func ssdpUSN(target string) string {
+	if target == "uuid:"+dlnaUUID {
+		return target
+	}
+	return "uuid:" + dlnaUUID + "::" + target
+}
+
+func (s *ssdpServer) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, remote, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+			continue
+		}
+		go s.respond(remote, req.Header.Get("St"), req.Header.Get("Mx"))
+	}
+}
+
+// respond sends one unicast reply per matching target after a random delay
+// of up to MX seconds, as the UPnP spec requires.
+func (s *ssdpServer) respond(remote *net.UDPAddr, st, mx string) {
+	var targets []string
+	for _, t := range ssdpTargets() {
+		if st == "ssdp:all" || st == t {
+			targets = append(targets, t)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	if wait, err := strconv.Atoi(mx); err == nil && wait > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(min(wait, 5)) * int64(time.Second))))
+	}
+	location := s.location(remote)
+	for _, t := range targets {
+		msg := fmt.Sprintf("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=%d\r\nDATE: %s\r\nEXT:\r\nLOCATION: %s\r\nSERVER: %s\r\nST: %s\r\nUSN: %s\r\n\r\n",
+			SSDP_MAX_AGE, time.Now().UTC().Format(http.TimeFormat), location, ssdpServerHeader(), t, ssdpUSN(t))
+		if _, err := s.conn.WriteToUDP([]byte(msg), remote); err != nil {
+			log.Printf("SSDP reply error: %v", err)
+			return
+		}
+	}
+}
+
+// advertise multicasts ssdp:alive notifications now and every interval.
+func (s *ssdpServer) advertise(interval time.Duration) {
+	for {
+		location := s.location(s.group)
+		for _, t := range ssdpTargets() {
+			msg := fmt.Sprintf("NOTIFY * HTTP/1.1\r\nHOST: %s\r\nCACHE-CONTROL: max-age=%d\r\nLOCATION: %s\r\nNT: %s\r\nNTS: ssdp:alive\r\nSERVER: %s\r\nUSN: %s\r\n\r\n",
+				s.group, SSDP_MAX_AGE, location, t, ssdpServerHeader(), ssdpUSN(t))
+			if _, err := s.conn.WriteToUDP([]byte(msg), s.group); err != nil {
+				return
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// location returns the device description URL as reachable from remote.
+func (s *ssdpServer) location(remote *net.UDPAddr) string {
+	if dlnaBaseURL != "" {
+		return dlnaBaseURL + "/dlna/device.xml"
+	}
+	host := "127.0.0.1"
+	if conn, err := net.DialUDP("udp4", nil, remote); err == nil {
+		host = conn.LocalAddr().(*net.UDPAddr).IP.String()
+		_ = conn.Close()
+	}
+	return fmt.Sprintf("http://%s/dlna/device.xml", net.JoinHostPort(host, strconv.Itoa(s.port)))
+}
+
+func ssdpServerHeader() string {
+	return "Linux/1.0 UPnP/1.0 go-music/" + Version
+}
+
+const deviceDescription = `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+    <friendlyName>%s</friendlyName>
+    <manufacturer>go-music</manufacturer>
+    <modelName>go-music</modelName>
+    <modelNumber>%s</modelNumber>
+    <UDN>uuid:%s</UDN>
+    <dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC>
+    <serviceList>
+      <service>
+        <serviceType>%s</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+        <SCPDURL>/dlna/ContentDirectory.xml</SCPDURL>
+        <controlURL>/dlna/control/ContentDirectory</controlURL>
+        <eventSubURL>/dlna/event/ContentDirectory</eventSubURL>
+      </service>
+      <service>
+        <serviceType>%s</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+        <SCPDURL>/dlna/ConnectionManager.xml</SCPDURL>
+        <controlURL>/dlna/control/ConnectionManager</controlURL>
+        <eventSubURL>/dlna/event/ConnectionManager</eventSubURL>
+      </service>
+    </serviceList>
+  </device>
+</root>`
+
+const soapFault = `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`
+
+const contentDirectorySCPD = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action><name>Browse</name><argumentList>
+      <argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+      <argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+      <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+      <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+      <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+      <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+      <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>Search</name><argumentList>
+      <argument><name>ContainerID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+      <argument><name>SearchCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SearchCriteria</relatedStateVariable></argument>
+      <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+      <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+      <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+      <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+      <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSearchCapabilities</name><argumentList>
+      <argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSortCapabilities</name><argumentList>
+      <argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSystemUpdateID</name><argumentList>
+      <argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SearchCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>`
+
+const connectionManagerSCPD = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action><name>GetProtocolInfo</name><argumentList>
+      <argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>
+      <argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetCurrentConnectionIDs</name><argumentList>
+      <argument><name>ConnectionIDs</name><direction>out</direction><relatedStateVariable>CurrentConnectionIDs</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetCurrentConnectionInfo</name><argumentList>
+      <argument><name>ConnectionID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+      <argument><name>RcsID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_RcsID</relatedStateVariable></argument>
+      <argument><name>AVTransportID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_AVTransportID</relatedStateVariable></argument>
+      <argument><name>ProtocolInfo</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ProtocolInfo</relatedStateVariable></argument>
+      <argument><name>PeerConnectionManager</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionManager</relatedStateVariable></argument>
+      <argument><name>PeerConnectionID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+      <argument><name>Direction</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Direction</relatedStateVariable></argument>
+      <argument><name>Status</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionStatus</relatedStateVariable></argument>
+    </argumentList></action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>CurrentConnectionIDs</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionStatus</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>OK</allowedValue><allowedValue>ContentFormatMismatch</allowedValue><allowedValue>InsufficientBandwidth</allowedValue><allowedValue>UnreliableChannel</allowedValue><allowedValue>Unknown</allowedValue></allowedValueList></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionManager</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Direction</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>Input</allowedValue><allowedValue>Output</allowedValue></allowedValueList></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionID</name><dataType>i4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_AVTransportID</name><dataType>i4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_RcsID</name><dataType>i4</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>`
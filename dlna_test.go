@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/ipv4"
+)
+
+// dlnaCall posts a SOAP action to the ContentDirectory control URL
+func dlnaCall(action string, args map[string]string) *httptest.ResponseRecorder {
+	var b strings.Builder
+	for k, v := range args {
+		fmt.Fprintf(&b, "<%s>%s</%s>", k, xmlEscape(v), k)
+	}
+	body := fmt.Sprintf(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%s xmlns:u="%s">%s</u:%s></s:Body></s:Envelope>`,
+		action, DLNA_CONTENT_DIR, b.String(), action)
+	req := httptest.NewRequest("POST", "/dlna/control/ContentDirectory", strings.NewReader(body))
+	req.Header.Set("SOAPAction", `"`+DLNA_CONTENT_DIR+"#"+action+`"`)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// testDIDL decodes DIDL-Lite with namespace-qualified element names
+type testDIDL struct {
+	Containers []struct {
+		ID       string `xml:"id,attr"`
+		ParentID string `xml:"parentID,attr"`
+	} `xml:"container"`
+	Items []struct {
+		ID          string `xml:"id,attr"`
+		ParentID    string `xml:"parentID,attr"`
+		Title       string `xml:"http://purl.org/dc/elements/1.1/ title"`
+		Album       string `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ album"`
+		AlbumArtURI string `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ albumArtURI"`
+		Res         struct {
+			ProtocolInfo string `xml:"protocolInfo,attr"`
+			URL          string `xml:",chardata"`
+		} `xml:"res"`
+	} `xml:"item"`
+}
+
+// dlnaDIDL extracts and decodes the DIDL-Lite result of a Browse or Search
+func dlnaDIDL(t *testing.T, w *httptest.ResponseRecorder) (testDIDL, string) {
+	t.Helper()
+	var resp struct {
+		Body struct {
+			Response struct {
+				Result       string `xml:"Result"`
+				TotalMatches string `xml:"TotalMatches"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &resp))
+	var didl testDIDL
+	assert.NoError(t, xml.Unmarshal([]byte(resp.Body.Response.Result), &didl))
+	return didl, resp.Body.Response.TotalMatches
+}
+
+// TestDLNAContentDirectory checks device description, Browse and Search
+func TestDLNAContentDirectory(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origLocalMusicDir, origEnabled := localMusicDir, dlnaEnabled
+	defer func() {
+		localMusicDir, dlnaEnabled = origLocalMusicDir, origEnabled
+	}()
+	localMusicDir = tmpDir
+
+	os.MkdirAll(filepath.Join(tmpDir, "Abba", "Gold"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Abba", "Gold", "Abba - Dancing Queen.mp3"), []byte("queen"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Abba", "Gold", "cover.jpg"), []byte("jpeg"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "loose.mp3"), []byte("loose"), 0644)
+
+	t.Run("Disabled", func(t *testing.T) {
+		dlnaEnabled = false
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/dlna/device.xml", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	dlnaEnabled = true
+
+	t.Run("Device description", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/dlna/device.xml", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "<UDN>uuid:"+dlnaUUID+"</UDN>")
+		assert.Contains(t, w.Body.String(), DLNA_MEDIA_SERVER)
+		assert.Equal(t, dlnaUUID, dlnaDeviceUUID(dlnaFriendlyName), "UUID is stable")
+	})
+
+	t.Run("Browse", func(t *testing.T) {
+		didl, total := dlnaDIDL(t, dlnaCall("Browse", map[string]string{"ObjectID": "0", "BrowseFlag": "BrowseDirectChildren"}))
+		assert.Equal(t, "2", total)
+		assert.Len(t, didl.Containers, 1)
+		assert.Equal(t, "0/Abba", didl.Containers[0].ID)
+		assert.Len(t, didl.Items, 1)
+		assert.Equal(t, "http://example.com/dlna/media/loose.mp3", didl.Items[0].Res.URL)
+
+		didl, _ = dlnaDIDL(t, dlnaCall("Browse", map[string]string{"ObjectID": "0/Abba/Gold", "BrowseFlag": "BrowseDirectChildren"}))
+		assert.Len(t, didl.Items, 1)
+		item := didl.Items[0]
+		assert.Equal(t, "0/Abba/Gold", item.ParentID)
+		assert.Equal(t, "Dancing Queen", item.Title)
+		assert.Equal(t, "Gold", item.Album)
+		assert.Contains(t, item.Res.ProtocolInfo, "audio/mpeg:DLNA.ORG_PN=MP3")
+		assert.Equal(t, "http://example.com/dlna/media/Abba/Gold/cover.jpg", item.AlbumArtURI)
+
+		didl, total = dlnaDIDL(t, dlnaCall("Browse", map[string]string{"ObjectID": "0", "BrowseFlag": "BrowseDirectChildren", "StartingIndex": "1", "RequestedCount": "1"}))
+		assert.Equal(t, "2", total)
+		assert.Len(t, didl.Items, 1)
+		assert.Empty(t, didl.Containers)
+
+		didl, _ = dlnaDIDL(t, dlnaCall("Browse", map[string]string{"ObjectID": "0/Abba", "BrowseFlag": "BrowseMetadata"}))
+		assert.Equal(t, "0", didl.Containers[0].ParentID)
+
+		w := dlnaCall("Browse", map[string]string{"ObjectID": "0/../etc", "BrowseFlag": "BrowseDirectChildren"})
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Contains(t, w.Body.String(), "<errorCode>701</errorCode>")
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		didl, total := dlnaDIDL(t, dlnaCall("Search", map[string]string{"ContainerID": "0", "SearchCriteria": `upnp:class derivedfrom "object.item.audioItem" and dc:title contains "queen"`}))
+		assert.Equal(t, "1", total)
+		assert.Equal(t, "0/Abba/Gold/Abba - Dancing Queen.mp3", didl.Items[0].ID)
+
+		_, total = dlnaDIDL(t, dlnaCall("Search", map[string]string{"ContainerID": "0", "SearchCriteria": "*"}))
+		assert.Equal(t, "2", total)
+	})
+
+	t.Run("Media", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/dlna/media/Abba/Gold/Abba%20-%20Dancing%20Queen.mp3", nil)
+		req.Header.Set("getcontentFeatures.dlna.org", "1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "queen", w.Body.String())
+		assert.Equal(t, "Streaming", w.Header().Get("transferMode.dlna.org"))
+		assert.Contains(t, w.Header().Get("contentFeatures.dlna.org"), "DLNA.ORG_PN=MP3")
+	})
+
+	t.Run("Unknown action", func(t *testing.T) {
+		w := dlnaCall("DestroyObject", nil)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Contains(t, w.Body.String(), "<errorCode>401</errorCode>")
+	})
+}
+
+// TestSSDPDiscovery sends an M-SEARCH over loopback multicast
+func TestSSDPDiscovery(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface")
+	}
+	const group = "239.255.255.250:19001"
+	srv, err := newSSDPServer(lo, group, DLNA_HTTP_PORT)
+	if err != nil {
+		t.Skipf("multicast listen failed: %v", err)
+	}
+	defer srv.close()
+	go srv.serve()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer conn.Close()
+	pc := ipv4.NewPacketConn(conn)
+	if err := pc.SetMulticastInterface(lo); err != nil {
+		t.Skipf("cannot select loopback for multicast: %v", err)
+	}
+	_ = pc.SetMulticastLoopback(true)
+
+	dst, _ := net.ResolveUDPAddr("udp4", group)
+	msg := "M-SEARCH * HTTP/1.1\r\nHOST: " + group + "\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: " + DLNA_MEDIA_SERVER + "\r\n\r\n"
+	_, err = conn.WriteToUDP([]byte(msg), dst)
+	assert.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Skipf("no SSDP reply over loopback: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, DLNA_MEDIA_SERVER, resp.Header.Get("St"))
+	assert.Equal(t, "uuid:"+dlnaUUID+"::"+DLNA_MEDIA_SERVER, resp.Header.Get("Usn"))
+	assert.Equal(t, "http://127.0.0.1:8080/dlna/device.xml", resp.Header.Get("Location"))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+// Download limits (0 disables a limit). DOWNLOAD_MAX_BYTES requires a stat of
+// every track before streaming, so it is only checked when set.
+var (
+	downloadMaxFiles = envInt("DOWNLOAD_MAX_FILES", 0)
+	downloadMaxBytes = envInt64("DOWNLOAD_MAX_BYTES", 0)
+)
+
+var (
+	errTooManyFiles = errors.New("too many files")
+	errTooLarge     = errors.New("archive too large")
+)
+
+// downloadEntry is a library track and its name inside the archive.
+type downloadEntry struct {
+	Key  string
+	Name string
+}
+
+// downloadHandler streams a ZIP archive of a library directory or of a posted
+// track list. Entries are stored uncompressed and copied one at a time, so
+// memory use stays constant regardless of archive size.
+//
+//	GET  /download/Rock/Album/                    every track below the directory
+//	POST /download  {"name":"Mix","tracks":[...]} the listed tracks (JSON or form)
+func downloadHandler(c *gin.Context) {
+	name, entries, ok := downloadEntries(c)
+	if !ok {
+		return
+	}
+	sendZip(c, name, entries)
+}
+
+// sendZip checks the download limits and streams entries as name.zip.
+func sendZip(c *gin.Context, name string, entries []downloadEntry) {
+	if len(entries) == 0 {
+		c.String(http.StatusNotFound, "No audio files to download")
+		return
+	}
+	if err := checkDownloadLimits(c.Request.Context(), entries); err != nil {
+		downloadLimitError(c, err)
+		return
+	}
+
+	filename := strings.NewReplacer(`"`, "", "/", "_", `\`, "_").Replace(name) + ".zip"
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(filename))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	if err := writeZip(c.Request.Context(), c.Writer, entries); err != nil && c.Request.Context().Err() == nil {
+		log.Printf("Download archive error for [%s]: %v", name, err)
+	}
+}
+
+// downloadEntries collects the archive name and entries for a download
+// request, writing an error response when the request is invalid.
+func downloadEntries(c *gin.Context) (string, []downloadEntry, bool) {
+	if c.Request.Method == http.MethodPost {
+		var req struct {
+			Name   string   `json:"name" form:"name"`
+			Tracks []string `json:"tracks" form:"tracks"`
+		}
+		if err := c.ShouldBind(&req); err != nil {
+			c.String(http.StatusBadRequest, "Invalid request")
+			return "", nil, false
+		}
+		tracks := make([]string, 0, len(req.Tracks))
+		for _, t := range req.Tracks {
+			if key, ok := cleanKey(t); ok {
+				tracks = append(tracks, key)
+			}
+		}
+		return playlistName(req.Name, "playlist"), trackEntries(accessFor(c).filterFiles(tracks)), true
+	}
+
+	dir := strings.TrimPrefix(c.Param("path"), "/")
+	if strings.Contains(dir, "..") {
+		c.String(http.StatusBadRequest, "Invalid path")
+		return "", nil, false
+	}
+	if dir != "" && !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	files, err := listAllAudioFiles(dir)
+	if err != nil {
+		log.Printf("Download list error for [%s]: %v", dir, err)
+		c.String(http.StatusNotFound, TXT_ACC_DIR)
+		return "", nil, false
+	}
+	files = accessFor(c).filterFiles(files)
+	entries := make([]downloadEntry, 0, len(files))
+	for _, f := range files {
+		key := strings.ReplaceAll(f, `\`, "/")
+		entries = append(entries, downloadEntry{Key: key, Name: strings.TrimPrefix(key, dir)})
+	}
+	return playlistName("", path.Base("/"+strings.TrimSuffix(dir, "/"))), entries, true
+}
+
+// trackEntries names each track by its file name, numbering duplicates so
+// tracks from different directories do not collide inside the archive.
+func trackEntries(tracks []string) []downloadEntry {
+	entries := make([]downloadEntry, 0, len(tracks))
+	seen := make(map[string]int)
+	for _, t := range tracks {
+		key, ok := cleanKey(t)
+		if !ok || !isAudioFile(key) {
+			continue
+		}
+		name := path.Base(key)
+		if n := seen[strings.ToLower(name)]; n > 0 {
+			ext := path.Ext(name)
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n+1, ext)
+		}
+		seen[strings.ToLower(path.Base(key))]++
+		entries = append(entries, downloadEntry{Key: key, Name: name})
+	}
+	return entries
+}
+
+// checkDownloadLimits enforces DOWNLOAD_MAX_FILES and DOWNLOAD_MAX_BYTES
+// before any of the archive is sent.
+func checkDownloadLimits(ctx context.Context, entries []downloadEntry) error {
+	if downloadMaxFiles > 0 && len(entries) > downloadMaxFiles {
+		return errTooManyFiles
+	}
+	if downloadMaxBytes <= 0 {
+		return nil
+	}
+	var total int64
+	for _, e := range entries {
+		size, err := audioSize(ctx, e.Key)
+		if err != nil {
+			return err
+		}
+		if total += size; total > downloadMaxBytes {
+			return errTooLarge
+		}
+	}
+	return nil
+}
+
+func downloadLimitError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errTooManyFiles):
+		c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("Too many files (limit %d)", downloadMaxFiles))
+	case errors.Is(err, errTooLarge):
+		c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("Download too large (limit %d bytes)", downloadMaxBytes))
+	default:
+		localPathError(c, err)
+	}
+}
+
+// audioSize returns the size of a track without reading it.
+func audioSize(ctx context.Context, key string) (int64, error) {
+	if usingLocal() {
+		absPath, err := localAbsPath(key)
+		if err != nil {
+			return 0, err
+		}
+		info, err := os.Stat(absPath)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	out, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(s3Prefix + key),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return 0, errNotFound
+		}
+		return 0, err
+	}
+	return aws.ToInt64(out.ContentLength), nil
+}
+
+// writeZip writes entries to w as a stored ZIP archive. Tracks that cannot be
+// opened once streaming has started are skipped and logged.
+func writeZip(ctx context.Context, w io.Writer, entries []downloadEntry) error {
+	zw := zip.NewWriter(w)
+	buf := make([]byte, S3_PROXY_BUFFER_SIZE)
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		obj, err := openAudio(ctx, e.Key)
+		if err != nil {
+			log.Printf("Download skipped [%s]: %v", e.Key, err)
+			continue
+		}
+		err = writeZipEntry(zw, e.Name, obj, buf)
+		_ = obj.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeZipEntry(zw *zip.Writer, name string, obj *audioObject, buf []byte) error {
+	modified := obj.ModTime
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyBuffer(fw, obj, buf)
+	return err
+}
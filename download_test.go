@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readZip returns the archive entries of a response body by name
+func readZip(t *testing.T, body []byte) map[string]string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		assert.Equal(t, zip.Store, f.Method, f.Name)
+		rc, err := f.Open()
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	return files
+}
+
+// TestDownloadLocal checks directory and track list archives from local disk
+func TestDownloadLocal(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origLocalMusicDir, origMaxFiles, origMaxBytes := localMusicDir, downloadMaxFiles, downloadMaxBytes
+	defer func() {
+		localMusicDir, downloadMaxFiles, downloadMaxBytes = origLocalMusicDir, origMaxFiles, origMaxBytes
+	}()
+	localMusicDir = tmpDir
+
+	os.MkdirAll(filepath.Join(tmpDir, "Rock", "Album", "CD2"), 0755)
+	os.MkdirAll(filepath.Join(tmpDir, "Jazz"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Rock", "Album", "01 Intro.mp3"), []byte("intro"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Rock", "Album", "cover.jpg"), []byte("jpg"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Rock", "Album", "CD2", "01 Intro.mp3"), []byte("intro2"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "tune.wav"), []byte("tune"), 0644)
+
+	t.Run("Directory", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/download/Rock/Album", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Header().Get("Content-Disposition"), "Album.zip")
+		assert.Equal(t, map[string]string{
+			"01 Intro.mp3":     "intro",
+			"CD2/01 Intro.mp3": "intro2",
+		}, readZip(t, w.Body.Bytes()))
+	})
+
+	t.Run("Posted tracks as JSON", func(t *testing.T) {
+		body := `{"name":"Mix","tracks":["Rock/Album/01 Intro.mp3","Jazz/tune.wav","Rock/Album/CD2/01 Intro.mp3","../etc/passwd"]}`
+		req := httptest.NewRequest("POST", "/download", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Disposition"), "Mix.zip")
+		assert.Equal(t, map[string]string{
+			"01 Intro.mp3":     "intro",
+			"tune.wav":         "tune",
+			"01 Intro (2).mp3": "intro2",
+		}, readZip(t, w.Body.Bytes()))
+	})
+
+	t.Run("Posted tracks as form", func(t *testing.T) {
+		form := url.Values{"tracks": {"Jazz/tune.wav"}}
+		req := httptest.NewRequest("POST", "/download", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, map[string]string{"tune.wav": "tune"}, readZip(t, w.Body.Bytes()))
+	})
+
+	t.Run("Posted tracks are cleaned before access rules apply", func(t *testing.T) {
+		withACLRules(t, `[{"path":"Jazz/","allow":["alice"]}]`)
+		body := `{"tracks":["./Jazz/tune.wav","Rock/./Album/01 Intro.mp3"]}`
+		req := httptest.NewRequest("POST", "/download", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, map[string]string{"01 Intro.mp3": "intro"}, readZip(t, w.Body.Bytes()))
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		downloadMaxFiles = 1
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/download/Rock/", nil))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+		downloadMaxFiles, downloadMaxBytes = 0, 10
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/download/Rock/", nil))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+		downloadMaxBytes = 11
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/download/Rock/", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		downloadMaxBytes = 0
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/download/../secret/", nil))
+		assert.NotEqual(t, http.StatusOK, w.Code)
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/download/Missing/", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		req := httptest.NewRequest("POST", "/download", strings.NewReader(`{"tracks":[]}`))
+		req.Header.Set("Content-Type", "application/json")
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+// TestDownloadS3 checks archives streamed from S3 objects
+func TestDownloadS3(t *testing.T) {
+	newFakeS3(t, map[string][]byte{
+		"Rock/a.mp3":   []byte("aaa"),
+		"Rock/b.mp3":   []byte("bbbb"),
+		"Rock/art.png": []byte("png"),
+	})
+	origMaxBytes := downloadMaxBytes
+	defer func() { downloadMaxBytes = origMaxBytes }()
+	downloadMaxBytes = 7
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/download/Rock/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, map[string]string{"a.mp3": "aaa", "b.mp3": "bbbb"}, readZip(t, w.Body.Bytes()))
+
+	downloadMaxBytes = 6
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/download/Rock/", nil))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
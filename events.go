@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Library change events: a watcher lists the library every
+// LIBRARY_WATCH_INTERVAL, and S3 event notifications posted to /events/s3
+// report uploads and deletions as they happen. Changes are grouped by the
+// directory whose listing changed and streamed to browsers on /events as
+// Server-Sent Events. A reconnecting client sends Last-Event-ID and gets
+// the events it missed, or a reset event when they are no longer kept.
+
+const (
+	EVENTS_PATH           = "/events"
+	EVENTS_S3_PATH        = "/events/s3"
+	EVENT_LOG_SIZE        = 1000
+	EVENT_SUB_QUEUE       = 256
+	EVENT_MAX_TRACKS      = 100
+	EVENT_RETRY_MS        = 5000
+	EVENTS_KEEPALIVE      = 25 * time.Second
+	DEFAULT_LIBRARY_WATCH = 30 * time.Second
+	MAX_S3_EVENT_BODY     = 1 << 20
+)
+
+// Event types. A directory whose listing only gained entries is added, one
+// that only lost entries is removed, and any other change is rescanned.
+const (
+	EVENT_ADDED     = "added"
+	EVENT_REMOVED   = "removed"
+	EVENT_RESCANNED = "rescanned"
+	EVENT_RESET     = "reset"
+)
+
+var (
+	libraryWatch   = envDuration("LIBRARY_WATCH_INTERVAL", DEFAULT_LIBRARY_WATCH)
+	libraryWatchS3 = envBool("LIBRARY_WATCH_S3")
+	snsClient      = &http.Client{Timeout: 10 * time.Second}
+)
+
+// libraryEvent reports a change to the listing of Dir: the tracks and
+// subdirectories that appeared, disappeared or changed in it.
+type libraryEvent struct {
+	ID     uint64    `json:"id"`
+	Type   string    `json:"type"`
+	Dir    string    `json:"dir"`
+	Tracks []string  `json:"tracks,omitempty"`
+	Dirs   []string  `json:"dirs,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// --- Change detection ---
+
+// librarySnapshot is the set of known tracks, with the number of tracks
+// below each directory so new and emptied directories can be told apart.
+type librarySnapshot struct {
+	mu     sync.Mutex
+	loaded bool
+	files  map[string]feedFile
+	dirs   map[string]int
+}
+
+var watched = newLibrarySnapshot()
+
+func newLibrarySnapshot() *librarySnapshot {
+	return &librarySnapshot{files: map[string]feedFile{}, dirs: map[string]int{}}
+}
+
+// dirChange collects the changes to one directory's listing.
+type dirChange struct {
+	added, removed, modified bool
+	tracks, dirs             []string
+}
+
+// eventDir returns the directory of a key in listing form: "" or "a/b/".
+func eventDir(key string) string {
+	dir := path.Dir(strings.TrimSuffix(key, "/"))
+	if dir == "." {
+		return ""
+	}
+	return dir + "/"
+}
+
+// sync replaces the snapshot with a full listing and returns the changes.
+// The first listing only records the library.
+func (s *librarySnapshot) sync(files []feedFile) []libraryEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first := !s.loaded
+	s.loaded = true
+	seen := make(map[string]bool, len(files))
+	changes := map[string]*dirChange{}
+	for _, f := range files {
+		seen[f.Key] = true
+		s.put(changes, f)
+	}
+	for key := range s.files {
+		if !seen[key] {
+			s.remove(changes, key)
+		}
+	}
+	if first {
+		return nil
+	}
+	return changeEvents(changes)
+}
+
+// applyChanges records uploads and deletions reported by S3 and returns
+// the changes. The snapshot is listed first if it has not been yet.
+func (s *librarySnapshot) applyChanges(added []feedFile, removed []string) ([]libraryEvent, error) {
+	s.mu.Lock()
+	loaded := s.loaded
+	s.mu.Unlock()
+	if !loaded {
+		files, err := listFeedFiles("")
+		if err != nil {
+			return nil, err
+		}
+		s.sync(files)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changes := map[string]*dirChange{}
+	for _, f := range added {
+		s.put(changes, f)
+	}
+	for _, key := range removed {
+		s.remove(changes, key)
+	}
+	return changeEvents(changes), nil
+}
+
+func change(changes map[string]*dirChange, dir string) *dirChange {
+	ch := changes[dir]
+	if ch == nil {
+		ch = &dirChange{}
+		changes[dir] = ch
+	}
+	return ch
+}
+
+// put adds or updates a track. The caller holds mu.
+func (s *librarySnapshot) put(changes map[string]*dirChange, f feedFile) {
+	old, ok := s.files[f.Key]
+	s.files[f.Key] = f
+	if ok {
+		if old.Size != f.Size || !old.ModTime.Equal(f.ModTime) {
+			ch := change(changes, eventDir(f.Key))
+			ch.modified, ch.tracks = true, append(ch.tracks, f.Key)
+		}
+		return
+	}
+	ch := change(changes, eventDir(f.Key))
+	ch.added, ch.tracks = true, append(ch.tracks, f.Key)
+	for dir := eventDir(f.Key); dir != ""; dir = eventDir(dir) {
+		s.dirs[dir]++
+		if s.dirs[dir] == 1 {
+			ch := change(changes, eventDir(dir))
+			ch.added, ch.dirs = true, append(ch.dirs, dir)
+		}
+	}
+}
+
+// remove drops a track. The caller holds mu.
+func (s *librarySnapshot) remove(changes map[string]*dirChange, key string) {
+	if _, ok := s.files[key]; !ok {
+		return
+	}
+	delete(s.files, key)
+	ch := change(changes, eventDir(key))
+	ch.removed, ch.tracks = true, append(ch.tracks, key)
+	for dir := eventDir(key); dir != ""; dir = eventDir(dir) {
+		s.dirs[dir]--
+		if s.dirs[dir] == 0 {
+			delete(s.dirs, dir)
+			ch := change(changes, eventDir(dir))
+			ch.removed, ch.dirs = true, append(ch.dirs, dir)
+		}
+	}
+}
+
+// changeEvents turns the collected changes into events, one per directory.
+func changeEvents(changes map[string]*dirChange) []libraryEvent {
+	out := make([]libraryEvent, 0, len(changes))
+	now := time.Now().UTC()
+	for dir, ch := range changes {
+		typ := EVENT_RESCANNED
+		switch {
+		case ch.added && !ch.removed && !ch.modified:
+			typ = EVENT_ADDED
+		case ch.removed && !ch.added && !ch.modified:
+			typ = EVENT_REMOVED
+		}
+		sort.Strings(ch.tracks)
+		sort.Strings(ch.dirs)
+		out = append(out, libraryEvent{Type: typ, Dir: dir, Tracks: ch.tracks[:min(len(ch.tracks), EVENT_MAX_TRACKS)], Dirs: ch.dirs, Time: now})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Dir < out[j].Dir })
+	return out
+}
+
+// startLibraryWatcher lists the library every LIBRARY_WATCH_INTERVAL and
+// publishes what changed. S3 libraries are only listed with LIBRARY_WATCH_S3.
+func startLibraryWatcher() {
+	if !usingLocal() && !libraryWatchS3 {
+		return
+	}
+	go func() {
+		for ; ; time.Sleep(libraryWatch) {
+			files, err := listFeedFiles("")
+			if err != nil {
+				log.Printf("Library watch error: %v", err)
+				continue
+			}
+			publishLibraryEvents(watched.sync(files))
+		}
+	}()
+}
+
+// publishLibraryEvents sends events to subscribers and marks the library
+// index for a rebuild.
+func publishLibraryEvents(evs []libraryEvent) {
+	if len(evs) == 0 {
+		return
+	}
+	library.invalidate()
+	libraryEvents.publish(evs)
+}
+
+// --- Event log and subscribers ---
+
+type eventHub struct {
+	mu   sync.Mutex
+	next uint64 // ID of the next event
+	log  []libraryEvent
+	subs map[chan libraryEvent]struct{}
+}
+
+var libraryEvents = newEventHub()
+
+// newEventHub numbers events from the current time in milliseconds, so IDs
+// from before a restart are older than any kept and get a reset.
+func newEventHub() *eventHub {
+	return &eventHub{next: uint64(time.Now().UnixMilli()), subs: map[chan libraryEvent]struct{}{}}
+}
+
+func (h *eventHub) publish(evs []libraryEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ev := range evs {
+		ev.ID = h.next
+		h.next++
+		h.log = append(h.log, ev)
+		for ch := range h.subs {
+			select {
+			case ch <- ev:
+			default:
+				// The client reconnects and catches up from the log.
+				delete(h.subs, ch)
+				close(ch)
+			}
+		}
+	}
+	if over := len(h.log) - EVENT_LOG_SIZE; over > 0 {
+		h.log = slices.Delete(h.log, 0, over)
+	}
+}
+
+// subscribe returns the events after lastID and a channel of new ones.
+// reset is set when events after lastID are no longer kept; latest is the
+// ID to resume from then.
+func (h *eventHub) subscribe(lastID uint64, resume bool) (replay []libraryEvent, reset bool, latest uint64, ch chan libraryEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if resume {
+		oldest := h.next
+		if len(h.log) > 0 {
+			oldest = h.log[0].ID
+		}
+		reset = lastID+1 < oldest || lastID >= h.next
+		for _, ev := range h.log {
+			if !reset && ev.ID > lastID {
+				replay = append(replay, ev)
+			}
+		}
+	}
+	ch = make(chan libraryEvent, EVENT_SUB_QUEUE)
+	h.subs[ch] = struct{}{}
+	return replay, reset, h.next - 1, ch
+}
+
+func (h *eventHub) unsubscribe(ch chan libraryEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// visibleEvent narrows ev to what acc may see; ok is false when nothing is
+// left.
+func visibleEvent(acc *aclAccess, ev libraryEvent) (libraryEvent, bool) {
+	if acc == nil {
+		return ev, true
+	}
+	if !acc.dirVisible(ev.Dir) {
+		return ev, false
+	}
+	ev.Tracks, ev.Dirs = acc.filterFiles(ev.Tracks), acc.filterDirs(ev.Dirs)
+	return ev, len(ev.Tracks) > 0 || len(ev.Dirs) > 0
+}
+
+// --- Handlers ---
+
+// eventsHandler streams library changes as Server-Sent Events. The event
+// name is the change type and the data a libraryEvent.
+func eventsHandler(c *gin.Context) {
+	if isLambda {
+		c.String(http.StatusNotImplemented, "Events are not available on Lambda")
+		return
+	}
+	last := c.GetHeader("Last-Event-ID")
+	if last == "" {
+		last = c.Query("lastEventId")
+	}
+	lastID, err := strconv.ParseUint(last, 10, 64)
+	replay, reset, latest, ch := libraryEvents.subscribe(lastID, err == nil)
+	defer libraryEvents.unsubscribe(ch)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	w, acc := c.Writer, accessFor(c)
+	fmt.Fprintf(w, "retry: %d\n\n", EVENT_RETRY_MS)
+	if reset {
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: {}\n\n", latest, EVENT_RESET)
+	}
+	for _, ev := range replay {
+		writeLibraryEvent(w, acc, ev)
+	}
+	w.Flush()
+
+	keepalive := time.NewTicker(EVENTS_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeLibraryEvent(w, acc, ev)
+		case <-keepalive.C:
+			_, _ = io.WriteString(w, ": keepalive\n\n")
+		}
+		w.Flush()
+	}
+}
+
+func writeLibraryEvent(w io.Writer, acc *aclAccess, ev libraryEvent) {
+	ev, ok := visibleEvent(acc, ev)
+	if !ok {
+		return
+	}
+	data, _ := json.Marshal(ev)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+}
+
+// s3Notification is the part of an S3 event notification used here. It
+// arrives as is, wrapped in an SNS message, or as an EventBridge event.
+type s3Notification struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key  string `json:"key"`
+				Size int64  `json:"size"`
+			} `json:"object"`
+		} `json:"s3"`
+		EventTime time.Time `json:"eventTime"`
+	} `json:"Records"`
+
+	// SNS
+	Type         string `json:"Type"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+
+	// EventBridge
+	DetailType string    `json:"detail-type"`
+	Time       time.Time `json:"time"`
+	Detail     struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key  string `json:"key"`
+			Size int64  `json:"size"`
+		} `json:"object"`
+	} `json:"detail"`
+}
+
+// s3EventsHandler takes S3 event notifications for the library bucket and
+// publishes the changes. Point an SNS subscription or EventBridge API
+// destination at it with admin credentials.
+func s3EventsHandler(c *gin.Context) {
+	if !isAdmin(c) {
+		c.String(http.StatusForbidden, "Forbidden")
+		return
+	}
+	var n s3Notification
+	if err := json.NewDecoder(io.LimitReader(c.Request.Body, MAX_S3_EVENT_BODY)).Decode(&n); err != nil {
+		c.String(http.StatusBadRequest, "Invalid notification")
+		return
+	}
+	switch n.Type {
+	case "SubscriptionConfirmation":
+		if err := confirmSNS(c.Request.Context(), n.SubscribeURL); err != nil {
+			log.Printf("SNS confirmation error: %v", err)
+			c.String(http.StatusBadRequest, "Invalid subscription")
+			return
+		}
+		c.String(http.StatusOK, "OK")
+		return
+	case "Notification":
+		inner := s3Notification{}
+		if err := json.Unmarshal([]byte(n.Message), &inner); err != nil {
+			c.String(http.StatusBadRequest, "Invalid notification")
+			return
+		}
+		n = inner
+	}
+	added, removed := s3Changes(n)
+	evs, err := watched.applyChanges(added, removed)
+	if err != nil {
+		log.Printf("Library list error: %v", err)
+		c.String(http.StatusInternalServerError, "Failed to list library")
+		return
+	}
+	publishLibraryEvents(evs)
+	c.String(http.StatusOK, "OK")
+}
+
+// s3Changes extracts the library tracks created and removed in a
+// notification. Other buckets, keys outside S3_PREFIX and non-audio files
+// are ignored.
+func s3Changes(n s3Notification) (added []feedFile, removed []string) {
+	record := func(bucket, name, key string, size int64, at time.Time) {
+		key, ok := strings.CutPrefix(key, s3Prefix)
+		if bucket != s3Bucket || !ok || !isAudioFile(key) {
+			return
+		}
+		switch {
+		case strings.HasPrefix(name, "ObjectCreated") || name == "Object Created":
+			added = append(added, feedFile{Key: key, Size: size, ModTime: at})
+		case strings.HasPrefix(name, "ObjectRemoved") || name == "Object Deleted":
+			removed = append(removed, key)
+		}
+	}
+	for _, r := range n.Records {
+		// Keys in S3 notifications are form-encoded.
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err == nil {
+			record(r.S3.Bucket.Name, r.EventName, key, r.S3.Object.Size, r.EventTime)
+		}
+	}
+	if n.DetailType != "" {
+		record(n.Detail.Bucket.Name, n.DetailType, n.Detail.Object.Key, n.Detail.Object.Size, n.Time)
+	}
+	return added, removed
+}
+
+// confirmSNS confirms an SNS subscription. Only SNS endpoints are fetched.
+func confirmSNS(ctx context.Context, subscribeURL string) error {
+	u, err := url.Parse(subscribeURL)
+	if err != nil || u.Scheme != "https" || !strings.HasPrefix(u.Host, "sns.") || !strings.HasSuffix(u.Host, ".amazonaws.com") {
+		return errors.New("not an sns subscription url")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := snsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sns confirmation: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withLibraryEvents gives a test its own event log and snapshot
+func withLibraryEvents(t *testing.T) {
+	t.Helper()
+	origEvents, origWatched := libraryEvents, watched
+	t.Cleanup(func() { libraryEvents, watched = origEvents, origWatched })
+	libraryEvents, watched = newEventHub(), newLibrarySnapshot()
+}
+
+// TestLibrarySnapshot checks grouping changes by directory
+func TestLibrarySnapshot(t *testing.T) {
+	s := newLibrarySnapshot()
+	t0 := time.Now()
+	assert.Empty(t, s.sync([]feedFile{{Key: "Jazz/a.mp3", Size: 1, ModTime: t0}, {Key: "Jazz/b.mp3", Size: 1, ModTime: t0}, {Key: "Rock/c.mp3", Size: 1, ModTime: t0}}), "the first listing is the baseline")
+
+	evs := s.sync([]feedFile{
+		{Key: "Jazz/a.mp3", Size: 2, ModTime: t0},
+		{Key: "Jazz/b.mp3", Size: 1, ModTime: t0},
+		{Key: "Jazz/New/Album/d.mp3", Size: 1, ModTime: t0},
+	})
+	byDir := map[string]libraryEvent{}
+	for _, ev := range evs {
+		byDir[ev.Dir] = ev
+	}
+	assert.Len(t, evs, 5)
+	assert.Equal(t, EVENT_RESCANNED, byDir["Jazz/"].Type)
+	assert.Equal(t, []string{"Jazz/a.mp3"}, byDir["Jazz/"].Tracks)
+	assert.Equal(t, []string{"Jazz/New/"}, byDir["Jazz/"].Dirs)
+	assert.Equal(t, EVENT_ADDED, byDir["Jazz/New/"].Type)
+	assert.Equal(t, []string{"Jazz/New/Album/"}, byDir["Jazz/New/"].Dirs)
+	assert.Equal(t, []string{"Jazz/New/Album/d.mp3"}, byDir["Jazz/New/Album/"].Tracks)
+	assert.Equal(t, EVENT_REMOVED, byDir["Rock/"].Type)
+	assert.Equal(t, EVENT_REMOVED, byDir[""].Type)
+	assert.Equal(t, []string{"Rock/"}, byDir[""].Dirs)
+}
+
+// TestEventHub checks Last-Event-ID replay and resets
+func TestEventHub(t *testing.T) {
+	h := newEventHub()
+	_, _, _, live := h.subscribe(0, false)
+	h.publish([]libraryEvent{{Type: EVENT_ADDED, Dir: "a/"}, {Type: EVENT_ADDED, Dir: "b/"}})
+	first := <-live
+	assert.Equal(t, "b/", (<-live).Dir)
+
+	replay, reset, _, ch := h.subscribe(first.ID, true)
+	h.unsubscribe(ch)
+	assert.False(t, reset)
+	assert.Len(t, replay, 1)
+	assert.Equal(t, "b/", replay[0].Dir)
+
+	_, reset, latest, ch := h.subscribe(first.ID-5, true)
+	h.unsubscribe(ch)
+	assert.True(t, reset, "events before the log")
+	assert.Equal(t, first.ID+1, latest)
+	_, reset, _, ch = h.subscribe(first.ID+10, true)
+	h.unsubscribe(ch)
+	assert.True(t, reset, "an ID from another process")
+}
+
+// TestEventsStream checks the SSE endpoint
+func TestEventsStream(t *testing.T) {
+	withLibraryEvents(t)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	libraryEvents.publish([]libraryEvent{{Type: EVENT_ADDED, Dir: "Jazz/", Tracks: []string{"Jazz/a.mp3"}}})
+	_, _, latest, ch := libraryEvents.subscribe(0, false)
+	libraryEvents.unsubscribe(ch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+EVENTS_PATH, nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(latest-1, 10))
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	lines := bufio.NewScanner(resp.Body)
+	next := func() string {
+		for lines.Scan() {
+			if strings.HasPrefix(lines.Text(), "event: ") {
+				event := strings.TrimPrefix(lines.Text(), "event: ")
+				lines.Scan()
+				return event + " " + strings.TrimPrefix(lines.Text(), "data: ")
+			}
+		}
+		return ""
+	}
+	assert.Contains(t, next(), `added {"id":`+strconv.FormatUint(latest, 10)+`,"type":"added","dir":"Jazz/"`)
+	libraryEvents.publish([]libraryEvent{{Type: EVENT_REMOVED, Dir: "Rock/", Dirs: []string{"Rock/Old/"}}})
+	assert.Contains(t, next(), `removed {"id":`)
+}
+
+// TestS3Events checks ingesting S3 event notifications
+func TestS3Events(t *testing.T) {
+	withLibraryEvents(t)
+	tmpDir := t.TempDir()
+	origLocalMusicDir, origBucket, origPrefix := localMusicDir, s3Bucket, s3Prefix
+	defer func() { localMusicDir, s3Bucket, s3Prefix = origLocalMusicDir, origBucket, origPrefix }()
+	localMusicDir, s3Bucket, s3Prefix = tmpDir, "music", "library/"
+	os.MkdirAll(filepath.Join(tmpDir, "Jazz"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "a.mp3"), []byte("a"), 0644)
+	_, _, _, live := libraryEvents.subscribe(0, false)
+
+	post := func(body string) int {
+		req := httptest.NewRequest("POST", EVENTS_S3_PATH, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, 200, post(`{"Records":[
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"music"},"object":{"key":"library/Jazz/New+Album/b+side.mp3","size":5}}},
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"music"},"object":{"key":"library/Jazz/New+Album/cover.jpg","size":5}}},
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"other"},"object":{"key":"library/Jazz/x.mp3","size":5}}}]}`))
+	assert.Equal(t, "Jazz/", (<-live).Dir)
+	ev := <-live
+	assert.Equal(t, []string{"Jazz/New Album/b side.mp3"}, ev.Tracks)
+
+	// EventBridge, wrapped in nothing, and SNS-wrapped S3 events.
+	assert.Equal(t, 200, post(`{"detail-type":"Object Deleted","detail":{"bucket":{"name":"music"},"object":{"key":"library/Jazz/a.mp3"}}}`))
+	ev = <-live
+	assert.Equal(t, EVENT_REMOVED, ev.Type)
+	assert.Equal(t, []string{"Jazz/a.mp3"}, ev.Tracks)
+	assert.Equal(t, 200, post(`{"Type":"Notification","Message":"{\"Records\":[{\"eventName\":\"ObjectRemoved:Delete\",\"s3\":{\"bucket\":{\"name\":\"music\"},\"object\":{\"key\":\"library/Jazz/New+Album/b+side.mp3\"}}}]}"}`))
+	assert.Equal(t, EVENT_REMOVED, (<-live).Type)
+
+	assert.Equal(t, 400, post(`{"Type":"SubscriptionConfirmation","SubscribeURL":"https://evil.example/confirm"}`))
+	assert.Equal(t, 400, post(`not json`))
+}
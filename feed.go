@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	FEED_SUFFIX      = ".rss"
+	FEED_SORT_NAME   = "name"
+	FEED_SORT_MTIME  = "mtime"
+	FEED_ITUNES_NS   = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	FEED_TOKEN_FEED  = "feed"
+	FEED_TOKEN_MEDIA = "media"
+	FEED_OWNER_PARAM = "u"
+)
+
+// feedSecret signs the tokens embedded in feed and enclosure URLs. When it is
+// unset feeds are public and URLs carry no token.
+var feedSecret = os.Getenv("FEED_SECRET")
+
+// feedFile is an audio file with the metadata needed for an enclosure.
+type feedFile struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// signToken returns an HMAC of subject for the given purpose, so a token
+// issued for one feed or file cannot be replayed against another.
+func signToken(purpose, subject string) string {
+	if feedSecret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(feedSecret))
+	mac.Write([]byte(purpose + "\x00" + subject))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validToken(purpose, subject, token string) bool {
+	if feedSecret == "" {
+		return true
+	}
+	return hmac.Equal([]byte(token), []byte(signToken(purpose, subject)))
+}
+
+// feedPurpose binds a token to the user whose access rules apply, so the
+// owner parameter of a URL cannot be swapped for another user's.
+func feedPurpose(purpose, owner string) string {
+	if owner == "" {
+		return purpose
+	}
+	return purpose + ":" + owner
+}
+
+// feedQuery returns the token and owner query parameters when tokens are in
+// use, or "" for public feeds.
+func feedQuery(purpose, subject, owner string) string {
+	token := signToken(feedPurpose(purpose, owner), subject)
+	if token == "" {
+		return ""
+	}
+	q := "?token=" + url.QueryEscape(token)
+	if owner != "" {
+		q += "&" + FEED_OWNER_PARAM + "=" + url.QueryEscape(owner)
+	}
+	return q
+}
+
+// feedAuthorize checks the request's token. Tokenized feeds skip sign-in, so
+// the owner named in the URL becomes the user for access control.
+func feedAuthorize(c *gin.Context, purpose, subject string) bool {
+	if feedSecret == "" {
+		return true
+	}
+	owner := c.Query(FEED_OWNER_PARAM)
+	if !validToken(feedPurpose(purpose, owner), subject, c.Query("token")) {
+		return false
+	}
+	if owner != "" {
+		u, ok := authUsers[owner]
+		if !ok {
+			return false
+		}
+		c.Set(AUTH_USER_KEY, u)
+	}
+	return true
+}
+
+// feedHandler serves a directory feed for paths ending in ".rss" and the
+// feed's enclosures and cover art otherwise.
+//
+//	GET /feed/Audiobooks/Dune.rss?sort=mtime&token=...
+//	GET /feed/Audiobooks/Dune/01.mp3?token=...
+func feedHandler(c *gin.Context) {
+	p := strings.TrimPrefix(c.Param("path"), "/")
+	if dir, ok := strings.CutSuffix(p, FEED_SUFFIX); ok {
+		feedRSSHandler(c, strings.Trim(dir, "/"))
+		return
+	}
+	key, ok := cleanKey(p)
+	if !ok || !(isAudioFile(key) || isImageFile(key)) {
+		c.String(http.StatusBadRequest, "Invalid path")
+		return
+	}
+	if !feedAuthorize(c, FEED_TOKEN_MEDIA, key) {
+		c.String(http.StatusForbidden, "Invalid token")
+		return
+	}
+	c.Set(CLOUDFRONT_KEY_URL_CTX, true)
+	serveAudio(c, key)
+}
+
+func feedRSSHandler(c *gin.Context, dir string) {
+	if strings.Contains(dir, "..") {
+		c.String(http.StatusBadRequest, "Invalid path")
+		return
+	}
+	if !feedAuthorize(c, FEED_TOKEN_FEED, dir) {
+		c.String(http.StatusForbidden, "Invalid token")
+		return
+	}
+	access := accessFor(c)
+	if !access.dirVisible(dir) {
+		c.String(http.StatusNotFound, "Directory not found")
+		return
+	}
+	order := c.DefaultQuery("sort", FEED_SORT_NAME)
+	if order != FEED_SORT_NAME && order != FEED_SORT_MTIME {
+		c.String(http.StatusBadRequest, "sort must be name or mtime")
+		return
+	}
+	files, err := listFeedFiles(dir)
+	if err != nil {
+		log.Printf("Feed list error for [%s]: %v", dir, err)
+		c.String(http.StatusNotFound, "Directory not found")
+		return
+	}
+	files = slices.DeleteFunc(files, func(f feedFile) bool { return !access.allowed(f.Key) })
+	if len(files) == 0 {
+		c.String(http.StatusNotFound, "No audio files in directory")
+		return
+	}
+	out, err := xml.MarshalIndent(buildFeed(requestBaseURL(c), dir, order, files, access), "", "  ")
+	if err != nil {
+		log.Printf("Feed encode error: %v", err)
+		c.String(http.StatusInternalServerError, "Failed to render feed")
+		return
+	}
+	c.Data(http.StatusOK, "application/rss+xml; charset=utf-8", append([]byte(xml.Header), out...))
+}
+
+// feedURL returns the subscription URL for dir, including its token and the
+// owner whose access rules the feed follows.
+func feedURL(base, dir, owner string) string {
+	u := trackURL(base, "/feed/", dir+FEED_SUFFIX)
+	if dir == "" {
+		u = base + "/feed/" + FEED_SUFFIX
+	}
+	return u + feedQuery(FEED_TOKEN_FEED, dir, owner)
+}
+
+// handleFeedURL returns the feed URL of a directory for the web player.
+func handleFeedURL(c *gin.Context, dir string) {
+	dir = strings.Trim(dir, "/")
+	access := accessFor(c)
+	if strings.Contains(dir, "..") || !access.dirVisible(dir) {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid path"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "url": feedURL(requestBaseURL(c), dir, access.userName())})
+}
+
+// --- RSS document ---
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Itunes  string     `xml:"xmlns:itunes,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string       `xml:"title"`
+	Link          string       `xml:"link"`
+	Description   string       `xml:"description"`
+	Generator     string       `xml:"generator"`
+	LastBuildDate string       `xml:"lastBuildDate"`
+	Image         *itunesImage `xml:"itunes:image,omitempty"`
+	Block         string       `xml:"itunes:block"`
+	Type          string       `xml:"itunes:type"`
+	Items         []rssItem    `xml:"item"`
+}
+
+type itunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type rssItem struct {
+	Title     string       `xml:"title"`
+	GUID      rssGUID      `xml:"guid"`
+	PubDate   string       `xml:"pubDate"`
+	Enclosure rssEnclosure `xml:"enclosure"`
+	Episode   int          `xml:"itunes:episode,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// buildFeed renders files as podcast episodes. Name order is published as a
+// serial show whose publication dates follow the file names, so apps play it
+// from the first file; mtime order is an episodic show, newest first.
+func buildFeed(base, dir, order string, files []feedFile, access *aclAccess) rssFeed {
+	owner := access.userName()
+	title := path.Base(dir)
+	if dir == "" {
+		title = "go-music"
+	}
+	ch := rssChannel{
+		Title:         title,
+		Link:          base + "/",
+		Description:   "Audio files in " + title,
+		Generator:     "go-music " + Version,
+		LastBuildDate: time.Now().UTC().Format(time.RFC1123Z),
+		Block:         "yes",
+		Type:          "serial",
+	}
+	if art, ok := findCoverArt(dir); ok && access.allowed(art) {
+		ch.Image = &itunesImage{Href: feedMediaURL(base, art, owner)}
+	}
+
+	dates := feedDates(files, order)
+	for i, f := range files {
+		item := rssItem{
+			Title:   trackTitle(f.Key),
+			GUID:    rssGUID{IsPermaLink: "false", Value: feedGUID(f.Key)},
+			PubDate: dates[i].Format(time.RFC1123Z),
+			Enclosure: rssEnclosure{
+				URL:    feedMediaURL(base, f.Key, owner),
+				Length: f.Size,
+				Type:   s3ContentType(f.Key, ""),
+			},
+		}
+		if order == FEED_SORT_NAME {
+			item.Episode = i + 1
+		}
+		ch.Items = append(ch.Items, item)
+	}
+	if order == FEED_SORT_MTIME {
+		ch.Type = "episodic"
+	}
+	return rssFeed{Version: "2.0", Itunes: FEED_ITUNES_NS, Channel: ch}
+}
+
+// feedDates sorts files in place and returns their publication dates. For
+// name order the dates count up one minute per file, ending at the newest
+// modification time, so the order survives apps that sort by date.
+func feedDates(files []feedFile, order string) []time.Time {
+	dates := make([]time.Time, len(files))
+	if order == FEED_SORT_MTIME {
+		sort.SliceStable(files, func(i, j int) bool { return files[i].ModTime.After(files[j].ModTime) })
+		for i, f := range files {
+			dates[i] = f.ModTime.UTC()
+		}
+		return dates
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+	var newest time.Time
+	for _, f := range files {
+		if f.ModTime.After(newest) {
+			newest = f.ModTime
+		}
+	}
+	for i := range files {
+		dates[i] = newest.UTC().Add(-time.Duration(len(files)-1-i) * time.Minute)
+	}
+	return dates
+}
+
+// feedGUID is derived from the library path, so episodes keep their identity
+// across feed refreshes and server restarts.
+func feedGUID(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return "go-music:" + hex.EncodeToString(sum[:])
+}
+
+func feedMediaURL(base, key, owner string) string {
+	return trackURL(base, "/feed/", key) + feedQuery(FEED_TOKEN_MEDIA, key, owner)
+}
+
+// --- Listing ---
+
+// listFeedFiles returns every audio file below dir with its size and
+// modification time.
+func listFeedFiles(dir string) ([]feedFile, error) {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	if usingLocal() {
+		return localFeedFiles(prefix)
+	}
+	return s3FeedFiles(prefix)
+}
+
+func localFeedFiles(prefix string) ([]feedFile, error) {
+	base := localMusicDir
+	if prefix != "" {
+		abs, err := localAbsPath(prefix)
+		if err != nil {
+			return nil, err
+		}
+		base = abs
+	}
+	var files []feedFile
+	err := filepath.Walk(base, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && isAudioFile(info.Name()) {
+			rel, _ := filepath.Rel(localMusicDir, p)
+			files = append(files, feedFile{Key: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	return files, err
+}
+
+func s3FeedFiles(prefix string) ([]feedFile, error) {
+	var files []feedFile
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s3Bucket), Prefix: aws.String(s3Prefix + prefix)}
+	paginator := s3.NewListObjectsV2Paginator(s3Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			key := strings.TrimPrefix(aws.ToString(obj.Key), s3Prefix)
+			if isAudioFile(key) {
+				files = append(files, feedFile{Key: key, Size: aws.ToInt64(obj.Size), ModTime: aws.ToTime(obj.LastModified)})
+			}
+		}
+	}
+	return files, nil
+}
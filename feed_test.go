@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRSS decodes the parts of a feed the tests check
+type testRSS struct {
+	Channel struct {
+		Title string `xml:"title"`
+		Type  string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd type"`
+		Image struct {
+			Href string `xml:"href,attr"`
+		} `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+		Items []struct {
+			Title     string `xml:"title"`
+			GUID      string `xml:"guid"`
+			PubDate   string `xml:"pubDate"`
+			Enclosure struct {
+				URL    string `xml:"url,attr"`
+				Length int64  `xml:"length,attr"`
+				Type   string `xml:"type,attr"`
+			} `xml:"enclosure"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+func getFeed(t *testing.T, target string) (*httptest.ResponseRecorder, testRSS) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	var feed testRSS
+	if w.Code == http.StatusOK {
+		assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &feed))
+	}
+	return w, feed
+}
+
+// TestFeed checks feed rendering, ordering and token checks
+func TestFeed(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origLocalMusicDir, origSecret := localMusicDir, feedSecret
+	defer func() {
+		localMusicDir, feedSecret = origLocalMusicDir, origSecret
+	}()
+	localMusicDir = tmpDir
+	feedSecret = ""
+
+	book := filepath.Join(tmpDir, "Books", "Dune")
+	os.MkdirAll(book, 0755)
+	old := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"02 Two.mp3", "01 One.mp3", "03 Three.ogg"} {
+		p := filepath.Join(book, name)
+		os.WriteFile(p, []byte(strings.Repeat("x", i+1)), 0644)
+		os.Chtimes(p, old.Add(time.Duration(i)*time.Hour), old.Add(time.Duration(i)*time.Hour))
+	}
+	os.WriteFile(filepath.Join(book, "cover.jpg"), []byte("jpeg"), 0644)
+
+	t.Run("Name order", func(t *testing.T) {
+		w, feed := getFeed(t, "/feed/Books/Dune.rss")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Type"), "application/rss+xml")
+		assert.Equal(t, "Dune", feed.Channel.Title)
+		assert.Equal(t, "serial", feed.Channel.Type)
+		assert.Equal(t, "http://example.com/feed/Books/Dune/cover.jpg", feed.Channel.Image.Href)
+		items := feed.Channel.Items
+		assert.Len(t, items, 3)
+		assert.Equal(t, "01 One", items[0].Title)
+		assert.Equal(t, "http://example.com/feed/Books/Dune/01%20One.mp3", items[0].Enclosure.URL)
+		assert.Equal(t, int64(2), items[0].Enclosure.Length)
+		assert.Equal(t, "audio/mpeg", items[0].Enclosure.Type)
+		assert.Equal(t, "audio/ogg", items[2].Enclosure.Type)
+		assert.Equal(t, feedGUID("Books/Dune/01 One.mp3"), items[0].GUID)
+
+		first, _ := time.Parse(time.RFC1123Z, items[0].PubDate)
+		last, _ := time.Parse(time.RFC1123Z, items[2].PubDate)
+		assert.True(t, first.Before(last), "publication dates follow name order")
+	})
+
+	t.Run("Mtime order", func(t *testing.T) {
+		_, feed := getFeed(t, "/feed/Books/Dune.rss?sort=mtime")
+		assert.Equal(t, "episodic", feed.Channel.Type)
+		assert.Equal(t, "03 Three", feed.Channel.Items[0].Title)
+		assert.Equal(t, "02 Two", feed.Channel.Items[2].Title)
+
+		w, _ := getFeed(t, "/feed/Books/Dune.rss?sort=size")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Missing directories", func(t *testing.T) {
+		w, _ := getFeed(t, "/feed/Nope.rss")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w, _ = getFeed(t, "/feed/../etc.rss")
+		assert.NotEqual(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Tokens", func(t *testing.T) {
+		feedSecret = "s3cret"
+		defer func() { feedSecret = "" }()
+
+		w, _ := getFeed(t, "/feed/Books/Dune.rss")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api", strings.NewReader(`{"function":"feedUrl","data":"Books/Dune/"}`))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var resp struct {
+			Status string `json:"status"`
+			URL    string `json:"url"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "ok", resp.Status)
+
+		u, err := url.Parse(resp.URL)
+		assert.NoError(t, err)
+		w, feed := getFeed(t, u.RequestURI())
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		enc, err := url.Parse(feed.Channel.Items[0].Enclosure.URL)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, enc.Query().Get("token"))
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", enc.RequestURI(), nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "xx", w.Body.String())
+
+		// A token for one file does not unlock another.
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/feed/Books/Dune/02%20Two.mp3?"+enc.RawQuery, nil))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
+// TestFeedS3 checks sizes and dates come from the S3 listing
+func TestFeedS3(t *testing.T) {
+	newFakeS3(t, map[string][]byte{"Talks/a.mp3": []byte("abc"), "Talks/notes.txt": []byte("n")})
+	_, feed := getFeed(t, "/feed/Talks.rss")
+	assert.Len(t, feed.Channel.Items, 1)
+	assert.Equal(t, int64(3), feed.Channel.Items[0].Enclosure.Length)
+}
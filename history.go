@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Play history: the web player reports when a track starts and when it has
+// been played long enough to count (half its length or four minutes). Each
+// user's plays are kept in their own state document, newest last, and the
+// stats function aggregates them.
+
+const (
+	HISTORY_FILE_PREFIX = "history-"
+	DEFAULT_HISTORY_MAX = 3000
+	DEFAULT_STATS_RANGE = 30 * 24 * time.Hour
+	DEFAULT_STATS_LIMIT = 10
+	MAX_STATS_LIMIT     = 100
+	HISTORY_DAY_FORMAT  = "2006-01-02"
+	HISTORY_ALL_USERS   = "*"
+	PLAY_EVENT_START    = "start"
+	PLAY_EVENT_COMPLETE = "complete"
+)
+
+// historyMax caps the plays kept per user; the oldest are dropped first.
+var historyMax = envInt("HISTORY_MAX_EVENTS", DEFAULT_HISTORY_MAX)
+
+// playRecord is one play of a track. Played and Duration are in seconds and
+// are reported when the play completes.
+type playRecord struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	Time      time.Time `json:"time"`
+	Played    int       `json:"played,omitempty"`
+	Duration  int       `json:"duration,omitempty"`
+	Completed bool      `json:"completed,omitempty"`
+}
+
+// listened is the listening time a play counts for.
+func (p playRecord) listened() int {
+	if p.Completed && p.Duration > p.Played {
+		return p.Duration
+	}
+	return p.Played
+}
+
+var history = newHistoryStore()
+
+// historyStore keeps each user's plays in their own document.
+type historyStore struct {
+	*userDocs[[]playRecord]
+}
+
+func newHistoryStore() *historyStore {
+	return &historyStore{newUserDocs[[]playRecord](HISTORY_FILE_PREFIX)}
+}
+
+// start records the start of a play and returns it.
+func (h *historyStore) start(owner, key string, now time.Time) (playRecord, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return playRecord{}, err
+	}
+	rec := playRecord{ID: hex.EncodeToString(id), Path: key, Time: now.UTC()}
+	_, err := h.doc(owner).update(func(plays *[]playRecord) error {
+		*plays = append(*plays, rec)
+		if over := len(*plays) - historyMax; over > 0 {
+			*plays = (*plays)[over:]
+		}
+		return nil
+	})
+	return rec, err
+}
+
+// complete marks the play id as completed. A play that was not recorded
+// (or has been dropped) is added as a completed play. done reports that the
+// play had already been completed, in which case it is left as it was.
+func (h *historyStore) complete(owner string, rec playRecord) (out playRecord, done bool, err error) {
+	_, err = h.doc(owner).update(func(plays *[]playRecord) error {
+		for i := len(*plays) - 1; i >= 0; i-- {
+			if p := &(*plays)[i]; p.ID == rec.ID && p.Path == rec.Path {
+				done = p.Completed
+				if !done {
+					p.Completed, p.Played, p.Duration = true, rec.Played, rec.Duration
+				}
+				out = *p
+				return nil
+			}
+		}
+		out = rec
+		out.Completed = true
+		*plays = append(*plays, out)
+		if over := len(*plays) - historyMax; over > 0 {
+			*plays = (*plays)[over:]
+		}
+		return nil
+	})
+	return out, done, err
+}
+
+// plays returns the plays of owner.
+func (h *historyStore) plays(owner string) ([]playRecord, error) {
+	return h.doc(owner).get()
+}
+
+// --- API functions ---
+
+// handlePlayEvent records a play event. Data: {"event":"start","path":...}
+// returns the play's id; {"event":"complete","id":...,"path":...,
+// "played":seconds,"duration":seconds} marks it as completed.
+func handlePlayEvent(c *gin.Context, raw string) {
+	var req struct {
+		Event    string `json:"event"`
+		ID       string `json:"id"`
+		Path     string `json:"path"`
+		Played   int    `json:"played"`
+		Duration int    `json:"duration"`
+	}
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid request"})
+		return
+	}
+	key, ok := cleanKey(req.Path)
+	if !ok || !isAudioFile(key) || !accessFor(c).allowed(key) {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid path"})
+		return
+	}
+	owner := currentUserName(c)
+	var rec playRecord
+	var done bool
+	var err error
+	switch req.Event {
+	case PLAY_EVENT_START:
+		rec, err = history.start(owner, key, time.Now())
+	case PLAY_EVENT_COMPLETE:
+		rec, done, err = history.complete(owner, playRecord{ID: req.ID, Path: key, Time: time.Now().UTC(), Played: max(req.Played, 0), Duration: max(req.Duration, 0)})
+	default:
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Unknown event"})
+		return
+	}
+	if err != nil {
+		log.Printf("Play history save error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to record play"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "id": rec.ID})
+	if done {
+		// A repeated complete event was scrobbled the first time.
+		return
+	}
+	acct := findScrobbleAccount(owner)
+	switch {
+	case acct == nil:
+	case isLambda:
+		// Lambda freezes the instance after the response; scrobble now.
+		scrobblePlay(c.Request.Context(), acct, req.Event, rec)
+		retryScrobbles(c.Request.Context(), time.Now())
+	default:
+		go scrobblePlay(context.Background(), acct, req.Event, rec)
+	}
+}
+
+type statsRequest struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Limit int    `json:"limit"`
+	User  string `json:"user"`
+	TZ    string `json:"tz"`
+}
+
+type statsCount struct {
+	Name  string `json:"name"`
+	Plays int    `json:"plays"`
+}
+
+type statsDay struct {
+	Date    string `json:"date"`
+	Plays   int    `json:"plays"`
+	Seconds int    `json:"seconds"`
+}
+
+type statsResult struct {
+	From       time.Time    `json:"from"`
+	To         time.Time    `json:"to"`
+	Plays      int          `json:"plays"`
+	Seconds    int          `json:"seconds"`
+	TopTracks  []statsCount `json:"topTracks"`
+	TopFolders []statsCount `json:"topFolders"`
+	TopArtists []statsCount `json:"topArtists"`
+	Days       []statsDay   `json:"days"`
+	Recent     []playRecord `json:"recent"`
+}
+
+// handleStats returns listening statistics for a time range. Data (all
+// optional): from and to (RFC 3339 times, or from as a lifetime such as
+// "7d" before now; default the last 30 days), limit, tz (IANA zone for
+// daily totals) and, for admins, user ("*" for everyone).
+func handleStats(c *gin.Context, raw string) {
+	var req statsRequest
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &req); err != nil {
+			c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid request"})
+			return
+		}
+	}
+	from, to, ok := statsRange(req.From, req.To, time.Now())
+	loc, err := time.LoadLocation(req.TZ)
+	if !ok || err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid time range"})
+		return
+	}
+	owners := []string{currentUserName(c)}
+	if req.User != "" && req.User != owners[0] {
+		if !isAdmin(c) {
+			c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Admin access required"})
+			return
+		}
+		owners = historyOwners(req.User)
+	}
+	var plays []playRecord
+	for _, owner := range owners {
+		p, err := history.plays(owner)
+		if err != nil {
+			log.Printf("Play history load error: %v", err)
+			c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to load play history"})
+			return
+		}
+		plays = append(plays, p...)
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > MAX_STATS_LIMIT {
+		limit = DEFAULT_STATS_LIMIT
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "stats": buildStats(plays, from, to, limit, loc)})
+}
+
+// historyOwners lists the owners whose history an admin asked for.
+func historyOwners(user string) []string {
+	if user != HISTORY_ALL_USERS {
+		return []string{user}
+	}
+	owners := []string{""}
+	for name := range authUsers {
+		owners = append(owners, name)
+	}
+	return owners
+}
+
+func statsRange(fromStr, toStr string, now time.Time) (time.Time, time.Time, bool) {
+	from, to := now.Add(-DEFAULT_STATS_RANGE), now
+	if toStr != "" {
+		t, err := time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			return from, to, false
+		}
+		to = t
+	}
+	if fromStr != "" {
+		if d, ok := parseLifetime(fromStr); ok {
+			from = to.Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, fromStr); err == nil {
+			from = t
+		} else {
+			return from, to, false
+		}
+	}
+	return from, to, from.Before(to)
+}
+
+// buildStats aggregates the plays in [from, to).
+func buildStats(plays []playRecord, from, to time.Time, limit int, loc *time.Location) statsResult {
+	res := statsResult{From: from, To: to}
+	tracks, folders, artists := map[string]int{}, map[string]int{}, map[string]int{}
+	days := map[string]*statsDay{}
+	var inRange []playRecord
+	for _, p := range plays {
+		if p.Time.Before(from) || !p.Time.Before(to) {
+			continue
+		}
+		inRange = append(inRange, p)
+		res.Plays++
+		res.Seconds += p.listened()
+		tracks[p.Path]++
+		folders[path.Dir(p.Path)]++
+		if artist := trackArtist(p.Path); artist != "" {
+			artists[artist]++
+		}
+		date := p.Time.In(loc).Format(HISTORY_DAY_FORMAT)
+		if days[date] == nil {
+			days[date] = &statsDay{Date: date}
+		}
+		days[date].Plays++
+		days[date].Seconds += p.listened()
+	}
+	res.TopTracks, res.TopFolders, res.TopArtists = topCounts(tracks, limit), topCounts(folders, limit), topCounts(artists, limit)
+	res.Days = []statsDay{}
+	for _, d := range days {
+		res.Days = append(res.Days, *d)
+	}
+	sort.Slice(res.Days, func(i, j int) bool { return res.Days[i].Date < res.Days[j].Date })
+	sort.SliceStable(inRange, func(i, j int) bool { return inRange[i].Time.After(inRange[j].Time) })
+	res.Recent = inRange[:min(limit, len(inRange))]
+	if res.Recent == nil {
+		res.Recent = []playRecord{}
+	}
+	return res
+}
+
+// topCounts returns the limit most played names, ties by name.
+func topCounts(counts map[string]int, limit int) []statsCount {
+	out := make([]statsCount, 0, len(counts))
+	for name, n := range counts {
+		out = append(out, statsCount{Name: name, Plays: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Plays != out[j].Plays {
+			return out[i].Plays > out[j].Plays
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out[:min(limit, len(out))]
+}
+
+// trackArtist guesses a track's artist from its path: "Artist - Title"
+// file names, else the Artist directory of Artist/Album/track.
+func trackArtist(key string) string {
+	if artist, _, found := strings.Cut(trackTitle(key), " - "); found {
+		return strings.TrimSpace(artist)
+	}
+	if album := path.Dir(key); album != "." {
+		if artist := path.Dir(album); artist != "." {
+			return path.Base(artist)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withHistory gives a test its own play history
+func withHistory(t *testing.T) {
+	t.Helper()
+	origHistory := history
+	t.Cleanup(func() { history = origHistory })
+	history = newHistoryStore()
+	withStateDir(t)
+}
+
+func historyAPI(t *testing.T, user, function string, data any) map[string]any {
+	t.Helper()
+	raw, _ := json.Marshal(data)
+	body, _ := json.Marshal(map[string]string{"function": function, "data": string(raw)})
+	req := httptest.NewRequest("POST", "/api", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if user != "" {
+		req.SetBasicAuth(user, "sesame")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var resp map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+// TestPlayHistory checks recording plays through the API
+func TestPlayHistory(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	origLocalMusicDir := localMusicDir
+	defer func() { localMusicDir = origLocalMusicDir }()
+	localMusicDir = tmpDir
+	withHistory(t)
+	os.MkdirAll(filepath.Join(tmpDir, "Miles Davis", "Kind of Blue"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Miles Davis", "Kind of Blue", "So What.mp3"), []byte("x"), 0644)
+
+	track := "Miles Davis/Kind of Blue/So What.mp3"
+	resp := historyAPI(t, "", "playEvent", map[string]any{"event": "start", "path": track})
+	assert.Equal(t, "ok", resp["status"])
+	id, _ := resp["id"].(string)
+	assert.NotEmpty(t, id)
+
+	resp = historyAPI(t, "", "playEvent", map[string]any{"event": "complete", "id": id, "path": track, "played": 200, "duration": 545})
+	assert.Equal(t, "ok", resp["status"])
+	assert.Equal(t, id, resp["id"])
+
+	assert.Equal(t, "error", historyAPI(t, "", "playEvent", map[string]any{"event": "start", "path": "../secret.mp3"})["status"])
+	assert.Equal(t, "error", historyAPI(t, "", "playEvent", map[string]any{"event": "pause", "path": track})["status"])
+
+	plays, err := history.plays("")
+	assert.NoError(t, err)
+	assert.Len(t, plays, 1)
+	assert.True(t, plays[0].Completed)
+	assert.Equal(t, 545, plays[0].listened())
+
+	resp = historyAPI(t, "", "stats", map[string]any{"from": "1d"})
+	stats, _ := resp["stats"].(map[string]any)
+	assert.Equal(t, float64(1), stats["plays"])
+	assert.Equal(t, float64(545), stats["seconds"])
+	assert.Equal(t, "Miles Davis", stats["topArtists"].([]any)[0].(map[string]any)["name"])
+
+	assert.Equal(t, "error", historyAPI(t, "", "stats", map[string]any{"from": "soon"})["status"])
+	assert.Equal(t, "error", historyAPI(t, "", "stats", map[string]any{"tz": "Mars/Olympus"})["status"])
+}
+
+// TestPlayHistoryScrobble checks that a repeated complete event is not
+// scrobbled again
+func TestPlayHistoryScrobble(t *testing.T) {
+	tmpDir := t.TempDir()
+	origLocalMusicDir, origLambda := localMusicDir, isLambda
+	defer func() { localMusicDir, isLambda = origLocalMusicDir, origLambda }()
+	localMusicDir, isLambda = tmpDir, true // scrobble before responding
+	withHistory(t)
+	lb, srv := newMockScrobbleServer(t, `{"status":"ok"}`)
+	withScrobbling(t, srv.URL, "")
+	assert.NoError(t, updateScrobbleAccount("", func(a *scrobbleAccount) { a.ListenBrainzToken = "tok" }))
+	os.MkdirAll(filepath.Join(tmpDir, "Miles Davis", "Kind of Blue"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Miles Davis", "Kind of Blue", "So What.mp3"), []byte("x"), 0644)
+	track := "Miles Davis/Kind of Blue/So What.mp3"
+
+	id, _ := historyAPI(t, "", "playEvent", map[string]any{"event": "start", "path": track})["id"].(string)
+	assert.Len(t, lb.requests, 1, "now playing")
+	complete := map[string]any{"event": "complete", "id": id, "path": track, "played": 30, "duration": 30}
+	assert.Equal(t, "ok", historyAPI(t, "", "playEvent", complete)["status"])
+	assert.Len(t, lb.requests, 2)
+	complete["played"] = 60
+	assert.Equal(t, "ok", historyAPI(t, "", "playEvent", complete)["status"])
+	assert.Len(t, lb.requests, 2, "repeated complete events are not scrobbled")
+
+	plays, err := history.plays("")
+	assert.NoError(t, err)
+	assert.Len(t, plays, 1)
+	assert.Equal(t, 30, plays[0].Played)
+}
+
+// TestPlayHistoryUsers checks that history is kept per user
+func TestPlayHistoryUsers(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	origLocalMusicDir := localMusicDir
+	defer func() { localMusicDir = origLocalMusicDir }()
+	localMusicDir = tmpDir
+	withHistory(t)
+	os.WriteFile(filepath.Join(tmpDir, "a.mp3"), []byte("a"), 0644)
+	withAuthUsers(t, map[string]*authUser{
+		"root":  {Password: bcryptHash(t, "sesame"), Groups: []string{ADMIN_GROUP}},
+		"alice": {Password: bcryptHash(t, "sesame")},
+	})
+
+	historyAPI(t, "alice", "playEvent", map[string]any{"event": "start", "path": "a.mp3"})
+	historyAPI(t, "alice", "playEvent", map[string]any{"event": "start", "path": "a.mp3"})
+	historyAPI(t, "root", "playEvent", map[string]any{"event": "start", "path": "a.mp3"})
+
+	count := func(user string, data map[string]any) any {
+		stats, _ := historyAPI(t, user, "stats", data)["stats"].(map[string]any)
+		return stats["plays"]
+	}
+	assert.Equal(t, float64(2), count("alice", nil))
+	assert.Equal(t, float64(1), count("root", nil))
+	assert.Equal(t, float64(2), count("root", map[string]any{"user": "alice"}))
+	assert.Equal(t, float64(3), count("root", map[string]any{"user": "*"}))
+	assert.Equal(t, "error", historyAPI(t, "alice", "stats", map[string]any{"user": "root"})["status"])
+}
+
+// TestBuildStats checks the aggregation of plays
+func TestBuildStats(t *testing.T) {
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	plays := []playRecord{
+		{Path: "Rock/Band/One.mp3", Time: day.Add(-48 * time.Hour), Played: 100},
+		{Path: "Rock/Band/One.mp3", Time: day, Played: 60, Duration: 200, Completed: true},
+		{Path: "Rock/Band/Two.mp3", Time: day.Add(time.Hour), Played: 30},
+		{Path: "Jazz/Artist - Tune.mp3", Time: day.Add(4 * time.Hour), Played: 90},
+		{Path: "Old.mp3", Time: day.Add(-30 * 24 * time.Hour), Played: 10},
+	}
+	res := buildStats(plays, day.Add(-72*time.Hour), day.Add(24*time.Hour), 2, time.UTC)
+
+	assert.Equal(t, 4, res.Plays)
+	assert.Equal(t, 100+200+30+90, res.Seconds)
+	assert.Equal(t, []statsCount{{"Rock/Band/One.mp3", 2}, {"Jazz/Artist - Tune.mp3", 1}}, res.TopTracks)
+	assert.Equal(t, []statsCount{{"Rock/Band", 3}, {"Jazz", 1}}, res.TopFolders)
+	assert.Equal(t, []statsCount{{"Rock", 3}, {"Artist", 1}}, res.TopArtists)
+	assert.Equal(t, []statsDay{{"2026-02-27", 1, 100}, {"2026-03-01", 3, 320}}, res.Days)
+	assert.Len(t, res.Recent, 2)
+	assert.Equal(t, "Jazz/Artist - Tune.mp3", res.Recent[0].Path, "newest first")
+
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	res = buildStats(plays, day.Add(-72*time.Hour), day.Add(24*time.Hour), 10, tokyo)
+	assert.Equal(t, "2026-03-02", res.Days[len(res.Days)-1].Date, "days follow the requested zone")
+}
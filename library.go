@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The library index lists every track with its size, modification time and
+// tags. It is rebuilt from a listing at most every LIBRARY_REFRESH, in the
+// background while the previous index is served; tags are only read for new
+// or changed files, at most LIBRARY_SCAN_BATCH per rebuild. The index is
+// kept in state documents of about LIBRARY_SHARD_TRACKS tracks each, so it
+// fits the store's size limits and a rebuild only saves the shards that
+// changed; other instances and restarts reuse them.
+
+const (
+	LIBRARY_MANIFEST_FILE   = "library-manifest.json"
+	LIBRARY_SHARD_PREFIX    = "library-shard-"
+	LIBRARY_SHARD_TRACKS    = 300
+	LIBRARY_SCAN_WORKERS    = 8
+	DEFAULT_LIBRARY_REFRESH = 10 * time.Minute
+	DEFAULT_LIBRARY_BATCH   = 2000
+)
+
+var (
+	libraryRefresh   = envDuration("LIBRARY_REFRESH", DEFAULT_LIBRARY_REFRESH)
+	libraryScanBatch = envInt("LIBRARY_SCAN_BATCH", DEFAULT_LIBRARY_BATCH)
+)
+
+// libraryTrack is one track of the index. Scanned is set once its tags
+// have been read.
+type libraryTrack struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Scanned  bool      `json:"scanned,omitempty"`
+	Tags     trackTags `json:"tags"`
+}
+
+// libraryManifest names the shard documents of the stored index. Tracks
+// are spread over Shards documents by a hash of their path.
+type libraryManifest struct {
+	Shards int `json:"shards"`
+}
+
+var library = newLibraryIndex()
+
+type libraryIndex struct {
+	manifest *stateDoc[libraryManifest]
+	build    sync.Mutex     // serializes loading and rebuilding
+	rebuilds sync.WaitGroup // background rebuilds
+	unsaved  bool           // a save failed, so every shard is saved next; guarded by build
+
+	mu       sync.Mutex // guards the fields below
+	tracks   []libraryTrack
+	checked  time.Time
+	gen      int // bumped by invalidate
+	building bool
+}
+
+func newLibraryIndex() *libraryIndex {
+	return &libraryIndex{manifest: &stateDoc[libraryManifest]{name: LIBRARY_MANIFEST_FILE}}
+}
+
+// all returns the indexed tracks sorted by path. When the index is older
+// than LIBRARY_REFRESH it is rebuilt in the background and the current one
+// is returned; only the first call, with no stored index, waits for a
+// build. The slice must not be modified.
+func (l *libraryIndex) all(ctx context.Context) ([]libraryTrack, error) {
+	if tracks, ok := l.cached(); ok {
+		return tracks, nil
+	}
+	l.build.Lock()
+	defer l.build.Unlock()
+	if tracks, ok := l.cached(); ok {
+		return tracks, nil
+	}
+	l.mu.Lock()
+	gen := l.gen
+	l.mu.Unlock()
+	if stored := l.load(); stored != nil {
+		// Serve the stored index; cached starts a rebuild as it is stale.
+		l.set(stored, time.Time{}, gen)
+		tracks, _ := l.cached()
+		return tracks, nil
+	}
+	tracks, err := l.rebuild(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	l.set(tracks, time.Now(), gen)
+	return tracks, nil
+}
+
+// cached returns the current index, if there is one, and starts a
+// background rebuild when it is stale.
+func (l *libraryIndex) cached() ([]libraryTrack, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tracks == nil {
+		return nil, false
+	}
+	if time.Since(l.checked) >= libraryRefresh && !l.building {
+		l.building = true
+		l.rebuilds.Add(1)
+		go l.refresh(l.tracks, l.gen)
+	}
+	return l.tracks, true
+}
+
+func (l *libraryIndex) refresh(prev []libraryTrack, gen int) {
+	defer l.rebuilds.Done()
+	l.build.Lock()
+	defer l.build.Unlock()
+	start := time.Now()
+	tracks, err := l.rebuild(context.Background(), prev)
+	if err != nil {
+		// Keep serving the previous index and try again after LIBRARY_REFRESH.
+		log.Printf("Library index rebuild error: %v", err)
+		tracks = prev
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.building = false
+	l.setLocked(tracks, start, gen)
+}
+
+// set stores a built index. It stays stale when the index was invalidated
+// after gen was read.
+func (l *libraryIndex) set(tracks []libraryTrack, checked time.Time, gen int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setLocked(tracks, checked, gen)
+}
+
+func (l *libraryIndex) setLocked(tracks []libraryTrack, checked time.Time, gen int) {
+	if l.gen != gen {
+		checked = time.Time{}
+	}
+	l.tracks, l.checked = tracks, checked
+}
+
+// invalidate marks the index stale, so the next call to all starts a
+// rebuild.
+func (l *libraryIndex) invalidate() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+	l.checked = time.Time{}
+}
+
+// rebuild lists the library and returns the new index, reusing the tags of
+// prev (or of the stored index when prev is nil) for unchanged files.
+func (l *libraryIndex) rebuild(ctx context.Context, prev []libraryTrack) ([]libraryTrack, error) {
+	files, err := listFeedFiles("")
+	if err != nil {
+		return nil, err
+	}
+	if prev == nil {
+		prev = l.load()
+	}
+	known := make(map[string]libraryTrack, len(prev))
+	for _, t := range prev {
+		known[t.Path] = t
+	}
+	tracks := make([]libraryTrack, len(files))
+	for i, f := range files {
+		t, ok := known[f.Key]
+		if !ok || t.Size != f.Size || !t.Modified.Equal(f.ModTime) {
+			t = libraryTrack{Path: f.Key, Size: f.Size, Modified: f.ModTime}
+		}
+		tracks[i] = t
+	}
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].Path < tracks[j].Path })
+	scanLibraryTags(ctx, tracks)
+	l.save(tracks, known)
+	return tracks, nil
+}
+
+// load reads the stored index, or returns nil when there is none or it
+// cannot be read.
+func (l *libraryIndex) load() []libraryTrack {
+	m, err := l.manifest.get()
+	if err != nil || m.Shards == 0 {
+		if err != nil {
+			log.Printf("Library index load error: %v", err)
+		}
+		return nil
+	}
+	tracks := []libraryTrack{}
+	for i := range m.Shards {
+		shard, err := libraryShard(m.Shards, i).get()
+		if err != nil {
+			log.Printf("Library index load error: %v", err)
+			return nil
+		}
+		tracks = append(tracks, shard...)
+	}
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].Path < tracks[j].Path })
+	return tracks
+}
+
+// save stores the shards of tracks that differ from known, the index they
+// were built from. A new shard count saves a new set of shards, switches the
+// manifest to it and then empties the old set.
+func (l *libraryIndex) save(tracks []libraryTrack, known map[string]libraryTrack) {
+	m, err := l.manifest.get()
+	if err != nil {
+		log.Printf("Library index load error: %v", err)
+	}
+	n := libraryShardCount(len(tracks))
+	all := l.unsaved || n != m.Shards
+	shards, dirty := libraryShards(tracks, known, n)
+	l.unsaved = false
+	for i, shard := range shards {
+		if all || dirty[i] {
+			l.saveShard(libraryShard(n, i), shard)
+		}
+	}
+	if n == m.Shards || l.unsaved {
+		return
+	}
+	if _, err := l.manifest.update(func(v *libraryManifest) error {
+		v.Shards = n
+		return nil
+	}); err != nil {
+		log.Printf("Library index save error: %v", err)
+		l.unsaved = true
+		return
+	}
+	for i := range m.Shards {
+		l.saveShard(libraryShard(m.Shards, i), nil)
+	}
+}
+
+// libraryShards splits tracks into n shards and reports which shards
+// differ from known.
+func libraryShards(tracks []libraryTrack, known map[string]libraryTrack, n int) ([][]libraryTrack, map[int]bool) {
+	shards := make([][]libraryTrack, n)
+	dirty := map[int]bool{}
+	seen := make(map[string]bool, len(tracks))
+	for _, t := range tracks {
+		i := libraryShardOf(t.Path, n)
+		shards[i] = append(shards[i], t)
+		seen[t.Path] = true
+		if old, ok := known[t.Path]; !ok || old.Scanned != t.Scanned || old.Size != t.Size || !old.Modified.Equal(t.Modified) {
+			dirty[i] = true
+		}
+	}
+	for p := range known {
+		if !seen[p] {
+			dirty[libraryShardOf(p, n)] = true
+		}
+	}
+	return shards, dirty
+}
+
+func (l *libraryIndex) saveShard(doc *stateDoc[[]libraryTrack], tracks []libraryTrack) {
+	if _, err := doc.update(func(v *[]libraryTrack) error {
+		*v = tracks
+		return nil
+	}); err != nil {
+		log.Printf("Library index save error: %v", err)
+		l.unsaved = true
+	}
+}
+
+// libraryShardCount returns the number of shards for n tracks, a power of
+// two so it only changes when the library about doubles or halves.
+func libraryShardCount(n int) int {
+	shards := 1
+	for shards*LIBRARY_SHARD_TRACKS < n {
+		shards *= 2
+	}
+	return shards
+}
+
+func libraryShardOf(path string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return int(h.Sum32() % uint32(shards))
+}
+
+func libraryShard(shards, i int) *stateDoc[[]libraryTrack] {
+	return &stateDoc[[]libraryTrack]{name: fmt.Sprintf("%s%d-%d.json", LIBRARY_SHARD_PREFIX, shards, i)}
+}
+
+// scanLibraryTags reads the tags of up to LIBRARY_SCAN_BATCH unscanned
+// tracks.
+func scanLibraryTags(ctx context.Context, tracks []libraryTrack) {
+	var todo []int
+	for i := range tracks {
+		if !tracks[i].Scanned && len(todo) < libraryScanBatch {
+			todo = append(todo, i)
+		}
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(LIBRARY_SCAN_WORKERS, len(todo)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// Files without tags count as scanned; unreadable ones are
+				// tried again on the next rebuild.
+				tags, err := readTags(ctx, tracks[i].Path)
+				if err == nil || errors.Is(err, errNoTags) {
+					tracks[i].Tags, tracks[i].Scanned = tags, true
+				}
+			}
+		}()
+	}
+	for _, i := range todo {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withLibrary gives a test its own library index over dir
+func withLibrary(t *testing.T, dir string) {
+	t.Helper()
+	origLibrary, origLocalMusicDir := library, localMusicDir
+	t.Cleanup(func() {
+		library = origLibrary
+		localMusicDir = origLocalMusicDir
+	})
+	library = newLibraryIndex()
+	localMusicDir = dir
+	withStateDir(t)
+	t.Cleanup(func() { library.rebuilds.Wait() })
+}
+
+// TestLibraryIndex checks building and refreshing the library index
+func TestLibraryIndex(t *testing.T) {
+	tmpDir := t.TempDir()
+	withLibrary(t, tmpDir)
+	os.MkdirAll(filepath.Join(tmpDir, "Jazz"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "So What.mp3"), id3Tag(3, id3Frame("TIT2", "So What"), id3Frame("TCON", "Jazz")), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "untagged.mp3"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "cover.jpg"), []byte("x"), 0644)
+
+	ctx := context.Background()
+	tracks, err := library.all(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, tracks, 2)
+	assert.Equal(t, "Jazz/So What.mp3", tracks[0].Path)
+	assert.Equal(t, "Jazz", tracks[0].Tags.Genre)
+	assert.True(t, tracks[1].Scanned, "files without tags are not read again")
+
+	// Within LIBRARY_REFRESH the cached index is returned.
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "Blue in Green.mp3"), id3Tag(3, id3Frame("TIT2", "Blue in Green")), 0644)
+	tracks, _ = library.all(ctx)
+	assert.Len(t, tracks, 2)
+
+	// A changed file is read again; the stored tags are reused for the rest.
+	later := time.Now().Add(time.Hour)
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "So What.mp3"), id3Tag(3, id3Frame("TIT2", "So What (take 2)")), 0644)
+	os.Chtimes(filepath.Join(tmpDir, "Jazz", "So What.mp3"), later, later)
+	// A new instance serves the stored index while it rebuilds.
+	library = newLibraryIndex()
+	tracks, err = library.all(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, tracks, 2)
+	library.rebuilds.Wait()
+	tracks, _ = library.all(ctx)
+	assert.Len(t, tracks, 3)
+	assert.Equal(t, "Blue in Green", tracks[0].Tags.Title)
+	assert.Equal(t, "So What (take 2)", tracks[1].Tags.Title)
+
+	library.invalidate()
+	os.Remove(filepath.Join(tmpDir, "Jazz", "untagged.mp3"))
+	tracks, _ = library.all(ctx)
+	assert.Len(t, tracks, 3)
+	library.rebuilds.Wait()
+	tracks, _ = library.all(ctx)
+	assert.Len(t, tracks, 2)
+}
+
+// TestLibraryShards checks that the stored index is split into shards
+func TestLibraryShards(t *testing.T) {
+	assert.Equal(t, 1, libraryShardCount(0))
+	assert.Equal(t, 1, libraryShardCount(LIBRARY_SHARD_TRACKS))
+	assert.Equal(t, 2, libraryShardCount(LIBRARY_SHARD_TRACKS+1))
+	assert.Equal(t, 4, libraryShardCount(3*LIBRARY_SHARD_TRACKS))
+
+	tmpDir := t.TempDir()
+	withLibrary(t, tmpDir)
+	stateDir := withStateDir(t)
+	for i := range LIBRARY_SHARD_TRACKS + 1 {
+		os.WriteFile(filepath.Join(tmpDir, fmt.Sprintf("%04d.mp3", i)), []byte("x"), 0644)
+	}
+	tracks, err := library.all(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, tracks, LIBRARY_SHARD_TRACKS+1)
+	for i := range 2 {
+		shard, err := libraryShard(2, i).get()
+		assert.NoError(t, err)
+		assert.NotEmpty(t, shard)
+		assert.Less(t, len(shard), LIBRARY_SHARD_TRACKS+1)
+	}
+	stored := newLibraryIndex().load()
+	assert.Len(t, stored, len(tracks), "the shards hold the whole index")
+	assert.Equal(t, tracks[0].Path, stored[0].Path)
+
+	// Fewer tracks move the index to a smaller set of shards and empty the old one.
+	for i := range LIBRARY_SHARD_TRACKS / 2 {
+		os.Remove(filepath.Join(tmpDir, fmt.Sprintf("%04d.mp3", i)))
+	}
+	library.invalidate()
+	library.all(context.Background())
+	library.rebuilds.Wait()
+	m, _ := library.manifest.get()
+	assert.Equal(t, 1, m.Shards)
+	old, _ := libraryShard(2, 0).get()
+	assert.Empty(t, old)
+	assert.Len(t, newLibraryIndex().load(), LIBRARY_SHARD_TRACKS+1-LIBRARY_SHARD_TRACKS/2)
+	_, err = os.Stat(filepath.Join(stateDir, LIBRARY_MANIFEST_FILE))
+	assert.NoError(t, err)
+}
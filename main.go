@@ -4,13 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,10 +37,21 @@ const (
 	TXT_ACC_DIR       = "Server is unable to access the directory."
 	TXT_NO_RES        = "Server not responding."
 	TXT_MIN_SEARCH    = "Minimum search characters: "
+
+	// MAX_PLAYLIST_FILE_SIZE caps how much of a library playlist file is read.
+	MAX_PLAYLIST_FILE_SIZE = 1 << 20
+
+	API_REQUEST_CTX = "apiRequest" // gin context key of the bound POST /api request
 )
 
 var audioExtensions = []string{"mp3", "wav", "ogg", "mp4"}
 
+// playlistExtensions are playlist files shown alongside tracks in listings.
+var playlistExtensions = []string{"m3u", "m3u8"}
+
+// imageExtensions are collected in listings so album art can be found.
+var imageExtensions = []string{"jpg", "jpeg", "png", "gif", "webp"}
+
 // S3 configuration from environment variables
 var (
 	s3Bucket = os.Getenv("BUCKET")
@@ -46,6 +60,10 @@ var (
 )
 var localMusicDir = os.Getenv("MUSIC_DIR") // e.g. "/mp3"
 
+// s3ProxyMode streams S3 objects through /audio instead of handing out
+// presigned URLs (S3_PROXY=true).
+var s3ProxyMode = envBool("S3_PROXY")
+
 var s3Client *s3.Client
 
 // isLambda will be set early in init() when the app detects it is running in
@@ -82,9 +100,32 @@ func Handler(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.AP
 
 // main is the entry point for local execution or Lambda deployment.
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		runHashPassword()
+		return
+	}
+
 	// Initialize storage backend (do this in main so tests can control
 	// the storage backend through MUSIC_DIR before the app starts).
 	initStorage()
+	if err := initState(); err != nil {
+		log.Fatalf("State store init error: %v", err)
+	}
+	if err := initAuth(); err != nil {
+		log.Fatalf("Auth init error: %v", err)
+	}
+	if err := initACL(); err != nil {
+		log.Fatalf("ACL init error: %v", err)
+	}
+	if err := initShares(); err != nil {
+		log.Fatalf("Share init error: %v", err)
+	}
+	if err := initAPIKeys(); err != nil {
+		log.Fatalf("API key init error: %v", err)
+	}
+	if err := initRadio(); err != nil {
+		log.Fatalf("Radio init error: %v", err)
+	}
 
 	// Initialize router on startup (moved out of init to avoid running heavy
 	// setup during package initialization). Tests should initialize router in
@@ -95,6 +136,13 @@ func main() {
 		ginLambda = ginadapter.NewV2(r)
 		lambda.Start(Handler)
 	} else {
+		startScrobbleWorker()
+		startLibraryWatcher()
+		if dlnaEnabled {
+			if err := startSSDP(); err != nil {
+				log.Fatalf("DLNA init error: %v", err)
+			}
+		}
 		log.Println("Running local server on :8080")
 		if err := r.Run(":8080"); err != nil {
 			log.Fatalf("Gin server error: %v", err)
@@ -103,6 +151,7 @@ func main() {
 }
 
 // audioProxyHandler returns a pre-signed S3 URL for the audio file instead of streaming it through Lambda.
+// With S3_PROXY enabled it streams the object through the server instead.
 func audioProxyHandler(c *gin.Context) {
 	key := strings.TrimPrefix(c.Param("path"), "/")
 	if key == "" {
@@ -115,6 +164,17 @@ func audioProxyHandler(c *gin.Context) {
 		c.String(http.StatusBadRequest, "Invalid path")
 		return
 	}
+	if aclDenied(c, key) {
+		return
+	}
+
+	// In proxy mode the object itself is streamed from S3. Clients that ask
+	// for JSON (the web player) get the proxied URL instead, mirroring the
+	// presigned flow below.
+	if !usingLocal() && s3ProxyMode && !wantsJSON(c) {
+		s3StreamHandler(c, key)
+		return
+	}
 
 	// Prevent caching of pre-signed URLs by Cloudflare or other proxies
 	c.Header("Cache-Control", "no-store, no-cache, must-revalidate, proxy-revalidate, max-age=0")
@@ -123,36 +183,21 @@ func audioProxyHandler(c *gin.Context) {
 
 	if localMusicDir != "" {
 		// For local disk, return a JSON with the local file URL
-		filePath := filepath.Join(localMusicDir, filepath.Clean(key))
-
-		// Ensure the resolved path is within the music directory
-		absPath, err := filepath.Abs(filePath)
-		if err != nil {
-			c.String(http.StatusBadRequest, "Invalid path")
-			return
-		}
-
-		absMusicDir, err := filepath.Abs(localMusicDir)
-		if err != nil {
-			c.String(http.StatusInternalServerError, "Server configuration error")
-			return
-		}
-
-		if !strings.HasPrefix(absPath, absMusicDir) {
-			c.String(http.StatusForbidden, "Access denied")
-			return
-		}
-
-		if _, err := os.Stat(absPath); err != nil {
-			c.String(http.StatusNotFound, "Audio not found")
+		if _, err := localAbsPath(key); err != nil {
+			localPathError(c, err)
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"url": "/localdisk/" + key})
 		return
 	}
 
-	// S3 mode: return presigned URL as JSON
-	presignedUrl, err := s3GetPresignedUrl(key)
+	if s3ProxyMode {
+		c.JSON(http.StatusOK, gin.H{"url": trackURL("", "/audio/", key)})
+		return
+	}
+
+	// S3 mode: return presigned (or CloudFront signed) URL as JSON
+	presignedUrl, err := signedAudioURL(c, key)
 	if err != nil {
 		log.Printf("S3 presign error for key [%s]: %v", key, err)
 		c.String(http.StatusNotFound, "Audio not found")
@@ -170,52 +215,42 @@ func localDiskHandler(c *gin.Context) {
 		c.String(http.StatusBadRequest, "Invalid path")
 		return
 	}
-
-	filePath := filepath.Join(localMusicDir, filepath.Clean(key))
-
-	// Ensure the resolved path is within the music directory
-	absPath, err := filepath.Abs(filePath)
-	if err != nil {
-		c.String(http.StatusBadRequest, "Invalid path")
+	if aclDenied(c, key) {
 		return
 	}
 
-	absMusicDir, err := filepath.Abs(localMusicDir)
+	absPath, err := localAbsPath(key)
 	if err != nil {
-		c.String(http.StatusInternalServerError, "Server configuration error")
+		localPathError(c, err)
 		return
 	}
+	c.File(absPath)
+}
 
-	if !strings.HasPrefix(absPath, absMusicDir) {
-		c.String(http.StatusForbidden, "Access denied")
-		return
+// initS3 initializes the S3 client from environment variables.
+func initS3() error {
+	cfg, err := loadAWSConfig()
+	if err != nil {
+		return err
 	}
 
-	if _, err := os.Stat(absPath); err != nil {
-		c.String(http.StatusNotFound, "Audio not found")
-		return
-	}
-	c.File(absPath)
-}
+	log.Printf("S3 client configured for region: %s", cfg.Region)
+	log.Printf("S3 bucket set: %s", s3Bucket)
 
-// s3GetPresignedUrl generates a pre-signed URL for the given S3 key.
-func s3GetPresignedUrl(key string) (string, error) {
-	presignClient := s3.NewPresignClient(s3Client)
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(s3Bucket),
-		Key:    aws.String(s3Prefix + key),
+	if s3Prefix != "" {
+		log.Printf("S3 prefix set: %s", s3Prefix)
 	}
-	presignedReq, err := presignClient.PresignGetObject(context.Background(), input, func(opts *s3.PresignOptions) {
-		opts.Expires = 15 * time.Minute // 15 minutes
-	})
-	if err != nil {
-		return "", err
+
+	if s3Prefix != "" && !strings.HasSuffix(s3Prefix, "/") {
+		s3Prefix += "/"
 	}
-	return presignedReq.URL, nil
+
+	s3Client = s3.NewFromConfig(cfg)
+	return nil
 }
 
-// initS3 initializes the S3 client from environment variables.
-func initS3() error {
+// loadAWSConfig loads the AWS configuration for S3 and the state store.
+func loadAWSConfig() (aws.Config, error) {
 	var cfgOpts []func(*config.LoadOptions) error
 	// If the AWS_REGION is explicitly set, use it.
 	if s3Region != "" {
@@ -226,49 +261,98 @@ func initS3() error {
 	// in other places (like the Lambda environment variable AWS_REGION) if it's not provided.
 	cfg, err := config.LoadDefaultConfig(context.Background(), cfgOpts...)
 	if err != nil {
-		return fmt.Errorf("failed to load AWS config: %w", err)
+		return cfg, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
 	// After attempting to load everything, if the region is still missing, we must error out.
 	if cfg.Region == "" {
-		return fmt.Errorf("AWS region could not be found. Please set the AWS_REGION environment variable or configure it in your AWS profile")
+		return cfg, fmt.Errorf("AWS region could not be found. Please set the AWS_REGION environment variable or configure it in your AWS profile")
 	}
+	return cfg, nil
+}
 
-	log.Printf("S3 client configured for region: %s", cfg.Region)
-	log.Printf("S3 bucket set: %s", s3Bucket)
-
-	if s3Prefix != "" {
-		log.Printf("S3 prefix set: %s", s3Prefix)
-	}
+// apiFunctions are the /api functions that take the raw data string,
+// dispatched when handleRequest's switch has no case for them.
+var apiFunctions = map[string]func(*gin.Context, string){
+	// Saved playlists
+	"listPlaylists":        handleListPlaylists,
+	"getPlaylist":          handleGetPlaylist,
+	"createPlaylist":       handleCreatePlaylist,
+	"renamePlaylist":       playlistChange(renamePlaylist),
+	"deletePlaylist":       handleDeletePlaylist,
+	"duplicatePlaylist":    handleDuplicatePlaylist,
+	"addPlaylistTracks":    playlistChange(addPlaylistTracks),
+	"removePlaylistTracks": playlistChange(removePlaylistTracks),
+	"movePlaylistTrack":    playlistChange(movePlaylistTrack),
+	"setPlaylistTracks":    playlistChange(setPlaylistTracks),
+
+	// Smart playlists
+	"listSmartPlaylists":  handleListSmartPlaylists,
+	"saveSmartPlaylist":   handleSaveSmartPlaylist,
+	"deleteSmartPlaylist": handleDeleteSmartPlaylist,
+	"smartPlaylistTracks": handleSmartPlaylistTracks,
+
+	// Play history
+	"playEvent": handlePlayEvent,
+	"stats":     handleStats,
+
+	// Resume
+	"getPlayState":  handleGetPlayState,
+	"savePlayState": handleSavePlayState,
+
+	// Favorites and ratings
+	"star":       handleStar,
+	"unstar":     handleUnstar,
+	"setRating":  handleSetRating,
+	"getRatings": handleGetRatings,
+	"starred":    handleStarred,
+
+	// Scrobbling
+	"scrobbleSettings":     handleScrobbleSettings,
+	"setListenBrainzToken": handleSetListenBrainzToken,
+	"disconnectLastfm":     handleDisconnectLastfm,
+}
 
-	if s3Prefix != "" && !strings.HasSuffix(s3Prefix, "/") {
-		s3Prefix += "/"
-	}
+// apiRequest is the body of a POST /api call.
+type apiRequest struct {
+	Function string `json:"function" form:"dffunc"`
+	Data     string `json:"data" form:"dfdata"`
+}
 
-	s3Client = s3.NewFromConfig(cfg)
-	return nil
+type boundAPIRequest struct {
+	req apiRequest
+	err error
 }
 
-// handleRequest is the main router for API calls from the frontend.
-func handleRequest(c *gin.Context) {
-	var req struct {
-		Function string `json:"function" form:"dffunc"`
-		Data     string `json:"data" form:"dfdata"`
+// bindAPIRequest binds a POST /api request once and keeps the result in the
+// context, so the scope check and handleRequest see the same function.
+func bindAPIRequest(c *gin.Context) (apiRequest, error) {
+	if b, ok := c.Get(API_REQUEST_CTX); ok {
+		return b.(boundAPIRequest).req, b.(boundAPIRequest).err
 	}
-
+	var req apiRequest
+	var err error
 	// Check content type to determine binding method
-	contentType := c.GetHeader("Content-Type")
-	if strings.Contains(contentType, "application/json") {
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid JSON"})
-			return
-		}
+	if strings.Contains(c.GetHeader("Content-Type"), "application/json") {
+		err = c.ShouldBindJSON(&req)
 	} else {
 		// Form data (backwards compatibility)
-		if err := c.ShouldBind(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid form data"})
-			return
+		err = c.ShouldBind(&req)
+	}
+	c.Set(API_REQUEST_CTX, boundAPIRequest{req: req, err: err})
+	return req, err
+}
+
+// handleRequest is the main router for API calls from the frontend.
+func handleRequest(c *gin.Context) {
+	req, err := bindAPIRequest(c)
+	if err != nil {
+		msg := "Invalid form data"
+		if strings.Contains(c.GetHeader("Content-Type"), "application/json") {
+			msg = "Invalid JSON"
 		}
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": msg})
+		return
 	}
 
 	switch req.Function {
@@ -288,7 +372,29 @@ func handleRequest(c *gin.Context) {
 		handleGetAllDirs(c)
 	case "getAllMp3InDirs":
 		handleGetAllMp3InDirs(c, req.Data)
+	case "importPlaylist":
+		handleImportPlaylist(c, req.Data)
+	case "resolvePlaylist":
+		handleResolvePlaylist(c, req.Data)
+	case "feedUrl":
+		handleFeedURL(c, req.Data)
+	case "createShare":
+		handleCreateShare(c, req.Data)
+	case "listShares":
+		handleListShares(c)
+	case "revokeShare":
+		handleRevokeShare(c, req.Data)
+	case "createApiKey":
+		handleCreateApiKey(c, req.Data)
+	case "listApiKeys":
+		handleListApiKeys(c)
+	case "revokeApiKey":
+		handleRevokeApiKey(c, req.Data)
 	default:
+		if fn, ok := apiFunctions[req.Function]; ok {
+			fn(c, req.Data)
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Unknown function"})
 	}
 }
@@ -296,6 +402,11 @@ func handleRequest(c *gin.Context) {
 // --- S3 Helper Functions ---
 
 func s3ListAllAudioFiles(prefix string) ([]string, error) {
+	return s3ListAllFiles(prefix, isAudioFile)
+}
+
+// s3ListAllFiles returns the keys below prefix whose name satisfies match.
+func s3ListAllFiles(prefix string, match func(string) bool) ([]string, error) {
 	var allFiles []string
 	input := &s3.ListObjectsV2Input{Bucket: aws.String(s3Bucket), Prefix: aws.String(s3Prefix + prefix)}
 	paginator := s3.NewListObjectsV2Paginator(s3Client, input)
@@ -305,7 +416,7 @@ func s3ListAllAudioFiles(prefix string) ([]string, error) {
 			return nil, err
 		}
 		for _, obj := range page.Contents {
-			if isAudioFile(*obj.Key) {
+			if match(*obj.Key) {
 				name := strings.TrimPrefix(*obj.Key, s3Prefix)
 				allFiles = append(allFiles, name)
 			}
@@ -323,6 +434,7 @@ func handleGetAllMp3(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to scan music files"})
 		return
 	}
+	files = accessFor(c).filterFiles(files)
 	sort.Strings(files)
 	c.JSON(http.StatusOK, gin.H{"status": "ok", "files": files})
 }
@@ -342,6 +454,7 @@ func handleGetAllMp3InDir(c *gin.Context, data string) {
 		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to scan music directory"})
 		return
 	}
+	files = accessFor(c).filterFiles(files)
 	sort.Strings(files)
 	c.JSON(http.StatusOK, gin.H{"status": "ok", "files": files})
 }
@@ -353,6 +466,7 @@ func handleGetAllDirs(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to scan directories"})
 		return
 	}
+	dirs = accessFor(c).filterDirs(dirs)
 	if len(dirs) > 1 {
 		sort.Strings(dirs[1:]) // keep root at top
 	}
@@ -360,21 +474,58 @@ func handleGetAllDirs(c *gin.Context) {
 }
 
 func handleDirRequest(c *gin.Context, dir string) {
-	dirs, files, err := listDir(dir)
+	access := accessFor(c)
+	listing, err := listDirEntries(dir)
+	if err == nil && !access.dirVisible(dir) {
+		err = errAccessDenied
+	}
 	if err != nil {
 		log.Printf("List error: %v", err)
-		c.JSON(http.StatusOK, gin.H{"status": "error", "message": TXT_ACC_DIR, "dir": dir, "dirs": []string{}, "files": []string{}})
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": TXT_ACC_DIR, "dir": dir, "dirs": []string{}, "files": []string{}, "playlists": []string{}})
 		return
 	}
+	listing = access.filterListing(dir, listing)
+	dirs, files, playlists := listing.Dirs, listing.Files, listing.Playlists
+	if playlists == nil {
+		playlists = []string{}
+	}
 	sort.Strings(dirs)
 	sort.Strings(files)
-	result := gin.H{"status": "ok", "dir": dir, "dirs": dirs, "files": files}
-	log.Printf("Returning dir response: status=ok, dir=%s, dirs=%d, files=%d", dir, len(dirs), len(files))
+	sort.Strings(playlists)
+	result := gin.H{"status": "ok", "dir": dir, "dirs": dirs, "files": files, "playlists": playlists}
+	log.Printf("Returning dir response: status=ok, dir=%s, dirs=%d, files=%d, playlists=%d", dir, len(dirs), len(files), len(playlists))
 	c.JSON(http.StatusOK, result)
 }
 
-func handleSearchTitle(c *gin.Context, searchStr string) {
-	searchStr = strings.TrimSpace(searchStr)
+// handleResolvePlaylist resolves the entries of a playlist file inside the
+// library into playable tracks. Request 'data' is the playlist path, e.g. "Rock/best.m3u".
+func handleResolvePlaylist(c *gin.Context, data string) {
+	key, ok := cleanKey(strings.TrimSpace(data))
+	if !ok || !isPlaylistFile(key) {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid playlist path", "files": []string{}, "missing": []string{}})
+		return
+	}
+	access := accessFor(c)
+	if !access.allowed(key) {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Playlist not found", "files": []string{}, "missing": []string{}})
+		return
+	}
+	files, missing, err := resolveLibraryPlaylist(c.Request.Context(), key, access)
+	if err != nil {
+		log.Printf("Resolve playlist error (%s): %v", key, err)
+		msg := err.Error()
+		var pe *playlistError
+		if errors.As(err, &pe) {
+			msg = pe.msg
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": msg, "files": []string{}, "missing": []string{}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "playlist": key, "files": files, "missing": missing})
+}
+
+func handleSearchTitle(c *gin.Context, data string) {
+	searchStr, filter := parseSearchQuery(data)
 	if len(searchStr) < MIN_SEARCH_STR {
 		c.JSON(http.StatusOK, gin.H{"status": "error", "message": TXT_MIN_SEARCH + fmt.Sprintf("%d", MIN_SEARCH_STR), "titles": []string{}})
 		return
@@ -385,15 +536,19 @@ func handleSearchTitle(c *gin.Context, searchStr string) {
 		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Search error", "titles": []string{}})
 		return
 	}
-	if len(titles) > MAX_SEARCH_RESULT {
-		titles = titles[:MAX_SEARCH_RESULT]
-	}
+	titles = accessFor(c).filterFiles(titles)
 	sort.Strings(titles)
-	c.JSON(http.StatusOK, gin.H{"status": "ok", "titles": titles})
+	titles, truncated, err := filter.apply(c, titles, MAX_SEARCH_RESULT)
+	if err != nil {
+		log.Printf("Search rating error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Search error", "titles": []string{}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "titles": titles, "truncated": truncated})
 }
 
-func handleSearchDir(c *gin.Context, searchStr string) {
-	searchStr = strings.TrimSpace(searchStr)
+func handleSearchDir(c *gin.Context, data string) {
+	searchStr, filter := parseSearchQuery(data)
 	if len(searchStr) < MIN_SEARCH_STR {
 		c.JSON(http.StatusOK, gin.H{"status": "error", "message": TXT_MIN_SEARCH + fmt.Sprintf("%d", MIN_SEARCH_STR), "dirs": []string{}})
 		return
@@ -404,20 +559,39 @@ func handleSearchDir(c *gin.Context, searchStr string) {
 		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Search dir error", "dirs": []string{}})
 		return
 	}
-	if len(dirs) > MAX_SEARCH_RESULT {
-		dirs = dirs[:MAX_SEARCH_RESULT]
-	}
+	dirs = accessFor(c).filterDirs(dirs)
 	sort.Strings(dirs)
-	c.JSON(http.StatusOK, gin.H{"status": "ok", "dirs": dirs})
+	dirs, truncated, err := filter.apply(c, dirs, MAX_SEARCH_RESULT)
+	if err != nil {
+		log.Printf("Search dir rating error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Search dir error", "dirs": []string{}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "dirs": dirs, "truncated": truncated})
+}
+
+// parseSearchQuery reads the data of searchTitle and searchDir: the search
+// string, or {"term":...} with the rating filters of ratingFilter.
+func parseSearchQuery(data string) (string, ratingFilter) {
+	var req struct {
+		Term string `json:"term"`
+		ratingFilter
+	}
+	if strings.HasPrefix(data, "{") && json.Unmarshal([]byte(data), &req) == nil {
+		return strings.TrimSpace(req.Term), req.ratingFilter
+	}
+	return strings.TrimSpace(data), ratingFilter{}
 }
 
 // handleSearchInDir performs a recursive search for audio files under the provided directory.
-// Request 'data' is expected to be a JSON object: {"dir":"A/B/","term":"query","limit":200}
+// Request 'data' is expected to be a JSON object: {"dir":"A/B/","term":"query","limit":200},
+// optionally with the rating filters minRating, maxRating and starred.
 func handleSearchInDir(c *gin.Context, raw string) {
 	var req struct {
 		Dir   string `json:"dir"`
 		Term  string `json:"term"`
 		Limit int    `json:"limit"`
+		ratingFilter
 	}
 	if err := json.Unmarshal([]byte(raw), &req); err != nil {
 		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid request"})
@@ -453,31 +627,42 @@ func handleSearchInDir(c *gin.Context, raw string) {
 		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Search failed", "matches": []string{}})
 		return
 	}
+	files = accessFor(c).filterFiles(files)
 
 	lcTerm := strings.ToLower(term)
-	var matches []map[string]string
+	var matched []string
 	for _, f := range files {
 		if strings.Contains(strings.ToLower(f), lcTerm) {
-			// Build match entry: path, title and dir
-			// Normalize title: use filename without path and extension and replace underscores
-			base := filepath.Base(f)
-			name := strings.TrimSuffix(base, filepath.Ext(base))
-			name = strings.ReplaceAll(name, "_", " ")
-			title := name
-			dirpath := filepath.Dir(f)
-			if dirpath == "." {
-				dirpath = ""
-			} else if !strings.HasSuffix(dirpath, "/") {
-				dirpath += "/"
-			}
-			matches = append(matches, map[string]string{"path": f, "title": title, "dir": dirpath})
-			if len(matches) >= limit {
-				break
-			}
+			matched = append(matched, f)
+		}
+	}
+	files, truncated, err := req.ratingFilter.apply(c, matched, limit)
+	if err != nil {
+		log.Printf("searchInDir rating error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Search failed", "matches": []string{}})
+		return
+	}
+	var matches []map[string]string
+	for _, f := range files {
+		// Build match entry: path, title and dir
+		// Normalize title: use filename without path and extension and replace underscores
+		base := filepath.Base(f)
+		name := strings.TrimSuffix(base, filepath.Ext(base))
+		name = strings.ReplaceAll(name, "_", " ")
+		title := name
+		dirpath := filepath.Dir(f)
+		if dirpath == "." {
+			dirpath = ""
+		} else if !strings.HasSuffix(dirpath, "/") {
+			dirpath += "/"
+		}
+		matches = append(matches, map[string]string{"path": f, "title": title, "dir": dirpath})
+		if len(matches) >= limit {
+			break
 		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "ok", "matches": matches, "count": len(matches)})
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "matches": matches, "count": len(matches), "truncated": truncated})
 }
 
 func handleGetAllMp3InDirs(c *gin.Context, data string) {
@@ -503,6 +688,7 @@ func handleGetAllMp3InDirs(c *gin.Context, data string) {
 			finalFiles = append(finalFiles, file)
 		}
 	}
+	finalFiles = accessFor(c).filterFiles(finalFiles)
 	sort.Strings(finalFiles)
 	c.JSON(http.StatusOK, gin.H{"status": "ok", "files": finalFiles})
 	// FIX: Add missing closing bracket for function
@@ -515,8 +701,12 @@ type responseWriter struct {
 	buffer *bytes.Buffer
 }
 
+// Write only buffers error responses: those are the ones ResponseLogger logs,
+// and buffering streamed audio would grow without bound.
 func (rw *responseWriter) Write(b []byte) (int, error) {
-	rw.buffer.Write(b)
+	if rw.Status() >= 400 {
+		rw.buffer.Write(b)
+	}
 	return rw.ResponseWriter.Write(b)
 }
 
@@ -537,9 +727,21 @@ func ResponseLogger() gin.HandlerFunc {
 }
 
 func isAudioFile(filename string) bool {
+	return hasExtension(filename, audioExtensions)
+}
+
+func isPlaylistFile(filename string) bool {
+	return hasExtension(filename, playlistExtensions)
+}
+
+func isImageFile(filename string) bool {
+	return hasExtension(filename, imageExtensions)
+}
+
+func hasExtension(filename string, exts []string) bool {
 	ext := strings.ToLower(filepath.Ext(filename))
-	for _, audioExt := range audioExtensions {
-		if ext == "."+audioExt {
+	for _, e := range exts {
+		if ext == "."+e {
 			return true
 		}
 	}
@@ -552,6 +754,193 @@ func isAudioFile(filename string) bool {
 
 func usingLocal() bool { return localMusicDir != "" }
 
+// envBool reports whether the environment variable is set to a true value
+// such as "1" or "true".
+func envBool(name string) bool {
+	v, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && v
+}
+
+// envDuration parses a duration such as "90m" or a plain number of seconds
+// from the environment, falling back to def when unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		return d
+	}
+	log.Printf("Invalid %s %q, using %v", name, v, def)
+	return def
+}
+
+// parseLifetime reads a positive lifetime from an API request: a Go
+// duration such as "72h" or a number of days such as "30d".
+func parseLifetime(s string) (time.Duration, bool) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(strings.TrimSpace(s), "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(strings.TrimSpace(s))
+	}
+	return d, err == nil && d > 0
+}
+
+// envInt reads a non-negative integer from the environment.
+func envInt(name string, def int) int {
+	return int(envInt64(name, int64(def)))
+}
+
+// envInt64 reads a non-negative integer from the environment, falling back to
+// def when unset or invalid.
+func envInt64(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		log.Printf("Invalid %s %q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+var (
+	errInvalidPath  = errors.New("invalid path")
+	errAccessDenied = errors.New("access denied")
+	errNotFound     = errors.New("not found")
+)
+
+// cleanKey trims the leading slash from a wildcard route parameter, rejects
+// empty keys and directory traversal attempts, and cleans the rest the way
+// the storage backends resolve it, keeping a trailing slash.
+func cleanKey(raw string) (string, bool) {
+	key := strings.TrimPrefix(raw, "/")
+	if key == "" || strings.Contains(key, "..") || strings.HasPrefix(key, "/") {
+		return "", false
+	}
+	key, ok := aclKey(key)
+	return key, ok && key != ""
+}
+
+// localAbsPath resolves key against localMusicDir and ensures the result
+// stays inside the music directory and exists on disk.
+func localAbsPath(key string) (string, error) {
+	absPath, err := filepath.Abs(filepath.Join(localMusicDir, filepath.Clean(key)))
+	if err != nil {
+		return "", errInvalidPath
+	}
+	absMusicDir, err := filepath.Abs(localMusicDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve music dir: %w", err)
+	}
+	if !strings.HasPrefix(absPath, absMusicDir) {
+		return "", errAccessDenied
+	}
+	if _, err := os.Stat(absPath); err != nil {
+		return "", errNotFound
+	}
+	return absPath, nil
+}
+
+// localPathError writes the HTTP error matching a localAbsPath failure.
+func localPathError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errInvalidPath):
+		c.String(http.StatusBadRequest, "Invalid path")
+	case errors.Is(err, errAccessDenied):
+		c.String(http.StatusForbidden, "Access denied")
+	case errors.Is(err, errNotFound):
+		c.String(http.StatusNotFound, "Audio not found")
+	default:
+		c.String(http.StatusInternalServerError, "Server configuration error")
+	}
+}
+
+// audioObject is an open library file from either storage backend.
+type audioObject struct {
+	io.ReadCloser
+	Size    int64
+	ModTime time.Time
+}
+
+// openAudio opens a library file for sequential reading. Keys are resolved
+// exactly like /localdisk (local mode) and the presigned /audio path (S3 mode).
+func openAudio(ctx context.Context, key string) (*audioObject, error) {
+	if usingLocal() {
+		return localOpenAudio(key)
+	}
+	return s3OpenAudio(ctx, key)
+}
+
+func localOpenAudio(key string) (*audioObject, error) {
+	absPath, err := localAbsPath(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(absPath) // #nosec G304 -- path validated by localAbsPath
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		_ = f.Close()
+		return nil, errNotFound
+	}
+	return &audioObject{ReadCloser: f, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func s3OpenAudio(ctx context.Context, key string) (*audioObject, error) {
+	out, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(s3Prefix + key),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, errNotFound
+		}
+		return nil, err
+	}
+	obj := &audioObject{ReadCloser: out.Body, Size: aws.ToInt64(out.ContentLength)}
+	if out.LastModified != nil {
+		obj.ModTime = *out.LastModified
+	}
+	return obj, nil
+}
+
+// openAudioForRequest opens key for the current request, writing the
+// matching error response when it cannot be opened.
+func openAudioForRequest(c *gin.Context, key string) (*audioObject, bool) {
+	obj, err := openAudio(c.Request.Context(), key)
+	if err == nil {
+		return obj, true
+	}
+	if errors.Is(err, errNotFound) || errors.Is(err, errInvalidPath) || errors.Is(err, errAccessDenied) {
+		localPathError(c, err)
+		return nil, false
+	}
+	log.Printf("Open error for key [%s]: %v", key, err)
+	c.String(http.StatusNotFound, "Audio not found")
+	return nil, false
+}
+
+// isS3NotFound reports whether err is a 404 response from S3.
+func isS3NotFound(err error) bool {
+	return s3StatusCode(err) == http.StatusNotFound
+}
+
 // initStorage performs the storage backend initialization (either local or S3).
 // It fatals when no backend is configured. Keeping an explicit init function
 // means the work happens in main() (not in init()), which is better for tests.
@@ -566,6 +955,20 @@ func initStorage() {
 	if err := initS3(); err != nil {
 		log.Fatalf("S3 init error: %v", err)
 	}
+	if presignExpiry > MAX_PRESIGN_EXPIRY {
+		log.Printf("PRESIGN_EXPIRY %v exceeds the S3 maximum, using %v", presignExpiry, MAX_PRESIGN_EXPIRY)
+		presignExpiry = MAX_PRESIGN_EXPIRY
+	}
+	log.Printf("Signed URL expiry: %v", presignExpiry)
+	if err := initCloudFront(); err != nil {
+		log.Fatalf("CloudFront init error: %v", err)
+	}
+	if s3ProxyMode {
+		log.Printf("S3 proxy mode enabled: audio is streamed through the server")
+		if isLambda {
+			log.Printf("Warning: S3 proxy mode on Lambda is subject to response size limits")
+		}
+	}
 }
 
 // newRouter builds the Gin engine and registers all routes. This is separated
@@ -583,9 +986,29 @@ func newRouter() *gin.Engine {
 	log.Printf("Parsing template: ./templates/index.html")
 	indexTmpl = template.Must(template.ParseFiles("./templates/index.html"))
 
+	loginTmpl = template.Must(template.ParseFiles("./templates/login.html"))
+	shareTmpl = template.Must(template.ParseFiles("./templates/share.html"))
+	r.GET("/favicon.ico", func(c *gin.Context) {
+		c.File("./static/favicon.ico")
+	})
+	r.GET("/login", loginPageHandler)
+	r.POST("/login", loginHandler)
+	r.POST("/logout", logoutHandler)
+	registerShareRoutes(r)
+
+	// Every route registered below requires a signed-in user when
+	// AUTH_USERS is configured, or an API key with the route's scope.
+	r.Use(apiKeyMiddleware(), authMiddleware())
+
 	r.GET("/", func(c *gin.Context) {
 		c.Header("Content-Type", "text/html; charset=utf-8")
-		data := struct{ Version string }{Version: Version}
+		data := struct {
+			Version string
+			User    string
+		}{Version: Version}
+		if u := currentUser(c); u != nil {
+			data.User = u.Name
+		}
 		if err := indexTmpl.Execute(c.Writer, data); err != nil {
 			log.Printf("failed to render index template: %v", err)
 			c.String(http.StatusInternalServerError, "Internal Server Error")
@@ -593,26 +1016,71 @@ func newRouter() *gin.Engine {
 		}
 	})
 
-	r.GET("/favicon.ico", func(c *gin.Context) {
-		c.File("./static/favicon.ico")
-	})
-
 	r.Use(ResponseLogger())
 	r.POST("/api", handleRequest)
 	r.GET("/audio/*path", audioProxyHandler)
+	r.HEAD("/audio/*path", audioProxyHandler)
+	r.GET("/stream/*path", streamHandler)
+	r.HEAD("/stream/*path", streamHandler)
 	r.GET("/localdisk/*path", localDiskHandler)
+	r.GET("/preview/*path", previewHandler)
+	r.GET("/playlist/export", playlistExportHandler)
+	r.POST("/playlist/export", playlistExportHandler)
+	r.GET("/download/*path", downloadHandler)
+	r.POST("/download", downloadHandler)
+	r.GET("/radio", radioListHandler)
+	r.GET("/radio/:station", radioHandler)
+	r.HEAD("/radio/:station", radioHandler)
+	r.GET("/rest/*method", subsonicHandler)
+	r.POST("/rest/*method", subsonicHandler)
+	r.GET("/feed/*path", feedHandler)
+	r.HEAD("/feed/*path", feedHandler)
+	r.GET("/scrobble/lastfm/connect", lastfmConnectHandler)
+	r.GET(LASTFM_CALLBACK_PATH, lastfmCallbackHandler)
+	r.GET(REMOTE_PATH, remoteHandler)
+	r.GET(EVENTS_PATH, eventsHandler)
+	r.POST(EVENTS_S3_PATH, s3EventsHandler)
+	registerAPIv2Routes(r)
+	registerDLNARoutes(r)
+	registerDAVRoutes(r)
 	r.NoRoute(func(c *gin.Context) {
+		if isAPIv2(c) {
+			v2Fail(c, http.StatusNotFound, V2_NOT_FOUND, "Unknown API endpoint")
+			return
+		}
 		c.String(http.StatusNotFound, "Not found")
 	})
 
 	return r
 }
 
+// dirListing is the content of a single library directory.
+type dirListing struct {
+	Dirs      []string
+	Files     []string
+	Playlists []string
+	Images    []string
+	Meta      map[string]fileMeta // size and mtime of files, playlists and images
+}
+
+type fileMeta struct {
+	Size    int64
+	ModTime time.Time
+}
+
 func listDir(prefix string) ([]string, []string, error) {
+	listing, err := listDirEntries(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	return listing.Dirs, listing.Files, nil
+}
+
+func listDirEntries(prefix string) (dirListing, error) {
 	if usingLocal() {
-		return localList(prefix)
+		return localListing(prefix)
 	}
-	return s3List(prefix, "/")
+	return s3Listing(prefix, "/")
 }
 
 func listAllAudioFiles(prefix string) ([]string, error) {
@@ -622,6 +1090,14 @@ func listAllAudioFiles(prefix string) ([]string, error) {
 	return s3ListAllAudioFiles(prefix)
 }
 
+// listAllPlaylists returns every library playlist file.
+func listAllPlaylists() ([]string, error) {
+	if usingLocal() {
+		return localListAllFiles("", isPlaylistFile)
+	}
+	return s3ListAllFiles("", isPlaylistFile)
+}
+
 func listAllDirs() ([]string, error) {
 	if usingLocal() {
 		return localListAllDirs()
@@ -647,7 +1123,15 @@ func searchDirs(term string) ([]string, error) {
 // It's good practice to ensure all called functions exist.
 
 func s3List(prefix string, delimiter string) ([]string, []string, error) {
-	var dirs, files []string
+	listing, err := s3Listing(prefix, delimiter)
+	if err != nil {
+		return nil, nil, err
+	}
+	return listing.Dirs, listing.Files, nil
+}
+
+func s3Listing(prefix string, delimiter string) (dirListing, error) {
+	var listing dirListing
 	input := &s3.ListObjectsV2Input{
 		Bucket:    aws.String(s3Bucket),
 		Prefix:    aws.String(s3Prefix + prefix),
@@ -655,22 +1139,41 @@ func s3List(prefix string, delimiter string) ([]string, []string, error) {
 	}
 	resp, err := s3Client.ListObjectsV2(context.Background(), input)
 	if err != nil {
-		return nil, nil, err
+		return listing, err
 	}
 	for _, cp := range resp.CommonPrefixes {
 		name := strings.TrimPrefix(*cp.Prefix, s3Prefix+prefix)
 		name = strings.TrimSuffix(name, "/")
 		if name != "" {
-			dirs = append(dirs, name)
+			listing.Dirs = append(listing.Dirs, name)
 		}
 	}
+	listing.Meta = make(map[string]fileMeta)
 	for _, obj := range resp.Contents {
 		name := strings.TrimPrefix(*obj.Key, s3Prefix+prefix)
-		if name != "" && !strings.Contains(name, "/") {
-			files = append(files, name)
+		if name == "" || strings.Contains(name, "/") {
+			continue
 		}
+		if listing.add(name) {
+			listing.Meta[name] = fileMeta{Size: aws.ToInt64(obj.Size), ModTime: aws.ToTime(obj.LastModified)}
+		}
+	}
+	return listing, nil
+}
+
+// add files name under its kind and reports whether it is listed at all.
+func (l *dirListing) add(name string) bool {
+	switch {
+	case isAudioFile(name):
+		l.Files = append(l.Files, name)
+	case isPlaylistFile(name):
+		l.Playlists = append(l.Playlists, name)
+	case isImageFile(name):
+		l.Images = append(l.Images, name)
+	default:
+		return false
 	}
-	return dirs, files, nil
+	return true
 }
 
 func s3SearchFiles(searchStr string) ([]string, error) {
@@ -731,44 +1234,63 @@ func s3ListAllDirs() ([]string, error) {
 }
 
 func localList(prefix string) ([]string, []string, error) {
-	var dirs, files []string
+	listing, err := localListing(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	return listing.Dirs, listing.Files, nil
+}
+
+func localListing(prefix string) (dirListing, error) {
+	var listing dirListing
 	base := filepath.Join(localMusicDir, prefix)
 	// Validate that base is inside localMusicDir (avoid path traversal)
 	rootAbs, err := filepath.Abs(localMusicDir)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to resolve music dir: %w", err)
+		return listing, fmt.Errorf("failed to resolve music dir: %w", err)
 	}
 	baseAbs, err := filepath.Abs(base)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to resolve target dir: %w", err)
+		return listing, fmt.Errorf("failed to resolve target dir: %w", err)
 	}
 	// Ensure the requested baseAbs is within rootAbs
 	if !strings.HasPrefix(baseAbs, rootAbs) {
-		return nil, nil, fmt.Errorf("invalid directory path: %s", prefix)
+		return listing, fmt.Errorf("invalid directory path: %s", prefix)
 	}
 	entries, err := os.ReadDir(baseAbs)
 	if err != nil {
-		return nil, nil, err
+		return listing, err
 	}
+	listing.Meta = make(map[string]fileMeta)
 	for _, entry := range entries {
 		name := entry.Name()
 		if entry.IsDir() {
-			dirs = append(dirs, name)
-		} else if isAudioFile(name) {
-			files = append(files, name)
+			listing.Dirs = append(listing.Dirs, name)
+			continue
+		}
+		if !listing.add(name) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			listing.Meta[name] = fileMeta{Size: info.Size(), ModTime: info.ModTime()}
 		}
 	}
-	return dirs, files, nil
+	return listing, nil
 }
 
 func localListAllAudioFiles(prefix string) ([]string, error) {
+	return localListAllFiles(prefix, isAudioFile)
+}
+
+// localListAllFiles walks prefix and returns the files whose name satisfies match.
+func localListAllFiles(prefix string, match func(string) bool) ([]string, error) {
 	var allFiles []string
 	base := filepath.Join(localMusicDir, prefix)
 	err := filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() && isAudioFile(info.Name()) {
+		if !info.IsDir() && match(info.Name()) {
 			rel, _ := filepath.Rel(localMusicDir, path)
 			allFiles = append(allFiles, rel)
 		}
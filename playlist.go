@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Playlist formats supported by export and import.
+const (
+	PLAYLIST_M3U8 = "m3u8"
+	PLAYLIST_PLS  = "pls"
+	PLAYLIST_XSPF = "xspf"
+)
+
+var playlistContentTypes = map[string]string{
+	PLAYLIST_M3U8: "audio/x-mpegurl; charset=utf-8",
+	PLAYLIST_PLS:  "audio/x-scpls; charset=utf-8",
+	PLAYLIST_XSPF: "application/xspf+xml; charset=utf-8",
+}
+
+// audioRoutePrefixes are the server routes whose URLs map back onto library
+// paths when a playlist is imported.
+var audioRoutePrefixes = []string{"/audio/", "/stream/", "/localdisk/", "/preview/"}
+
+// playlistExportHandler renders a track list as M3U8, PLS or XSPF with
+// absolute /stream URLs.
+//
+//	GET  /playlist/export?format=m3u8&dir=Rock/&q=love  tracks under dir (optionally filtered)
+//	GET  /playlist/export?format=xspf&smart=<id>         tracks of a smart playlist
+//	POST /playlist/export?format=pls  {"name":"Mix","tracks":["Rock/a.mp3"]}
+func playlistExportHandler(c *gin.Context) {
+	format := strings.ToLower(c.DefaultQuery("format", PLAYLIST_M3U8))
+	if format == "m3u" {
+		format = PLAYLIST_M3U8
+	}
+	if _, ok := playlistContentTypes[format]; !ok {
+		c.String(http.StatusBadRequest, "Unsupported playlist format")
+		return
+	}
+
+	name, tracks, ok := exportTracks(c)
+	if !ok {
+		return
+	}
+
+	base := requestBaseURL(c)
+	var body string
+	switch format {
+	case PLAYLIST_PLS:
+		body = renderPLS(base, tracks)
+	case PLAYLIST_XSPF:
+		out, err := renderXSPF(base, name, tracks)
+		if err != nil {
+			log.Printf("XSPF render error: %v", err)
+			c.String(http.StatusInternalServerError, "Failed to render playlist")
+			return
+		}
+		body = out
+	default:
+		body = renderM3U8(base, name, tracks)
+	}
+
+	filename := strings.NewReplacer(`"`, "", "/", "_", `\`, "_").Replace(name) + "." + format
+	c.Header("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(filename))
+	c.Data(http.StatusOK, playlistContentTypes[format], []byte(body))
+}
+
+// exportTracks collects the playlist name and tracks for an export request,
+// writing an error response when the request is invalid.
+func exportTracks(c *gin.Context) (string, []string, bool) {
+	if c.Request.Method == http.MethodPost {
+		var req struct {
+			Name   string   `json:"name"`
+			Tracks []string `json:"tracks"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.String(http.StatusBadRequest, "Invalid JSON")
+			return "", nil, false
+		}
+		tracks := make([]string, 0, len(req.Tracks))
+		for _, t := range req.Tracks {
+			if key, ok := cleanKey(t); ok {
+				tracks = append(tracks, key)
+			}
+		}
+		return playlistName(req.Name, "playlist"), accessFor(c).filterFiles(tracks), true
+	}
+	if id := c.Query("smart"); id != "" {
+		return exportSmartTracks(c, id)
+	}
+
+	dir := strings.TrimPrefix(strings.TrimSpace(c.Query("dir")), "/")
+	if strings.Contains(dir, "..") {
+		c.String(http.StatusBadRequest, "Invalid directory")
+		return "", nil, false
+	}
+	files, err := listAllAudioFiles(dir)
+	if err != nil {
+		log.Printf("Playlist export list error: %v", err)
+		c.String(http.StatusNotFound, TXT_ACC_DIR)
+		return "", nil, false
+	}
+	term := strings.ToLower(strings.TrimSpace(c.Query("q")))
+	tracks := files[:0]
+	for _, f := range files {
+		if term == "" || strings.Contains(strings.ToLower(f), term) {
+			tracks = append(tracks, filepath.ToSlash(f))
+		}
+	}
+	tracks = accessFor(c).filterFiles(tracks)
+	sort.Strings(tracks)
+	return playlistName(c.Query("name"), path.Base("/"+strings.TrimSuffix(dir, "/"))), tracks, true
+}
+
+// exportSmartTracks evaluates the caller's smart playlist id.
+func exportSmartTracks(c *gin.Context, id string) (string, []string, bool) {
+	p, ok := findSmartPlaylist(currentUserName(c), id)
+	if !ok {
+		c.String(http.StatusNotFound, "Playlist not found")
+		return "", nil, false
+	}
+	tracks, err := evaluateSmart(c, p)
+	if err != nil {
+		log.Printf("Smart playlist export error: %v", err)
+		c.String(http.StatusInternalServerError, "Failed to build playlist")
+		return "", nil, false
+	}
+	return playlistName(p.Name, "playlist"), tracks, true
+}
+
+func playlistName(name, fallback string) string {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "/" {
+		name = fallback
+	}
+	if name == "" || name == "/" {
+		name = "Home"
+	}
+	return name
+}
+
+// requestBaseURL returns scheme://host for the current request, honouring
+// the X-Forwarded-* headers set by reverse proxies and API Gateway.
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	host := c.Request.Host
+	if fwd := c.GetHeader("X-Forwarded-Host"); fwd != "" {
+		host = strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	return scheme + "://" + host
+}
+
+// trackURL builds an absolute URL below route for a library path, escaping
+// each path segment.
+func trackURL(base, route, track string) string {
+	parts := strings.Split(track, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return base + route + strings.Join(parts, "/")
+}
+
+// streamHandler serves a track to external players, which cannot use the
+// JSON document /audio answers with: from disk, streamed from S3 in proxy
+// mode, or as a redirect to a signed URL.
+func streamHandler(c *gin.Context) {
+	key, ok := cleanKey(c.Param("path"))
+	if !ok || !isAudioFile(key) {
+		c.String(http.StatusBadRequest, "Invalid path")
+		return
+	}
+	serveAudio(c, key)
+}
+
+// trackTitle mirrors getTrackTitle in static/script.js.
+func trackTitle(track string) string {
+	name := path.Base(track)
+	name = strings.TrimSuffix(name, path.Ext(name))
+	return strings.ReplaceAll(name, "_", " ")
+}
+
+func renderM3U8(base, name string, tracks []string) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#PLAYLIST:%s\n", name)
+	for _, t := range tracks {
+		fmt.Fprintf(&b, "#EXTINF:-1,%s\n%s\n", trackTitle(t), trackURL(base, "/stream/", t))
+	}
+	return b.String()
+}
+
+func renderPLS(base string, tracks []string) string {
+	var b strings.Builder
+	b.WriteString("[playlist]\n")
+	for i, t := range tracks {
+		n := i + 1
+		fmt.Fprintf(&b, "File%d=%s\nTitle%d=%s\nLength%d=-1\n", n, trackURL(base, "/stream/", t), n, trackTitle(t), n)
+	}
+	fmt.Fprintf(&b, "NumberOfEntries=%d\nVersion=2\n", len(tracks))
+	return b.String()
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	XMLNS   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+}
+
+func renderXSPF(base, name string, tracks []string) (string, error) {
+	pl := xspfPlaylist{Version: "1", XMLNS: "http://xspf.org/ns/0/", Title: name, Tracks: []xspfTrack{}}
+	for _, t := range tracks {
+		pl.Tracks = append(pl.Tracks, xspfTrack{Location: trackURL(base, "/stream/", t), Title: trackTitle(t)})
+	}
+	out, err := xml.MarshalIndent(pl, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return xml.Header + string(out) + "\n", nil
+}
+
+// parsePlaylist extracts the entry locations from an M3U/M3U8, PLS or XSPF
+// document. When format is empty it is detected from the content.
+func parsePlaylist(content, format string) ([]string, error) {
+	content = strings.TrimPrefix(content, "\uFEFF")
+	trimmed := strings.TrimSpace(content)
+	if format == "" {
+		switch {
+		case strings.HasPrefix(trimmed, "<"):
+			format = PLAYLIST_XSPF
+		case strings.HasPrefix(strings.ToLower(trimmed), "[playlist]"):
+			format = PLAYLIST_PLS
+		default:
+			format = PLAYLIST_M3U8
+		}
+	}
+
+	switch strings.ToLower(format) {
+	case PLAYLIST_XSPF:
+		var pl xspfPlaylist
+		if err := xml.Unmarshal([]byte(trimmed), &pl); err != nil {
+			return nil, fmt.Errorf("invalid XSPF: %w", err)
+		}
+		entries := make([]string, 0, len(pl.Tracks))
+		for _, t := range pl.Tracks {
+			if loc := strings.TrimSpace(t.Location); loc != "" {
+				entries = append(entries, loc)
+			}
+		}
+		return entries, nil
+	case PLAYLIST_PLS:
+		return parsePLS(content), nil
+	case PLAYLIST_M3U8, "m3u":
+		var entries []string
+		sc := bufio.NewScanner(strings.NewReader(content))
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+		return entries, sc.Err()
+	}
+	return nil, fmt.Errorf("unsupported playlist format %q", format)
+}
+
+func parsePLS(content string) []string {
+	files := map[int]string{}
+	var order []int
+	for _, line := range strings.Split(content, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || len(k) < 5 || !strings.EqualFold(k[:4], "file") {
+			continue
+		}
+		n, err := strconv.Atoi(k[4:])
+		if err != nil {
+			continue
+		}
+		if _, seen := files[n]; !seen {
+			order = append(order, n)
+		}
+		files[n] = strings.TrimSpace(v)
+	}
+	sort.Ints(order)
+	entries := make([]string, 0, len(order))
+	for _, n := range order {
+		entries = append(entries, files[n])
+	}
+	return entries
+}
+
+// playlistEntryCandidates turns a raw playlist entry into library-relative
+// paths to try, in order of preference. baseDir is the library directory
+// that relative entries are resolved against.
+func playlistEntryCandidates(entry, baseDir string) []string {
+	entry = strings.ReplaceAll(strings.TrimSpace(entry), `\`, "/")
+	if u, err := url.Parse(entry); err == nil {
+		switch {
+		case len(u.Scheme) > 1:
+			entry = u.Path
+			for _, prefix := range audioRoutePrefixes {
+				if strings.HasPrefix(entry, prefix) {
+					entry = "/" + strings.TrimPrefix(entry, prefix)
+					break
+				}
+			}
+		case len(u.Scheme) == 1:
+			// Windows drive letter such as C:/Music/song.mp3
+			entry = "/" + strings.TrimPrefix(entry[2:], "/")
+		}
+	}
+
+	variants := []string{entry}
+	if strings.Contains(entry, "%") {
+		if unescaped, err := url.PathUnescape(entry); err == nil && unescaped != entry {
+			variants = append(variants, unescaped)
+		}
+	}
+
+	var candidates []string
+	for _, v := range variants {
+		if strings.HasPrefix(v, "/") {
+			if localMusicDir != "" {
+				root := filepath.ToSlash(filepath.Clean(localMusicDir)) + "/"
+				if strings.HasPrefix(v, root) {
+					candidates = append(candidates, strings.TrimPrefix(v, root))
+				}
+			}
+			candidates = append(candidates, strings.TrimPrefix(path.Clean(v), "/"))
+			continue
+		}
+		joined := path.Clean(path.Join("/", baseDir, v))
+		candidates = append(candidates, strings.TrimPrefix(joined, "/"))
+	}
+	return candidates
+}
+
+// resolvePlaylistEntries maps playlist entries onto tracks in library,
+// returning the playable tracks in order and the entries that could not be
+// found. Absolute paths from other machines are matched by their longest
+// path suffix that exists in the library.
+func resolvePlaylistEntries(entries []string, baseDir string, library []string) ([]string, []string) {
+	known := make(map[string]bool, len(library))
+	for _, f := range library {
+		known[filepath.ToSlash(f)] = true
+	}
+	files := []string{}
+	missing := []string{}
+	for _, entry := range entries {
+		if track, ok := resolvePlaylistEntry(entry, baseDir, known); ok {
+			files = append(files, track)
+		} else {
+			missing = append(missing, entry)
+		}
+	}
+	return files, missing
+}
+
+func resolvePlaylistEntry(entry, baseDir string, known map[string]bool) (string, bool) {
+	candidates := playlistEntryCandidates(entry, baseDir)
+	for _, cand := range candidates {
+		if known[cand] {
+			return cand, true
+		}
+	}
+	for _, cand := range candidates {
+		parts := strings.Split(cand, "/")
+		for i := 1; i < len(parts); i++ {
+			if suffix := strings.Join(parts[i:], "/"); known[suffix] {
+				return suffix, true
+			}
+		}
+	}
+	return "", false
+}
+
+// playlistError carries the message shown to API clients alongside the
+// underlying cause.
+type playlistError struct {
+	msg string
+	err error
+}
+
+func (e *playlistError) Error() string { return e.msg + ": " + e.err.Error() }
+func (e *playlistError) Unwrap() error { return e.err }
+
+// resolveLibraryPlaylist reads a .m3u/.m3u8 file stored in the library and
+// resolves its entries relative to the playlist's own directory. Entries the
+// user may not access are reported as missing.
+func resolveLibraryPlaylist(ctx context.Context, key string, access *aclAccess) ([]string, []string, error) {
+	obj, err := openAudio(ctx, key)
+	if err != nil {
+		return nil, nil, &playlistError{"Playlist not found", err}
+	}
+	content, err := io.ReadAll(io.LimitReader(obj, MAX_PLAYLIST_FILE_SIZE))
+	_ = obj.Close()
+	if err != nil {
+		return nil, nil, &playlistError{"Failed to read playlist", err}
+	}
+	entries, err := parsePlaylist(string(content), PLAYLIST_M3U8)
+	if err != nil {
+		return nil, nil, err
+	}
+	library, err := listAllAudioFiles("")
+	if err != nil {
+		return nil, nil, &playlistError{"Failed to scan music files", err}
+	}
+	library = access.filterFiles(library)
+	baseDir := path.Dir(key)
+	if baseDir == "." {
+		baseDir = ""
+	}
+	files, missing := resolvePlaylistEntries(entries, baseDir, library)
+	return files, missing, nil
+}
+
+// handleImportPlaylist resolves an uploaded playlist against the library.
+// Request 'data' is expected to be a JSON object: {"format":"m3u8","content":"#EXTM3U..."}
+// with format optional (detected from content when empty).
+func handleImportPlaylist(c *gin.Context, raw string) {
+	var req struct {
+		Format  string `json:"format"`
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid request"})
+		return
+	}
+	entries, err := parsePlaylist(req.Content, req.Format)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": err.Error()})
+		return
+	}
+	library, err := listAllAudioFiles("")
+	if err != nil {
+		log.Printf("Import playlist list error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to scan music files"})
+		return
+	}
+	files, missing := resolvePlaylistEntries(entries, "", accessFor(c).filterFiles(library))
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "files": files, "missing": missing})
+}
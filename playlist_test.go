@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParsePlaylist checks entry extraction for each supported format
+func TestParsePlaylist(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "M3U8 with BOM and comments",
+			content: "\uFEFF#EXTM3U\n#EXTINF:-1,Song\nRock/song.mp3\r\n\n# comment\nhttp://h/audio/Jazz/tune.mp3\n",
+			want:    []string{"Rock/song.mp3", "http://h/audio/Jazz/tune.mp3"},
+		},
+		{
+			name:    "PLS out of order",
+			content: "[playlist]\nFile2=b.mp3\nTitle2=B\nFile1=a.mp3\nNumberOfEntries=2\n",
+			want:    []string{"a.mp3", "b.mp3"},
+		},
+		{
+			name:    "XSPF",
+			content: `<?xml version="1.0"?><playlist version="1" xmlns="http://xspf.org/ns/0/"><trackList><track><location>file:///music/a.mp3</location></track></trackList></playlist>`,
+			want:    []string{"file:///music/a.mp3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePlaylist(tt.content, "")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// TestResolvePlaylistEntries covers relative, absolute, URL and encoded entries
+func TestResolvePlaylistEntries(t *testing.T) {
+	origLocalMusicDir := localMusicDir
+	defer func() {
+		localMusicDir = origLocalMusicDir
+	}()
+	localMusicDir = "/srv/music"
+
+	library := []string{"Rock/Song One.mp3", "Rock/Live/encore.mp3", "Jazz/太極樂隊 - 歌曲.mp3"}
+	entries := []string{
+		"Song One.mp3",                    // relative to base dir
+		"../Jazz/太極樂隊 - 歌曲.mp3",           // relative with parent
+		"/srv/music/Rock/Live/encore.mp3", // absolute under MUSIC_DIR
+		"http://example.com/audio/Rock/Song%20One.mp3",
+		"Live%2Fencore.mp3",                      // URL-encoded relative
+		`C:\Users\me\Music\Rock\Live\encore.mp3`, // foreign absolute path
+		"missing.mp3",
+	}
+	files, missing := resolvePlaylistEntries(entries, "Rock/", library)
+	assert.Equal(t, []string{
+		"Rock/Song One.mp3",
+		"Jazz/太極樂隊 - 歌曲.mp3",
+		"Rock/Live/encore.mp3",
+		"Rock/Song One.mp3",
+		"Rock/Live/encore.mp3",
+		"Rock/Live/encore.mp3",
+	}, files)
+	assert.Equal(t, []string{"missing.mp3"}, missing)
+}
+
+// TestPlaylistExport checks the export formats and absolute /audio URLs
+func TestPlaylistExport(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origLocalMusicDir := localMusicDir
+	defer func() {
+		localMusicDir = origLocalMusicDir
+	}()
+	localMusicDir = tmpDir
+
+	os.MkdirAll(filepath.Join(tmpDir, "Rock"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Rock", "My Song.mp3"), []byte("test"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Rock", "Other.mp3"), []byte("test"), 0644)
+
+	gin.SetMode(gin.TestMode)
+
+	t.Run("M3U8 from directory", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "http://music.local/playlist/export?dir=Rock/", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		body := w.Body.String()
+		assert.True(t, strings.HasPrefix(body, "#EXTM3U\n#PLAYLIST:Rock\n"))
+		assert.Contains(t, body, "#EXTINF:-1,My Song\nhttp://music.local/stream/Rock/My%20Song.mp3\n")
+		assert.Contains(t, w.Header().Get("Content-Disposition"), "Rock.m3u8")
+	})
+
+	t.Run("exported URLs stream the track", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/stream/Rock/My%20Song.mp3", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "test", w.Body.String())
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/stream/Rock/../../etc/passwd", nil))
+		assert.NotEqual(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("PLS from search", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/playlist/export?format=pls&q=other", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "music.example.com")
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		body := w.Body.String()
+		assert.Contains(t, body, "File1=https://music.example.com/stream/Rock/Other.mp3\n")
+		assert.Contains(t, body, "NumberOfEntries=1\n")
+	})
+
+	t.Run("XSPF from posted track list round-trips through import", func(t *testing.T) {
+		payload, _ := json.Marshal(map[string]interface{}{"name": "Mix", "tracks": []string{"Rock/Other.mp3", "Rock/My Song.mp3"}})
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/playlist/export?format=xspf", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "<title>Mix</title>")
+
+		data, _ := json.Marshal(map[string]string{"content": w.Body.String()})
+		reqBody, _ := json.Marshal(map[string]string{"function": "importPlaylist", "data": string(data)})
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest("POST", "/api", bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+
+		var response map[string]interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, "ok", response["status"])
+		assert.Equal(t, []interface{}{"Rock/Other.mp3", "Rock/My Song.mp3"}, response["files"])
+		assert.Empty(t, response["missing"])
+	})
+
+	t.Run("Unsupported format", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/playlist/export?format=wpl", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+// TestLibraryPlaylists checks that .m3u files are listed separately and
+// resolved into library tracks by the resolvePlaylist API function
+func TestLibraryPlaylists(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origLocalMusicDir := localMusicDir
+	defer func() {
+		localMusicDir = origLocalMusicDir
+	}()
+	localMusicDir = tmpDir
+
+	os.MkdirAll(filepath.Join(tmpDir, "Lists"), 0755)
+	os.MkdirAll(filepath.Join(tmpDir, "Rock"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Rock", "My Song.mp3"), []byte("test"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Rock", "Other.mp3"), []byte("test"), 0644)
+	m3u := "#EXTM3U\n../Rock/My Song.mp3\n" + filepath.Join(tmpDir, "Rock", "Other.mp3") + "\n/Rock/My%20Song.mp3\nGone.mp3\n"
+	os.WriteFile(filepath.Join(tmpDir, "Lists", "best.m3u"), []byte(m3u), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Lists", "more.M3U8"), []byte(""), 0644)
+
+	gin.SetMode(gin.TestMode)
+	call := func(function, data string) map[string]interface{} {
+		reqBody, _ := json.Marshal(map[string]string{"function": function, "data": data})
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api", bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var response map[string]interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	t.Run("Listing reports playlists separately", func(t *testing.T) {
+		response := call("dir", "Lists/")
+		assert.Equal(t, "ok", response["status"])
+		assert.Equal(t, []interface{}{"best.m3u", "more.M3U8"}, response["playlists"])
+		assert.Nil(t, response["files"])
+	})
+
+	t.Run("Resolve playlist entries", func(t *testing.T) {
+		response := call("resolvePlaylist", "Lists/best.m3u")
+		assert.Equal(t, "ok", response["status"])
+		assert.Equal(t, []interface{}{"Rock/My Song.mp3", "Rock/Other.mp3", "Rock/My Song.mp3"}, response["files"])
+		assert.Equal(t, []interface{}{"Gone.mp3"}, response["missing"])
+	})
+
+	t.Run("Resolve rejects non-playlist paths", func(t *testing.T) {
+		response := call("resolvePlaylist", "Rock/Other.mp3")
+		assert.Equal(t, "error", response["status"])
+		response = call("resolvePlaylist", "../secret.m3u")
+		assert.Equal(t, "error", response["status"])
+	})
+}
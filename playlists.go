@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Server-side playlists: named track lists stored per user, replacing the
+// web player's cookie. Every change names the version it was based on, and
+// changes based on an older version are refused so two devices cannot
+// silently overwrite each other.
+
+const (
+	PLAYLISTS_FILE_PREFIX = "playlists-"
+	MAX_PLAYLIST_TRACKS   = 10000
+	MAX_PLAYLIST_NAME     = 200
+)
+
+var (
+	errPlaylistNotFound = errors.New("playlist not found")
+	errPlaylistConflict = errors.New("playlist version conflict")
+)
+
+// playlistOpError is a validation message shown to the user as is.
+type playlistOpError string
+
+func (e playlistOpError) Error() string { return string(e) }
+
+type savedPlaylist struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Tracks  []string  `json:"tracks"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// clone returns a copy that does not share the track slice.
+func (p *savedPlaylist) clone() savedPlaylist {
+	out := *p
+	out.Tracks = slices.Clone(p.Tracks)
+	if out.Tracks == nil {
+		out.Tracks = []string{}
+	}
+	return out
+}
+
+var savedPlaylists = newPlaylistStore()
+
+// playlistStore keeps each user's playlists in their own document.
+type playlistStore struct {
+	*userDocs[[]*savedPlaylist]
+}
+
+func newPlaylistStore() *playlistStore {
+	return &playlistStore{newUserDocs[[]*savedPlaylist](PLAYLISTS_FILE_PREFIX)}
+}
+
+// list returns owner's playlists sorted by name.
+func (s *playlistStore) list(owner string) []savedPlaylist {
+	lists, err := s.doc(owner).get()
+	if err != nil {
+		log.Printf("Playlist load error: %v", err)
+	}
+	out := make([]savedPlaylist, 0, len(lists))
+	for _, p := range lists {
+		out = append(out, p.clone())
+	}
+	sort.Slice(out, func(i, j int) bool { return strings.ToLower(out[i].Name) < strings.ToLower(out[j].Name) })
+	return out
+}
+
+// get returns owner's playlist id, reading the playlists again if it is not
+// cached.
+func (s *playlistStore) get(owner, id string) (savedPlaylist, bool) {
+	doc := s.doc(owner)
+	lists, err := doc.get()
+	p := findPlaylist(lists, id)
+	if p == nil {
+		if lists, err = doc.refresh(); err != nil {
+			log.Printf("Playlist load error: %v", err)
+		}
+		p = findPlaylist(lists, id)
+	}
+	if p == nil {
+		return savedPlaylist{}, false
+	}
+	return p.clone(), true
+}
+
+func findPlaylist(lists []*savedPlaylist, id string) *savedPlaylist {
+	for _, p := range lists {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// create stores a new playlist for owner at version 1.
+func (s *playlistStore) create(owner, name string, tracks []string) (savedPlaylist, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return savedPlaylist{}, err
+	}
+	now := time.Now().UTC()
+	p := &savedPlaylist{ID: hex.EncodeToString(id), Name: name, Tracks: tracks, Version: 1, Created: now, Updated: now}
+	_, err := s.doc(owner).update(func(lists *[]*savedPlaylist) error {
+		*lists = append(*lists, p)
+		return nil
+	})
+	if err != nil {
+		return savedPlaylist{}, err
+	}
+	return p.clone(), nil
+}
+
+// update applies change to owner's playlist id if it is still at version.
+// On a version conflict the current playlist is returned with the error.
+func (s *playlistStore) update(owner, id string, version int, change func(*savedPlaylist) error) (savedPlaylist, error) {
+	var result savedPlaylist
+	_, err := s.doc(owner).update(func(lists *[]*savedPlaylist) error {
+		p := findPlaylist(*lists, id)
+		if p == nil {
+			return errPlaylistNotFound
+		}
+		result = p.clone()
+		if p.Version != version {
+			return errPlaylistConflict
+		}
+		if err := change(p); err != nil {
+			return err
+		}
+		p.Version++
+		p.Updated = time.Now().UTC()
+		result = p.clone()
+		return nil
+	})
+	return result, err
+}
+
+func (s *playlistStore) remove(owner, id string, version int) (savedPlaylist, error) {
+	var result savedPlaylist
+	_, err := s.doc(owner).update(func(lists *[]*savedPlaylist) error {
+		p := findPlaylist(*lists, id)
+		if p == nil {
+			return errPlaylistNotFound
+		}
+		result = p.clone()
+		if p.Version != version {
+			return errPlaylistConflict
+		}
+		*lists = slices.DeleteFunc(*lists, func(p *savedPlaylist) bool { return p.ID == id })
+		return nil
+	})
+	return result, err
+}
+
+// --- API functions ---
+
+// playlistRequest is the data of every playlist function; each uses the
+// fields it needs.
+type playlistRequest struct {
+	ID       string   `json:"id"`
+	Version  int      `json:"version"`
+	Name     string   `json:"name"`
+	Tracks   []string `json:"tracks"`
+	Position *int     `json:"position"`
+	Indexes  []int    `json:"indexes"`
+	From     int      `json:"from"`
+	To       int      `json:"to"`
+}
+
+type playlistSummary struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Count   int       `json:"count"`
+	Version int       `json:"version"`
+	Updated time.Time `json:"updated"`
+}
+
+func parsePlaylistRequest(c *gin.Context, raw string) (playlistRequest, bool) {
+	var req playlistRequest
+	if raw == "" {
+		return req, true
+	}
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid request"})
+		return req, false
+	}
+	return req, true
+}
+
+// playlistResult writes the outcome of a playlist change. Conflicts carry
+// the current playlist so the client can reload it.
+func playlistResult(c *gin.Context, p savedPlaylist, err error) {
+	var opErr playlistOpError
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "playlist": p})
+	case errors.Is(err, errPlaylistConflict):
+		c.JSON(http.StatusOK, gin.H{"status": "error", "code": "conflict", "message": "Playlist was changed elsewhere", "playlist": p})
+	case errors.Is(err, errPlaylistNotFound):
+		c.JSON(http.StatusOK, gin.H{"status": "error", "code": "notFound", "message": "Playlist not found"})
+	case errors.As(err, &opErr):
+		c.JSON(http.StatusOK, gin.H{"status": "error", "code": "invalid", "message": opErr.Error()})
+	default:
+		log.Printf("Playlist save error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to save playlist"})
+	}
+}
+
+func handleListPlaylists(c *gin.Context, _ string) {
+	list := []playlistSummary{}
+	for _, p := range savedPlaylists.list(currentUserName(c)) {
+		list = append(list, playlistSummary{ID: p.ID, Name: p.Name, Count: len(p.Tracks), Version: p.Version, Updated: p.Updated})
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "playlists": list})
+}
+
+// handleGetPlaylist returns a playlist. Tracks the user can no longer access
+// are left out but stay in the stored list.
+func handleGetPlaylist(c *gin.Context, raw string) {
+	req, ok := parsePlaylistRequest(c, raw)
+	if !ok {
+		return
+	}
+	p, found := savedPlaylists.get(currentUserName(c), req.ID)
+	if !found {
+		playlistResult(c, p, errPlaylistNotFound)
+		return
+	}
+	p.Tracks = accessFor(c).filterFiles(p.Tracks)
+	playlistResult(c, p, nil)
+}
+
+func handleCreatePlaylist(c *gin.Context, raw string) {
+	req, ok := parsePlaylistRequest(c, raw)
+	if !ok {
+		return
+	}
+	name, err := playlistTitle(req.Name)
+	if err != nil {
+		playlistResult(c, savedPlaylist{}, err)
+		return
+	}
+	tracks, err := playlistTracks(c, req.Tracks)
+	if err != nil {
+		playlistResult(c, savedPlaylist{}, err)
+		return
+	}
+	p, err := savedPlaylists.create(currentUserName(c), name, tracks)
+	playlistResult(c, p, err)
+}
+
+// handleDuplicatePlaylist copies a playlist, named "<name> (copy)" unless a
+// name is given.
+func handleDuplicatePlaylist(c *gin.Context, raw string) {
+	req, ok := parsePlaylistRequest(c, raw)
+	if !ok {
+		return
+	}
+	owner := currentUserName(c)
+	src, found := savedPlaylists.get(owner, req.ID)
+	if !found {
+		playlistResult(c, src, errPlaylistNotFound)
+		return
+	}
+	name, err := playlistTitle(playlistName(req.Name, src.Name+" (copy)"))
+	if err != nil {
+		playlistResult(c, savedPlaylist{}, err)
+		return
+	}
+	p, err := savedPlaylists.create(owner, name, src.Tracks)
+	playlistResult(c, p, err)
+}
+
+func handleDeletePlaylist(c *gin.Context, raw string) {
+	req, ok := parsePlaylistRequest(c, raw)
+	if !ok {
+		return
+	}
+	p, err := savedPlaylists.remove(currentUserName(c), req.ID, req.Version)
+	if err != nil {
+		playlistResult(c, p, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// playlistChange adapts a change to the API function signature.
+func playlistChange(change func(*gin.Context, playlistRequest, *savedPlaylist) error) func(*gin.Context, string) {
+	return func(c *gin.Context, raw string) {
+		req, ok := parsePlaylistRequest(c, raw)
+		if !ok {
+			return
+		}
+		p, err := savedPlaylists.update(currentUserName(c), req.ID, req.Version, func(p *savedPlaylist) error {
+			return change(c, req, p)
+		})
+		playlistResult(c, p, err)
+	}
+}
+
+func renamePlaylist(_ *gin.Context, req playlistRequest, p *savedPlaylist) error {
+	name, err := playlistTitle(req.Name)
+	p.Name = name
+	return err
+}
+
+func setPlaylistTracks(c *gin.Context, req playlistRequest, p *savedPlaylist) error {
+	tracks, err := playlistTracks(c, req.Tracks)
+	p.Tracks = tracks
+	return err
+}
+
+// addPlaylistTracks inserts tracks at position, or appends them.
+func addPlaylistTracks(c *gin.Context, req playlistRequest, p *savedPlaylist) error {
+	tracks, err := playlistTracks(c, req.Tracks)
+	if err != nil {
+		return err
+	}
+	if len(p.Tracks)+len(tracks) > MAX_PLAYLIST_TRACKS {
+		return playlistOpError(fmt.Sprintf("Playlists are limited to %d tracks", MAX_PLAYLIST_TRACKS))
+	}
+	pos := len(p.Tracks)
+	if vis := visibleTracks(c, p.Tracks); req.Position != nil && *req.Position >= 0 && *req.Position < len(vis) {
+		pos = vis[*req.Position]
+	}
+	p.Tracks = slices.Insert(p.Tracks, pos, tracks...)
+	return nil
+}
+
+// removePlaylistTracks removes tracks by index, so repeated tracks can be
+// removed individually.
+func removePlaylistTracks(c *gin.Context, req playlistRequest, p *savedPlaylist) error {
+	vis := visibleTracks(c, p.Tracks)
+	drop := make(map[int]bool, len(req.Indexes))
+	for _, i := range req.Indexes {
+		if i < 0 || i >= len(vis) {
+			return playlistOpError("Track index out of range")
+		}
+		drop[vis[i]] = true
+	}
+	kept := p.Tracks[:0]
+	for i, t := range p.Tracks {
+		if !drop[i] {
+			kept = append(kept, t)
+		}
+	}
+	p.Tracks = kept
+	return nil
+}
+
+// movePlaylistTrack moves the track at From to index To. Moving to the end
+// places the track after the last one the user can see.
+func movePlaylistTrack(c *gin.Context, req playlistRequest, p *savedPlaylist) error {
+	vis := visibleTracks(c, p.Tracks)
+	n := len(vis)
+	if req.From < 0 || req.From >= n || req.To < 0 || req.To >= n {
+		return playlistOpError("Track index out of range")
+	}
+	from := vis[req.From]
+	t := p.Tracks[from]
+	p.Tracks = slices.Delete(p.Tracks, from, from+1)
+	to := from
+	if vis = visibleTracks(c, p.Tracks); req.To < len(vis) {
+		to = vis[req.To]
+	} else if len(vis) > 0 {
+		to = vis[len(vis)-1] + 1
+	}
+	p.Tracks = slices.Insert(p.Tracks, to, t)
+	return nil
+}
+
+// visibleTracks returns the stored index of each track the user can access.
+// Clients see only those tracks, so their indexes are positions in this list.
+func visibleTracks(c *gin.Context, tracks []string) []int {
+	access := accessFor(c)
+	vis := make([]int, 0, len(tracks))
+	for i, t := range tracks {
+		if access.allowed(t) {
+			vis = append(vis, i)
+		}
+	}
+	return vis
+}
+
+func playlistTitle(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > MAX_PLAYLIST_NAME {
+		return "", playlistOpError(fmt.Sprintf("Playlist names must be 1 to %d characters", MAX_PLAYLIST_NAME))
+	}
+	return name, nil
+}
+
+// playlistTracks keeps the library audio files the user may access.
+func playlistTracks(c *gin.Context, tracks []string) ([]string, error) {
+	if len(tracks) > MAX_PLAYLIST_TRACKS {
+		return nil, playlistOpError(fmt.Sprintf("Playlists are limited to %d tracks", MAX_PLAYLIST_TRACKS))
+	}
+	out := make([]string, 0, len(tracks))
+	for _, t := range tracks {
+		if key, ok := cleanKey(t); ok && isAudioFile(key) {
+			out = append(out, key)
+		}
+	}
+	return accessFor(c).filterFiles(out), nil
+}
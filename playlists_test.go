@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testPlaylist struct {
+	Status   string        `json:"status"`
+	Code     string        `json:"code"`
+	Message  string        `json:"message"`
+	Playlist savedPlaylist `json:"playlist"`
+}
+
+// withSavedPlaylists gives a test its own playlist store
+func withSavedPlaylists(t *testing.T) {
+	t.Helper()
+	origPlaylists := savedPlaylists
+	t.Cleanup(func() { savedPlaylists = origPlaylists })
+	savedPlaylists = newPlaylistStore()
+	withStateDir(t)
+}
+
+func playlistAPI(t *testing.T, user, function, data string) testPlaylist {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"function": function, "data": data})
+	req := httptest.NewRequest("POST", "/api", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if user != "" {
+		req.SetBasicAuth(user, "sesame")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var resp testPlaylist
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func playlistData(fields map[string]any) string {
+	b, _ := json.Marshal(fields)
+	return string(b)
+}
+
+// TestSavedPlaylists checks playlist editing, versioning and persistence
+func TestSavedPlaylists(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	origLocalMusicDir := localMusicDir
+	defer func() { localMusicDir = origLocalMusicDir }()
+	localMusicDir = tmpDir
+	withSavedPlaylists(t)
+
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3"} {
+		os.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0644)
+	}
+
+	resp := playlistAPI(t, "", "createPlaylist", `{"name":" Mix ","tracks":["a.mp3","b.mp3","../x.mp3","notes.txt"]}`)
+	assert.Equal(t, "ok", resp.Status)
+	assert.Equal(t, "Mix", resp.Playlist.Name)
+	assert.Equal(t, []string{"a.mp3", "b.mp3"}, resp.Playlist.Tracks)
+	assert.Equal(t, 1, resp.Playlist.Version)
+	id := resp.Playlist.ID
+
+	t.Run("Edits", func(t *testing.T) {
+		pos := 1
+		resp := playlistAPI(t, "", "addPlaylistTracks", playlistData(map[string]any{"id": id, "version": 1, "tracks": []string{"c.mp3", "d.mp3"}, "position": pos}))
+		assert.Equal(t, []string{"a.mp3", "c.mp3", "d.mp3", "b.mp3"}, resp.Playlist.Tracks)
+		assert.Equal(t, 2, resp.Playlist.Version)
+
+		resp = playlistAPI(t, "", "movePlaylistTrack", playlistData(map[string]any{"id": id, "version": 2, "from": 3, "to": 0}))
+		assert.Equal(t, []string{"b.mp3", "a.mp3", "c.mp3", "d.mp3"}, resp.Playlist.Tracks)
+
+		resp = playlistAPI(t, "", "removePlaylistTracks", playlistData(map[string]any{"id": id, "version": 3, "indexes": []int{0, 2}}))
+		assert.Equal(t, []string{"a.mp3", "d.mp3"}, resp.Playlist.Tracks)
+
+		resp = playlistAPI(t, "", "removePlaylistTracks", playlistData(map[string]any{"id": id, "version": 4, "indexes": []int{5}}))
+		assert.Equal(t, "invalid", resp.Code)
+
+		resp = playlistAPI(t, "", "renamePlaylist", playlistData(map[string]any{"id": id, "version": 4, "name": "Road trip"}))
+		assert.Equal(t, "Road trip", resp.Playlist.Name)
+		assert.Equal(t, 5, resp.Playlist.Version)
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		resp := playlistAPI(t, "", "setPlaylistTracks", playlistData(map[string]any{"id": id, "version": 2, "tracks": []string{"c.mp3"}}))
+		assert.Equal(t, "conflict", resp.Code)
+		assert.Equal(t, 5, resp.Playlist.Version, "the current playlist is returned")
+		assert.Equal(t, []string{"a.mp3", "d.mp3"}, resp.Playlist.Tracks)
+	})
+
+	t.Run("Duplicate, list and persist", func(t *testing.T) {
+		resp := playlistAPI(t, "", "duplicatePlaylist", playlistData(map[string]any{"id": id}))
+		assert.Equal(t, "Road trip (copy)", resp.Playlist.Name)
+		assert.Equal(t, 1, resp.Playlist.Version)
+		assert.NotEqual(t, id, resp.Playlist.ID)
+
+		assert.Len(t, savedPlaylists.list(""), 2)
+		reloaded := savedPlaylists
+		savedPlaylists = newPlaylistStore()
+		p, ok := savedPlaylists.get("", id)
+		assert.True(t, ok, "playlists persist in the state store")
+		assert.Equal(t, []string{"a.mp3", "d.mp3"}, p.Tracks)
+		savedPlaylists = reloaded
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.Equal(t, "conflict", playlistAPI(t, "", "deletePlaylist", playlistData(map[string]any{"id": id, "version": 1})).Code)
+		assert.Equal(t, "ok", playlistAPI(t, "", "deletePlaylist", playlistData(map[string]any{"id": id, "version": 5})).Status)
+		assert.Equal(t, "notFound", playlistAPI(t, "", "getPlaylist", playlistData(map[string]any{"id": id})).Code)
+	})
+}
+
+// TestSavedPlaylistOwners checks that playlists are private to their owner
+func TestSavedPlaylistOwners(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	origLocalMusicDir := localMusicDir
+	defer func() { localMusicDir = origLocalMusicDir }()
+	localMusicDir = tmpDir
+	withSavedPlaylists(t)
+
+	os.MkdirAll(filepath.Join(tmpDir, "Private"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Private", "a.mp3"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "b.mp3"), []byte("b"), 0644)
+	withAuthUsers(t, map[string]*authUser{
+		"alice": {Password: bcryptHash(t, "sesame")},
+		"bob":   {Password: bcryptHash(t, "sesame")},
+	})
+	withACLRules(t, `[{"path":"Private/","allow":["alice"]}]`)
+
+	resp := playlistAPI(t, "bob", "createPlaylist", `{"name":"Bob","tracks":["Private/a.mp3","b.mp3"]}`)
+	assert.Equal(t, []string{"b.mp3"}, resp.Playlist.Tracks, "inaccessible tracks are dropped")
+
+	id := resp.Playlist.ID
+	assert.Equal(t, "notFound", playlistAPI(t, "alice", "getPlaylist", playlistData(map[string]any{"id": id})).Code)
+	assert.Equal(t, "notFound", playlistAPI(t, "alice", "deletePlaylist", playlistData(map[string]any{"id": id, "version": 1})).Code)
+	assert.Empty(t, savedPlaylists.list("alice"))
+	assert.Len(t, savedPlaylists.list("bob"), 1)
+}
+
+// TestSavedPlaylistHiddenTracks checks that edit indexes refer to the tracks
+// the user can see, not to the stored list
+func TestSavedPlaylistHiddenTracks(t *testing.T) {
+	withSavedPlaylists(t)
+	withAuthUsers(t, map[string]*authUser{"alice": {Password: bcryptHash(t, "sesame")}})
+
+	resp := playlistAPI(t, "alice", "createPlaylist", `{"name":"Mixed","tracks":["a.mp3","Private/p.mp3","b.mp3","c.mp3"]}`)
+	assert.Equal(t, "ok", resp.Status)
+	id := resp.Playlist.ID
+	withACLRules(t, `[{"path":"Private/","allow":["carol"]}]`)
+	assert.Equal(t, []string{"a.mp3", "b.mp3", "c.mp3"}, playlistAPI(t, "alice", "getPlaylist", playlistData(map[string]any{"id": id})).Playlist.Tracks)
+
+	stored := func() []string {
+		p, _ := savedPlaylists.get("alice", id)
+		return p.Tracks
+	}
+	resp = playlistAPI(t, "alice", "removePlaylistTracks", playlistData(map[string]any{"id": id, "version": 1, "indexes": []int{1}}))
+	assert.Equal(t, "ok", resp.Status)
+	assert.Equal(t, []string{"a.mp3", "Private/p.mp3", "c.mp3"}, stored(), "the second visible track is removed")
+
+	resp = playlistAPI(t, "alice", "movePlaylistTrack", playlistData(map[string]any{"id": id, "version": 2, "from": 0, "to": 1}))
+	assert.Equal(t, "ok", resp.Status)
+	assert.Equal(t, []string{"Private/p.mp3", "c.mp3", "a.mp3"}, stored())
+
+	resp = playlistAPI(t, "alice", "addPlaylistTracks", playlistData(map[string]any{"id": id, "version": 3, "tracks": []string{"d.mp3"}, "position": 1}))
+	assert.Equal(t, "ok", resp.Status)
+	assert.Equal(t, []string{"Private/p.mp3", "c.mp3", "d.mp3", "a.mp3"}, stored())
+
+	resp = playlistAPI(t, "alice", "removePlaylistTracks", playlistData(map[string]any{"id": id, "version": 4, "indexes": []int{3}}))
+	assert.Equal(t, "invalid", resp.Code, "indexes past the visible tracks are refused")
+	assert.Equal(t, []string{"c.mp3", "d.mp3", "a.mp3"}, playlistAPI(t, "alice", "getPlaylist", playlistData(map[string]any{"id": id})).Playlist.Tracks)
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MAX_PREVIEW_SECONDS = 30
+	MAX_PREVIEW_START   = 24 * 60 * 60 // later starts are out of range for any track
+	TXT_PREVIEW_FORMAT  = "Preview is only available for MP3 and WAV files."
+)
+
+// errClipOutOfRange is returned when the requested start lies beyond the end
+// of the track.
+var errClipOutOfRange = errors.New("clip start is beyond the end of the track")
+
+// previewHandler serves a short clip of a track at /preview/*path?start=&length=.
+// MP3 clips are cut on frame boundaries and WAV clips get a rewritten header,
+// so neither format is re-encoded. Clips are capped at MAX_PREVIEW_SECONDS so
+// the endpoint never hands out the full file.
+func previewHandler(c *gin.Context) {
+	key, ok := cleanKey(c.Param("path"))
+	if !ok {
+		c.String(http.StatusBadRequest, "Invalid path")
+		return
+	}
+	start, length, ok := previewRange(c)
+	if !ok {
+		return
+	}
+
+	ext := strings.ToLower(filepath.Ext(key))
+	if ext != ".mp3" && ext != ".wav" {
+		c.String(http.StatusUnsupportedMediaType, TXT_PREVIEW_FORMAT)
+		return
+	}
+
+	if aclDenied(c, key) {
+		return
+	}
+	obj, ok := openAudioForRequest(c, key)
+	if !ok {
+		return
+	}
+	defer func() { _ = obj.Close() }()
+
+	// Clips may sit behind sign-in, access rules or a share, so only the
+	// client may cache them.
+	c.Header("Cache-Control", "private, max-age=3600")
+	if ext == ".wav" {
+		serveWAVPreview(c, key, obj, start, length)
+		return
+	}
+	serveMP3Preview(c, key, obj, start, length)
+}
+
+// previewRange reads the start and length query parameters, writing a 400
+// response when they are invalid.
+func previewRange(c *gin.Context) (float64, float64, bool) {
+	start, err := parseSecondsParam(c.Query("start"), 0)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid start")
+		return 0, 0, false
+	}
+	length, err := parseSecondsParam(c.Query("length"), MAX_PREVIEW_SECONDS)
+	if err != nil || length == 0 {
+		c.String(http.StatusBadRequest, "Invalid length")
+		return 0, 0, false
+	}
+	// Bounded values keep the byte offsets computed from them in range.
+	return min(start, MAX_PREVIEW_START), min(length, MAX_PREVIEW_SECONDS), true
+}
+
+func serveWAVPreview(c *gin.Context, key string, r io.Reader, start, length float64) {
+	header, body, err := wavClip(r, start, length)
+	if err != nil {
+		previewError(c, key, err)
+		return
+	}
+	c.Header("Content-Length", strconv.FormatInt(int64(len(header))+body.N, 10))
+	c.Header("Content-Type", "audio/wav")
+	c.Status(http.StatusOK)
+	if _, err := c.Writer.Write(header); err != nil {
+		return
+	}
+	_, _ = io.Copy(c.Writer, body)
+}
+
+func serveMP3Preview(c *gin.Context, key string, r io.Reader, start, length float64) {
+	if err := mp3Clip(&mp3PreviewWriter{c: c}, r, start, length); err != nil {
+		if !c.Writer.Written() {
+			previewError(c, key, err)
+			return
+		}
+		log.Printf("Preview stream error for key [%s]: %v", key, err)
+	}
+}
+
+// mp3PreviewWriter sets the audio content type with the first frame, so
+// errors found before any audio is written are served as text.
+type mp3PreviewWriter struct {
+	c       *gin.Context
+	started bool
+}
+
+func (w *mp3PreviewWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.c.Header("Content-Type", "audio/mpeg")
+	}
+	return w.c.Writer.Write(p)
+}
+
+func previewError(c *gin.Context, key string, err error) {
+	if errors.Is(err, errClipOutOfRange) {
+		c.String(http.StatusRequestedRangeNotSatisfiable, "Start is beyond the end of the track")
+		return
+	}
+	log.Printf("Preview error for key [%s]: %v", key, err)
+	c.String(http.StatusUnprocessableEntity, "Unable to read audio file")
+}
+
+// parseSecondsParam parses a finite, non-negative number of seconds,
+// returning def when the parameter is absent.
+func parseSecondsParam(raw string, def float64) (float64, error) {
+	if raw == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid seconds value %q", raw)
+	}
+	return v, nil
+}
+
+// --- MP3 ---
+
+var (
+	mp3BitratesV1 = [3][16]int{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0}, // Layer I
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},    // Layer II
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},     // Layer III
+	}
+	mp3BitratesV2 = [3][16]int{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0}, // Layer I
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},      // Layer II
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},      // Layer III
+	}
+	mp3SampleRates = map[byte][3]int{
+		3: {44100, 48000, 32000}, // MPEG 1
+		2: {22050, 24000, 16000}, // MPEG 2
+		0: {11025, 12000, 8000},  // MPEG 2.5
+	}
+)
+
+// mp3Frame describes a single MPEG audio frame header.
+type mp3Frame struct {
+	Size       int     // frame length in bytes, header included
+	Duration   float64 // playback time in seconds
+	Bitrate    int     // kbit/s
+	SampleRate int
+}
+
+// parseMP3Header decodes the 4-byte frame header at the start of b.
+func parseMP3Header(b []byte) (mp3Frame, bool) {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return mp3Frame{}, false
+	}
+	version := (b[1] >> 3) & 0x03
+	layer := (b[1] >> 1) & 0x03
+	bitrateIdx := b[2] >> 4
+	rateIdx := (b[2] >> 2) & 0x03
+	padding := int((b[2] >> 1) & 0x01)
+	rates, ok := mp3SampleRates[version]
+	if !ok || layer == 0 || rateIdx == 3 {
+		return mp3Frame{}, false
+	}
+
+	layerIdx := 3 - int(layer) // 0 = Layer I, 1 = Layer II, 2 = Layer III
+	bitrate := mp3BitratesV1[layerIdx][bitrateIdx]
+	if version != 3 {
+		bitrate = mp3BitratesV2[layerIdx][bitrateIdx]
+	}
+	if bitrate == 0 {
+		return mp3Frame{}, false
+	}
+	sampleRate := rates[rateIdx]
+
+	var size, samples int
+	switch {
+	case layerIdx == 0:
+		size = (12*bitrate*1000/sampleRate + padding) * 4
+		samples = 384
+	case layerIdx == 2 && version != 3:
+		size = 72*bitrate*1000/sampleRate + padding
+		samples = 576
+	default:
+		size = 144*bitrate*1000/sampleRate + padding
+		samples = 1152
+	}
+	return mp3Frame{
+		Size:       size,
+		Duration:   float64(samples) / float64(sampleRate),
+		Bitrate:    bitrate,
+		SampleRate: sampleRate,
+	}, true
+}
+
+// skipID3v2 discards a leading ID3v2 tag, if present.
+func skipID3v2(br *bufio.Reader) error {
+	hdr, err := br.Peek(10)
+	if err != nil || string(hdr[:3]) != "ID3" {
+		return nil
+	}
+	size := int64(hdr[6]&0x7F)<<21 | int64(hdr[7]&0x7F)<<14 | int64(hdr[8]&0x7F)<<7 | int64(hdr[9]&0x7F)
+	size += 10
+	if hdr[5]&0x10 != 0 {
+		size += 10 // footer present
+	}
+	_, err = io.CopyN(io.Discard, br, size)
+	return err
+}
+
+// mp3FrameReader walks the MPEG frames of a stream, resynchronising past
+// tags and garbage between frames.
+type mp3FrameReader struct {
+	br    *bufio.Reader
+	first bool
+}
+
+func newMP3FrameReader(r io.Reader) (*mp3FrameReader, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	if err := skipID3v2(br); err != nil {
+		return nil, err
+	}
+	return &mp3FrameReader{br: br, first: true}, nil
+}
+
+// Next returns the next audio frame. Xing/Info/VBRI header frames are
+// skipped because their totals would not describe a cut stream. The returned
+// slice is only valid until the following call. io.EOF marks the end.
+func (fr *mp3FrameReader) Next() ([]byte, mp3Frame, error) {
+	for {
+		hdr, err := fr.br.Peek(4)
+		if err != nil {
+			return nil, mp3Frame{}, io.EOF
+		}
+		frame, ok := parseMP3Header(hdr)
+		if !ok {
+			if _, err := fr.br.Discard(1); err != nil {
+				return nil, mp3Frame{}, io.EOF
+			}
+			continue
+		}
+		data, err := fr.br.Peek(frame.Size)
+		if err != nil {
+			// Truncated final frame
+			return nil, mp3Frame{}, io.EOF
+		}
+		if _, err := fr.br.Discard(frame.Size); err != nil {
+			return nil, mp3Frame{}, err
+		}
+		if fr.first {
+			fr.first = false
+			if isVBRHeaderFrame(data) {
+				continue
+			}
+		}
+		return data, frame, nil
+	}
+}
+
+func isVBRHeaderFrame(data []byte) bool {
+	n := len(data)
+	if n > 64 {
+		n = 64
+	}
+	head := data[:n]
+	return bytes.Contains(head, []byte("Xing")) || bytes.Contains(head, []byte("Info")) || bytes.Contains(head, []byte("VBRI"))
+}
+
+// mp3Clip copies the frames of r that start within [start, start+length)
+// seconds to w.
+func mp3Clip(w io.Writer, r io.Reader, start, length float64) error {
+	fr, err := newMP3FrameReader(r)
+	if err != nil {
+		return err
+	}
+	end := start + length
+	pos := 0.0
+	written := 0
+	for pos < end {
+		data, frame, err := fr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if pos >= start {
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			written++
+		}
+		pos += frame.Duration
+	}
+	if written == 0 {
+		return errClipOutOfRange
+	}
+	return nil
+}
+
+// --- WAV ---
+
+// wavClip reads the RIFF header from r and positions the stream at start
+// seconds into the sample data. It returns a rewritten header describing a
+// clip of at most length seconds and a reader limited to that clip's data.
+func wavClip(r io.Reader, start, length float64) ([]byte, *io.LimitedReader, error) {
+	br := bufio.NewReader(r)
+	var riff [12]byte
+	if _, err := io.ReadFull(br, riff[:]); err != nil {
+		return nil, nil, err
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, nil, fmt.Errorf("not a RIFF/WAVE file")
+	}
+
+	var fmtChunk []byte
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(br, chunk[:]); err != nil {
+			return nil, nil, fmt.Errorf("missing data chunk: %w", err)
+		}
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		if id == "data" {
+			if fmtChunk == nil {
+				return nil, nil, fmt.Errorf("data chunk before fmt chunk")
+			}
+			return wavClipData(br, fmtChunk, size, start, length)
+		}
+		padded := size + size%2
+		if id == "fmt " {
+			if size < 16 || size > 1024 {
+				return nil, nil, fmt.Errorf("invalid fmt chunk size %d", size)
+			}
+			fmtChunk = make([]byte, padded)
+			if _, err := io.ReadFull(br, fmtChunk); err != nil {
+				return nil, nil, err
+			}
+			fmtChunk = fmtChunk[:size]
+			continue
+		}
+		if _, err := io.CopyN(io.Discard, br, padded); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func wavClipData(r io.Reader, fmtChunk []byte, dataSize int64, start, length float64) ([]byte, *io.LimitedReader, error) {
+	byteRate := int64(binary.LittleEndian.Uint32(fmtChunk[8:12]))
+	blockAlign := int64(binary.LittleEndian.Uint16(fmtChunk[12:14]))
+	if byteRate == 0 || blockAlign == 0 {
+		return nil, nil, fmt.Errorf("invalid fmt chunk")
+	}
+
+	offset := int64(start*float64(byteRate)) / blockAlign * blockAlign
+	if offset >= dataSize {
+		return nil, nil, errClipOutOfRange
+	}
+	clipSize := int64(length*float64(byteRate)) / blockAlign * blockAlign
+	if clipSize > dataSize-offset {
+		clipSize = dataSize - offset
+	}
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+		return nil, nil, err
+	}
+
+	fmtPadded := int64(len(fmtChunk) + len(fmtChunk)%2)
+	var hdr bytes.Buffer
+	hdr.WriteString("RIFF")
+	_ = binary.Write(&hdr, binary.LittleEndian, uint32(4+8+fmtPadded+8+clipSize))
+	hdr.WriteString("WAVEfmt ")
+	_ = binary.Write(&hdr, binary.LittleEndian, uint32(len(fmtChunk)))
+	hdr.Write(fmtChunk)
+	if len(fmtChunk)%2 == 1 {
+		hdr.WriteByte(0)
+	}
+	hdr.WriteString("data")
+	_ = binary.Write(&hdr, binary.LittleEndian, uint32(clipSize))
+	return hdr.Bytes(), &io.LimitedReader{R: r, N: clipSize}, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// testMP3FrameSize is the size of an MPEG-1 Layer III, 128 kbit/s, 44.1 kHz
+// frame without padding.
+const testMP3FrameSize = 417
+
+// testMP3 builds an MP3 stream of n silent frames, prefixed with an ID3v2 tag.
+func testMP3(n int) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, 20})
+	buf.Write(make([]byte, 20))
+	frame := make([]byte, testMP3FrameSize)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+	for i := 0; i < n; i++ {
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+// testWAV builds a mono 16-bit 8 kHz WAV file of the given duration.
+func testWAV(seconds int) []byte {
+	dataSize := seconds * 16000
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+dataSize))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))
+	binary.Write(&buf, binary.LittleEndian, uint16(1))     // PCM
+	binary.Write(&buf, binary.LittleEndian, uint16(1))     // channels
+	binary.Write(&buf, binary.LittleEndian, uint32(8000))  // sample rate
+	binary.Write(&buf, binary.LittleEndian, uint32(16000)) // byte rate
+	binary.Write(&buf, binary.LittleEndian, uint16(2))     // block align
+	binary.Write(&buf, binary.LittleEndian, uint16(16))    // bits per sample
+	buf.WriteString("LIST")
+	binary.Write(&buf, binary.LittleEndian, uint32(3))
+	buf.Write([]byte{1, 2, 3, 0}) // odd-sized chunk with pad byte
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(dataSize))
+	buf.Write(make([]byte, dataSize))
+	return buf.Bytes()
+}
+
+// TestParseMP3Header checks frame size and duration for common header types
+func TestParseMP3Header(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   []byte
+		ok       bool
+		size     int
+		duration float64
+	}{
+		{"MPEG1 L3 128k 44.1k", []byte{0xFF, 0xFB, 0x90, 0x00}, true, 417, 1152.0 / 44100},
+		{"MPEG1 L3 128k 44.1k padded", []byte{0xFF, 0xFB, 0x92, 0x00}, true, 418, 1152.0 / 44100},
+		{"MPEG2 L3 64k 22.05k", []byte{0xFF, 0xF3, 0x80, 0x00}, true, 208, 576.0 / 22050},
+		{"Bad sync", []byte{0xFF, 0x0B, 0x90, 0x00}, false, 0, 0},
+		{"Free bitrate", []byte{0xFF, 0xFB, 0x00, 0x00}, false, 0, 0},
+		{"Reserved sample rate", []byte{0xFF, 0xFB, 0x9C, 0x00}, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, ok := parseMP3Header(tt.header)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.size, frame.Size)
+			assert.InDelta(t, tt.duration, frame.Duration, 1e-9)
+		})
+	}
+}
+
+// TestPreviewHandler exercises MP3 and WAV clipping through the router
+func TestPreviewHandler(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origLocalMusicDir := localMusicDir
+	defer func() {
+		localMusicDir = origLocalMusicDir
+	}()
+	localMusicDir = tmpDir
+
+	os.MkdirAll(filepath.Join(tmpDir, "Album"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Album", "song.mp3"), testMP3(2000), 0644) // ~52s
+	os.WriteFile(filepath.Join(tmpDir, "Album", "tone.wav"), testWAV(10), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Album", "track.ogg"), []byte("OggS"), 0644)
+
+	gin.SetMode(gin.TestMode)
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	t.Run("MP3 clip is cut on frame boundaries", func(t *testing.T) {
+		w := get("/preview/Album/song.mp3?start=10&length=5")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "audio/mpeg", w.Header().Get("Content-Type"))
+		assert.Equal(t, "private, max-age=3600", w.Header().Get("Cache-Control"))
+		body := w.Body.Bytes()
+		assert.Equal(t, 0, len(body)%testMP3FrameSize)
+		assert.Equal(t, []byte{0xFF, 0xFB}, body[:2])
+		seconds := float64(len(body)/testMP3FrameSize) * 1152 / 44100
+		assert.InDelta(t, 5.0, seconds, 0.05)
+	})
+
+	t.Run("MP3 clip length is capped", func(t *testing.T) {
+		w := get("/preview/Album/song.mp3?length=600")
+		assert.Equal(t, http.StatusOK, w.Code)
+		seconds := float64(w.Body.Len()/testMP3FrameSize) * 1152 / 44100
+		assert.InDelta(t, float64(MAX_PREVIEW_SECONDS), seconds, 0.05)
+	})
+
+	t.Run("MP3 start beyond end", func(t *testing.T) {
+		w := get("/preview/Album/song.mp3?start=300")
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+		assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	})
+
+	t.Run("WAV clip gets a rewritten header", func(t *testing.T) {
+		w := get("/preview/Album/tone.wav?start=2&length=3")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "audio/wav", w.Header().Get("Content-Type"))
+		body := w.Body.Bytes()
+		assert.Equal(t, 44+48000, len(body))
+		assert.Equal(t, "RIFF", string(body[0:4]))
+		assert.Equal(t, uint32(len(body)-8), binary.LittleEndian.Uint32(body[4:8]))
+		assert.Equal(t, "data", string(body[36:40]))
+		assert.Equal(t, uint32(48000), binary.LittleEndian.Uint32(body[40:44]))
+	})
+
+	t.Run("WAV clip is truncated at end of data", func(t *testing.T) {
+		w := get("/preview/Album/tone.wav?start=8")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 44+32000, w.Body.Len())
+	})
+
+	t.Run("Unsupported format", func(t *testing.T) {
+		w := get("/preview/Album/track.ogg")
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		w := get("/preview/Album/missing.mp3")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Directory traversal", func(t *testing.T) {
+		w := get("/preview/Album/../../etc/passwd.mp3")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Invalid start", func(t *testing.T) {
+		w := get("/preview/Album/song.mp3?start=abc")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		for _, q := range []string{"start=Inf", "start=NaN", "length=%2BInf"} {
+			assert.Equal(t, http.StatusBadRequest, get("/preview/Album/tone.wav?"+q).Code, q)
+		}
+	})
+
+	t.Run("Huge start and length", func(t *testing.T) {
+		w := get("/preview/Album/tone.wav?start=1e300")
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+		w = get("/preview/Album/tone.wav?start=2&length=1e300")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, strconv.Itoa(w.Body.Len()), w.Header().Get("Content-Length"))
+	})
+}
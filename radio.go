@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// RADIO_LISTENER_QUEUE is how many frames may be pending for a listener
+	// before it is considered too slow and disconnected (~13s at 44.1kHz).
+	RADIO_LISTENER_QUEUE = 512
+	// RADIO_BURST_BYTES of recent audio are sent to new listeners so players
+	// can fill their buffer without waiting in real time.
+	RADIO_BURST_BYTES = 64 * 1024
+	// RADIO_RETRY_DELAY is the pause after a pass that played nothing, e.g.
+	// an empty folder, so a broken station does not spin.
+	RADIO_RETRY_DELAY = 10 * time.Second
+	// MAX_ICY_METADATA is the largest metadata block the length byte allows.
+	MAX_ICY_METADATA = 255 * 16
+)
+
+// radioMetaInt is the number of audio bytes between ICY metadata blocks.
+var radioMetaInt = 16000
+
+// radioStations holds the configured stations by id (RADIO_STATIONS).
+var radioStations = map[string]*radioStation{}
+
+// radioStationConfig describes where a station takes its tracks from. Exactly
+// one of Dir, Search and Playlist is set.
+type radioStationConfig struct {
+	Name     string `json:"name"`
+	Dir      string `json:"dir"`
+	Search   string `json:"search"`
+	Playlist string `json:"playlist"` // library .m3u/.m3u8 file
+	Shuffle  bool   `json:"shuffle"`
+}
+
+// radioChunk is one MP3 frame and the title of the track it belongs to.
+type radioChunk struct {
+	data  []byte
+	title string
+}
+
+type radioListener struct {
+	ch chan radioChunk
+}
+
+// radioStation is a shared, real-time broadcast. Playback starts when the
+// first listener connects and stops when the last one leaves, so every
+// listener hears the same position.
+type radioStation struct {
+	id  string
+	cfg radioStationConfig
+
+	mu        sync.Mutex
+	listeners map[*radioListener]struct{}
+	cancel    context.CancelFunc
+	gen       int // incremented per playback run so stale runs are ignored
+	burst     []radioChunk
+	burstSize int
+	title     string
+}
+
+func newRadioStation(id string, cfg radioStationConfig) *radioStation {
+	if cfg.Name == "" {
+		cfg.Name = id
+	}
+	return &radioStation{id: id, cfg: cfg, listeners: make(map[*radioListener]struct{})}
+}
+
+// initRadio loads stations from RADIO_STATIONS, which is either inline JSON
+// or the path of a JSON file:
+//
+//	{"office": {"name": "Office", "dir": "Chill/", "shuffle": true},
+//	 "jazz":   {"search": "jazz"},
+//	 "best":   {"playlist": "Lists/best.m3u"}}
+func initRadio() error {
+	raw := strings.TrimSpace(os.Getenv("RADIO_STATIONS"))
+	if raw == "" {
+		return nil
+	}
+	if !strings.HasPrefix(raw, "{") {
+		b, err := os.ReadFile(raw)
+		if err != nil {
+			return fmt.Errorf("read RADIO_STATIONS: %w", err)
+		}
+		raw = string(b)
+	}
+	stations, err := parseRadioStations([]byte(raw))
+	if err != nil {
+		return err
+	}
+	radioStations = stations
+	log.Printf("Radio stations configured: %d", len(stations))
+	return nil
+}
+
+func parseRadioStations(b []byte) (map[string]*radioStation, error) {
+	var cfgs map[string]radioStationConfig
+	if err := json.Unmarshal(b, &cfgs); err != nil {
+		return nil, fmt.Errorf("parse RADIO_STATIONS: %w", err)
+	}
+	stations := make(map[string]*radioStation, len(cfgs))
+	for id, cfg := range cfgs {
+		sources := 0
+		for _, s := range []string{cfg.Dir, cfg.Search, cfg.Playlist} {
+			if s != "" {
+				sources++
+			}
+		}
+		if sources != 1 || id == "" || strings.ContainsAny(id, "/.") {
+			return nil, fmt.Errorf("radio station %q needs a plain id and exactly one of dir, search or playlist", id)
+		}
+		stations[id] = newRadioStation(id, cfg)
+	}
+	return stations, nil
+}
+
+// radioListHandler lists the configured stations with their stream URLs.
+func radioListHandler(c *gin.Context) {
+	ids := make([]string, 0, len(radioStations))
+	for id := range radioStations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	base := requestBaseURL(c)
+	stations := make([]gin.H, 0, len(ids))
+	for _, id := range ids {
+		st := radioStations[id]
+		listeners, title := st.status()
+		stations = append(stations, gin.H{
+			"id":         id,
+			"name":       st.cfg.Name,
+			"url":        base + "/radio/" + id,
+			"listeners":  listeners,
+			"nowPlaying": title,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"stations": stations})
+}
+
+// radioHandler streams a station as an endless MP3 stream. Clients that send
+// "Icy-MetaData: 1" receive StreamTitle metadata every icy-metaint bytes.
+func radioHandler(c *gin.Context) {
+	id := strings.TrimSuffix(c.Param("station"), ".mp3")
+	st, ok := radioStations[id]
+	if !ok {
+		c.String(http.StatusNotFound, "Station not found")
+		return
+	}
+
+	metaint := 0
+	if c.GetHeader("Icy-MetaData") == "1" {
+		metaint = radioMetaInt
+		c.Header("icy-metaint", strconv.Itoa(metaint))
+	}
+	c.Header("Content-Type", "audio/mpeg")
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Header("icy-name", st.cfg.Name)
+	c.Header("icy-pub", "0")
+	c.Status(http.StatusOK)
+	if c.Request.Method == http.MethodHead {
+		return
+	}
+	c.Writer.Flush()
+
+	l := st.join()
+	defer st.leave(l)
+	iw := &icyWriter{w: c.Writer, metaint: metaint, left: metaint}
+	ctx := c.Request.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case chunk, ok := <-l.ch:
+			if !ok {
+				return // dropped as too slow
+			}
+			if err := iw.write(chunk.data, chunk.title); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// join registers a listener, primes it with the burst buffer and starts
+// playback if the station is idle.
+func (st *radioStation) join() *radioListener {
+	l := &radioListener{ch: make(chan radioChunk, RADIO_LISTENER_QUEUE)}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, chunk := range st.burst {
+		select {
+		case l.ch <- chunk:
+		default: // burst larger than the queue; the rest arrives live
+		}
+	}
+	st.listeners[l] = struct{}{}
+	if st.cancel == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		st.cancel = cancel
+		st.gen++
+		st.burst, st.burstSize = nil, 0
+		go st.run(ctx, st.gen)
+	}
+	return l
+}
+
+// leave removes a listener and stops playback once nobody is listening.
+func (st *radioStation) leave(l *radioListener) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.listeners, l)
+	if len(st.listeners) == 0 && st.cancel != nil {
+		st.cancel()
+		st.cancel = nil
+	}
+}
+
+// status returns the listener count and the title currently on air.
+func (st *radioStation) status() (int, string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.cancel == nil {
+		return 0, ""
+	}
+	return len(st.listeners), st.title
+}
+
+// broadcast hands a frame to every listener without blocking; listeners
+// whose queue is full are disconnected.
+func (st *radioStation) broadcast(gen int, chunk radioChunk) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if gen != st.gen {
+		return
+	}
+	st.title = chunk.title
+	st.burst = append(st.burst, chunk)
+	st.burstSize += len(chunk.data)
+	for st.burstSize > RADIO_BURST_BYTES {
+		st.burstSize -= len(st.burst[0].data)
+		st.burst = st.burst[1:]
+	}
+	for l := range st.listeners {
+		select {
+		case l.ch <- chunk:
+		default:
+			log.Printf("Radio [%s]: dropping slow listener", st.id)
+			close(l.ch)
+			delete(st.listeners, l)
+		}
+	}
+	if len(st.listeners) == 0 && st.cancel != nil {
+		st.cancel()
+		st.cancel = nil
+	}
+}
+
+// run plays the station's tracks in a loop, pacing frames by their duration
+// so the stream runs in real time.
+func (st *radioStation) run(ctx context.Context, gen int) {
+	clock := &radioClock{start: time.Now()}
+	for ctx.Err() == nil {
+		tracks, err := st.tracks(ctx)
+		if err != nil {
+			log.Printf("Radio [%s]: track list error: %v", st.id, err)
+		}
+		played := false
+		for _, key := range tracks {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := st.playTrack(ctx, gen, key, clock); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Radio [%s]: skipping %s: %v", st.id, key, err)
+				}
+				continue
+			}
+			played = true
+		}
+		if !played {
+			if err := sleepContext(ctx, RADIO_RETRY_DELAY); err != nil {
+				return
+			}
+			clock = &radioClock{start: time.Now()}
+		}
+	}
+}
+
+// tracks returns the station's MP3 tracks in play order.
+func (st *radioStation) tracks(ctx context.Context) ([]string, error) {
+	var files []string
+	var err error
+	switch {
+	case st.cfg.Dir != "":
+		files, err = listAllAudioFiles(strings.TrimPrefix(st.cfg.Dir, "/"))
+	case st.cfg.Search != "":
+		files, err = searchFiles(st.cfg.Search)
+	default:
+		files, _, err = resolveLibraryPlaylist(ctx, strings.TrimPrefix(st.cfg.Playlist, "/"), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tracks := make([]string, 0, len(files))
+	for _, f := range files {
+		if strings.EqualFold(path.Ext(f), ".mp3") {
+			tracks = append(tracks, strings.ReplaceAll(f, `\`, "/"))
+		}
+	}
+	switch {
+	case st.cfg.Shuffle:
+		rand.Shuffle(len(tracks), func(i, j int) { tracks[i], tracks[j] = tracks[j], tracks[i] })
+	case st.cfg.Playlist == "":
+		sort.Strings(tracks)
+	}
+	return tracks, nil
+}
+
+// radioClock tracks how much audio a run has sent since it started.
+type radioClock struct {
+	start  time.Time
+	played time.Duration
+}
+
+// playTrack broadcasts one track frame by frame, sleeping whenever the stream
+// gets ahead of the wall clock.
+func (st *radioStation) playTrack(ctx context.Context, gen int, key string, clock *radioClock) error {
+	obj, err := openAudio(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = obj.Close() }()
+	fr, err := newMP3FrameReader(obj)
+	if err != nil {
+		return err
+	}
+	title := trackTitle(key)
+	for {
+		data, frame, err := fr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		st.broadcast(gen, radioChunk{data: append([]byte(nil), data...), title: title})
+		clock.played += time.Duration(frame.Duration * float64(time.Second))
+		if err := sleepContext(ctx, time.Until(clock.start.Add(clock.played))); err != nil {
+			return err
+		}
+	}
+}
+
+// sleepContext waits for d or until ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// icyWriter interleaves ICY metadata blocks into an audio stream every
+// metaint bytes. A metaint of 0 writes audio only.
+type icyWriter struct {
+	w       io.Writer
+	metaint int
+	left    int
+	sent    string
+}
+
+func (iw *icyWriter) write(data []byte, title string) error {
+	if iw.metaint == 0 {
+		_, err := iw.w.Write(data)
+		return err
+	}
+	for len(data) > 0 {
+		n := min(len(data), iw.left)
+		if _, err := iw.w.Write(data[:n]); err != nil {
+			return err
+		}
+		data, iw.left = data[n:], iw.left-n
+		if iw.left > 0 {
+			continue
+		}
+		meta := []byte{0} // unchanged title
+		if title != iw.sent {
+			meta = icyMetadata(title)
+			iw.sent = title
+		}
+		if _, err := iw.w.Write(meta); err != nil {
+			return err
+		}
+		iw.left = iw.metaint
+	}
+	return nil
+}
+
+// icyMetadata encodes a StreamTitle block: a length byte counting 16-byte
+// units followed by the zero-padded text.
+func icyMetadata(title string) []byte {
+	title = strings.ReplaceAll(title, "'", "’")
+	const wrapper = len("StreamTitle='';")
+	for len(title)+wrapper > MAX_ICY_METADATA {
+		_, size := utf8.DecodeLastRuneInString(title)
+		title = title[:len(title)-size]
+	}
+	text := "StreamTitle='" + title + "';"
+	blocks := (len(text) + 15) / 16
+	buf := make([]byte, 1+blocks*16)
+	buf[0] = byte(blocks)
+	copy(buf[1:], text)
+	return buf
+}
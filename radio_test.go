@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestICYWriter checks metadata placement and the unchanged-title marker
+func TestICYWriter(t *testing.T) {
+	var buf bytes.Buffer
+	iw := &icyWriter{w: &buf, metaint: 4, left: 4}
+	assert.NoError(t, iw.write([]byte("abcdef"), "A - B"))
+	assert.NoError(t, iw.write([]byte("gh"), "A - B"))
+
+	meta := icyMetadata("A - B")
+	assert.Equal(t, byte(2), meta[0])
+	assert.Equal(t, "StreamTitle='A - B';", strings.TrimRight(string(meta[1:]), "\x00"))
+
+	want := append([]byte("abcd"), meta...)
+	want = append(want, "efgh"...)
+	want = append(want, 0)
+	assert.Equal(t, want, buf.Bytes())
+
+	long := icyMetadata(strings.Repeat("x", 5000))
+	assert.Equal(t, byte(255), long[0])
+	assert.Len(t, long, 1+MAX_ICY_METADATA)
+}
+
+// TestParseRadioStations checks station validation
+func TestParseRadioStations(t *testing.T) {
+	stations, err := parseRadioStations([]byte(`{"office":{"dir":"Chill/","name":"Office"},"jazz":{"search":"jazz"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "Office", stations["office"].cfg.Name)
+	assert.Equal(t, "jazz", stations["jazz"].cfg.Name)
+
+	_, err = parseRadioStations([]byte(`{"both":{"dir":"a/","search":"b"}}`))
+	assert.Error(t, err)
+	_, err = parseRadioStations([]byte(`{"none":{}}`))
+	assert.Error(t, err)
+	_, err = parseRadioStations([]byte(`{"a/b":{"dir":"x/"}}`))
+	assert.Error(t, err)
+}
+
+// TestRadioStream checks the shared stream, ICY metadata and idle shutdown
+func TestRadioStream(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origLocalMusicDir, origStations, origMetaInt := localMusicDir, radioStations, radioMetaInt
+	defer func() {
+		localMusicDir, radioStations, radioMetaInt = origLocalMusicDir, origStations, origMetaInt
+	}()
+	localMusicDir = tmpDir
+	radioMetaInt = 1000
+
+	os.MkdirAll(filepath.Join(tmpDir, "Office"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Office", "Artist - First.mp3"), testMP3(40), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Office", "Artist - Second.mp3"), testMP3(40), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Office", "skip.wav"), testWAV(1), 0644)
+	station := newRadioStation("office", radioStationConfig{Name: "Office Radio", Dir: "Office/"})
+	radioStations = map[string]*radioStation{"office": station}
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	open := func(icy bool) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/radio/office", nil)
+		if icy {
+			req.Header.Set("Icy-MetaData", "1")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return resp
+	}
+
+	resp := open(true)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "audio/mpeg", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "1000", resp.Header.Get("icy-metaint"))
+	assert.Equal(t, "Office Radio", resp.Header.Get("icy-name"))
+
+	br := bufio.NewReader(resp.Body)
+	audio := make([]byte, 1000)
+	_, err = io.ReadFull(br, audio)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xFF, 0xFB, 0x90, 0x00}, audio[:4], "stream starts on a frame boundary")
+	n, err := br.ReadByte()
+	assert.NoError(t, err)
+	meta := make([]byte, int(n)*16)
+	_, err = io.ReadFull(br, meta)
+	assert.NoError(t, err)
+	assert.Equal(t, "StreamTitle='Artist - First';", strings.TrimRight(string(meta), "\x00"))
+
+	// A second listener joins the running broadcast instead of restarting it.
+	gen := station.gen
+	resp2 := open(false)
+	assert.Empty(t, resp2.Header.Get("icy-metaint"))
+	chunk := make([]byte, 100)
+	_, err = io.ReadFull(resp2.Body, chunk)
+	assert.NoError(t, err)
+	assert.Equal(t, gen, station.gen)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/radio", nil))
+	var list struct {
+		Stations []struct {
+			ID         string `json:"id"`
+			Listeners  int    `json:"listeners"`
+			NowPlaying string `json:"nowPlaying"`
+		} `json:"stations"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Stations, 1)
+	assert.Equal(t, 2, list.Stations[0].Listeners)
+	assert.Equal(t, "Artist - First", list.Stations[0].NowPlaying)
+
+	resp.Body.Close()
+	resp2.Body.Close()
+	assert.Eventually(t, func() bool {
+		station.mu.Lock()
+		defer station.mu.Unlock()
+		return station.cancel == nil
+	}, 2*time.Second, 10*time.Millisecond, "playback stops when the last listener leaves")
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/radio/missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
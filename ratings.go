@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Favorites and ratings: each user can star tracks, folders and albums and
+// rate them from 1 to 5. Both are kept in the user's ratings document. A
+// track the user has not rated takes the rating embedded in its tags (POPM
+// or FMPS_Rating), so ratings kept by other players carry over; setting a
+// rating of 0 clears it, including the embedded one.
+
+const (
+	RATINGS_FILE_PREFIX      = "ratings-"
+	MAX_RATING               = 5
+	MAX_RATING_PATHS         = 1000
+	DEFAULT_RATING_TAG_READS = 200
+	STAR_KIND_TRACK          = "track"
+	STAR_KIND_FOLDER         = "folder"
+	STAR_KIND_ALBUM          = "album"
+)
+
+// ratingTagReads bounds the uncached tag reads of one request.
+var ratingTagReads = envInt("RATING_TAG_READS", DEFAULT_RATING_TAG_READS)
+
+// userRatings is one user's stars and ratings, keyed by track path or
+// directory path without slashes at either end.
+type userRatings struct {
+	Stars   map[string]starEntry `json:"stars"`
+	Ratings map[string]int       `json:"ratings"`
+}
+
+type starEntry struct {
+	Kind    string    `json:"kind"`
+	Starred time.Time `json:"starred"`
+}
+
+var ratings = newRatingStore()
+
+type ratingStore struct {
+	*userDocs[userRatings]
+}
+
+func newRatingStore() *ratingStore {
+	return &ratingStore{newUserDocs[userRatings](RATINGS_FILE_PREFIX)}
+}
+
+func (s *ratingStore) update(owner string, change func(*userRatings)) error {
+	_, err := s.doc(owner).update(func(r *userRatings) error {
+		if r.Stars == nil {
+			r.Stars = map[string]starEntry{}
+		}
+		if r.Ratings == nil {
+			r.Ratings = map[string]int{}
+		}
+		change(r)
+		return nil
+	})
+	return err
+}
+
+// embeddedRatings caches the ratings read from track tags.
+var embeddedRatings sync.Map
+
+// ratingReader looks up effective ratings for one request, reading at most
+// ratingTagReads uncached tags.
+type ratingReader struct {
+	ctx   context.Context
+	user  userRatings
+	reads int
+}
+
+func newRatingReader(ctx context.Context, owner string) (*ratingReader, error) {
+	user, err := ratings.doc(owner).get()
+	return &ratingReader{ctx: ctx, user: user}, err
+}
+
+// rating returns the effective rating of key. ok is false when the
+// embedded rating is unknown because the request's tag reads are used up
+// or the tags could not be read.
+func (rr *ratingReader) rating(key string) (r int, ok bool) {
+	if r, ok := rr.user.Ratings[key]; ok {
+		return r, true
+	}
+	if !isAudioFile(key) {
+		return 0, true
+	}
+	if r, ok := embeddedRatings.Load(key); ok {
+		return r.(int), true
+	}
+	if rr.reads >= ratingTagReads {
+		return 0, false
+	}
+	rr.reads++
+	tags, err := readTags(rr.ctx, key)
+	if err != nil && !errors.Is(err, errNoTags) {
+		return 0, false
+	}
+	embeddedRatings.Store(key, tags.Rating)
+	return tags.Rating, true
+}
+
+func (rr *ratingReader) starred(key string) bool {
+	_, ok := rr.user.Stars[key]
+	return ok
+}
+
+// ratingFilter narrows search results by rating and stars.
+type ratingFilter struct {
+	MinRating int  `json:"minRating"`
+	MaxRating int  `json:"maxRating"`
+	Starred   bool `json:"starred"`
+}
+
+func (f ratingFilter) active() bool {
+	return f.MinRating > 0 || f.MaxRating > 0 || f.Starred
+}
+
+// apply keeps the first limit keys that pass the filter. It stops early,
+// reporting the result as truncated, when limit keys have passed or when a
+// rating cannot be told because the request's tag reads are used up; the
+// tags read so far are cached, so asking again gets further.
+func (f ratingFilter) apply(c *gin.Context, keys []string, limit int) ([]string, bool, error) {
+	if !f.active() {
+		if len(keys) > limit {
+			return keys[:limit], true, nil
+		}
+		return keys, false, nil
+	}
+	rr, err := newRatingReader(c.Request.Context(), currentUserName(c))
+	if err != nil {
+		return nil, false, err
+	}
+	out := make([]string, 0, min(len(keys), limit))
+	for _, k := range keys {
+		if len(out) == limit {
+			return out, true, nil
+		}
+		pass, known := f.passes(rr, ratingKey(k))
+		if !known {
+			return out, true, nil
+		}
+		if pass {
+			out = append(out, k)
+		}
+	}
+	return out, false, nil
+}
+
+// passes reports whether key passes the filter; known is false when its
+// rating could not be read.
+func (f ratingFilter) passes(rr *ratingReader, key string) (pass, known bool) {
+	if f.Starred && !rr.starred(key) {
+		return false, true
+	}
+	if f.MinRating == 0 && f.MaxRating == 0 {
+		return true, true
+	}
+	r, ok := rr.rating(key)
+	return ok && r >= f.MinRating && (f.MaxRating == 0 || r <= f.MaxRating), ok
+}
+
+// ratingKey normalizes a track or directory path.
+func ratingKey(p string) string {
+	return strings.Trim(p, "/")
+}
+
+// ratingPaths validates the paths of a request against the caller's access.
+func ratingPaths(c *gin.Context, paths []string) ([]string, bool) {
+	if len(paths) == 0 || len(paths) > MAX_RATING_PATHS {
+		return nil, false
+	}
+	acc := accessFor(c)
+	out := make([]string, 0, len(paths))
+	for _, p := range paths {
+		key, ok := cleanKey(ratingKey(p))
+		if !ok || (isAudioFile(key) && !acc.allowed(key)) || (!isAudioFile(key) && !acc.dirVisible(key)) {
+			return nil, false
+		}
+		out = append(out, key)
+	}
+	return out, true
+}
+
+// --- API functions ---
+
+type ratingRequest struct {
+	Paths  []string `json:"paths"`
+	Path   string   `json:"path"`
+	Kind   string   `json:"kind"`
+	Rating int      `json:"rating"`
+}
+
+func parseRatingRequest(c *gin.Context, raw string) (ratingRequest, []string, bool) {
+	var req ratingRequest
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid request"})
+		return req, nil, false
+	}
+	if req.Path != "" {
+		req.Paths = append(req.Paths, req.Path)
+	}
+	keys, ok := ratingPaths(c, req.Paths)
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid path"})
+	}
+	return req, keys, ok
+}
+
+func saveRatings(c *gin.Context, change func(*userRatings)) {
+	if err := ratings.update(currentUserName(c), change); err != nil {
+		log.Printf("Ratings save error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to save"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleStar stars tracks and directories. Data: {"paths":[...]} with an
+// optional "kind":"album" to star directories as albums rather than folders.
+func handleStar(c *gin.Context, raw string) {
+	req, keys, ok := parseRatingRequest(c, raw)
+	if !ok {
+		return
+	}
+	dirKind := STAR_KIND_FOLDER
+	if req.Kind == STAR_KIND_ALBUM {
+		dirKind = STAR_KIND_ALBUM
+	}
+	now := time.Now().UTC()
+	saveRatings(c, func(r *userRatings) {
+		for _, key := range keys {
+			kind := dirKind
+			if isAudioFile(key) {
+				kind = STAR_KIND_TRACK
+			}
+			if old, ok := r.Stars[key]; !ok || old.Kind != kind {
+				r.Stars[key] = starEntry{Kind: kind, Starred: now}
+			}
+		}
+	})
+}
+
+// handleUnstar removes stars. Data: {"paths":[...]}
+func handleUnstar(c *gin.Context, raw string) {
+	_, keys, ok := parseRatingRequest(c, raw)
+	if !ok {
+		return
+	}
+	saveRatings(c, func(r *userRatings) {
+		for _, key := range keys {
+			delete(r.Stars, key)
+		}
+	})
+}
+
+// handleSetRating rates tracks or directories. Data: {"path":...,
+// "rating":1-5} or {"paths":[...],"rating":...}; 0 clears the rating.
+func handleSetRating(c *gin.Context, raw string) {
+	req, keys, ok := parseRatingRequest(c, raw)
+	if !ok {
+		return
+	}
+	if req.Rating < 0 || req.Rating > MAX_RATING {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Rating must be 0 to 5"})
+		return
+	}
+	saveRatings(c, func(r *userRatings) {
+		for _, key := range keys {
+			r.Ratings[key] = req.Rating
+		}
+	})
+}
+
+// ratingInfo is the rating and star of a path. Rating is null when the
+// track's embedded rating has not been read yet.
+type ratingInfo struct {
+	Path    string    `json:"path"`
+	Kind    string    `json:"kind,omitempty"`
+	Rating  *int      `json:"rating"`
+	Starred time.Time `json:"starred,omitzero"`
+}
+
+func (rr *ratingReader) info(key string) ratingInfo {
+	star := rr.user.Stars[key]
+	info := ratingInfo{Path: key, Kind: star.Kind, Starred: star.Starred}
+	if r, ok := rr.rating(key); ok {
+		info.Rating = &r
+	}
+	return info
+}
+
+// handleGetRatings returns the rating and star of each path. Data:
+// {"paths":[...]}
+func handleGetRatings(c *gin.Context, raw string) {
+	_, keys, ok := parseRatingRequest(c, raw)
+	if !ok {
+		return
+	}
+	rr, err := newRatingReader(c.Request.Context(), currentUserName(c))
+	if err != nil {
+		log.Printf("Ratings load error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to load ratings"})
+		return
+	}
+	out := make([]ratingInfo, 0, len(keys))
+	for _, key := range keys {
+		out = append(out, rr.info(key))
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "ratings": out})
+}
+
+// handleStarred lists the caller's starred tracks, folders and albums,
+// most recently starred first. Data (optional): {"minRating":n}. Entries
+// whose rating could not be read are left out and the result is marked
+// truncated.
+func handleStarred(c *gin.Context, raw string) {
+	var filter ratingFilter
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &filter); err != nil {
+			c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid request"})
+			return
+		}
+	}
+	rr, err := newRatingReader(c.Request.Context(), currentUserName(c))
+	if err != nil {
+		log.Printf("Ratings load error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to load ratings"})
+		return
+	}
+	acc := accessFor(c)
+	lists := map[string][]ratingInfo{STAR_KIND_TRACK: {}, STAR_KIND_FOLDER: {}, STAR_KIND_ALBUM: {}}
+	truncated := false
+	for key, star := range rr.user.Stars {
+		visible := acc.allowed(key)
+		if star.Kind != STAR_KIND_TRACK {
+			visible = acc.dirVisible(key)
+		}
+		if !visible {
+			continue
+		}
+		info := rr.info(key)
+		if filter.MinRating > 0 && (info.Rating == nil || *info.Rating < filter.MinRating) {
+			truncated = truncated || info.Rating == nil
+			continue
+		}
+		lists[star.Kind] = append(lists[star.Kind], info)
+	}
+	for _, l := range lists {
+		sort.Slice(l, func(i, j int) bool { return l[i].Starred.After(l[j].Starred) })
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "tracks": lists[STAR_KIND_TRACK], "folders": lists[STAR_KIND_FOLDER], "albums": lists[STAR_KIND_ALBUM], "truncated": truncated})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withRatings gives a test its own ratings
+func withRatings(t *testing.T) {
+	t.Helper()
+	origRatings := ratings
+	t.Cleanup(func() {
+		ratings = origRatings
+		embeddedRatings = sync.Map{}
+	})
+	ratings = newRatingStore()
+	embeddedRatings = sync.Map{}
+	withStateDir(t)
+}
+
+// TestStarsAndRatings checks starring and rating through the API
+func TestStarsAndRatings(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	origLocalMusicDir := localMusicDir
+	defer func() { localMusicDir = origLocalMusicDir }()
+	localMusicDir = tmpDir
+	withRatings(t)
+	os.MkdirAll(filepath.Join(tmpDir, "Jazz", "Kind of Blue"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "Kind of Blue", "So What.mp3"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "Kind of Blue", "Blue in Green.mp3"), id3Tag(3, popmFrame(196)), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "Kind of Blue", "Freddie Freeloader.mp3"), []byte("x"), 0644)
+
+	track := "Jazz/Kind of Blue/So What.mp3"
+	seeded := "Jazz/Kind of Blue/Blue in Green.mp3"
+	assert.Equal(t, "ok", historyAPI(t, "", "star", map[string]any{"paths": []string{track, "Jazz/"}})["status"])
+	assert.Equal(t, "ok", historyAPI(t, "", "star", map[string]any{"paths": []string{"Jazz/Kind of Blue"}, "kind": "album"})["status"])
+	assert.Equal(t, "ok", historyAPI(t, "", "setRating", map[string]any{"path": track, "rating": 5})["status"])
+	assert.Equal(t, "error", historyAPI(t, "", "setRating", map[string]any{"path": track, "rating": 6})["status"])
+	assert.Equal(t, "error", historyAPI(t, "", "star", map[string]any{"paths": []string{"../etc/passwd"}})["status"])
+
+	resp := historyAPI(t, "", "starred", nil)
+	assert.Equal(t, "ok", resp["status"])
+	tracks := resp["tracks"].([]any)
+	assert.Len(t, tracks, 1)
+	assert.Equal(t, float64(5), tracks[0].(map[string]any)["rating"])
+	assert.Equal(t, "Jazz", resp["folders"].([]any)[0].(map[string]any)["path"])
+	assert.Equal(t, "Jazz/Kind of Blue", resp["albums"].([]any)[0].(map[string]any)["path"])
+
+	resp = historyAPI(t, "", "getRatings", map[string]any{"paths": []string{seeded}})
+	assert.Equal(t, float64(4), resp["ratings"].([]any)[0].(map[string]any)["rating"], "seeded from the POPM frame")
+
+	search := func(filter map[string]any) []any {
+		filter["term"] = "Kind of Blue"
+		resp := historyAPI(t, "", "searchInDir", filter)
+		matches, _ := resp["matches"].([]any)
+		return matches
+	}
+	assert.Len(t, search(map[string]any{}), 3)
+	assert.Len(t, search(map[string]any{"minRating": 4}), 2)
+	assert.Len(t, search(map[string]any{"minRating": 1, "maxRating": 4}), 1)
+	assert.Len(t, search(map[string]any{"starred": true}), 1)
+
+	// A rating of 0 overrides the embedded rating.
+	historyAPI(t, "", "setRating", map[string]any{"path": seeded, "rating": 0})
+	assert.Len(t, search(map[string]any{"minRating": 1}), 1)
+
+	assert.Equal(t, "ok", historyAPI(t, "", "unstar", map[string]any{"paths": []string{track}})["status"])
+	assert.Empty(t, historyAPI(t, "", "starred", nil)["tracks"])
+}
+
+// TestSearchQuery checks the plain and JSON forms of search data
+func TestSearchQuery(t *testing.T) {
+	term, filter := parseSearchQuery(" blue ")
+	assert.Equal(t, "blue", term)
+	assert.False(t, filter.active())
+
+	term, filter = parseSearchQuery(`{"term":"blue","minRating":3,"starred":true}`)
+	assert.Equal(t, "blue", term)
+	assert.Equal(t, ratingFilter{MinRating: 3, Starred: true}, filter)
+}
+
+// TestRatingTagReads checks that ratings past the tag read budget are
+// reported as unknown, not as unrated
+func TestRatingTagReads(t *testing.T) {
+	tmpDir := t.TempDir()
+	origLocalMusicDir := localMusicDir
+	defer func() { localMusicDir = origLocalMusicDir }()
+	localMusicDir = tmpDir
+	withRatings(t)
+	origReads := ratingTagReads
+	defer func() { ratingTagReads = origReads }()
+	ratingTagReads = 1
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		os.WriteFile(filepath.Join(tmpDir, name), id3Tag(3, popmFrame(255)), 0644)
+	}
+
+	resp := historyAPI(t, "", "searchInDir", map[string]any{"term": ".mp3", "minRating": 5})
+	assert.Len(t, resp["matches"], 1)
+	assert.Equal(t, true, resp["truncated"], "unread ratings stop the search")
+	resp = historyAPI(t, "", "searchInDir", map[string]any{"term": ".mp3", "minRating": 5, "limit": 2})
+	assert.Len(t, resp["matches"], 2)
+	assert.Equal(t, true, resp["truncated"], "the limit is reached")
+	resp = historyAPI(t, "", "searchInDir", map[string]any{"term": ".mp3", "minRating": 5})
+	assert.Len(t, resp["matches"], 3, "read tags are cached")
+	assert.Equal(t, false, resp["truncated"])
+
+	embeddedRatings = sync.Map{}
+	resp = historyAPI(t, "", "getRatings", map[string]any{"paths": []string{"a.mp3", "b.mp3"}})
+	got := resp["ratings"].([]any)
+	assert.Equal(t, float64(5), got[0].(map[string]any)["rating"])
+	assert.Nil(t, got[1].(map[string]any)["rating"], "unread ratings are null")
+
+	embeddedRatings = sync.Map{}
+	resp = historyAPI(t, "", "getRatings", map[string]any{"paths": []string{"d.mp3"}})
+	got = resp["ratings"].([]any)
+	assert.Nil(t, got[0].(map[string]any)["rating"], "failed reads are unknown")
+	os.WriteFile(filepath.Join(tmpDir, "d.mp3"), id3Tag(3, popmFrame(255)), 0644)
+	resp = historyAPI(t, "", "getRatings", map[string]any{"paths": []string{"d.mp3"}})
+	got = resp["ratings"].([]any)
+	assert.Equal(t, float64(5), got[0].(map[string]any)["rating"], "failed reads are not cached")
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// Remote control: each web player keeps a WebSocket open to /remote and
+// registers as a device. Sessions of the same user see each other's
+// devices and playback state, and can send them commands: play, pause,
+// next, seek, a new queue. The hub lives in the process, so all of a
+// user's sessions must reach the same instance; it is not available on
+// Lambda.
+
+const (
+	REMOTE_PATH          = "/remote"
+	REMOTE_SEND_QUEUE    = 64
+	REMOTE_WRITE_TIMEOUT = 10 * time.Second
+	MAX_REMOTE_MESSAGE   = 1 << 20
+	MAX_REMOTE_DEVICES   = 20
+	DEFAULT_REMOTE_PING  = 25 * time.Second
+)
+
+// Message types. The server sends hello, devices, state, command, ping,
+// pong and error; players send state, command, ping and pong.
+const (
+	REMOTE_HELLO   = "hello"
+	REMOTE_DEVICES = "devices"
+	REMOTE_STATE   = "state"
+	REMOTE_COMMAND = "command"
+	REMOTE_PING    = "ping"
+	REMOTE_PONG    = "pong"
+	REMOTE_ERROR   = "error"
+)
+
+// remotePing is how often the server pings each device. A device that sends
+// nothing for two intervals is dropped.
+var remotePing = envDuration("REMOTE_PING_INTERVAL", DEFAULT_REMOTE_PING)
+
+var (
+	errRemoteDevice  = errors.New("device not connected")
+	errRemoteTooMany = errors.New("too many devices")
+)
+
+// remoteActions are the commands a device accepts.
+var remoteActions = []string{"play", "pause", "toggle", "next", "previous", "seek", "queue"}
+
+// remoteCommand asks a device to do something. Position is in seconds for
+// seek; queue replaces the device's queue and plays Queue[Index].
+type remoteCommand struct {
+	Action   string   `json:"action"`
+	Position float64  `json:"position,omitempty"`
+	Queue    []string `json:"queue,omitempty"`
+	Index    int      `json:"index,omitempty"`
+}
+
+// remoteState is what a device is playing, as it reports it.
+type remoteState struct {
+	Track    string   `json:"track"`
+	Position float64  `json:"position"`
+	Duration float64  `json:"duration"`
+	Playing  bool     `json:"playing"`
+	Shuffle  bool     `json:"shuffle"`
+	Queue    []string `json:"queue,omitempty"`
+	Index    int      `json:"index"`
+}
+
+// remoteDeviceInfo describes a connected device.
+type remoteDeviceInfo struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Connected time.Time    `json:"connected"`
+	State     *remoteState `json:"state,omitempty"`
+}
+
+// remoteMessage is every message in either direction. To addresses a
+// command; From names the device a state or command came from.
+type remoteMessage struct {
+	Type    string             `json:"type"`
+	To      string             `json:"to,omitempty"`
+	From    string             `json:"from,omitempty"`
+	Device  string             `json:"device,omitempty"`
+	Command *remoteCommand     `json:"command,omitempty"`
+	State   *remoteState       `json:"state,omitempty"`
+	Devices []remoteDeviceInfo `json:"devices,omitempty"`
+	Message string             `json:"message,omitempty"`
+}
+
+// remoteDevice is one connected player.
+type remoteDevice struct {
+	id, name, owner string
+	connected       time.Time
+	send            chan remoteMessage
+	done            chan struct{}
+	closeOnce       sync.Once
+	state           *remoteState // guarded by the hub's mu
+}
+
+// close disconnects the device; it is safe to call more than once.
+func (d *remoteDevice) close() {
+	d.closeOnce.Do(func() { close(d.done) })
+}
+
+// deliver queues msg for the device. A device that cannot keep up is
+// disconnected rather than holding up the others; it reconnects.
+func (d *remoteDevice) deliver(msg remoteMessage) {
+	select {
+	case d.send <- msg:
+	default:
+		d.close()
+	}
+}
+
+// remoteHub tracks the connected devices of each user.
+type remoteHub struct {
+	mu    sync.Mutex
+	users map[string]map[string]*remoteDevice
+}
+
+var remote = newRemoteHub()
+
+func newRemoteHub() *remoteHub {
+	return &remoteHub{users: map[string]map[string]*remoteDevice{}}
+}
+
+// join registers a device for owner. A device reconnecting with the same id
+// replaces its old connection.
+func (h *remoteHub) join(owner, id, name string) (*remoteDevice, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	devices := h.users[owner]
+	if devices == nil {
+		devices = map[string]*remoteDevice{}
+		h.users[owner] = devices
+	}
+	old := devices[id]
+	if old == nil && len(devices) >= MAX_REMOTE_DEVICES {
+		return nil, errRemoteTooMany
+	}
+	d := &remoteDevice{id: id, name: name, owner: owner, connected: time.Now().UTC(),
+		send: make(chan remoteMessage, REMOTE_SEND_QUEUE), done: make(chan struct{})}
+	if old != nil {
+		old.close()
+		d.state = old.state
+	}
+	devices[id] = d
+	d.deliver(remoteMessage{Type: REMOTE_HELLO, Device: id})
+	h.broadcastDevices(owner)
+	return d, nil
+}
+
+// leave unregisters d unless it has already been replaced.
+func (h *remoteHub) leave(d *remoteDevice) {
+	d.close()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	devices := h.users[d.owner]
+	if devices[d.id] != d {
+		return
+	}
+	delete(devices, d.id)
+	if len(devices) == 0 {
+		delete(h.users, d.owner)
+		return
+	}
+	h.broadcastDevices(d.owner)
+}
+
+// devices lists owner's devices by name. The caller holds mu.
+func (h *remoteHub) devices(owner string) []remoteDeviceInfo {
+	out := []remoteDeviceInfo{}
+	for _, d := range h.users[owner] {
+		out = append(out, remoteDeviceInfo{ID: d.id, Name: d.name, Connected: d.connected, State: d.state})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// broadcastDevices sends the device list to all of owner's devices. The
+// caller holds mu.
+func (h *remoteHub) broadcastDevices(owner string) {
+	msg := remoteMessage{Type: REMOTE_DEVICES, Devices: h.devices(owner)}
+	for _, d := range h.users[owner] {
+		d.deliver(msg)
+	}
+}
+
+// setState records what d is playing and passes it to the user's other
+// devices.
+func (h *remoteHub) setState(d *remoteDevice, st *remoteState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.users[d.owner][d.id] != d {
+		return
+	}
+	d.state = st
+	msg := remoteMessage{Type: REMOTE_STATE, From: d.id, State: st}
+	for _, other := range h.users[d.owner] {
+		if other != d {
+			other.deliver(msg)
+		}
+	}
+}
+
+// command sends cmd from d to the device to, which must belong to the same
+// user.
+func (h *remoteHub) command(d *remoteDevice, to string, cmd *remoteCommand) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	target := h.users[d.owner][to]
+	if target == nil {
+		return errRemoteDevice
+	}
+	target.deliver(remoteMessage{Type: REMOTE_COMMAND, From: d.id, Command: cmd})
+	return nil
+}
+
+// --- WebSocket endpoint ---
+
+// remoteHandler upgrades GET /remote?device=<id>&name=<name> to a
+// WebSocket for the signed-in user.
+func remoteHandler(c *gin.Context) {
+	if isLambda {
+		c.String(http.StatusNotImplemented, "Remote control is not available on Lambda")
+		return
+	}
+	id, name := c.Query("device"), c.Query("name")
+	if id == "" || len(id) > MAX_DEVICE_NAME || len(name) > MAX_DEVICE_NAME {
+		c.String(http.StatusBadRequest, "Invalid device")
+		return
+	}
+	if name == "" {
+		name = id
+	}
+	owner := currentUserName(c)
+	srv := websocket.Server{
+		Handshake: checkRemoteOrigin,
+		Handler:   func(ws *websocket.Conn) { serveRemote(c, ws, owner, id, name) },
+	}
+	srv.ServeHTTP(c.Writer, c.Request)
+}
+
+// checkRemoteOrigin refuses browser connections from other sites, which
+// would otherwise ride on the user's session cookie. Clients that send no
+// Origin are not browsers and authenticate like any other request.
+func checkRemoteOrigin(cfg *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(cfg, req)
+	if err != nil || origin == nil {
+		return err
+	}
+	hosts := []string{req.Host, req.Header.Get("X-Forwarded-Host")}
+	if slices.Contains(hosts, origin.Host) {
+		return nil
+	}
+	return fmt.Errorf("origin %s not allowed", origin.Host)
+}
+
+// serveRemote runs one device's connection: incoming messages are handled
+// here, outgoing ones by writeRemote.
+func serveRemote(c *gin.Context, ws *websocket.Conn, owner, id, name string) {
+	ws.MaxPayloadBytes = MAX_REMOTE_MESSAGE
+	d, err := remote.join(owner, id, name)
+	if err != nil {
+		_ = ws.SetWriteDeadline(time.Now().Add(REMOTE_WRITE_TIMEOUT))
+		_ = websocket.JSON.Send(ws, remoteMessage{Type: REMOTE_ERROR, Message: err.Error()})
+		_ = ws.Close()
+		return
+	}
+	defer remote.leave(d)
+	go writeRemote(ws, d)
+	for {
+		_ = ws.SetReadDeadline(time.Now().Add(2 * remotePing))
+		var msg remoteMessage
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+		handleRemoteMessage(c, d, msg)
+	}
+}
+
+// writeRemote sends d's queued messages and the heartbeat until d is
+// closed, then closes the connection.
+func writeRemote(ws *websocket.Conn, d *remoteDevice) {
+	ping := time.NewTicker(remotePing)
+	defer ping.Stop()
+	defer func() { _ = ws.Close() }()
+	for {
+		var msg remoteMessage
+		select {
+		case <-d.done:
+			return
+		case msg = <-d.send:
+		case <-ping.C:
+			msg = remoteMessage{Type: REMOTE_PING}
+		}
+		_ = ws.SetWriteDeadline(time.Now().Add(REMOTE_WRITE_TIMEOUT))
+		if err := websocket.JSON.Send(ws, msg); err != nil {
+			d.close()
+			return
+		}
+	}
+}
+
+func handleRemoteMessage(c *gin.Context, d *remoteDevice, msg remoteMessage) {
+	var err error
+	switch msg.Type {
+	case REMOTE_PING:
+		d.deliver(remoteMessage{Type: REMOTE_PONG})
+	case REMOTE_PONG:
+	case REMOTE_STATE:
+		err = remoteStateMessage(d, msg.State)
+	case REMOTE_COMMAND:
+		err = remoteCommandMessage(c, d, msg.To, msg.Command)
+	default:
+		err = fmt.Errorf("unknown message type %q", msg.Type)
+	}
+	if err != nil {
+		d.deliver(remoteMessage{Type: REMOTE_ERROR, To: msg.To, Message: err.Error()})
+	}
+}
+
+func remoteStateMessage(d *remoteDevice, st *remoteState) error {
+	if st == nil || len(st.Queue) > MAX_PLAYLIST_TRACKS {
+		return errors.New("invalid state")
+	}
+	remote.setState(d, st)
+	return nil
+}
+
+// remoteCommandMessage checks a command and passes it on. Queued tracks the
+// user may not play are dropped, as for playlists.
+func remoteCommandMessage(c *gin.Context, d *remoteDevice, to string, cmd *remoteCommand) error {
+	if cmd == nil || !slices.Contains(remoteActions, cmd.Action) || cmd.Position < 0 || cmd.Index < 0 {
+		return errors.New("invalid command")
+	}
+	if cmd.Action == "queue" {
+		tracks, err := playlistTracks(c, cmd.Queue)
+		if err != nil || len(tracks) == 0 {
+			return errors.New("invalid queue")
+		}
+		cmd.Queue, cmd.Index = tracks, min(cmd.Index, len(tracks)-1)
+	}
+	return remote.command(d, to, cmd)
+}
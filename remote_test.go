@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+// dialRemote connects to /remote as user with the given device id
+func dialRemote(t *testing.T, srv *httptest.Server, user, device, origin string) (*websocket.Conn, error) {
+	t.Helper()
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + REMOTE_PATH + "?device=" + url.QueryEscape(device)
+	cfg, err := websocket.NewConfig(u, origin)
+	assert.NoError(t, err)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth(user, "sesame")
+	cfg.Header.Set("Authorization", req.Header.Get("Authorization"))
+	return websocket.DialConfig(cfg)
+}
+
+// receiveRemote returns the next message of the given type, skipping others
+func receiveRemote(t *testing.T, ws *websocket.Conn, typ string) remoteMessage {
+	t.Helper()
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg remoteMessage
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if msg.Type == typ {
+			return msg
+		}
+	}
+}
+
+// TestRemoteControl checks devices, commands and state updates between sessions
+func TestRemoteControl(t *testing.T) {
+	tmpDir := t.TempDir()
+	origLocalMusicDir, origRemote := localMusicDir, remote
+	defer func() { localMusicDir, remote = origLocalMusicDir, origRemote }()
+	localMusicDir, remote = tmpDir, newRemoteHub()
+	os.WriteFile(filepath.Join(tmpDir, "a.mp3"), []byte("a"), 0644)
+	withAuthUsers(t, map[string]*authUser{
+		"alice": {Password: bcryptHash(t, "sesame")},
+		"bob":   {Password: bcryptHash(t, "sesame")},
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	office, err := dialRemote(t, srv, "alice", "office", srv.URL)
+	assert.NoError(t, err)
+	defer office.Close()
+	assert.Equal(t, "office", receiveRemote(t, office, REMOTE_HELLO).Device)
+	phone, err := dialRemote(t, srv, "alice", "phone", srv.URL)
+	assert.NoError(t, err)
+	defer phone.Close()
+	assert.Len(t, receiveRemote(t, phone, REMOTE_DEVICES).Devices, 2)
+	assert.Len(t, receiveRemote(t, office, REMOTE_DEVICES).Devices, 1)
+	assert.Len(t, receiveRemote(t, office, REMOTE_DEVICES).Devices, 2)
+
+	websocket.JSON.Send(phone, remoteMessage{Type: REMOTE_COMMAND, To: "office", Command: &remoteCommand{Action: "seek", Position: 42}})
+	msg := receiveRemote(t, office, REMOTE_COMMAND)
+	assert.Equal(t, "phone", msg.From)
+	assert.Equal(t, 42.0, msg.Command.Position)
+
+	websocket.JSON.Send(phone, remoteMessage{Type: REMOTE_COMMAND, To: "office", Command: &remoteCommand{Action: "queue", Queue: []string{"../etc/passwd", "a.mp3"}, Index: 5}})
+	msg = receiveRemote(t, office, REMOTE_COMMAND)
+	assert.Equal(t, []string{"a.mp3"}, msg.Command.Queue)
+	assert.Equal(t, 0, msg.Command.Index)
+
+	websocket.JSON.Send(office, remoteMessage{Type: REMOTE_STATE, State: &remoteState{Track: "a.mp3", Playing: true}})
+	msg = receiveRemote(t, phone, REMOTE_STATE)
+	assert.Equal(t, "office", msg.From)
+	assert.Equal(t, "a.mp3", msg.State.Track)
+
+	websocket.JSON.Send(phone, remoteMessage{Type: REMOTE_COMMAND, To: "office", Command: &remoteCommand{Action: "format"}})
+	assert.Equal(t, "invalid command", receiveRemote(t, phone, REMOTE_ERROR).Message)
+	websocket.JSON.Send(phone, remoteMessage{Type: REMOTE_PING})
+	receiveRemote(t, phone, REMOTE_PONG)
+
+	// Another user cannot see or control alice's devices.
+	tv, err := dialRemote(t, srv, "bob", "tv", srv.URL)
+	assert.NoError(t, err)
+	defer tv.Close()
+	assert.Len(t, receiveRemote(t, tv, REMOTE_DEVICES).Devices, 1)
+	websocket.JSON.Send(tv, remoteMessage{Type: REMOTE_COMMAND, To: "office", Command: &remoteCommand{Action: "pause"}})
+	assert.Equal(t, errRemoteDevice.Error(), receiveRemote(t, tv, REMOTE_ERROR).Message)
+
+	// Reconnecting replaces the old connection and keeps the last state.
+	office2, err := dialRemote(t, srv, "alice", "office", srv.URL)
+	assert.NoError(t, err)
+	defer office2.Close()
+	devices := receiveRemote(t, office2, REMOTE_DEVICES).Devices
+	assert.Len(t, devices, 2)
+	assert.Equal(t, "a.mp3", devices[0].State.Track)
+	_ = office.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var m remoteMessage
+		if websocket.JSON.Receive(office, &m) != nil {
+			break
+		}
+	}
+
+	// Pages on other sites cannot connect with the user's cookie.
+	_, err = dialRemote(t, srv, "alice", "evil", "http://evil.example")
+	assert.Error(t, err)
+}
+
+// TestRemoteHeartbeat checks that silent devices are dropped
+func TestRemoteHeartbeat(t *testing.T) {
+	origRemote, origPing := remote, remotePing
+	defer func() { remote, remotePing = origRemote, origPing }()
+	remote, remotePing = newRemoteHub(), 50*time.Millisecond
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	ws, err := dialRemote(t, srv, "", "speaker", srv.URL)
+	assert.NoError(t, err)
+	defer ws.Close()
+	receiveRemote(t, ws, REMOTE_PING)
+	assert.Eventually(t, func() bool {
+		remote.mu.Lock()
+		defer remote.mu.Unlock()
+		return len(remote.users) == 0
+	}, 2*time.Second, 20*time.Millisecond)
+}
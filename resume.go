@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resume: the web player saves what it is playing (the queue, the track and
+// the position) every few seconds, and a player opened on another device
+// picks up from there. Saves carry the time the device made the change and
+// the latest change wins. Periodic saves also carry the time of the state
+// the device last knew; once another device has saved after that, they are
+// refused, so the device that took over keeps the state.
+
+const (
+	PLAY_STATE_FILE_PREFIX = "playstate-"
+	PLAY_STATE_MAX_SKEW    = time.Minute
+	MAX_DEVICE_NAME        = 100
+	PLAY_SOURCE_LIST       = "list"
+	PLAY_SOURCE_BROWSER    = "browser"
+)
+
+var errPlayStateStale = errors.New("a newer play state was saved")
+
+// playState is a user's current queue and position. Updated is the
+// device's time of the change; Saved is the server's. Since is only sent.
+type playState struct {
+	Device     string    `json:"device"`
+	DeviceName string    `json:"deviceName"`
+	Source     string    `json:"source"`
+	PlaylistID string    `json:"playlistId,omitempty"`
+	Queue      []string  `json:"queue"`
+	Index      int       `json:"index"`
+	Track      string    `json:"track"`
+	Position   float64   `json:"position"`
+	Playing    bool      `json:"playing"`
+	Shuffle    bool      `json:"shuffle"`
+	Updated    time.Time `json:"updated"`
+	Saved      time.Time `json:"saved"`
+	Since      time.Time `json:"since,omitzero"`
+}
+
+// supersedes reports whether st was saved after next was based on it.
+func (st *playState) supersedes(next *playState) bool {
+	if st == nil {
+		return false
+	}
+	return st.Updated.After(next.Updated) || (!next.Since.IsZero() && st.Device != next.Device && st.Updated.After(next.Since))
+}
+
+var playStates = newUserDocs[*playState](PLAY_STATE_FILE_PREFIX)
+
+// savePlayState stores next unless the stored state supersedes it. A nil queue
+// keeps the stored one, so players only send it when it changed.
+func savePlayState(owner string, next playState, now time.Time) (*playState, error) {
+	// Clocks that run ahead would otherwise win every later save.
+	if next.Updated.IsZero() || next.Updated.After(now.Add(PLAY_STATE_MAX_SKEW)) {
+		next.Updated = now
+	}
+	next.Saved = now
+	var current *playState
+	stored, err := playStates.doc(owner).update(func(st **playState) error {
+		current = *st
+		if current.supersedes(&next) {
+			return errPlayStateStale
+		}
+		saved := next
+		saved.Since = time.Time{}
+		if saved.Queue == nil && current != nil {
+			saved.Queue = current.Queue
+		}
+		*st = &saved
+		return nil
+	})
+	if errors.Is(err, errPlayStateStale) {
+		return current, err
+	}
+	return stored, err
+}
+
+// --- API functions ---
+
+// handleGetPlayState returns the caller's saved play state, or null.
+func handleGetPlayState(c *gin.Context, _ string) {
+	st, err := playStates.doc(currentUserName(c)).refresh()
+	if err != nil {
+		log.Printf("Play state load error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to load play state"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "state": st})
+}
+
+// handleSavePlayState saves the caller's play state. Data: a playState
+// without Saved. A save the stored state supersedes is refused with
+// "code":"stale" and the stored state.
+func handleSavePlayState(c *gin.Context, raw string) {
+	var req playState
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid request"})
+		return
+	}
+	if !validPlayState(c, &req) {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid play state"})
+		return
+	}
+	st, err := savePlayState(currentUserName(c), req, time.Now().UTC())
+	switch {
+	case errors.Is(err, errPlayStateStale):
+		c.JSON(http.StatusOK, gin.H{"status": "error", "code": "stale", "message": "Playback continued on another device", "state": st})
+	case err != nil:
+		log.Printf("Play state save error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to save play state"})
+	default:
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "state": st})
+	}
+}
+
+// validPlayState checks the fields of a saved state. Queue tracks the user
+// may not play are dropped, as for playlists.
+func validPlayState(c *gin.Context, st *playState) bool {
+	if st.Source != PLAY_SOURCE_LIST && st.Source != PLAY_SOURCE_BROWSER {
+		return false
+	}
+	if len(st.Device) > MAX_DEVICE_NAME || len(st.DeviceName) > MAX_DEVICE_NAME || st.Position < 0 || st.Index < 0 {
+		return false
+	}
+	if st.Queue != nil && !filterQueue(c, st) {
+		return false
+	}
+	if st.Track == "" {
+		return true
+	}
+	key, ok := cleanKey(st.Track)
+	st.Track = key
+	return ok && isAudioFile(key) && accessFor(c).allowed(key)
+}
+
+// filterQueue drops the queue tracks the user may not play and moves Index
+// with them, so it names the same track, or the next one kept when that
+// track was dropped. An index past the end of the queue is refused.
+func filterQueue(c *gin.Context, st *playState) bool {
+	if st.Index > 0 && st.Index >= len(st.Queue) {
+		return false
+	}
+	tracks, err := playlistTracks(c, st.Queue)
+	if err != nil {
+		return false
+	}
+	before, _ := playlistTracks(c, st.Queue[:st.Index])
+	st.Queue, st.Index = tracks, min(len(before), max(len(tracks)-1, 0))
+	return true
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPlayState checks saving and restoring the play state through the API
+func TestPlayState(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	origLocalMusicDir := localMusicDir
+	defer func() { localMusicDir = origLocalMusicDir }()
+	localMusicDir = tmpDir
+	withStateDir(t)
+	origStates := playStates
+	defer func() { playStates = origStates }()
+	playStates = newUserDocs[*playState](PLAY_STATE_FILE_PREFIX)
+	os.WriteFile(filepath.Join(tmpDir, "mix.mp3"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "next.mp3"), []byte("x"), 0644)
+
+	resp := historyAPI(t, "", "getPlayState", nil)
+	assert.Equal(t, "ok", resp["status"])
+	assert.Nil(t, resp["state"])
+
+	t0 := time.Now().UTC().Add(-time.Minute)
+	laptop := map[string]any{"device": "laptop", "source": "list", "queue": []string{"../x.mp3", "mix.mp3", "next.mp3"}, "index": 1, "track": "mix.mp3", "position": 3600.5, "updated": t0}
+	resp = historyAPI(t, "", "savePlayState", laptop)
+	assert.Equal(t, "ok", resp["status"])
+	state := resp["state"].(map[string]any)
+	assert.Equal(t, []any{"mix.mp3", "next.mp3"}, state["queue"], "invalid tracks are dropped")
+	assert.Equal(t, float64(0), state["index"], "the index follows its track")
+
+	// A save without the queue keeps the stored one.
+	laptop["position"], laptop["updated"] = 3615.0, t0.Add(15*time.Second)
+	delete(laptop, "queue")
+	resp = historyAPI(t, "", "savePlayState", laptop)
+	assert.Equal(t, "ok", resp["status"])
+
+	resp = historyAPI(t, "", "getPlayState", nil)
+	state = resp["state"].(map[string]any)
+	assert.Equal(t, 3615.0, state["position"])
+	assert.Len(t, state["queue"], 2)
+
+	// The phone takes over; the laptop's next periodic save is refused.
+	phone := map[string]any{"device": "phone", "source": "list", "track": "mix.mp3", "position": 3620.0, "updated": t0.Add(20 * time.Second)}
+	assert.Equal(t, "ok", historyAPI(t, "", "savePlayState", phone)["status"])
+	laptop["updated"], laptop["since"] = t0.Add(30*time.Second), state["updated"]
+	resp = historyAPI(t, "", "savePlayState", laptop)
+	assert.Equal(t, "stale", resp["code"])
+	assert.Equal(t, "phone", resp["state"].(map[string]any)["device"])
+
+	// An older change loses even when taking over.
+	delete(laptop, "since")
+	laptop["updated"] = t0.Add(10 * time.Second)
+	assert.Equal(t, "stale", historyAPI(t, "", "savePlayState", laptop)["code"])
+
+	assert.Equal(t, "error", historyAPI(t, "", "savePlayState", map[string]any{"source": "radio"})["status"])
+	assert.Equal(t, "error", historyAPI(t, "", "savePlayState", map[string]any{"source": "list", "queue": []string{"mix.mp3"}, "index": 1})["status"])
+	assert.Equal(t, "error", historyAPI(t, "", "savePlayState", map[string]any{"source": "list", "track": "../etc/passwd.mp3"})["status"])
+}
+
+// TestPlayStateClock checks that a device clock far ahead cannot pin the state
+func TestPlayStateClock(t *testing.T) {
+	withStateDir(t)
+	origStates := playStates
+	defer func() { playStates = origStates }()
+	playStates = newUserDocs[*playState](PLAY_STATE_FILE_PREFIX)
+
+	now := time.Now().UTC()
+	st, err := savePlayState("", playState{Device: "fast", Source: PLAY_SOURCE_LIST, Updated: now.Add(24 * time.Hour)}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, now, st.Updated)
+
+	st, err = savePlayState("", playState{Device: "other", Source: PLAY_SOURCE_LIST, Updated: now.Add(time.Second)}, now.Add(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, "other", st.Device)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+// S3_PROXY_BUFFER_SIZE is the copy buffer used per streamed response, which
+// bounds memory use regardless of object size.
+const S3_PROXY_BUFFER_SIZE = 32 * 1024
+
+// wantsJSON reports whether the client explicitly asked for a JSON response.
+func wantsJSON(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), "application/json")
+}
+
+// s3StreamHandler streams an S3 object to the client, passing Range, If-Range
+// and ETag validators through to S3 so browsers can seek and revalidate. The
+// S3 request uses the client's context, so it is cancelled on disconnect.
+func s3StreamHandler(c *gin.Context, key string) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(s3Prefix + key),
+	}
+	ranged := applyRangeHeaders(c, input)
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		input.IfNoneMatch = aws.String(inm)
+	} else if ims, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil {
+		input.IfModifiedSince = aws.Time(ims)
+	}
+
+	ctx := c.Request.Context()
+	out, err := s3Client.GetObject(ctx, input)
+	if err != nil && ranged && s3StatusCode(err) == http.StatusPreconditionFailed {
+		// If-Range validator no longer matches: send the full object.
+		input.Range, input.IfMatch, input.IfUnmodifiedSince = nil, nil, nil
+		out, err = s3Client.GetObject(ctx, input)
+	}
+	if err != nil {
+		s3StreamError(c, key, err)
+		return
+	}
+	defer func() { _ = out.Body.Close() }()
+
+	h := c.Writer.Header()
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Content-Type", s3ContentType(key, aws.ToString(out.ContentType)))
+	h.Set("Cache-Control", "private, no-cache")
+	if out.ContentLength != nil {
+		h.Set("Content-Length", strconv.FormatInt(*out.ContentLength, 10))
+	}
+	if out.ETag != nil {
+		h.Set("ETag", *out.ETag)
+	}
+	if out.LastModified != nil {
+		h.Set("Last-Modified", out.LastModified.UTC().Format(http.TimeFormat))
+	}
+	status := http.StatusOK
+	if out.ContentRange != nil {
+		h.Set("Content-Range", *out.ContentRange)
+		status = http.StatusPartialContent
+	}
+	c.Status(status)
+	if c.Request.Method == http.MethodHead {
+		return
+	}
+
+	buf := make([]byte, S3_PROXY_BUFFER_SIZE)
+	if _, err := io.CopyBuffer(c.Writer, out.Body, buf); err != nil && ctx.Err() == nil {
+		log.Printf("S3 stream error for key [%s]: %v", key, err)
+	}
+}
+
+// applyRangeHeaders copies the client's Range header onto input. An If-Range
+// validator becomes an S3 precondition so a stale range fails with 412 and
+// can be retried as a full request. It reports whether a range was applied.
+func applyRangeHeaders(c *gin.Context, input *s3.GetObjectInput) bool {
+	rng := c.GetHeader("Range")
+	if rng == "" {
+		return false
+	}
+	if ir := c.GetHeader("If-Range"); ir != "" {
+		if strings.HasPrefix(ir, `"`) {
+			input.IfMatch = aws.String(ir)
+		} else if t, err := http.ParseTime(ir); err == nil {
+			input.IfUnmodifiedSince = aws.Time(t)
+		} else {
+			return false
+		}
+	}
+	input.Range = aws.String(rng)
+	return true
+}
+
+func s3StreamError(c *gin.Context, key string, err error) {
+	switch s3StatusCode(err) {
+	case http.StatusNotModified:
+		c.Status(http.StatusNotModified)
+	case http.StatusNotFound:
+		c.String(http.StatusNotFound, "Audio not found")
+	case http.StatusRequestedRangeNotSatisfiable:
+		c.String(http.StatusRequestedRangeNotSatisfiable, "Requested range not satisfiable")
+	case http.StatusPreconditionFailed:
+		c.String(http.StatusPreconditionFailed, "Precondition failed")
+	default:
+		if c.Request.Context().Err() != nil {
+			return // client went away
+		}
+		log.Printf("S3 stream error for key [%s]: %v", key, err)
+		c.String(http.StatusBadGateway, "Failed to fetch audio")
+	}
+}
+
+// s3StatusCode returns the HTTP status of an S3 error response, or 0.
+func s3StatusCode(err error) int {
+	var re interface{ HTTPStatusCode() int }
+	if errors.As(err, &re) {
+		return re.HTTPStatusCode()
+	}
+	return 0
+}
+
+// s3ContentType prefers a specific stored content type and falls back to the
+// file extension, since many uploads are stored as binary/octet-stream.
+func s3ContentType(key, stored string) string {
+	if stored != "" && stored != "binary/octet-stream" && stored != "application/octet-stream" {
+		return stored
+	}
+	if ct := mime.TypeByExtension(strings.ToLower(filepath.Ext(key))); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is a minimal path-style S3 endpoint backed by memory. It supports
+// GetObject (with Range and conditional headers), HeadObject, PutObject
+// (with If-Match and If-None-Match) and ListObjectsV2, which is enough to
+// exercise the S3 code paths offline.
+type fakeS3 struct {
+	mu       sync.Mutex
+	bucket   string
+	objects  map[string][]byte
+	modTime  time.Time
+	requests []*http.Request
+}
+
+// newFakeS3 starts a fake S3 server and points the package S3 configuration
+// at it for the duration of the test.
+func newFakeS3(t *testing.T, objects map[string][]byte) *fakeS3 {
+	t.Helper()
+	f := &fakeS3{bucket: "music", objects: objects, modTime: time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)}
+	srv := httptest.NewServer(f)
+
+	origClient, origBucket, origPrefix, origLocal := s3Client, s3Bucket, s3Prefix, localMusicDir
+	t.Cleanup(func() {
+		srv.Close()
+		s3Client, s3Bucket, s3Prefix, localMusicDir = origClient, origBucket, origPrefix, origLocal
+	})
+	s3Client = s3.New(s3.Options{
+		Region:                     "us-east-1",
+		BaseEndpoint:               aws.String(srv.URL),
+		UsePathStyle:               true,
+		RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+	})
+	s3Bucket, s3Prefix, localMusicDir = f.bucket, "", ""
+	return f
+}
+
+func (f *fakeS3) etag(key string) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(f.objects[key]))
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.mu.Unlock()
+
+	key := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/"+f.bucket), "/")
+	if key == "" && req.URL.Query().Get("list-type") == "2" {
+		f.list(w, req)
+		return
+	}
+	if req.Method == http.MethodPut {
+		f.put(w, req, key)
+		return
+	}
+	f.mu.Lock()
+	data, ok := f.objects[key]
+	f.mu.Unlock()
+	if !ok {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>missing</Message></Error>`)
+		return
+	}
+	w.Header().Set("ETag", f.etag(key))
+	w.Header().Set("Content-Type", "binary/octet-stream")
+	http.ServeContent(w, req, "", f.modTime, bytes.NewReader(data))
+}
+
+func (f *fakeS3) put(w http.ResponseWriter, req *http.Request, key string) {
+	body, _ := io.ReadAll(req.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, exists := f.objects[key]
+	if (req.Header.Get("If-None-Match") == "*" && exists) ||
+		(req.Header.Get("If-Match") != "" && (!exists || req.Header.Get("If-Match") != f.etag(key))) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code><Message>precondition</Message></Error>`)
+		return
+	}
+	f.objects[key] = body
+	w.Header().Set("ETag", f.etag(key))
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, req *http.Request) {
+	type object struct {
+		Key          string
+		Size         int64
+		LastModified string
+		ETag         string
+	}
+	type commonPrefix struct{ Prefix string }
+	type result struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		IsTruncated    bool
+		Contents       []object
+		CommonPrefixes []commonPrefix
+	}
+
+	prefix := req.URL.Query().Get("prefix")
+	delim := req.URL.Query().Get("delimiter")
+	res := result{Name: f.bucket, Prefix: prefix}
+	seen := map[string]bool{}
+
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	f.mu.Unlock()
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(k, prefix)
+		if delim != "" {
+			if i := strings.Index(rest, delim); i >= 0 {
+				cp := prefix + rest[:i+len(delim)]
+				if !seen[cp] {
+					seen[cp] = true
+					res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{cp})
+				}
+				continue
+			}
+		}
+		res.Contents = append(res.Contents, object{Key: k, Size: int64(len(f.objects[k])), LastModified: f.modTime.Format(time.RFC3339), ETag: f.etag(k)})
+	}
+	res.KeyCount = len(res.Contents) + len(res.CommonPrefixes)
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+// TestS3Listing checks listing and opening objects through the fake S3 server
+func TestS3Listing(t *testing.T) {
+	newFakeS3(t, map[string][]byte{
+		"Rock/song.mp3":   []byte("abc"),
+		"Rock/best.m3u":   []byte("song.mp3\n"),
+		"Rock/cover.jpg":  []byte("jpg"),
+		"Rock/Live/a.mp3": []byte("a"),
+	})
+
+	listing, err := listDirEntries("Rock/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Live"}, listing.Dirs)
+	assert.Equal(t, []string{"song.mp3"}, listing.Files)
+	assert.Equal(t, []string{"best.m3u"}, listing.Playlists)
+
+	obj, err := openAudio(context.Background(), "Rock/song.mp3")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), obj.Size)
+	obj.Close()
+
+	_, err = openAudio(context.Background(), "Rock/missing.mp3")
+	assert.ErrorIs(t, err, errNotFound)
+}
+
+// TestS3ProxyMode checks that /audio streams S3 objects with Range support
+func TestS3ProxyMode(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	fake := newFakeS3(t, map[string][]byte{"Rock/song.mp3": content})
+
+	origProxy := s3ProxyMode
+	defer func() { s3ProxyMode = origProxy }()
+	s3ProxyMode = true
+
+	gin.SetMode(gin.TestMode)
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/audio/Rock/song.mp3", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Full object", func(t *testing.T) {
+		w := get(nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, content, w.Body.Bytes())
+		assert.Equal(t, "audio/mpeg", w.Header().Get("Content-Type"))
+		assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+		assert.Equal(t, fake.etag("Rock/song.mp3"), w.Header().Get("ETag"))
+		assert.Equal(t, "20", w.Header().Get("Content-Length"))
+	})
+
+	t.Run("Range request", func(t *testing.T) {
+		w := get(map[string]string{"Range": "bytes=5-9"})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "56789", w.Body.String())
+		assert.Equal(t, "bytes 5-9/20", w.Header().Get("Content-Range"))
+	})
+
+	t.Run("If-Range matching ETag keeps range", func(t *testing.T) {
+		w := get(map[string]string{"Range": "bytes=0-1", "If-Range": fake.etag("Rock/song.mp3")})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "01", w.Body.String())
+	})
+
+	t.Run("Stale If-Range returns full object", func(t *testing.T) {
+		w := get(map[string]string{"Range": "bytes=0-1", "If-Range": `"stale"`})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, content, w.Body.Bytes())
+	})
+
+	t.Run("If-None-Match revalidates", func(t *testing.T) {
+		w := get(map[string]string{"If-None-Match": fake.etag("Rock/song.mp3")})
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Empty(t, w.Body.Bytes())
+	})
+
+	t.Run("Unsatisfiable range", func(t *testing.T) {
+		w := get(map[string]string{"Range": "bytes=100-200"})
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+	})
+
+	t.Run("JSON clients get the proxied URL", func(t *testing.T) {
+		w := get(map[string]string{"Accept": "application/json"})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"url":"/audio/Rock/song.mp3"}`, w.Body.String())
+	})
+
+	t.Run("Missing object", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/audio/Rock/missing.mp3", nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+// TestS3ProxyCancelsOnDisconnect checks the S3 fetch uses the client context
+func TestS3ProxyCancelsOnDisconnect(t *testing.T) {
+	newFakeS3(t, map[string][]byte{"song.mp3": []byte("data")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/audio/song.mp3", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+	s3StreamHandler(c, "song.mp3")
+	assert.Empty(t, w.Body.Bytes(), "cancelled request must not stream data")
+}
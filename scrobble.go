@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scrobbling: play events are forwarded to the ListenBrainz and Last.fm
+// accounts users connect. A start becomes a "now playing" notice (best
+// effort) and a completed play a scrobble. Scrobbles that fail with a
+// temporary error are queued in a state document and retried with backoff,
+// by a background worker or, on Lambda, after later play events.
+
+const (
+	SCROBBLE_ACCOUNTS_FILE = "scrobble-accounts.json"
+	SCROBBLE_QUEUE_FILE    = "scrobble-queue.json"
+	SCROBBLE_TIMEOUT       = 5 * time.Second
+	SCROBBLE_RETRY_BATCH   = 20
+	SCROBBLE_MAX_BACKOFF   = 6 * time.Hour
+	SCROBBLE_MAX_AGE       = 14 * 24 * time.Hour // Last.fm refuses older scrobbles
+	SCROBBLE_CLIENT        = "go-music"
+	SERVICE_LISTENBRAINZ   = "listenbrainz"
+	SERVICE_LASTFM         = "lastfm"
+	LASTFM_CALLBACK_PATH   = "/scrobble/lastfm/callback"
+	LASTFM_STATE_TTL       = 15 * time.Minute
+	DEFAULT_LISTENBRAINZ   = "https://api.listenbrainz.org"
+	DEFAULT_LASTFM_API     = "https://ws.audioscrobbler.com/2.0/"
+	DEFAULT_LASTFM_AUTH    = "https://www.last.fm/api/auth/"
+	DEFAULT_SCROBBLE_RETRY = time.Minute
+)
+
+var (
+	listenBrainzURL = envDefault("LISTENBRAINZ_URL", DEFAULT_LISTENBRAINZ)
+	lastfmAPIURL    = envDefault("LASTFM_URL", DEFAULT_LASTFM_API)
+	lastfmAuthURL   = envDefault("LASTFM_AUTH_URL", DEFAULT_LASTFM_AUTH)
+	lastfmAPIKey    = os.Getenv("LASTFM_API_KEY")
+	lastfmSecret    = os.Getenv("LASTFM_API_SECRET")
+	scrobbleRetry   = envDuration("SCROBBLE_RETRY_INTERVAL", DEFAULT_SCROBBLE_RETRY)
+	scrobbleClient  = &http.Client{Timeout: SCROBBLE_TIMEOUT}
+
+	scrobbleAccounts = &stateDoc[[]*scrobbleAccount]{name: SCROBBLE_ACCOUNTS_FILE}
+	scrobbleQueue    = &stateDoc[[]*queuedScrobble]{name: SCROBBLE_QUEUE_FILE}
+)
+
+// scrobbleAccount holds a user's scrobbling credentials.
+type scrobbleAccount struct {
+	User              string `json:"user"`
+	ListenBrainzToken string `json:"listenbrainzToken,omitempty"`
+	ListenBrainzUser  string `json:"listenbrainzUser,omitempty"`
+	LastfmSession     string `json:"lastfmSession,omitempty"`
+	LastfmUser        string `json:"lastfmUser,omitempty"`
+}
+
+// listen is one play as sent to the services.
+type listen struct {
+	Artist      string    `json:"artist"`
+	Track       string    `json:"track"`
+	Album       string    `json:"album,omitempty"`
+	TrackNumber int       `json:"trackNumber,omitempty"`
+	Duration    int       `json:"duration,omitempty"`
+	ListenedAt  time.Time `json:"listenedAt"`
+}
+
+// queuedScrobble is a scrobble waiting to be retried.
+type queuedScrobble struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Service   string    `json:"service"`
+	Listen    listen    `json:"listen"`
+	Attempts  int       `json:"attempts"`
+	NextTry   time.Time `json:"nextTry"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// scrobbleError is a failed submission. Temporary errors (network errors,
+// rate limits, server errors) are retried.
+type scrobbleError struct {
+	temporary bool
+	msg       string
+}
+
+func (e *scrobbleError) Error() string { return e.msg }
+
+func isTemporary(err error) bool {
+	var se *scrobbleError
+	return !errors.As(err, &se) || se.temporary
+}
+
+// scrobbler submits listens to one service.
+type scrobbler interface {
+	connected(a *scrobbleAccount) bool
+	nowPlaying(ctx context.Context, a *scrobbleAccount, l listen) error
+	scrobble(ctx context.Context, a *scrobbleAccount, l listen) error
+}
+
+var scrobblers = map[string]scrobbler{
+	SERVICE_LISTENBRAINZ: listenBrainz{},
+	SERVICE_LASTFM:       lastfm{},
+}
+
+// --- Play events ---
+
+// scrobblePlay forwards a recorded play event to acct's services.
+func scrobblePlay(ctx context.Context, acct *scrobbleAccount, event string, rec playRecord) {
+	owner := acct.User
+	meta := trackMeta(ctx, rec.Path)
+	if meta.Artist == "" {
+		return // both services require an artist
+	}
+	l := listen{Artist: meta.Artist, Track: meta.Title, Album: meta.Album, TrackNumber: meta.TrackNumber, Duration: meta.Duration, ListenedAt: rec.Time}
+	if l.Duration == 0 {
+		l.Duration = rec.Duration
+	}
+	for _, name := range sortedServices() {
+		s := scrobblers[name]
+		if !s.connected(acct) {
+			continue
+		}
+		if event == PLAY_EVENT_START {
+			if err := s.nowPlaying(ctx, acct, l); err != nil {
+				log.Printf("Scrobble now playing to %s for %q failed: %v", name, owner, err)
+			}
+			continue
+		}
+		if err := s.scrobble(ctx, acct, l); err != nil {
+			log.Printf("Scrobble to %s for %q failed: %v", name, owner, err)
+			if isTemporary(err) {
+				queueScrobble(owner, name, l, err)
+			}
+		}
+	}
+}
+
+func sortedServices() []string {
+	names := make([]string, 0, len(scrobblers))
+	for name := range scrobblers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func findScrobbleAccount(user string) *scrobbleAccount {
+	accts, err := scrobbleAccounts.get()
+	if err != nil {
+		log.Printf("Scrobble account load error: %v", err)
+	}
+	for _, a := range accts {
+		if a.User == user {
+			return a
+		}
+	}
+	return nil
+}
+
+// updateScrobbleAccount applies change to user's account, creating it.
+func updateScrobbleAccount(user string, change func(*scrobbleAccount)) error {
+	_, err := scrobbleAccounts.update(func(accts *[]*scrobbleAccount) error {
+		i := slices.IndexFunc(*accts, func(a *scrobbleAccount) bool { return a.User == user })
+		if i < 0 {
+			*accts = append(*accts, &scrobbleAccount{User: user})
+			i = len(*accts) - 1
+		}
+		change((*accts)[i])
+		if a := (*accts)[i]; a.ListenBrainzToken == "" && a.LastfmSession == "" {
+			*accts = slices.Delete(*accts, i, i+1)
+		}
+		return nil
+	})
+	return err
+}
+
+// --- Retry queue ---
+
+func queueScrobble(user, service string, l listen, cause error) {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	q := &queuedScrobble{ID: hex.EncodeToString(id), User: user, Service: service, Listen: l, Attempts: 1, NextTry: time.Now().Add(scrobbleRetry), LastError: cause.Error()}
+	if _, err := scrobbleQueue.update(func(queue *[]*queuedScrobble) error {
+		*queue = append(*queue, q)
+		return nil
+	}); err != nil {
+		log.Printf("Scrobble queue save error: %v", err)
+	}
+}
+
+// retryScrobbles submits the queued scrobbles that are due. Scrobbles are
+// dropped when they succeed, fail permanently or become too old.
+func retryScrobbles(ctx context.Context, now time.Time) {
+	queue, err := scrobbleQueue.get()
+	if err != nil {
+		log.Printf("Scrobble queue load error: %v", err)
+		return
+	}
+	results := map[string]error{}
+	for _, q := range queue {
+		if len(results) == SCROBBLE_RETRY_BATCH {
+			break
+		}
+		if q.NextTry.After(now) || now.Sub(q.Listen.ListenedAt) > SCROBBLE_MAX_AGE {
+			continue
+		}
+		results[q.ID] = submitQueued(ctx, q)
+	}
+	if _, err := scrobbleQueue.update(func(queue *[]*queuedScrobble) error {
+		*queue = slices.DeleteFunc(*queue, func(q *queuedScrobble) bool {
+			return now.Sub(q.Listen.ListenedAt) > SCROBBLE_MAX_AGE || settleQueued(q, results, now)
+		})
+		return nil
+	}); err != nil {
+		log.Printf("Scrobble queue save error: %v", err)
+	}
+}
+
+func submitQueued(ctx context.Context, q *queuedScrobble) error {
+	s, ok := scrobblers[q.Service]
+	acct := findScrobbleAccount(q.User)
+	if !ok || acct == nil || !s.connected(acct) {
+		return &scrobbleError{msg: "account disconnected"}
+	}
+	return s.scrobble(ctx, acct, q.Listen)
+}
+
+// settleQueued records the result of a retry and reports whether q is done.
+func settleQueued(q *queuedScrobble, results map[string]error, now time.Time) bool {
+	err, tried := results[q.ID]
+	if !tried {
+		return false
+	}
+	if err == nil {
+		return true
+	}
+	if !isTemporary(err) {
+		log.Printf("Dropping scrobble to %s for %q: %v", q.Service, q.User, err)
+		return true
+	}
+	q.Attempts++
+	q.LastError = err.Error()
+	q.NextTry = now.Add(min(scrobbleRetry<<min(q.Attempts, 16), SCROBBLE_MAX_BACKOFF))
+	return false
+}
+
+// startScrobbleWorker retries queued scrobbles every SCROBBLE_RETRY_INTERVAL.
+func startScrobbleWorker() {
+	go func() {
+		for range time.Tick(scrobbleRetry) {
+			ctx, cancel := context.WithTimeout(context.Background(), scrobbleRetry)
+			retryScrobbles(ctx, time.Now())
+			cancel()
+		}
+	}()
+}
+
+// --- ListenBrainz ---
+
+type listenBrainz struct{}
+
+func (listenBrainz) connected(a *scrobbleAccount) bool { return a.ListenBrainzToken != "" }
+
+func (lb listenBrainz) nowPlaying(ctx context.Context, a *scrobbleAccount, l listen) error {
+	return lb.submit(ctx, a.ListenBrainzToken, "playing_now", l)
+}
+
+func (lb listenBrainz) scrobble(ctx context.Context, a *scrobbleAccount, l listen) error {
+	return lb.submit(ctx, a.ListenBrainzToken, "single", l)
+}
+
+func (listenBrainz) submit(ctx context.Context, token, listenType string, l listen) error {
+	info := map[string]any{"submission_client": SCROBBLE_CLIENT}
+	if l.Duration > 0 {
+		info["duration_ms"] = l.Duration * 1000
+	}
+	if l.TrackNumber > 0 {
+		info["tracknumber"] = l.TrackNumber
+	}
+	payload := map[string]any{"track_metadata": map[string]any{
+		"artist_name":     l.Artist,
+		"track_name":      l.Track,
+		"release_name":    l.Album,
+		"additional_info": info,
+	}}
+	if listenType == "single" {
+		payload["listened_at"] = l.ListenedAt.Unix()
+	}
+	body, _ := json.Marshal(map[string]any{"listen_type": listenType, "payload": []any{payload}})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(listenBrainzURL, "/")+"/1/submit-listens", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Token "+token)
+	_, err = scrobbleDo(req)
+	return err
+}
+
+// validateListenBrainzToken returns the user name a token belongs to.
+func validateListenBrainzToken(ctx context.Context, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(listenBrainzURL, "/")+"/1/validate-token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Token "+token)
+	body, err := scrobbleDo(req)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Valid    bool   `json:"valid"`
+		UserName string `json:"user_name"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || !resp.Valid {
+		return "", &scrobbleError{msg: "invalid token"}
+	}
+	return resp.UserName, nil
+}
+
+// scrobbleDo sends req and returns the response body. Network errors, 429
+// and 5xx responses are temporary errors.
+func scrobbleDo(req *http.Request) ([]byte, error) {
+	resp, err := scrobbleClient.Do(req)
+	if err != nil {
+		return nil, &scrobbleError{temporary: true, msg: err.Error()}
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, &scrobbleError{temporary: true, msg: err.Error()}
+	}
+	if resp.StatusCode >= 300 {
+		temporary := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return body, &scrobbleError{temporary: temporary, msg: fmt.Sprintf("%s: HTTP %d", req.URL.Host, resp.StatusCode)}
+	}
+	return body, nil
+}
+
+// --- Last.fm ---
+
+type lastfm struct{}
+
+func lastfmAvailable() bool { return lastfmAPIKey != "" && lastfmSecret != "" }
+
+func (lastfm) connected(a *scrobbleAccount) bool {
+	return a.LastfmSession != "" && lastfmAvailable()
+}
+
+func (lastfm) nowPlaying(ctx context.Context, a *scrobbleAccount, l listen) error {
+	params := lastfmTrackParams(l)
+	params.Set("sk", a.LastfmSession)
+	_, err := lastfmCall(ctx, "track.updateNowPlaying", params)
+	return err
+}
+
+func (lastfm) scrobble(ctx context.Context, a *scrobbleAccount, l listen) error {
+	params := lastfmTrackParams(l)
+	params.Set("sk", a.LastfmSession)
+	params.Set("timestamp", strconv.FormatInt(l.ListenedAt.Unix(), 10))
+	_, err := lastfmCall(ctx, "track.scrobble", params)
+	return err
+}
+
+func lastfmTrackParams(l listen) url.Values {
+	params := url.Values{"artist": {l.Artist}, "track": {l.Track}}
+	if l.Album != "" {
+		params.Set("album", l.Album)
+	}
+	if l.Duration > 0 {
+		params.Set("duration", strconv.Itoa(l.Duration))
+	}
+	if l.TrackNumber > 0 {
+		params.Set("trackNumber", strconv.Itoa(l.TrackNumber))
+	}
+	return params
+}
+
+// lastfmCall calls a signed Last.fm API method and returns the JSON body.
+func lastfmCall(ctx context.Context, method string, params url.Values) ([]byte, error) {
+	params.Set("method", method)
+	params.Set("api_key", lastfmAPIKey)
+	params.Set("api_sig", lastfmSignature(params))
+	params.Set("format", "json")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, lastfmAPIURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := scrobbleDo(req)
+	var apiErr struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != 0 {
+		// 11 service offline, 16 temporarily unavailable, 29 rate limit
+		temporary := apiErr.Error == 11 || apiErr.Error == 16 || apiErr.Error == 29
+		return nil, &scrobbleError{temporary: temporary, msg: fmt.Sprintf("last.fm error %d: %s", apiErr.Error, apiErr.Message)}
+	}
+	return body, err
+}
+
+// lastfmSignature signs params: the MD5 of the sorted names and values
+// followed by the shared secret.
+func lastfmSignature(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if k != "format" && k != "callback" && k != "api_sig" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteString(params.Get(k))
+	}
+	b.WriteString(lastfmSecret)
+	sum := md5.Sum([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// --- Routes and API functions ---
+
+// lastfmConnectHandler sends the user to Last.fm to authorize the app.
+func lastfmConnectHandler(c *gin.Context) {
+	if !lastfmAvailable() {
+		c.String(http.StatusNotFound, "Last.fm is not configured")
+		return
+	}
+	cb := requestBaseURL(c) + LASTFM_CALLBACK_PATH + "?" + url.Values{"state": {lastfmState(currentUserName(c), time.Now())}}.Encode()
+	q := url.Values{"api_key": {lastfmAPIKey}, "cb": {cb}}
+	c.Redirect(http.StatusFound, lastfmAuthURL+"?"+q.Encode())
+}
+
+// lastfmState returns the state carried through Last.fm's authorization:
+// an expiry signed together with the user who started it, so a callback
+// can only connect an account for that user.
+func lastfmState(user string, now time.Time) string {
+	expires := strconv.FormatInt(now.Add(LASTFM_STATE_TTL).Unix(), 10)
+	return expires + "." + lastfmStateMAC(user, expires)
+}
+
+func lastfmStateMAC(user, expires string) string {
+	mac := hmac.New(sha256.New, []byte(lastfmSecret))
+	mac.Write([]byte("lastfm-state\x00" + user + "\x00" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validLastfmState(user, state string, now time.Time) bool {
+	expires, sig, ok := strings.Cut(state, ".")
+	n, err := strconv.ParseInt(expires, 10, 64)
+	return ok && err == nil && now.Unix() <= n && hmac.Equal([]byte(sig), []byte(lastfmStateMAC(user, expires)))
+}
+
+// lastfmCallbackHandler exchanges the token Last.fm returns for a session.
+// The state must have been issued to the signed-in user, so a link carrying
+// someone else's token cannot connect their account.
+func lastfmCallbackHandler(c *gin.Context) {
+	token := c.Query("token")
+	if !lastfmAvailable() || token == "" {
+		c.String(http.StatusBadRequest, "Missing Last.fm token")
+		return
+	}
+	if !validLastfmState(currentUserName(c), c.Query("state"), time.Now()) {
+		c.String(http.StatusForbidden, "Invalid or expired Last.fm authorization; connect again")
+		return
+	}
+	body, err := lastfmCall(c.Request.Context(), "auth.getSession", url.Values{"token": {token}})
+	var resp struct {
+		Session struct {
+			Name string `json:"name"`
+			Key  string `json:"key"`
+		} `json:"session"`
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &resp)
+	}
+	if err != nil || resp.Session.Key == "" {
+		log.Printf("Last.fm session error: %v", err)
+		c.String(http.StatusBadGateway, "Could not connect to Last.fm")
+		return
+	}
+	if err := updateScrobbleAccount(currentUserName(c), func(a *scrobbleAccount) {
+		a.LastfmSession, a.LastfmUser = resp.Session.Key, resp.Session.Name
+	}); err != nil {
+		log.Printf("Scrobble account save error: %v", err)
+		c.String(http.StatusInternalServerError, "Could not save Last.fm account")
+		return
+	}
+	c.Redirect(http.StatusFound, "/")
+}
+
+// handleScrobbleSettings reports the caller's connected services.
+func handleScrobbleSettings(c *gin.Context, _ string) {
+	acct := findScrobbleAccount(currentUserName(c))
+	if acct == nil {
+		acct = &scrobbleAccount{}
+	}
+	queued := 0
+	queue, _ := scrobbleQueue.get()
+	for _, q := range queue {
+		if q.User == currentUserName(c) {
+			queued++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":       "ok",
+		"listenbrainz": gin.H{"connected": acct.ListenBrainzToken != "", "user": acct.ListenBrainzUser},
+		"lastfm":       gin.H{"available": lastfmAvailable(), "connected": acct.LastfmSession != "", "user": acct.LastfmUser, "connectUrl": "/scrobble/lastfm/connect"},
+		"queued":       queued,
+	})
+}
+
+// handleSetListenBrainzToken connects the ListenBrainz account a user token
+// belongs to. Data: {"token":...}; an empty token disconnects it.
+func handleSetListenBrainzToken(c *gin.Context, raw string) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid request"})
+		return
+	}
+	token, name := strings.TrimSpace(req.Token), ""
+	if token != "" {
+		var err error
+		if name, err = validateListenBrainzToken(c.Request.Context(), token); err != nil {
+			c.JSON(http.StatusOK, gin.H{"status": "error", "message": "ListenBrainz rejected the token"})
+			return
+		}
+	}
+	if err := updateScrobbleAccount(currentUserName(c), func(a *scrobbleAccount) {
+		a.ListenBrainzToken, a.ListenBrainzUser = token, name
+	}); err != nil {
+		log.Printf("Scrobble account save error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to save settings"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "user": name})
+}
+
+func handleDisconnectLastfm(c *gin.Context, _ string) {
+	if err := updateScrobbleAccount(currentUserName(c), func(a *scrobbleAccount) {
+		a.LastfmSession, a.LastfmUser = "", ""
+	}); err != nil {
+		log.Printf("Scrobble account save error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to save settings"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockScrobbleServer records requests to a fake ListenBrainz or Last.fm API
+type mockScrobbleServer struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	status   int    // response status
+	response string // response body
+}
+
+func newMockScrobbleServer(t *testing.T, response string) (*mockScrobbleServer, *httptest.Server) {
+	m := &mockScrobbleServer{status: http.StatusOK, response: response}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.requests = append(m.requests, req)
+		m.bodies = append(m.bodies, string(body))
+		w.WriteHeader(m.status)
+		_, _ = w.Write([]byte(m.response))
+	}))
+	t.Cleanup(srv.Close)
+	return m, srv
+}
+
+// withScrobbling points the scrobblers at mock servers
+func withScrobbling(t *testing.T, lbURL, lastfmURL string) {
+	t.Helper()
+	origLB, origLastfm, origKey, origSecret := listenBrainzURL, lastfmAPIURL, lastfmAPIKey, lastfmSecret
+	origAccounts, origQueue := scrobbleAccounts, scrobbleQueue
+	t.Cleanup(func() {
+		listenBrainzURL, lastfmAPIURL, lastfmAPIKey, lastfmSecret = origLB, origLastfm, origKey, origSecret
+		scrobbleAccounts, scrobbleQueue = origAccounts, origQueue
+	})
+	listenBrainzURL, lastfmAPIURL, lastfmAPIKey, lastfmSecret = lbURL, lastfmURL, "key", "secret"
+	scrobbleAccounts = &stateDoc[[]*scrobbleAccount]{name: SCROBBLE_ACCOUNTS_FILE}
+	scrobbleQueue = &stateDoc[[]*queuedScrobble]{name: SCROBBLE_QUEUE_FILE}
+	withStateDir(t)
+}
+
+// TestListenBrainzSubmit checks the ListenBrainz payloads
+func TestListenBrainzSubmit(t *testing.T) {
+	lb, srv := newMockScrobbleServer(t, `{"status":"ok"}`)
+	withScrobbling(t, srv.URL, "")
+	acct := &scrobbleAccount{User: "alice", ListenBrainzToken: "tok"}
+	played := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	l := listen{Artist: "Miles Davis", Track: "So What", Album: "Kind of Blue", TrackNumber: 1, Duration: 545, ListenedAt: played}
+
+	assert.NoError(t, listenBrainz{}.nowPlaying(context.Background(), acct, l))
+	assert.NoError(t, listenBrainz{}.scrobble(context.Background(), acct, l))
+	assert.Len(t, lb.requests, 2)
+	assert.Equal(t, "/1/submit-listens", lb.requests[1].URL.Path)
+	assert.Equal(t, "Token tok", lb.requests[1].Header.Get("Authorization"))
+
+	var body struct {
+		ListenType string `json:"listen_type"`
+		Payload    []struct {
+			ListenedAt int64 `json:"listened_at"`
+			Track      struct {
+				Artist string         `json:"artist_name"`
+				Track  string         `json:"track_name"`
+				Album  string         `json:"release_name"`
+				Info   map[string]any `json:"additional_info"`
+			} `json:"track_metadata"`
+		} `json:"payload"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(lb.bodies[0]), &body))
+	assert.Equal(t, "playing_now", body.ListenType)
+	assert.Zero(t, body.Payload[0].ListenedAt)
+	assert.NoError(t, json.Unmarshal([]byte(lb.bodies[1]), &body))
+	assert.Equal(t, "single", body.ListenType)
+	assert.Equal(t, played.Unix(), body.Payload[0].ListenedAt)
+	assert.Equal(t, "Kind of Blue", body.Payload[0].Track.Album)
+	assert.Equal(t, float64(545000), body.Payload[0].Track.Info["duration_ms"])
+
+	lb.status = http.StatusUnauthorized
+	err := listenBrainz{}.scrobble(context.Background(), acct, l)
+	assert.Error(t, err)
+	assert.False(t, isTemporary(err))
+	lb.status = http.StatusServiceUnavailable
+	assert.True(t, isTemporary(listenBrainz{}.scrobble(context.Background(), acct, l)))
+}
+
+// TestLastfmSubmit checks the Last.fm signature and error handling
+func TestLastfmSubmit(t *testing.T) {
+	fm, srv := newMockScrobbleServer(t, `{"scrobbles":{}}`)
+	withScrobbling(t, "", srv.URL)
+	acct := &scrobbleAccount{User: "alice", LastfmSession: "sk1"}
+	l := listen{Artist: "Miles Davis", Track: "So What", ListenedAt: time.Unix(1700000000, 0)}
+
+	assert.NoError(t, lastfm{}.scrobble(context.Background(), acct, l))
+	form, err := url.ParseQuery(fm.bodies[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "track.scrobble", form.Get("method"))
+	assert.Equal(t, "1700000000", form.Get("timestamp"))
+	assert.Equal(t, "sk1", form.Get("sk"))
+	assert.Equal(t, "json", form.Get("format"))
+	sig := form.Get("api_sig")
+	form.Del("api_sig")
+	assert.Equal(t, lastfmSignature(form), sig)
+
+	// The signature is the MD5 of the sorted parameters and the secret.
+	assert.Equal(t, "670699129dd49818b5abd9e7c2fd6569", lastfmSignature(url.Values{"b": {"2"}, "a": {"1"}, "format": {"json"}}))
+
+	fm.response = `{"error":29,"message":"Rate limit exceeded"}`
+	assert.True(t, isTemporary(lastfm{}.scrobble(context.Background(), acct, l)))
+	fm.response = `{"error":9,"message":"Invalid session key"}`
+	assert.False(t, isTemporary(lastfm{}.scrobble(context.Background(), acct, l)))
+
+	lastfmSecret = ""
+	assert.False(t, lastfm{}.connected(acct), "Last.fm needs an API key and secret")
+}
+
+// TestScrobbleQueue checks that failed scrobbles are retried
+func TestScrobbleQueue(t *testing.T) {
+	origLocalMusicDir := localMusicDir
+	defer func() { localMusicDir = origLocalMusicDir }()
+	localMusicDir = t.TempDir()
+	lb, srv := newMockScrobbleServer(t, `{"status":"ok"}`)
+	withScrobbling(t, srv.URL, "")
+	assert.NoError(t, updateScrobbleAccount("alice", func(a *scrobbleAccount) { a.ListenBrainzToken = "tok" }))
+	acct := findScrobbleAccount("alice")
+	assert.NotNil(t, acct)
+
+	now := time.Now()
+	lb.status = http.StatusBadGateway
+	rec := playRecord{Path: "Miles Davis/Kind of Blue/So What.mp3", Time: now}
+	scrobblePlay(context.Background(), acct, PLAY_EVENT_COMPLETE, rec)
+	queue, _ := scrobbleQueue.get()
+	assert.Len(t, queue, 1)
+	assert.Equal(t, "Miles Davis", queue[0].Listen.Artist)
+
+	retryScrobbles(context.Background(), now)
+	assert.Len(t, lb.requests, 1, "not due yet")
+
+	retryScrobbles(context.Background(), now.Add(2*scrobbleRetry))
+	assert.Len(t, lb.requests, 2)
+	queue, _ = scrobbleQueue.get()
+	assert.Equal(t, 2, queue[0].Attempts, "still failing")
+
+	lb.status = http.StatusOK
+	retryScrobbles(context.Background(), now.Add(time.Hour))
+	queue, _ = scrobbleQueue.get()
+	assert.Empty(t, queue)
+
+	// Now playing notices are not queued.
+	lb.status = http.StatusBadGateway
+	scrobblePlay(context.Background(), acct, PLAY_EVENT_START, rec)
+	queue, _ = scrobbleQueue.get()
+	assert.Empty(t, queue)
+
+	// Stale scrobbles are dropped.
+	queueScrobble("alice", SERVICE_LISTENBRAINZ, listen{Artist: "A", ListenedAt: now}, io.EOF)
+	retryScrobbles(context.Background(), now.Add(SCROBBLE_MAX_AGE+time.Hour))
+	queue, _ = scrobbleQueue.get()
+	assert.Empty(t, queue)
+}
+
+// TestScrobbleSettings checks connecting accounts through the API
+func TestScrobbleSettings(t *testing.T) {
+	lb, srv := newMockScrobbleServer(t, `{"valid":true,"user_name":"alice_lb"}`)
+	withScrobbling(t, srv.URL, "")
+
+	resp := historyAPI(t, "", "setListenBrainzToken", map[string]string{"token": "tok"})
+	assert.Equal(t, "ok", resp["status"])
+	assert.Equal(t, "alice_lb", resp["user"])
+	assert.Equal(t, "/1/validate-token", lb.requests[0].URL.Path)
+
+	resp = historyAPI(t, "", "scrobbleSettings", nil)
+	assert.Equal(t, true, resp["listenbrainz"].(map[string]any)["connected"])
+	assert.Equal(t, false, resp["lastfm"].(map[string]any)["connected"])
+
+	lb.response = `{"valid":false}`
+	assert.Equal(t, "error", historyAPI(t, "", "setListenBrainzToken", map[string]string{"token": "bad"})["status"])
+
+	assert.Equal(t, "ok", historyAPI(t, "", "setListenBrainzToken", map[string]string{"token": ""})["status"])
+	assert.Nil(t, findScrobbleAccount(""), "accounts without services are removed")
+}
+
+// TestLastfmConnect checks that the callback only accepts a state issued to
+// the signed-in user
+func TestLastfmConnect(t *testing.T) {
+	lf, srv := newMockScrobbleServer(t, `{"session":{"name":"alice_lf","key":"sk"}}`)
+	withScrobbling(t, "", srv.URL)
+	withAuthUsers(t, map[string]*authUser{
+		"alice": {Password: bcryptHash(t, "sesame")},
+		"bob":   {Password: bcryptHash(t, "sesame")},
+	})
+	get := func(user, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.SetBasicAuth(user, "sesame")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("alice", "/scrobble/lastfm/connect")
+	assert.Equal(t, http.StatusFound, w.Code)
+	loc, err := url.Parse(w.Header().Get("Location"))
+	assert.NoError(t, err)
+	cb, err := url.Parse(loc.Query().Get("cb"))
+	assert.NoError(t, err)
+	assert.Equal(t, LASTFM_CALLBACK_PATH, cb.Path)
+	state := cb.Query().Get("state")
+	assert.NotEmpty(t, state)
+
+	callback := LASTFM_CALLBACK_PATH + "?" + url.Values{"token": {"tok"}, "state": {state}}.Encode()
+	assert.Equal(t, http.StatusForbidden, get("bob", callback).Code, "a state issued to another user is refused")
+	assert.Equal(t, http.StatusForbidden, get("alice", LASTFM_CALLBACK_PATH+"?token=tok").Code)
+	assert.Empty(t, lf.requests)
+	assert.Nil(t, findScrobbleAccount("bob"))
+
+	assert.Equal(t, http.StatusFound, get("alice", callback).Code)
+	assert.Equal(t, "alice_lf", findScrobbleAccount("alice").LastfmUser)
+
+	now := time.Now()
+	assert.False(t, validLastfmState("alice", lastfmState("alice", now), now.Add(LASTFM_STATE_TTL+time.Minute)), "states expire")
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	SHARE_PREFIX        = "/s/"
+	SHARE_COOKIE_PREFIX = "gomusic_share_"
+	SHARES_FILE         = "shares.json"
+	DEFAULT_SHARE_TTL   = 7 * 24 * time.Hour
+	DEFAULT_SHARE_MAX   = 90 * 24 * time.Hour
+)
+
+// Share links expire after SHARE_TTL unless the request asks for another
+// lifetime, which may not exceed SHARE_MAX_TTL. Tokens are signed with
+// SHARE_SECRET, falling back to AUTH_SECRET.
+var (
+	shareTTL    = envDuration("SHARE_TTL", DEFAULT_SHARE_TTL)
+	shareMaxTTL = envDuration("SHARE_MAX_TTL", DEFAULT_SHARE_MAX)
+	shareSecret []byte
+	shareTmpl   *template.Template
+	shares      = newShareStore()
+)
+
+// shareLink grants access without an account to a library path (a track, a
+// directory or a playlist file) or to a fixed list of tracks.
+type shareLink struct {
+	ID       string    `json:"id"`
+	Owner    string    `json:"owner,omitempty"`
+	Name     string    `json:"name"`
+	Path     string    `json:"path,omitempty"`
+	Tracks   []string  `json:"tracks,omitempty"`
+	Password string    `json:"password,omitempty"` // bcrypt hash
+	Download bool      `json:"download"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+}
+
+func (l *shareLink) expired(now time.Time) bool { return !now.Before(l.Expires) }
+
+// initShares sets the signing key and loads the links saved in DATA_DIR.
+func initShares() error {
+	secret := os.Getenv("SHARE_SECRET")
+	if secret == "" {
+		secret = os.Getenv("AUTH_SECRET")
+	}
+	if secret != "" {
+		shareSecret = []byte(secret)
+	} else {
+		shareSecret = make([]byte, 32)
+		if _, err := rand.Read(shareSecret); err != nil {
+			return err
+		}
+		log.Printf("SHARE_SECRET not set; share links will not survive a restart")
+	}
+	return shares.load()
+}
+
+// --- Store ---
+
+// shareStore keeps the links in the shares.json state document.
+type shareStore struct {
+	doc *stateDoc[[]*shareLink]
+}
+
+func newShareStore() *shareStore {
+	return &shareStore{doc: &stateDoc[[]*shareLink]{name: SHARES_FILE}}
+}
+
+func (s *shareStore) load() error {
+	_, err := s.doc.get()
+	return err
+}
+
+// add stores l and drops expired links.
+func (s *shareStore) add(l *shareLink) error {
+	_, err := s.doc.update(func(links *[]*shareLink) error {
+		now := time.Now()
+		*links = slices.DeleteFunc(*links, func(old *shareLink) bool { return old.expired(now) || old.ID == l.ID })
+		if !l.expired(now) {
+			*links = append(*links, l)
+		}
+		return nil
+	})
+	return err
+}
+
+// get returns a link that has not expired.
+func (s *shareStore) get(id string) (*shareLink, bool) {
+	l := s.find(id)
+	if l == nil || l.expired(time.Now()) {
+		return nil, false
+	}
+	return l, true
+}
+
+// find looks id up, reading the links again if it is not cached.
+func (s *shareStore) find(id string) *shareLink {
+	links, err := s.doc.get()
+	if i := slices.IndexFunc(links, func(l *shareLink) bool { return l.ID == id }); i >= 0 {
+		return links[i]
+	}
+	if links, err = s.doc.refresh(); err != nil {
+		log.Printf("Share load error: %v", err)
+	}
+	if i := slices.IndexFunc(links, func(l *shareLink) bool { return l.ID == id }); i >= 0 {
+		return links[i]
+	}
+	return nil
+}
+
+// remove deletes the link id if it belongs to owner.
+func (s *shareStore) remove(id, owner string) (bool, error) {
+	if l := s.find(id); l == nil || l.Owner != owner {
+		return false, nil
+	}
+	_, err := s.doc.update(func(links *[]*shareLink) error {
+		*links = slices.DeleteFunc(*links, func(l *shareLink) bool { return l.ID == id && l.Owner == owner })
+		return nil
+	})
+	return err == nil, err
+}
+
+// list returns owner's live links, newest first.
+func (s *shareStore) list(owner string) []*shareLink {
+	links, err := s.doc.get()
+	if err != nil {
+		log.Printf("Share load error: %v", err)
+	}
+	now := time.Now()
+	var out []*shareLink
+	for _, l := range links {
+		if l.Owner == owner && !l.expired(now) {
+			out = append(out, l)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out
+}
+
+// --- Tokens ---
+
+// shareToken is the link ID and a signature over the ID and expiry, so
+// guessed or altered tokens are rejected before the store is consulted.
+func shareToken(l *shareLink) string {
+	return l.ID + "." + shareMAC("link", l.ID, strconv.FormatInt(l.Expires.Unix(), 10))
+}
+
+func shareMAC(parts ...string) string {
+	mac := hmac.New(sha256.New, shareSecret)
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func shareFromToken(token string) (*shareLink, bool) {
+	id, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, false
+	}
+	l, found := shares.get(id)
+	if !found || !hmac.Equal([]byte(token), []byte(shareToken(l))) {
+		return nil, false
+	}
+	return l, true
+}
+
+func shareURL(base string, l *shareLink) string {
+	return base + SHARE_PREFIX + shareToken(l)
+}
+
+// --- Public routes ---
+
+// registerShareRoutes adds the public share pages. They are registered
+// ahead of the auth middleware: the token is the credential.
+//
+//	GET  /s/<token>                  player page (or password form)
+//	POST /s/<token>                  unlock with the link's password
+//	GET  /s/<token>/tracks           track list as JSON
+//	GET  /s/<token>/audio/<path>     a track of the share
+//	GET  /s/<token>/download         ZIP archive, when the link allows it
+func registerShareRoutes(r *gin.Engine) {
+	g := r.Group(SHARE_PREFIX+":token", shareMiddleware)
+	g.GET("", sharePageHandler)
+	g.POST("", shareUnlockHandler)
+	g.GET("/tracks", shareUnlocked, shareTracksHandler)
+	g.GET("/audio/*path", shareUnlocked, shareAudioHandler)
+	g.HEAD("/audio/*path", shareUnlocked, shareAudioHandler)
+	g.GET("/download", shareUnlocked, shareDownloadHandler)
+}
+
+// shareMiddleware resolves the token. Requests act as the link's owner, so
+// the owner's access rules still apply to what the link exposes.
+func shareMiddleware(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	l, ok := shareFromToken(c.Param("token"))
+	if ok && l.Owner != "" && authEnabled() {
+		// Links stop working when their owner's account is removed.
+		var owner *authUser
+		owner, ok = authUsers[l.Owner]
+		c.Set(AUTH_USER_KEY, owner)
+	}
+	if !ok {
+		c.String(http.StatusNotFound, "Share link not found or expired")
+		c.Abort()
+		return
+	}
+	c.Set("share", l)
+}
+
+func currentShare(c *gin.Context) *shareLink {
+	return c.MustGet("share").(*shareLink)
+}
+
+// shareUnlockCookie is set once the password of a protected link has been
+// entered. Its value changes with the password.
+func shareUnlockCookie(l *shareLink) (string, string) {
+	return SHARE_COOKIE_PREFIX + l.ID, shareMAC("unlock", l.ID, l.Password)
+}
+
+func isShareUnlocked(c *gin.Context, l *shareLink) bool {
+	if l.Password == "" {
+		return true
+	}
+	name, want := shareUnlockCookie(l)
+	got, err := c.Cookie(name)
+	return err == nil && hmac.Equal([]byte(got), []byte(want))
+}
+
+func shareUnlocked(c *gin.Context) {
+	if !isShareUnlocked(c, currentShare(c)) {
+		c.String(http.StatusUnauthorized, "Password required")
+		c.Abort()
+	}
+}
+
+type sharePage struct {
+	Version  string
+	Token    string
+	Name     string
+	Expires  string
+	Download bool
+	Locked   bool
+	Error    string
+	Tracks   []shareTrack
+}
+
+type shareTrack struct {
+	Title string `json:"title"`
+	Path  string `json:"path"`
+	URL   string `json:"url"`
+}
+
+func sharePageHandler(c *gin.Context) {
+	l := currentShare(c)
+	page := sharePage{
+		Version:  Version,
+		Token:    c.Param("token"),
+		Name:     l.Name,
+		Expires:  l.Expires.UTC().Format("2 Jan 2006 15:04 MST"),
+		Download: l.Download,
+		Locked:   !isShareUnlocked(c, l),
+	}
+	if !page.Locked {
+		tracks, err := shareTrackList(c, l)
+		if err != nil {
+			log.Printf("Share tracks error (%s): %v", l.ID, err)
+			page.Error = "The shared files are not available."
+		}
+		page.Tracks = tracks
+	}
+	renderShare(c, http.StatusOK, page)
+}
+
+func renderShare(c *gin.Context, status int, page sharePage) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+	if err := shareTmpl.Execute(c.Writer, page); err != nil {
+		log.Printf("failed to render share template: %v", err)
+	}
+}
+
+// shareUnlockHandler checks the password form of a protected link.
+func shareUnlockHandler(c *gin.Context) {
+	l := currentShare(c)
+	token := c.Param("token")
+	if l.Password != "" && !checkPassword(l.Password, c.PostForm("password")) {
+		time.Sleep(AUTH_FAILURE_DELAY)
+		renderShare(c, http.StatusUnauthorized, sharePage{Version: Version, Token: token, Name: l.Name, Locked: true, Error: "Wrong password"})
+		return
+	}
+	name, value := shareUnlockCookie(l)
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(name, value, int(time.Until(l.Expires).Seconds()), SHARE_PREFIX+token, "", secure, true)
+	c.Redirect(http.StatusSeeOther, SHARE_PREFIX+token)
+}
+
+func shareTracksHandler(c *gin.Context) {
+	l := currentShare(c)
+	tracks, err := shareTrackList(c, l)
+	if err != nil {
+		log.Printf("Share tracks error (%s): %v", l.ID, err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "The shared files are not available.", "tracks": []shareTrack{}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "name": l.Name, "download": l.Download, "expires": l.Expires.UTC().Format(time.RFC3339), "tracks": tracks})
+}
+
+func shareTrackList(c *gin.Context, l *shareLink) ([]shareTrack, error) {
+	keys, err := shareTracks(c.Request.Context(), l, accessFor(c))
+	if err != nil {
+		return nil, err
+	}
+	tracks := make([]shareTrack, 0, len(keys))
+	for _, k := range keys {
+		tracks = append(tracks, shareTrack{Title: trackTitle(k), Path: k, URL: trackURL(SHARE_PREFIX+c.Param("token"), "/audio/", k)})
+	}
+	return tracks, nil
+}
+
+// shareTracks lists the tracks a link exposes, in playback order.
+func shareTracks(ctx context.Context, l *shareLink, access *aclAccess) ([]string, error) {
+	var tracks []string
+	var err error
+	switch {
+	case len(l.Tracks) > 0:
+		tracks = l.Tracks
+	case isPlaylistFile(l.Path):
+		tracks, _, err = resolveLibraryPlaylist(ctx, l.Path, access)
+	case isAudioFile(l.Path):
+		tracks = []string{l.Path}
+	default:
+		tracks, err = listAllAudioFiles(l.Path)
+		for i := range tracks {
+			tracks[i] = strings.ReplaceAll(tracks[i], `\`, "/")
+		}
+		sort.Strings(tracks)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return access.filterFiles(tracks), nil
+}
+
+// shareAudioHandler serves a track if it belongs to the share. Directory
+// links cover every track below the directory without listing it.
+func shareAudioHandler(c *gin.Context) {
+	l := currentShare(c)
+	key, ok := cleanKey(c.Param("path"))
+	if ok && strings.HasSuffix(l.Path, "/") {
+		ok = strings.HasPrefix(key, l.Path) && isAudioFile(key)
+	} else if ok {
+		tracks, err := shareTracks(c.Request.Context(), l, accessFor(c))
+		ok = err == nil && slices.Contains(tracks, key)
+	}
+	if !ok {
+		c.String(http.StatusNotFound, "Audio not found")
+		return
+	}
+	c.Set(CLOUDFRONT_KEY_URL_CTX, true)
+	serveAudio(c, key)
+}
+
+func shareDownloadHandler(c *gin.Context) {
+	l := currentShare(c)
+	if !l.Download {
+		c.String(http.StatusForbidden, "Downloads are not allowed for this link")
+		return
+	}
+	tracks, err := shareTracks(c.Request.Context(), l, accessFor(c))
+	if err != nil {
+		log.Printf("Share download error (%s): %v", l.ID, err)
+		c.String(http.StatusNotFound, TXT_ACC_DIR)
+		return
+	}
+	entries := trackEntries(tracks)
+	if strings.HasSuffix(l.Path, "/") {
+		for i := range entries {
+			entries[i].Name = strings.TrimPrefix(entries[i].Key, l.Path)
+		}
+	}
+	sendZip(c, l.Name, entries)
+}
+
+// --- API functions ---
+
+// handleCreateShare creates a link for a library path or a track list.
+// expires is a duration such as "72h" or "7d"; password and download are
+// optional.
+func handleCreateShare(c *gin.Context, raw string) {
+	var req struct {
+		Path     string   `json:"path"`
+		Tracks   []string `json:"tracks"`
+		Name     string   `json:"name"`
+		Expires  string   `json:"expires"`
+		Password string   `json:"password"`
+		Download bool     `json:"download"`
+	}
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid request"})
+		return
+	}
+	ttl, ok := parseShareTTL(req.Expires)
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": fmt.Sprintf("Invalid expiry (maximum %v)", shareMaxTTL)})
+		return
+	}
+	l, msg := newShareLink(c, req.Path, req.Tracks)
+	if l == nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": msg})
+		return
+	}
+	l.Name = playlistName(req.Name, l.Name)
+	l.Download = req.Download
+	l.Expires = l.Created.Add(ttl)
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to create share"})
+			return
+		}
+		l.Password = string(hash)
+	}
+	if err := shares.add(l); err != nil {
+		log.Printf("Share save error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to save share"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "share": newShareInfo(requestBaseURL(c), l)})
+}
+
+// newShareLink checks that the user may share the path or tracks and fills
+// in the scope of a new link, or returns an error message.
+func newShareLink(c *gin.Context, p string, tracks []string) (*shareLink, string) {
+	access := accessFor(c)
+	l := &shareLink{Created: time.Now().UTC()}
+	if u := currentUser(c); u != nil {
+		l.Owner = u.Name
+	}
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "Failed to create share"
+	}
+	l.ID = base64.RawURLEncoding.EncodeToString(id)
+
+	if len(tracks) > 0 {
+		for _, e := range trackEntries(tracks) {
+			l.Tracks = append(l.Tracks, e.Key)
+		}
+		l.Tracks = access.filterFiles(l.Tracks)
+		if len(l.Tracks) == 0 {
+			return nil, "No audio files to share"
+		}
+		l.Name = "Shared playlist"
+		return l, ""
+	}
+
+	key, ok := cleanKey(strings.TrimSpace(p))
+	if !ok {
+		return nil, "Invalid path"
+	}
+	if !isAudioFile(key) && !isPlaylistFile(key) && !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+	if !access.allowed(key) {
+		return nil, "Path not found"
+	}
+	l.Path, l.Name = key, shareName(key)
+	if found, err := shareTracks(c.Request.Context(), l, access); err != nil || len(found) == 0 {
+		return nil, "No audio files to share"
+	}
+	return l, ""
+}
+
+// parseShareTTL reads the requested lifetime, defaulting to SHARE_TTL and
+// capped at SHARE_MAX_TTL.
+func parseShareTTL(s string) (time.Duration, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return shareTTL, true
+	}
+	d, ok := parseLifetime(s)
+	return d, ok && d <= shareMaxTTL
+}
+
+// shareInfo is a link as returned by the API; the password hash and track
+// list stay on the server.
+type shareInfo struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Path     string    `json:"path,omitempty"`
+	Tracks   int       `json:"tracks,omitempty"`
+	Password bool      `json:"password"`
+	Download bool      `json:"download"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	URL      string    `json:"url"`
+}
+
+func newShareInfo(base string, l *shareLink) shareInfo {
+	return shareInfo{
+		ID:       l.ID,
+		Name:     l.Name,
+		Path:     l.Path,
+		Tracks:   len(l.Tracks),
+		Password: l.Password != "",
+		Download: l.Download,
+		Created:  l.Created,
+		Expires:  l.Expires,
+		URL:      shareURL(base, l),
+	}
+}
+
+// handleListShares returns the user's live links.
+func handleListShares(c *gin.Context) {
+	owner := ""
+	if u := currentUser(c); u != nil {
+		owner = u.Name
+	}
+	base := requestBaseURL(c)
+	list := []shareInfo{}
+	for _, l := range shares.list(owner) {
+		list = append(list, newShareInfo(base, l))
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "shares": list})
+}
+
+// handleRevokeShare deletes one of the user's links by ID.
+func handleRevokeShare(c *gin.Context, id string) {
+	owner := ""
+	if u := currentUser(c); u != nil {
+		owner = u.Name
+	}
+	ok, err := shares.remove(strings.TrimSpace(id), owner)
+	if err != nil {
+		log.Printf("Share save error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to save shares"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Share not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// shareName is the default name of a link to key: the directory name or the
+// track title.
+func shareName(key string) string {
+	if dir, ok := strings.CutSuffix(key, "/"); ok {
+		return path.Base("/" + dir)
+	}
+	return trackTitle(key)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testShare struct {
+	Status  string    `json:"status"`
+	Message string    `json:"message"`
+	Share   shareInfo `json:"share"`
+}
+
+// withShares gives a test its own share store and signing key
+func withShares(t *testing.T) {
+	t.Helper()
+	origShares, origSecret := shares, shareSecret
+	t.Cleanup(func() { shares, shareSecret = origShares, origSecret })
+	shares = newShareStore()
+	shareSecret = []byte("share-secret")
+	withStateDir(t)
+}
+
+func shareAPI(t *testing.T, function, data string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"function": function, "data": data})
+	req := httptest.NewRequest("POST", "/api", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func createShare(t *testing.T, data string) testShare {
+	t.Helper()
+	var resp testShare
+	assert.NoError(t, json.Unmarshal(shareAPI(t, "createShare", data).Body.Bytes(), &resp))
+	return resp
+}
+
+func shareGet(target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// TestShareLinks checks creating, using, listing and revoking share links
+func TestShareLinks(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	origLocalMusicDir := localMusicDir
+	defer func() { localMusicDir = origLocalMusicDir }()
+	localMusicDir = tmpDir
+	withShares(t)
+
+	album := filepath.Join(tmpDir, "Jazz", "Kind of Blue")
+	os.MkdirAll(album, 0755)
+	os.WriteFile(filepath.Join(album, "01 So What.mp3"), []byte("so what"), 0644)
+	os.WriteFile(filepath.Join(album, "02 Freddie.mp3"), []byte("freddie"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Jazz", "other.mp3"), []byte("other"), 0644)
+
+	t.Run("Directory", func(t *testing.T) {
+		resp := createShare(t, `{"path":"Jazz/Kind of Blue","expires":"2d"}`)
+		assert.Equal(t, "ok", resp.Status)
+		assert.Equal(t, "Kind of Blue", resp.Share.Name)
+		assert.Equal(t, "Jazz/Kind of Blue/", resp.Share.Path)
+		assert.WithinDuration(t, time.Now().Add(48*time.Hour), resp.Share.Expires, time.Minute)
+
+		u, _ := url.Parse(resp.Share.URL)
+		w := shareGet(u.Path)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "01 So What")
+		assert.NotContains(t, w.Body.String(), "Download ZIP")
+
+		w = shareGet(u.Path + "/audio/Jazz/Kind%20of%20Blue/01%20So%20What.mp3")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "so what", w.Body.String())
+		assert.Equal(t, http.StatusNotFound, shareGet(u.Path+"/audio/Jazz/other.mp3").Code, "files outside the share")
+		assert.Equal(t, http.StatusForbidden, shareGet(u.Path+"/download").Code)
+
+		assert.Equal(t, http.StatusNotFound, shareGet(u.Path+"x").Code, "altered token")
+		id, _, _ := strings.Cut(strings.TrimPrefix(u.Path, SHARE_PREFIX), ".")
+		assert.Equal(t, http.StatusNotFound, shareGet(SHARE_PREFIX+id).Code, "unsigned ID")
+	})
+
+	t.Run("Password and download", func(t *testing.T) {
+		resp := createShare(t, `{"tracks":["Jazz/other.mp3","Jazz/Kind of Blue/02 Freddie.mp3","../etc/passwd"],"name":"Mix","password":"blue","download":true}`)
+		assert.Equal(t, "ok", resp.Status)
+		assert.True(t, resp.Share.Password)
+		assert.Equal(t, 2, resp.Share.Tracks)
+		u, _ := url.Parse(resp.Share.URL)
+
+		w := shareGet(u.Path)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "protected by a password")
+		assert.NotContains(t, w.Body.String(), "Freddie")
+		assert.Equal(t, http.StatusUnauthorized, shareGet(u.Path+"/audio/Jazz/other.mp3").Code)
+
+		post := func(password string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", u.Path, strings.NewReader(url.Values{"password": {password}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			return w
+		}
+		assert.Equal(t, http.StatusUnauthorized, post("wrong").Code)
+		w = post("blue")
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		cookies := w.Result().Cookies()
+		assert.Len(t, cookies, 1)
+
+		w = shareGet(u.Path+"/tracks", cookies...)
+		var tracks struct {
+			Tracks []shareTrack `json:"tracks"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tracks))
+		assert.Len(t, tracks.Tracks, 2)
+		assert.Equal(t, "other", tracks.Tracks[0].Title)
+
+		w = shareGet(u.Path+"/download", cookies...)
+		assert.Equal(t, http.StatusOK, w.Code)
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		assert.NoError(t, err)
+		assert.Len(t, zr.File, 2)
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		assert.Equal(t, "error", createShare(t, `{"path":"Nope/"}`).Status)
+		assert.Equal(t, "error", createShare(t, `{"path":"../etc"}`).Status)
+		assert.Equal(t, "error", createShare(t, `{"path":"Jazz","expires":"1000d"}`).Status)
+		assert.Equal(t, "error", createShare(t, `{"path":"Jazz","expires":"soon"}`).Status)
+	})
+
+	t.Run("List, persist and revoke", func(t *testing.T) {
+		var list struct {
+			Shares []shareInfo `json:"shares"`
+		}
+		assert.NoError(t, json.Unmarshal(shareAPI(t, "listShares", "").Body.Bytes(), &list))
+		assert.Len(t, list.Shares, 2)
+		assert.Equal(t, "Mix", list.Shares[0].Name, "newest first")
+
+		reloaded := newShareStore()
+		assert.NoError(t, reloaded.load())
+		assert.Len(t, reloaded.list(""), 2)
+
+		u, _ := url.Parse(list.Shares[1].URL)
+		assert.Contains(t, shareAPI(t, "revokeShare", list.Shares[1].ID).Body.String(), `"ok"`)
+		assert.Equal(t, http.StatusNotFound, shareGet(u.Path).Code)
+		assert.Contains(t, shareAPI(t, "revokeShare", list.Shares[1].ID).Body.String(), "Share not found")
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		l := &shareLink{ID: "old", Path: "Jazz/", Created: time.Now().Add(-2 * time.Hour), Expires: time.Now().Add(-time.Hour)}
+		assert.NoError(t, shares.add(l))
+		assert.Equal(t, http.StatusNotFound, shareGet(SHARE_PREFIX+shareToken(l)).Code)
+		assert.Nil(t, shares.find("old"), "expired links are dropped on save")
+	})
+}
+
+// TestShareOwner checks that links follow the owner's account and access rules
+func TestShareOwner(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	origLocalMusicDir := localMusicDir
+	defer func() { localMusicDir = origLocalMusicDir }()
+	localMusicDir = tmpDir
+	withShares(t)
+
+	os.MkdirAll(filepath.Join(tmpDir, "Private"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Private", "a.mp3"), []byte("a"), 0644)
+	withAuthUsers(t, map[string]*authUser{
+		"alice": {Password: bcryptHash(t, "sesame")},
+		"bob":   {Password: bcryptHash(t, "sesame")},
+	})
+	withACLRules(t, `[{"path":"Private/","allow":["alice"]}]`)
+
+	create := func(user string) testShare {
+		body, _ := json.Marshal(map[string]string{"function": "createShare", "data": `{"path":"Private/"}`})
+		req := httptest.NewRequest("POST", "/api", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth(user, "sesame")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp testShare
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+	assert.Equal(t, "error", create("bob").Status)
+	resp := create("alice")
+	assert.Equal(t, "ok", resp.Status)
+
+	u, _ := url.Parse(resp.Share.URL)
+	assert.Equal(t, http.StatusOK, shareGet(u.Path+"/audio/Private/a.mp3").Code, "no sign-in needed")
+	assert.Empty(t, shares.list(""), "links are listed per owner")
+
+	delete(authUsers, "alice")
+	assert.Equal(t, http.StatusNotFound, shareGet(u.Path).Code, "removed owners' links stop working")
+}
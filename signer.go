@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// DEFAULT_PRESIGN_EXPIRY is the signed URL lifetime when PRESIGN_EXPIRY is unset.
+	DEFAULT_PRESIGN_EXPIRY = 15 * time.Minute
+	// MAX_PRESIGN_EXPIRY is the longest lifetime S3 accepts for SigV4 presigned URLs.
+	MAX_PRESIGN_EXPIRY = 7 * 24 * time.Hour
+	// SIGNED_URL_CACHE_SIZE bounds the number of cached signed URLs.
+	SIGNED_URL_CACHE_SIZE = 1024
+
+	CLOUDFRONT_MODE_URL    = "url"
+	CLOUDFRONT_MODE_COOKIE = "cookie"
+	CLOUDFRONT_KEY_URL_CTX = "cloudFrontKeyURL" // gin context key set when a request must not get library-wide cookies
+)
+
+// presignExpiry is the lifetime of presigned S3 and CloudFront URLs
+// (PRESIGN_EXPIRY, e.g. "1h" or "3600").
+var presignExpiry = envDuration("PRESIGN_EXPIRY", DEFAULT_PRESIGN_EXPIRY)
+
+// signedURLs caches signed URLs so repeated plays of a track reuse a URL that
+// still has at least half of its lifetime left.
+var signedURLs = newURLCache(SIGNED_URL_CACHE_SIZE)
+
+// cloudFront is set when CloudFront signing is configured; audio URLs then
+// point at the distribution instead of the bucket.
+var cloudFront *cloudFrontSigner
+
+type cachedURL struct {
+	url     string
+	expires time.Time
+}
+
+// urlCache is a small, bounded map of signed URLs keyed by track.
+type urlCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]cachedURL
+}
+
+func newURLCache(max int) *urlCache {
+	return &urlCache{max: max, entries: make(map[string]cachedURL)}
+}
+
+// get returns the cached URL for key if it stays valid for at least minTTL.
+func (uc *urlCache) get(key string, now time.Time, minTTL time.Duration) (string, bool) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	e, ok := uc.entries[key]
+	if !ok || e.expires.Sub(now) < minTTL {
+		return "", false
+	}
+	return e.url, true
+}
+
+// put stores a URL, evicting expired entries first and then the entry closest
+// to expiry when the cache is full.
+func (uc *urlCache) put(key, url string, expires, now time.Time) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	if _, ok := uc.entries[key]; !ok && len(uc.entries) >= uc.max {
+		var oldest string
+		for k, e := range uc.entries {
+			if !e.expires.After(now) {
+				delete(uc.entries, k)
+			} else if oldest == "" || e.expires.Before(uc.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(uc.entries) >= uc.max {
+			delete(uc.entries, oldest)
+		}
+	}
+	uc.entries[key] = cachedURL{url: url, expires: expires}
+}
+
+// signedAudioURL returns the URL the browser should play an S3 track from:
+// a CloudFront signed URL (or cookie-authorized URL) when configured,
+// otherwise a presigned S3 URL.
+func signedAudioURL(c *gin.Context, key string) (string, error) {
+	if cloudFront != nil {
+		return cloudFront.audioURL(c, key, time.Now())
+	}
+	return cachedSignedURL("s3:"+key, time.Now(), func(expires time.Time) (string, error) {
+		return s3GetPresignedUrl(key)
+	})
+}
+
+// cachedSignedURL returns a cached URL for cacheKey or signs a new one that
+// expires presignExpiry from now.
+func cachedSignedURL(cacheKey string, now time.Time, sign func(expires time.Time) (string, error)) (string, error) {
+	if u, ok := signedURLs.get(cacheKey, now, presignExpiry/2); ok {
+		return u, nil
+	}
+	expires := now.Add(presignExpiry)
+	u, err := sign(expires)
+	if err != nil {
+		return "", err
+	}
+	signedURLs.put(cacheKey, u, expires, now)
+	return u, nil
+}
+
+// s3GetPresignedUrl generates a pre-signed URL for the given S3 key.
+func s3GetPresignedUrl(key string) (string, error) {
+	presignClient := s3.NewPresignClient(s3Client)
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(s3Prefix + key),
+	}
+	presignedReq, err := presignClient.PresignGetObject(context.Background(), input, func(opts *s3.PresignOptions) {
+		opts.Expires = presignExpiry
+	})
+	if err != nil {
+		return "", err
+	}
+	return presignedReq.URL, nil
+}
+
+// cloudFrontSigner signs CloudFront URLs or cookies with a trusted key pair.
+type cloudFrontSigner struct {
+	baseURL      string // e.g. "https://d111111abcdef8.cloudfront.net"
+	keyPairID    string
+	key          *rsa.PrivateKey
+	mode         string
+	cookieDomain string
+
+	mu            sync.Mutex
+	cookiePolicy  string
+	cookieSig     string
+	cookieExpires time.Time
+}
+
+// initCloudFront configures CloudFront signing from CLOUDFRONT_* variables.
+// It is a no-op when CLOUDFRONT_DOMAIN is unset.
+func initCloudFront() error {
+	domain := os.Getenv("CLOUDFRONT_DOMAIN")
+	if domain == "" {
+		return nil
+	}
+	keyPEM := []byte(os.Getenv("CLOUDFRONT_PRIVATE_KEY"))
+	if file := os.Getenv("CLOUDFRONT_PRIVATE_KEY_FILE"); file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("read CloudFront private key: %w", err)
+		}
+		keyPEM = b
+	}
+	signer, err := newCloudFrontSigner(domain, os.Getenv("CLOUDFRONT_KEY_PAIR_ID"), keyPEM, os.Getenv("CLOUDFRONT_SIGN_MODE"))
+	if err != nil {
+		return err
+	}
+	signer.cookieDomain = os.Getenv("CLOUDFRONT_COOKIE_DOMAIN")
+	cloudFront = signer
+	log.Printf("CloudFront signing enabled: %s (%s mode)", signer.baseURL, signer.mode)
+	return nil
+}
+
+func newCloudFrontSigner(domain, keyPairID string, keyPEM []byte, mode string) (*cloudFrontSigner, error) {
+	if keyPairID == "" {
+		return nil, errors.New("CLOUDFRONT_KEY_PAIR_ID must be set")
+	}
+	switch mode = strings.ToLower(mode); mode {
+	case "":
+		mode = CLOUDFRONT_MODE_URL
+	case CLOUDFRONT_MODE_URL, CLOUDFRONT_MODE_COOKIE:
+	default:
+		return nil, fmt.Errorf("unsupported CLOUDFRONT_SIGN_MODE %q", mode)
+	}
+	key, err := parseRSAPrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(domain, "://") {
+		domain = "https://" + domain
+	}
+	return &cloudFrontSigner{baseURL: strings.TrimSuffix(domain, "/"), keyPairID: keyPairID, key: key, mode: mode}, nil
+}
+
+// parseRSAPrivateKey accepts PKCS#1 and PKCS#8 PEM encoded RSA keys.
+func parseRSAPrivateKey(keyPEM []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("CloudFront private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse CloudFront private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("CloudFront private key must be RSA")
+	}
+	return key, nil
+}
+
+// audioURL returns the distribution URL for key. In URL mode the URL carries
+// a canned-policy signature; in cookie mode signed cookies covering the whole
+// library are set on the response and the plain URL is returned.
+func (cf *cloudFrontSigner) audioURL(c *gin.Context, key string, now time.Time) (string, error) {
+	resource := trackURL(cf.baseURL, "/", s3Prefix+key)
+	if cf.cookiesFor(c) {
+		return resource, cf.setCookies(c, now)
+	}
+	return cachedSignedURL("cf:"+key, now, func(expires time.Time) (string, error) {
+		return cf.signURL(resource, expires)
+	})
+}
+
+// cookiesFor reports whether the response may carry the library-wide
+// cookies. Under access rules they would open the paths the rules hide to
+// the CDN, and share and feed visitors may only play what they were given,
+// so those tracks are signed on their own instead.
+func (cf *cloudFrontSigner) cookiesFor(c *gin.Context) bool {
+	return cf.mode == CLOUDFRONT_MODE_COOKIE && len(aclRules) == 0 && !c.GetBool(CLOUDFRONT_KEY_URL_CTX)
+}
+
+// signURL appends canned-policy signature parameters to resource.
+func (cf *cloudFrontSigner) signURL(resource string, expires time.Time) (string, error) {
+	policy := cloudFrontPolicy(resource, expires)
+	sig, err := cf.sign(policy)
+	if err != nil {
+		return "", err
+	}
+	sep := "?"
+	if strings.Contains(resource, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%sExpires=%d&Signature=%s&Key-Pair-Id=%s", resource, sep, expires.Unix(), sig, cf.keyPairID), nil
+}
+
+// setCookies sets CloudFront signed cookies using a custom policy for every
+// object under the library prefix. The policy is re-signed once less than
+// half of its lifetime remains.
+func (cf *cloudFrontSigner) setCookies(c *gin.Context, now time.Time) error {
+	cf.mu.Lock()
+	if cf.cookieExpires.Sub(now) < presignExpiry/2 {
+		expires := now.Add(presignExpiry)
+		policy := cloudFrontPolicy(cf.baseURL+"/"+s3Prefix+"*", expires)
+		sig, err := cf.sign(policy)
+		if err != nil {
+			cf.mu.Unlock()
+			return err
+		}
+		cf.cookiePolicy, cf.cookieSig, cf.cookieExpires = cloudFrontEncode([]byte(policy)), sig, expires
+	}
+	values := map[string]string{
+		"CloudFront-Policy":      cf.cookiePolicy,
+		"CloudFront-Signature":   cf.cookieSig,
+		"CloudFront-Key-Pair-Id": cf.keyPairID,
+	}
+	expires := cf.cookieExpires
+	cf.mu.Unlock()
+
+	for name, value := range values {
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     "/",
+			Domain:   cf.cookieDomain,
+			Expires:  expires,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return nil
+}
+
+// sign returns the CloudFront-safe base64 RSA-SHA1 signature of policy.
+func (cf *cloudFrontSigner) sign(policy string) (string, error) {
+	sum := sha1.Sum([]byte(policy))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, cf.key, crypto.SHA1, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("sign CloudFront policy: %w", err)
+	}
+	return cloudFrontEncode(sig), nil
+}
+
+// cloudFrontPolicy builds a policy statement for resource. A resource without
+// wildcards is equivalent to CloudFront's canned policy.
+func cloudFrontPolicy(resource string, expires time.Time) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(resource)
+	return fmt.Sprintf(`{"Statement":[{"Resource":%s,"Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`,
+		strings.TrimSpace(buf.String()), expires.Unix())
+}
+
+// cloudFrontEncode is base64 with the characters CloudFront forbids in query
+// strings and cookies replaced.
+func cloudFrontEncode(b []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(b))
+}
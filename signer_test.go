@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestURLCache checks reuse while half the lifetime remains and eviction
+func TestURLCache(t *testing.T) {
+	now := time.Now()
+	uc := newURLCache(2)
+	uc.put("a", "url-a", now.Add(10*time.Minute), now)
+	uc.put("b", "url-b", now.Add(20*time.Minute), now)
+
+	got, ok := uc.get("a", now, 5*time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, "url-a", got)
+	_, ok = uc.get("a", now.Add(6*time.Minute), 5*time.Minute)
+	assert.False(t, ok, "entry with too little lifetime left must not be reused")
+
+	uc.put("c", "url-c", now.Add(30*time.Minute), now)
+	assert.Len(t, uc.entries, 2)
+	_, ok = uc.get("a", now, 0)
+	assert.False(t, ok, "entry closest to expiry is evicted first")
+}
+
+// TestEnvDuration checks duration and plain-seconds parsing
+func TestEnvDuration(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"":      DEFAULT_PRESIGN_EXPIRY,
+		"3600":  time.Hour,
+		"90m":   90 * time.Minute,
+		"bogus": DEFAULT_PRESIGN_EXPIRY,
+		"-5":    DEFAULT_PRESIGN_EXPIRY,
+	} {
+		t.Setenv("TEST_PRESIGN_EXPIRY", value)
+		assert.Equal(t, want, envDuration("TEST_PRESIGN_EXPIRY", DEFAULT_PRESIGN_EXPIRY), value)
+	}
+}
+
+// TestPresignedURLExpiry checks the configured lifetime and URL caching
+func TestPresignedURLExpiry(t *testing.T) {
+	origClient, origLocal, origExpiry, origCache := s3Client, localMusicDir, presignExpiry, signedURLs
+	defer func() {
+		s3Client, localMusicDir, presignExpiry, signedURLs = origClient, origLocal, origExpiry, origCache
+	}()
+	s3Client = s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String("https://s3.example.com"),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+	})
+	localMusicDir, presignExpiry, signedURLs = "", 2*time.Hour, newURLCache(SIGNED_URL_CACHE_SIZE)
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/audio/Rock/song.mp3", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response map[string]string
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response["url"]
+	}
+	first := get()
+	u, err := url.Parse(first)
+	assert.NoError(t, err)
+	assert.Equal(t, "7200", u.Query().Get("X-Amz-Expires"))
+	assert.Equal(t, first, get(), "second request reuses the cached URL")
+}
+
+func testRSAKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func verifyCloudFrontSignature(t *testing.T, key *rsa.PrivateKey, policy, sig string) {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(sig))
+	assert.NoError(t, err)
+	sum := sha1.Sum([]byte(policy))
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, sum[:], raw))
+}
+
+// TestCloudFrontSigner checks signed URLs and signed cookies
+func TestCloudFrontSigner(t *testing.T) {
+	key, keyPEM := testRSAKey(t)
+
+	origPrefix, origCF, origCache, origLocal := s3Prefix, cloudFront, signedURLs, localMusicDir
+	defer func() {
+		s3Prefix, cloudFront, signedURLs, localMusicDir = origPrefix, origCF, origCache, origLocal
+	}()
+	s3Prefix, signedURLs, localMusicDir = "music/", newURLCache(SIGNED_URL_CACHE_SIZE), ""
+
+	_, err := newCloudFrontSigner("cdn.example.com", "", keyPEM, "")
+	assert.Error(t, err, "key pair ID is required")
+	_, err = newCloudFrontSigner("cdn.example.com", "K2JCJMDEHXQW5F", keyPEM, "bogus")
+	assert.Error(t, err)
+
+	t.Run("Signed URL", func(t *testing.T) {
+		cf, err := newCloudFrontSigner("cdn.example.com", "K2JCJMDEHXQW5F", keyPEM, "")
+		assert.NoError(t, err)
+		cloudFront = cf
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/audio/Rock/My%20Song.mp3", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response map[string]string
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+		u, err := url.Parse(response["url"])
+		assert.NoError(t, err)
+		assert.Equal(t, "cdn.example.com", u.Host)
+		assert.Equal(t, "/music/Rock/My%20Song.mp3", u.EscapedPath())
+		assert.Equal(t, "K2JCJMDEHXQW5F", u.Query().Get("Key-Pair-Id"))
+		expires, err := strconv.ParseInt(u.Query().Get("Expires"), 10, 64)
+		assert.NoError(t, err)
+		assert.InDelta(t, time.Now().Add(presignExpiry).Unix(), expires, 5)
+
+		resource := "https://cdn.example.com/music/Rock/My%20Song.mp3"
+		verifyCloudFrontSignature(t, key, cloudFrontPolicy(resource, time.Unix(expires, 0)), u.Query().Get("Signature"))
+	})
+
+	t.Run("Signed cookies", func(t *testing.T) {
+		cf, err := newCloudFrontSigner("https://cdn.example.com/", "K2JCJMDEHXQW5F", keyPEM, "cookie")
+		assert.NoError(t, err)
+		cloudFront = cf
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/audio/Rock/a.mp3", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"url":"https://cdn.example.com/music/Rock/a.mp3"}`, w.Body.String())
+
+		cookies := map[string]string{}
+		for _, ck := range w.Result().Cookies() {
+			cookies[ck.Name] = ck.Value
+			assert.True(t, ck.Secure)
+		}
+		assert.Equal(t, "K2JCJMDEHXQW5F", cookies["CloudFront-Key-Pair-Id"])
+		policy, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(cookies["CloudFront-Policy"]))
+		assert.NoError(t, err)
+		assert.Contains(t, string(policy), `"Resource":"https://cdn.example.com/music/*"`)
+		verifyCloudFrontSignature(t, key, string(policy), cookies["CloudFront-Signature"])
+	})
+
+	t.Run("Signed cookies under access rules", func(t *testing.T) {
+		cf, err := newCloudFrontSigner("cdn.example.com", "K2JCJMDEHXQW5F", keyPEM, "cookie")
+		assert.NoError(t, err)
+		cloudFront = cf
+		withACLRules(t, `[{"path":"Private/","allow":["bob"]}]`)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/audio/Rock/b.mp3", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Result().Cookies(), "cookies would cover paths the rules hide")
+		var response map[string]string
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		u, err := url.Parse(response["url"])
+		assert.NoError(t, err)
+		assert.Equal(t, "/music/Rock/b.mp3", u.Path)
+		assert.NotEmpty(t, u.Query().Get("Signature"), "the track gets its own signed URL")
+	})
+}
+
+// TestCloudFrontNotUsedLocally checks local mode ignores CDN signing
+func TestCloudFrontNotUsedLocally(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	os.WriteFile(filepath.Join(tmpDir, "x.mp3"), []byte("test"), 0644)
+
+	_, keyPEM := testRSAKey(t)
+	origCF, origLocal := cloudFront, localMusicDir
+	defer func() { cloudFront, localMusicDir = origCF, origLocal }()
+	cf, err := newCloudFrontSigner("cdn.example.com", "K2JCJMDEHXQW5F", keyPEM, "")
+	assert.NoError(t, err)
+	cloudFront, localMusicDir = cf, tmpDir
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/audio/x.mp3", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"url":"/localdisk/x.mp3"}`, w.Body.String())
+}
+
+// TestCloudFrontKeyURLs checks that share and feed visitors get a signed URL
+// for the track instead of cookies covering the whole library
+func TestCloudFrontKeyURLs(t *testing.T) {
+	_, keyPEM := testRSAKey(t)
+	newFakeS3(t, map[string][]byte{"Jazz/a.mp3": []byte("a")})
+	withShares(t)
+	origCF, origCache := cloudFront, signedURLs
+	defer func() { cloudFront, signedURLs = origCF, origCache }()
+	cf, err := newCloudFrontSigner("cdn.example.com", "K2JCJMDEHXQW5F", keyPEM, "cookie")
+	assert.NoError(t, err)
+	cloudFront, signedURLs = cf, newURLCache(SIGNED_URL_CACHE_SIZE)
+
+	resp := createShare(t, `{"path":"Jazz"}`)
+	assert.Equal(t, "ok", resp.Status)
+	u, _ := url.Parse(resp.Share.URL)
+	for _, target := range []string{u.Path + "/audio/Jazz/a.mp3", "/feed/Jazz/a.mp3"} {
+		w := shareGet(target)
+		assert.Equal(t, http.StatusFound, w.Code, target)
+		assert.Empty(t, w.Result().Cookies(), target)
+		loc, err := url.Parse(w.Header().Get("Location"))
+		assert.NoError(t, err)
+		assert.Equal(t, "/Jazz/a.mp3", loc.Path, target)
+		assert.NotEmpty(t, loc.Query().Get("Signature"), target)
+	}
+
+	w := shareGet("/stream/Jazz/a.mp3")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.NotEmpty(t, w.Result().Cookies(), "library users still get cookies")
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Smart playlists are defined by rules instead of tracks, such as
+// "genre is Jazz and year < 1970" or "never played". Their tracks are
+// worked out when requested, from the library index, the owner's play
+// history and ratings.
+
+const (
+	SMART_PLAYLISTS_FILE = "smart-playlists.json"
+	MAX_SMART_RULES      = 50
+	SMART_MATCH_ALL      = "all"
+	SMART_MATCH_ANY      = "any"
+	SMART_SORT_RANDOM    = "random"
+	SMART_ORDER_ASC      = "asc"
+	SMART_ORDER_DESC     = "desc"
+	SMART_DATE_FORMAT    = "2006-01-02"
+)
+
+// smartRule is one condition, e.g. {"field":"year","op":"<","value":"1970"}.
+type smartRule struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+// smartPlaylist is a stored rule set. PlaysIn limits the play counts used by
+// the plays field and sort to a period: a span such as "30d", or "week",
+// "month" or "year" for the current calendar period.
+type smartPlaylist struct {
+	ID      string      `json:"id"`
+	Owner   string      `json:"owner,omitempty"`
+	Name    string      `json:"name"`
+	Match   string      `json:"match"`
+	Rules   []smartRule `json:"rules"`
+	PlaysIn string      `json:"playsIn,omitempty"`
+	Sort    string      `json:"sort,omitempty"`
+	Order   string      `json:"order,omitempty"`
+	Limit   int         `json:"limit,omitempty"`
+	Created time.Time   `json:"created"`
+	Updated time.Time   `json:"updated"`
+}
+
+// smartTrack is a library track with the owner's plays and ratings.
+type smartTrack struct {
+	libraryTrack
+	Plays      int
+	LastPlayed time.Time
+	Rating     int
+	Starred    bool
+}
+
+// smartPredicate tests one track.
+type smartPredicate func(t *smartTrack) bool
+
+var smartPlaylists = &stateDoc[[]*smartPlaylist]{name: SMART_PLAYLISTS_FILE}
+
+// --- Rules ---
+
+var smartTextFields = map[string]func(t *smartTrack) string{
+	"title":  func(t *smartTrack) string { return t.Tags.Title },
+	"artist": func(t *smartTrack) string { return t.Tags.Artist },
+	"album":  func(t *smartTrack) string { return t.Tags.Album },
+	"genre":  func(t *smartTrack) string { return t.Tags.Genre },
+	"path":   func(t *smartTrack) string { return t.Path },
+}
+
+var smartNumberFields = map[string]func(t *smartTrack) float64{
+	"year":        func(t *smartTrack) float64 { return float64(t.Tags.Year) },
+	"duration":    func(t *smartTrack) float64 { return float64(t.Tags.Duration) },
+	"trackNumber": func(t *smartTrack) float64 { return float64(t.Tags.TrackNumber) },
+	"rating":      func(t *smartTrack) float64 { return float64(t.Rating) },
+	"plays":       func(t *smartTrack) float64 { return float64(t.Plays) },
+	"size":        func(t *smartTrack) float64 { return float64(t.Size) },
+}
+
+var smartTimeFields = map[string]func(t *smartTrack) time.Time{
+	"added":      func(t *smartTrack) time.Time { return t.Modified },
+	"lastPlayed": func(t *smartTrack) time.Time { return t.LastPlayed },
+}
+
+// compileRule turns a rule into a predicate, or an error naming what is
+// wrong with it.
+func compileRule(r smartRule, now time.Time) (smartPredicate, error) {
+	if get, ok := smartTextFields[r.Field]; ok {
+		return compileTextRule(get, r)
+	}
+	if get, ok := smartNumberFields[r.Field]; ok {
+		return compileNumberRule(get, r)
+	}
+	if get, ok := smartTimeFields[r.Field]; ok {
+		return compileTimeRule(get, r, now)
+	}
+	switch r.Field {
+	case "folder":
+		return compileFolderRule(r)
+	case "starred":
+		want, err := strconv.ParseBool(r.Value)
+		if err != nil || r.Op != "is" {
+			return nil, playlistOpError("starred takes \"is\" and true or false")
+		}
+		return func(t *smartTrack) bool { return t.Starred == want }, nil
+	}
+	return nil, playlistOpError(fmt.Sprintf("Unknown field %q", r.Field))
+}
+
+func compileTextRule(get func(*smartTrack) string, r smartRule) (smartPredicate, error) {
+	want := strings.ToLower(r.Value)
+	var test func(string) bool
+	switch r.Op {
+	case "is", "=":
+		test = func(s string) bool { return s == want }
+	case "isNot", "!=":
+		test = func(s string) bool { return s != want }
+	case "contains":
+		test = func(s string) bool { return strings.Contains(s, want) }
+	case "notContains":
+		test = func(s string) bool { return !strings.Contains(s, want) }
+	case "startsWith":
+		test = func(s string) bool { return strings.HasPrefix(s, want) }
+	default:
+		return nil, playlistOpError(fmt.Sprintf("Unknown operator %q for %s", r.Op, r.Field))
+	}
+	return func(t *smartTrack) bool { return test(strings.ToLower(get(t))) }, nil
+}
+
+func compileNumberRule(get func(*smartTrack) float64, r smartRule) (smartPredicate, error) {
+	want, err := strconv.ParseFloat(strings.TrimSpace(r.Value), 64)
+	if err != nil {
+		return nil, playlistOpError(fmt.Sprintf("%s needs a number", r.Field))
+	}
+	var test func(float64) bool
+	switch r.Op {
+	case "is", "=":
+		test = func(v float64) bool { return v == want }
+	case "isNot", "!=":
+		test = func(v float64) bool { return v != want }
+	case "<":
+		test = func(v float64) bool { return v < want }
+	case "<=":
+		test = func(v float64) bool { return v <= want }
+	case ">":
+		test = func(v float64) bool { return v > want }
+	case ">=":
+		test = func(v float64) bool { return v >= want }
+	default:
+		return nil, playlistOpError(fmt.Sprintf("Unknown operator %q for %s", r.Op, r.Field))
+	}
+	return func(t *smartTrack) bool { return test(get(t)) }, nil
+}
+
+// compileTimeRule handles "inLast"/"notInLast" with a span such as "30d",
+// "before"/"after" with a date, and "never" for tracks never played.
+func compileTimeRule(get func(*smartTrack) time.Time, r smartRule, now time.Time) (smartPredicate, error) {
+	switch r.Op {
+	case "never":
+		return func(t *smartTrack) bool { return get(t).IsZero() }, nil
+	case "inLast", "notInLast":
+		d, ok := parseLifetime(r.Value)
+		if !ok {
+			return nil, playlistOpError(fmt.Sprintf("%s needs a span such as 30d", r.Field))
+		}
+		since, in := now.Add(-d), r.Op == "inLast"
+		return func(t *smartTrack) bool { return !get(t).Before(since) == in }, nil
+	case "before", "after":
+		date, err := parseSmartDate(r.Value)
+		if err != nil {
+			return nil, playlistOpError(fmt.Sprintf("%s needs a date such as 2024-01-31", r.Field))
+		}
+		if r.Op == "before" {
+			return func(t *smartTrack) bool { v := get(t); return !v.IsZero() && v.Before(date) }, nil
+		}
+		return func(t *smartTrack) bool { return !get(t).Before(date) }, nil
+	}
+	return nil, playlistOpError(fmt.Sprintf("Unknown operator %q for %s", r.Op, r.Field))
+}
+
+func parseSmartDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(SMART_DATE_FORMAT, s)
+}
+
+func compileFolderRule(r smartRule) (smartPredicate, error) {
+	dir := strings.Trim(r.Value, "/") + "/"
+	if dir == "/" || strings.Contains(dir, "..") {
+		return nil, playlistOpError("folder needs a directory")
+	}
+	switch r.Op {
+	case "under", "is":
+		return func(t *smartTrack) bool { return strings.HasPrefix(t.Path, dir) }, nil
+	case "notUnder", "isNot":
+		return func(t *smartTrack) bool { return !strings.HasPrefix(t.Path, dir) }, nil
+	}
+	return nil, playlistOpError(fmt.Sprintf("Unknown operator %q for folder", r.Op))
+}
+
+// playsSince returns the start of a PlaysIn period; zero means all time.
+func playsSince(period string, now time.Time) (time.Time, error) {
+	y, m, d := now.Date()
+	switch period {
+	case "":
+		return time.Time{}, nil
+	case "week":
+		return time.Date(y, m, d-(int(now.Weekday())+6)%7, 0, 0, 0, 0, now.Location()), nil
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, now.Location()), nil
+	case "year":
+		return time.Date(y, 1, 1, 0, 0, 0, 0, now.Location()), nil
+	}
+	if span, ok := parseLifetime(period); ok {
+		return now.Add(-span), nil
+	}
+	return time.Time{}, playlistOpError("playsIn takes a span such as 30d, or week, month or year")
+}
+
+// --- Evaluation ---
+
+var smartSortKeys = map[string]func(a, b *smartTrack) int{
+	"title":      func(a, b *smartTrack) int { return strings.Compare(a.Tags.Title, b.Tags.Title) },
+	"artist":     func(a, b *smartTrack) int { return strings.Compare(a.Tags.Artist, b.Tags.Artist) },
+	"album":      func(a, b *smartTrack) int { return strings.Compare(a.Tags.Album, b.Tags.Album) },
+	"genre":      func(a, b *smartTrack) int { return strings.Compare(a.Tags.Genre, b.Tags.Genre) },
+	"path":       func(a, b *smartTrack) int { return strings.Compare(a.Path, b.Path) },
+	"year":       func(a, b *smartTrack) int { return a.Tags.Year - b.Tags.Year },
+	"duration":   func(a, b *smartTrack) int { return a.Tags.Duration - b.Tags.Duration },
+	"rating":     func(a, b *smartTrack) int { return a.Rating - b.Rating },
+	"plays":      func(a, b *smartTrack) int { return a.Plays - b.Plays },
+	"added":      func(a, b *smartTrack) int { return a.Modified.Compare(b.Modified) },
+	"lastPlayed": func(a, b *smartTrack) int { return a.LastPlayed.Compare(b.LastPlayed) },
+}
+
+// smartDescending lists the sorts that default to largest or newest first.
+var smartDescending = []string{"rating", "plays", "added", "lastPlayed"}
+
+// validateSmart checks the settings of p other than its rules.
+func validateSmart(p *smartPlaylist) error {
+	if p.Match == "" {
+		p.Match = SMART_MATCH_ALL
+	}
+	if p.Match != SMART_MATCH_ALL && p.Match != SMART_MATCH_ANY {
+		return playlistOpError("match must be all or any")
+	}
+	if len(p.Rules) > MAX_SMART_RULES {
+		return playlistOpError(fmt.Sprintf("Smart playlists are limited to %d rules", MAX_SMART_RULES))
+	}
+	if _, ok := smartSortKeys[p.Sort]; !ok && p.Sort != "" && p.Sort != SMART_SORT_RANDOM {
+		return playlistOpError(fmt.Sprintf("Unknown sort %q", p.Sort))
+	}
+	if p.Order != "" && p.Order != SMART_ORDER_ASC && p.Order != SMART_ORDER_DESC {
+		return playlistOpError("order must be asc or desc")
+	}
+	if p.Limit < 0 || p.Limit > MAX_PLAYLIST_TRACKS {
+		return playlistOpError(fmt.Sprintf("limit must be 0 to %d", MAX_PLAYLIST_TRACKS))
+	}
+	return nil
+}
+
+// compileSmart validates p and returns its predicate and the start of its
+// plays period.
+func compileSmart(p *smartPlaylist, now time.Time) (smartPredicate, time.Time, error) {
+	if err := validateSmart(p); err != nil {
+		return nil, time.Time{}, err
+	}
+	preds := make([]smartPredicate, len(p.Rules))
+	for i, r := range p.Rules {
+		pred, err := compileRule(r, now)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		preds[i] = pred
+	}
+	since, err := playsSince(p.PlaysIn, now)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	// "all" fails on the first rule that fails, "any" passes on the first
+	// that passes; no rules match everything.
+	anyMatch := p.Match == SMART_MATCH_ANY
+	return func(t *smartTrack) bool {
+		for _, pred := range preds {
+			if pred(t) == anyMatch {
+				return anyMatch
+			}
+		}
+		return !anyMatch || len(preds) == 0
+	}, since, nil
+}
+
+// evaluateSmart returns the tracks of p for the caller.
+func evaluateSmart(c *gin.Context, p *smartPlaylist) ([]string, error) {
+	now := time.Now()
+	match, since, err := compileSmart(p, now)
+	if err != nil {
+		return nil, err
+	}
+	tracks, err := smartTracks(c, since)
+	if err != nil {
+		return nil, err
+	}
+	var out []*smartTrack
+	for i := range tracks {
+		if match(&tracks[i]) {
+			out = append(out, &tracks[i])
+		}
+	}
+	sortSmart(out, p.Sort, p.Order)
+	limit := p.Limit
+	if limit == 0 {
+		limit = MAX_PLAYLIST_TRACKS
+	}
+	paths := make([]string, 0, min(limit, len(out)))
+	for _, t := range out[:min(limit, len(out))] {
+		paths = append(paths, t.Path)
+	}
+	return paths, nil
+}
+
+// smartTracks joins the library index with the caller's plays (counted
+// from since) and ratings, leaving out tracks the caller may not access.
+func smartTracks(c *gin.Context, since time.Time) ([]smartTrack, error) {
+	lib, err := library.all(c.Request.Context())
+	if err != nil {
+		return nil, err
+	}
+	owner := currentUserName(c)
+	plays, err := history.plays(owner)
+	if err != nil {
+		return nil, err
+	}
+	user, err := ratings.doc(owner).get()
+	if err != nil {
+		return nil, err
+	}
+	count, last := playCounts(plays, since)
+	acc := accessFor(c)
+	out := make([]smartTrack, 0, len(lib))
+	for _, t := range lib {
+		if !acc.allowed(t.Path) {
+			continue
+		}
+		rating, ok := user.Ratings[t.Path]
+		if !ok {
+			rating = t.Tags.Rating
+		}
+		_, starred := user.Stars[t.Path]
+		out = append(out, smartTrack{libraryTrack: t, Plays: count[t.Path], LastPlayed: last[t.Path], Rating: rating, Starred: starred})
+	}
+	return out, nil
+}
+
+// playCounts counts the plays of each track from since, and finds when
+// each was last played.
+func playCounts(plays []playRecord, since time.Time) (map[string]int, map[string]time.Time) {
+	count, last := map[string]int{}, map[string]time.Time{}
+	for _, p := range plays {
+		if !p.Time.Before(since) {
+			count[p.Path]++
+		}
+		if p.Time.After(last[p.Path]) {
+			last[p.Path] = p.Time
+		}
+	}
+	return count, last
+}
+
+func sortSmart(tracks []*smartTrack, key, order string) {
+	if key == SMART_SORT_RANDOM {
+		mrand.Shuffle(len(tracks), func(i, j int) { tracks[i], tracks[j] = tracks[j], tracks[i] })
+		return
+	}
+	if key == "" {
+		key = "path"
+	}
+	cmp := smartSortKeys[key]
+	desc := order == SMART_ORDER_DESC || (order == "" && slices.Contains(smartDescending, key))
+	sort.SliceStable(tracks, func(i, j int) bool {
+		if n := cmp(tracks[i], tracks[j]); n != 0 {
+			return (n > 0) == desc
+		}
+		return tracks[i].Path < tracks[j].Path
+	})
+}
+
+// --- Store ---
+
+func findSmartPlaylist(owner, id string) (*smartPlaylist, bool) {
+	lists, err := smartPlaylists.get()
+	i := slices.IndexFunc(lists, func(p *smartPlaylist) bool { return p.ID == id && p.Owner == owner })
+	if i < 0 {
+		if lists, err = smartPlaylists.refresh(); err != nil {
+			log.Printf("Smart playlist load error: %v", err)
+		}
+		i = slices.IndexFunc(lists, func(p *smartPlaylist) bool { return p.ID == id && p.Owner == owner })
+	}
+	if i < 0 {
+		return nil, false
+	}
+	p := *lists[i]
+	return &p, true
+}
+
+// --- API functions ---
+
+// smartRequest selects a stored playlist by id, or carries a definition
+// to save or preview.
+type smartRequest struct {
+	ID       string         `json:"id"`
+	Playlist *smartPlaylist `json:"playlist"`
+}
+
+func parseSmartRequest(c *gin.Context, raw string) (smartRequest, bool) {
+	var req smartRequest
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid request"})
+		return req, false
+	}
+	return req, true
+}
+
+// handleListSmartPlaylists lists the caller's smart playlists by name.
+func handleListSmartPlaylists(c *gin.Context, _ string) {
+	lists, err := smartPlaylists.get()
+	if err != nil {
+		log.Printf("Smart playlist load error: %v", err)
+	}
+	owner := currentUserName(c)
+	out := []smartPlaylist{}
+	for _, p := range lists {
+		if p.Owner == owner {
+			out = append(out, *p)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return strings.ToLower(out[i].Name) < strings.ToLower(out[j].Name) })
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "playlists": out})
+}
+
+// handleSaveSmartPlaylist creates a smart playlist, or replaces the one
+// with the given id. Data: {"playlist":{"name":...,"match":"all",
+// "rules":[...],"sort":...,"order":...,"limit":n,"playsIn":...}}
+func handleSaveSmartPlaylist(c *gin.Context, raw string) {
+	req, ok := parseSmartRequest(c, raw)
+	if !ok {
+		return
+	}
+	p := req.Playlist
+	if p == nil || strings.TrimSpace(p.Name) == "" || len(p.Name) > MAX_PLAYLIST_NAME {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Invalid playlist name"})
+		return
+	}
+	if _, _, err := compileSmart(p, time.Now()); err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": err.Error(), "code": "invalid"})
+		return
+	}
+	p.Name, p.Owner = strings.TrimSpace(p.Name), currentUserName(c)
+	saved, err := storeSmartPlaylist(p)
+	if err == errPlaylistNotFound {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Playlist not found", "code": "notFound"})
+		return
+	}
+	if err != nil {
+		log.Printf("Smart playlist save error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to save playlist"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "playlist": saved})
+}
+
+// storeSmartPlaylist adds p, or replaces the playlist with p's id.
+func storeSmartPlaylist(p *smartPlaylist) (*smartPlaylist, error) {
+	now := time.Now().UTC()
+	p.Updated = now
+	if p.ID == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		p.ID, p.Created = hex.EncodeToString(id), now
+	}
+	_, err := smartPlaylists.update(func(lists *[]*smartPlaylist) error {
+		i := slices.IndexFunc(*lists, func(old *smartPlaylist) bool { return old.ID == p.ID && old.Owner == p.Owner })
+		switch {
+		case i >= 0:
+			p.Created = (*lists)[i].Created
+			(*lists)[i] = p
+		case p.Created.IsZero():
+			return errPlaylistNotFound
+		default:
+			*lists = append(*lists, p)
+		}
+		return nil
+	})
+	return p, err
+}
+
+// handleDeleteSmartPlaylist deletes a smart playlist. Data: {"id":...}
+func handleDeleteSmartPlaylist(c *gin.Context, raw string) {
+	req, ok := parseSmartRequest(c, raw)
+	if !ok {
+		return
+	}
+	owner := currentUserName(c)
+	_, err := smartPlaylists.update(func(lists *[]*smartPlaylist) error {
+		n := len(*lists)
+		*lists = slices.DeleteFunc(*lists, func(p *smartPlaylist) bool { return p.ID == req.ID && p.Owner == owner })
+		if len(*lists) == n {
+			return errPlaylistNotFound
+		}
+		return nil
+	})
+	if err == errPlaylistNotFound {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Playlist not found", "code": "notFound"})
+		return
+	}
+	if err != nil {
+		log.Printf("Smart playlist save error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to delete playlist"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleSmartPlaylistTracks returns the tracks of a stored smart playlist,
+// {"id":...}, or previews a definition, {"playlist":{...}}.
+func handleSmartPlaylistTracks(c *gin.Context, raw string) {
+	req, ok := parseSmartRequest(c, raw)
+	if !ok {
+		return
+	}
+	p := req.Playlist
+	if p == nil {
+		if p, ok = findSmartPlaylist(currentUserName(c), req.ID); !ok {
+			c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Playlist not found", "code": "notFound"})
+			return
+		}
+	}
+	tracks, err := evaluateSmart(c, p)
+	if msg, ok := err.(playlistOpError); ok {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": string(msg), "code": "invalid"})
+		return
+	}
+	if err != nil {
+		log.Printf("Smart playlist error: %v", err)
+		c.JSON(http.StatusOK, gin.H{"status": "error", "message": "Failed to build playlist"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "name": p.Name, "tracks": tracks})
+}
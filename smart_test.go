@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withSmartPlaylists gives a test its own smart playlists, history and
+// ratings over a small tagged library
+func withSmartPlaylists(t *testing.T) {
+	t.Helper()
+	tmpDir := t.TempDir()
+	withLibrary(t, tmpDir)
+	withHistory(t)
+	withRatings(t)
+	origSmart := smartPlaylists
+	t.Cleanup(func() { smartPlaylists = origSmart })
+	smartPlaylists = &stateDoc[[]*smartPlaylist]{name: SMART_PLAYLISTS_FILE}
+
+	files := map[string][]byte{
+		"Jazz/So What.mp3":       id3Tag(3, id3Frame("TIT2", "So What"), id3Frame("TCON", "Jazz"), id3Frame("TYER", "1959")),
+		"Jazz/Blue in Green.mp3": id3Tag(3, id3Frame("TIT2", "Blue in Green"), id3Frame("TCON", "Jazz"), id3Frame("TYER", "1959"), popmFrame(255)),
+		"Jazz/Giant Steps.mp3":   id3Tag(3, id3Frame("TIT2", "Giant Steps"), id3Frame("TCON", "Jazz"), id3Frame("TYER", "1960")),
+		"Rock/Paranoid.mp3":      id3Tag(3, id3Frame("TIT2", "Paranoid"), id3Frame("TCON", "Rock"), id3Frame("TYER", "1970")),
+	}
+	for name, data := range files {
+		os.MkdirAll(filepath.Join(tmpDir, filepath.Dir(name)), 0755)
+		os.WriteFile(filepath.Join(tmpDir, name), data, 0644)
+	}
+}
+
+func smartTrackList(resp map[string]any) []string {
+	tracks, _ := resp["tracks"].([]any)
+	out := make([]string, len(tracks))
+	for i, t := range tracks {
+		out[i] = t.(string)
+	}
+	return out
+}
+
+// TestSmartPlaylists checks saving, evaluating and exporting smart playlists
+func TestSmartPlaylists(t *testing.T) {
+	withSmartPlaylists(t)
+	now := time.Now()
+	for _, p := range []string{"Jazz/So What.mp3", "Jazz/So What.mp3", "Rock/Paranoid.mp3"} {
+		_, err := history.start("", p, now)
+		assert.NoError(t, err)
+	}
+	_, err := history.start("", "Jazz/Giant Steps.mp3", now.AddDate(0, 0, -60))
+	assert.NoError(t, err)
+	historyAPI(t, "", "star", map[string]any{"paths": []string{"Rock/Paranoid.mp3"}})
+
+	preview := func(p map[string]any) []string {
+		resp := historyAPI(t, "", "smartPlaylistTracks", map[string]any{"playlist": p})
+		assert.Equal(t, "ok", resp["status"], resp["message"])
+		return smartTrackList(resp)
+	}
+	rule := func(field, op, value string) map[string]any {
+		return map[string]any{"field": field, "op": op, "value": value}
+	}
+
+	jazz50s := map[string]any{"name": "Fifties jazz", "rules": []any{rule("genre", "is", "jazz"), rule("year", "<", "1960")}}
+	assert.Equal(t, []string{"Jazz/Blue in Green.mp3", "Jazz/So What.mp3"}, preview(jazz50s))
+
+	anyOf := map[string]any{"match": "any", "rules": []any{rule("starred", "is", "true"), rule("rating", ">=", "5")}, "sort": "title"}
+	assert.Equal(t, []string{"Jazz/Blue in Green.mp3", "Rock/Paranoid.mp3"}, preview(anyOf))
+
+	assert.Equal(t, []string{"Jazz/Blue in Green.mp3"}, preview(map[string]any{"rules": []any{rule("lastPlayed", "never", ""), rule("folder", "under", "Jazz")}}))
+	assert.Equal(t, []string{"Jazz/So What.mp3", "Jazz/Giant Steps.mp3"}, preview(map[string]any{"rules": []any{rule("folder", "under", "Jazz/")}, "sort": "plays", "limit": 2}))
+	assert.Equal(t, []string{"Jazz/So What.mp3"}, preview(map[string]any{"rules": []any{rule("plays", ">", "0"), rule("genre", "is", "jazz")}, "playsIn": "30d"}))
+
+	resp := historyAPI(t, "", "smartPlaylistTracks", map[string]any{"playlist": map[string]any{"rules": []any{rule("year", "contains", "19")}}})
+	assert.Equal(t, "invalid", resp["code"])
+
+	resp = historyAPI(t, "", "saveSmartPlaylist", map[string]any{"playlist": jazz50s})
+	assert.Equal(t, "ok", resp["status"])
+	id := resp["playlist"].(map[string]any)["id"].(string)
+	assert.Equal(t, "error", historyAPI(t, "", "saveSmartPlaylist", map[string]any{"playlist": map[string]any{"name": "x", "rules": []any{rule("mood", "is", "happy")}}})["status"])
+
+	lists := historyAPI(t, "", "listSmartPlaylists", nil)["playlists"].([]any)
+	assert.Len(t, lists, 1)
+	assert.Len(t, smartTrackList(historyAPI(t, "", "smartPlaylistTracks", map[string]any{"id": id})), 2)
+	assert.Equal(t, "notFound", historyAPI(t, "", "smartPlaylistTracks", map[string]any{"id": "nope"})["code"])
+
+	req := httptest.NewRequest("GET", "/playlist/export?format=m3u8&smart="+id, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "#PLAYLIST:Fifties jazz")
+	assert.Equal(t, 2, strings.Count(w.Body.String(), "/stream/Jazz/"))
+
+	jazz50s["id"], jazz50s["limit"] = id, 1
+	assert.Equal(t, "ok", historyAPI(t, "", "saveSmartPlaylist", map[string]any{"playlist": jazz50s})["status"])
+	assert.Len(t, smartTrackList(historyAPI(t, "", "smartPlaylistTracks", map[string]any{"id": id})), 1)
+
+	assert.Equal(t, "ok", historyAPI(t, "", "deleteSmartPlaylist", map[string]any{"id": id})["status"])
+	assert.Equal(t, "notFound", historyAPI(t, "", "deleteSmartPlaylist", map[string]any{"id": id})["code"])
+}
+
+// TestPlaysSince checks the calendar periods of playsIn
+func TestPlaysSince(t *testing.T) {
+	now := time.Date(2024, 5, 16, 15, 4, 5, 0, time.UTC) // a Thursday
+	since, err := playsSince("week", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC), since)
+	since, _ = playsSince("month", now)
+	assert.Equal(t, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), since)
+	since, _ = playsSince("7d", now)
+	assert.Equal(t, now.AddDate(0, 0, -7), since)
+	_, err = playsSince("fortnight", now)
+	assert.Error(t, err)
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Server-side state (share links, API keys, playlists) is kept as JSON
+// documents in a stateStore. Every document has a version, and saves name
+// the version they were based on, so instances sharing a store (Lambda)
+// never overwrite each other's changes.
+
+const (
+	STATE_RETRIES        = 5
+	STATE_FORCE_INTERVAL = time.Second
+	STATE_TIMEOUT        = 10 * time.Second
+	DEFAULT_STATE_PREFIX = "go-music-state/"
+)
+
+var errStateConflict = errors.New("state document was changed by another writer")
+
+// stateStore stores named documents. Load returns nil data and an empty
+// version for a missing document. Save stores data only if the document is
+// still at version (an empty version means it must not exist yet) and
+// returns the new version, or errStateConflict.
+type stateStore interface {
+	Load(ctx context.Context, name string) ([]byte, string, error)
+	Save(ctx context.Context, name string, data []byte, version string) (string, error)
+}
+
+var (
+	// dataDir holds the state files of the file store (DATA_DIR).
+	dataDir = os.Getenv("DATA_DIR")
+	// stateRefresh is how long cached state is trusted before it is read
+	// again, so changes made by other instances show up.
+	stateRefresh = envDuration("STATE_REFRESH", 10*time.Second)
+
+	stateBackend stateStore = newMemoryState()
+)
+
+// initState selects the state store from STATE_STORE: "file" (DATA_DIR,
+// the default when it is set), "s3", "dynamodb" or "memory" (the default
+// otherwise; state is lost when the process exits).
+func initState() error {
+	kind := strings.ToLower(os.Getenv("STATE_STORE"))
+	if kind == "" && dataDir != "" {
+		kind = "file"
+	}
+	switch kind {
+	case "", "memory":
+		log.Printf("STATE_STORE not set; server-side state is kept in memory")
+	case "file":
+		if dataDir == "" {
+			return errors.New("STATE_STORE=file needs DATA_DIR")
+		}
+		stateBackend = &fileState{dir: dataDir}
+	case "s3":
+		return initS3State()
+	case "dynamodb":
+		return initDynamoState()
+	default:
+		return fmt.Errorf("unknown STATE_STORE %q", kind)
+	}
+	return nil
+}
+
+func initS3State() error {
+	bucket := os.Getenv("STATE_BUCKET")
+	if bucket == "" {
+		bucket = s3Bucket
+	}
+	if bucket == "" {
+		return errors.New("STATE_STORE=s3 needs STATE_BUCKET or BUCKET")
+	}
+	client := s3Client
+	if client == nil {
+		cfg, err := loadAWSConfig()
+		if err != nil {
+			return err
+		}
+		client = s3.NewFromConfig(cfg)
+	}
+	prefix := os.Getenv("STATE_PREFIX")
+	if prefix == "" {
+		prefix = DEFAULT_STATE_PREFIX
+	}
+	stateBackend = &s3State{client: client, bucket: bucket, prefix: prefix}
+	log.Printf("State store: s3://%s/%s", bucket, prefix)
+	return nil
+}
+
+func initDynamoState() error {
+	table := os.Getenv("STATE_TABLE")
+	if table == "" {
+		return errors.New("STATE_STORE=dynamodb needs STATE_TABLE")
+	}
+	cfg, err := loadAWSConfig()
+	if err != nil {
+		return err
+	}
+	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if endpoint := os.Getenv("DYNAMODB_ENDPOINT"); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	stateBackend = &dynamoState{client: client, table: table}
+	log.Printf("State store: DynamoDB table %s", table)
+	return nil
+}
+
+// loadState decodes the state document name into v and returns its version.
+// A missing document leaves v unchanged.
+func loadState(name string, v any) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), STATE_TIMEOUT)
+	defer cancel()
+	data, version, err := stateBackend.Load(ctx, name)
+	if err != nil || data == nil {
+		return version, err
+	}
+	return version, json.Unmarshal(data, v)
+}
+
+// saveState writes v as the state document name if it is still at version.
+func saveState(name string, v any, version string) (string, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), STATE_TIMEOUT)
+	defer cancel()
+	return stateBackend.Save(ctx, name, data, version)
+}
+
+// stateDoc caches a state document decoded into T. Reads use the cached
+// copy for up to stateRefresh. Updates always start from the stored copy
+// and are retried when another instance saved in between, so values handed
+// out by get are never modified.
+type stateDoc[T any] struct {
+	name    string
+	writeMu sync.Mutex // serializes this process's updates
+	mu      sync.Mutex // guards the fields below
+	value   T
+	backend stateStore
+	loaded  time.Time
+	forced  time.Time
+}
+
+// get returns the cached document, reading it again when it is stale or
+// was read from another store.
+func (d *stateDoc[T]) get() (T, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.backend == stateBackend && time.Since(d.loaded) < stateRefresh {
+		return d.value, nil
+	}
+	return d.loadLocked()
+}
+
+// refresh reads the document again, at most once per STATE_FORCE_INTERVAL.
+// Callers use it when an ID is missing from the cache, as it may have been
+// created by another instance.
+func (d *stateDoc[T]) refresh() (T, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.backend == stateBackend && time.Since(d.forced) < STATE_FORCE_INTERVAL {
+		return d.value, nil
+	}
+	d.forced = time.Now()
+	return d.loadLocked()
+}
+
+func (d *stateDoc[T]) loadLocked() (T, error) {
+	var v T
+	backend := stateBackend
+	if _, err := loadState(d.name, &v); err != nil {
+		return d.value, fmt.Errorf("load %s: %w", d.name, err)
+	}
+	d.value, d.backend, d.loaded = v, backend, time.Now()
+	return v, nil
+}
+
+// update applies change to the stored document and saves it. change may run
+// more than once and must not keep state between runs. An error from change
+// aborts the update and is returned with the document it was given.
+func (d *stateDoc[T]) update(change func(*T) error) (T, error) {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	for range STATE_RETRIES {
+		var v T
+		backend := stateBackend
+		version, err := loadState(d.name, &v)
+		if err != nil {
+			return v, fmt.Errorf("load %s: %w", d.name, err)
+		}
+		if err := change(&v); err != nil {
+			return v, err
+		}
+		if _, err := saveState(d.name, v, version); errors.Is(err, errStateConflict) {
+			continue
+		} else if err != nil {
+			return v, fmt.Errorf("save %s: %w", d.name, err)
+		}
+		d.mu.Lock()
+		d.value, d.backend, d.loaded = v, backend, time.Now()
+		d.mu.Unlock()
+		return v, nil
+	}
+	var zero T
+	return zero, errStateConflict
+}
+
+// userDocs holds one document per user, named prefix+user+".json".
+type userDocs[T any] struct {
+	prefix string
+	mu     sync.Mutex
+	docs   map[string]*stateDoc[T]
+}
+
+func newUserDocs[T any](prefix string) *userDocs[T] {
+	return &userDocs[T]{prefix: prefix, docs: map[string]*stateDoc[T]{}}
+}
+
+// doc returns the document of owner.
+func (u *userDocs[T]) doc(owner string) *stateDoc[T] {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	d, ok := u.docs[owner]
+	if !ok {
+		d = &stateDoc[T]{name: u.prefix + url.PathEscape(owner) + ".json"}
+		u.docs[owner] = d
+	}
+	return d
+}
+
+// --- Memory ---
+
+// memoryState keeps documents in memory; versions count saves.
+type memoryState struct {
+	mu   sync.Mutex
+	docs map[string]memoryDoc
+}
+
+type memoryDoc struct {
+	data    []byte
+	version int
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{docs: map[string]memoryDoc{}}
+}
+
+func (m *memoryState) Load(_ context.Context, name string) ([]byte, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc, ok := m.docs[name]
+	if !ok {
+		return nil, "", nil
+	}
+	return doc.data, strconv.Itoa(doc.version), nil
+}
+
+func (m *memoryState) Save(_ context.Context, name string, data []byte, version string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc, ok := m.docs[name]
+	if (ok && version != strconv.Itoa(doc.version)) || (!ok && version != "") {
+		return "", errStateConflict
+	}
+	doc = memoryDoc{data: data, version: doc.version + 1}
+	m.docs[name] = doc
+	return strconv.Itoa(doc.version), nil
+}
+
+// --- File ---
+
+// fileState keeps documents as JSON files in dir. The version is the file's
+// modification time and size; a process-wide lock makes the check and the
+// replacing rename atomic, so it suits a single server.
+type fileState struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func (f *fileState) Load(_ context.Context, name string) ([]byte, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := os.ReadFile(filepath.Join(f.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	version, err := f.versionLocked(name)
+	return b, version, err
+}
+
+func (f *fileState) versionLocked(name string) (string, error) {
+	info, err := os.Stat(filepath.Join(f.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+// Save replaces the file by a rename, so readers never see a partial write.
+func (f *fileState) Save(_ context.Context, name string, data []byte, version string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, err := f.versionLocked(name)
+	if err != nil {
+		return "", err
+	}
+	if current != version {
+		return "", errStateConflict
+	}
+	if err := os.MkdirAll(f.dir, 0700); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(f.dir, name+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(f.dir, name)); err != nil {
+		return "", err
+	}
+	return f.versionLocked(name)
+}
+
+// --- S3 ---
+
+// s3State keeps each document as an object under prefix. The version is
+// the object's ETag, and saves use S3 conditional writes (If-Match, or
+// If-None-Match for new documents).
+type s3State struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func (s *s3State) Load(ctx context.Context, name string) ([]byte, string, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + name),
+	})
+	var missing *s3types.NoSuchKey
+	if errors.As(err, &missing) || s3StatusCode(err) == http.StatusNotFound {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = out.Body.Close() }()
+	b, err := io.ReadAll(out.Body)
+	return b, aws.ToString(out.ETag), err
+}
+
+func (s *s3State) Save(ctx context.Context, name string, data []byte, version string) (string, error) {
+	in := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.prefix + name),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}
+	if version == "" {
+		in.IfNoneMatch = aws.String("*")
+	} else {
+		in.IfMatch = aws.String(version)
+	}
+	out, err := s.client.PutObject(ctx, in)
+	switch s3StatusCode(err) {
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return "", errStateConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+// --- DynamoDB ---
+
+// dynamoState keeps each document as an item in a table whose partition key
+// is the string attribute "name". The version is a counter checked with a
+// condition expression. Items are limited to 400 KB.
+type dynamoState struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func (d *dynamoState) Load(ctx context.Context, name string) ([]byte, string, error) {
+	out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            map[string]ddbtypes.AttributeValue{"name": &ddbtypes.AttributeValueMemberS{Value: name}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || out.Item == nil {
+		return nil, "", err
+	}
+	data, ok := out.Item["data"].(*ddbtypes.AttributeValueMemberS)
+	version, ok2 := out.Item["version"].(*ddbtypes.AttributeValueMemberN)
+	if !ok || !ok2 {
+		return nil, "", fmt.Errorf("malformed state item %q", name)
+	}
+	return []byte(data.Value), version.Value, nil
+}
+
+func (d *dynamoState) Save(ctx context.Context, name string, data []byte, version string) (string, error) {
+	next := 1
+	in := &dynamodb.PutItemInput{
+		TableName:                aws.String(d.table),
+		ExpressionAttributeNames: map[string]string{"#n": "name"},
+		ConditionExpression:      aws.String("attribute_not_exists(#n)"),
+	}
+	if version != "" {
+		n, err := strconv.Atoi(version)
+		if err != nil {
+			return "", errStateConflict
+		}
+		next = n + 1
+		in.ExpressionAttributeNames = map[string]string{"#v": "version"}
+		in.ConditionExpression = aws.String("#v = :v")
+		in.ExpressionAttributeValues = map[string]ddbtypes.AttributeValue{":v": &ddbtypes.AttributeValueMemberN{Value: version}}
+	}
+	in.Item = map[string]ddbtypes.AttributeValue{
+		"name":    &ddbtypes.AttributeValueMemberS{Value: name},
+		"data":    &ddbtypes.AttributeValueMemberS{Value: string(data)},
+		"version": &ddbtypes.AttributeValueMemberN{Value: strconv.Itoa(next)},
+	}
+	_, err := d.client.PutItem(ctx, in)
+	var failed *ddbtypes.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return "", errStateConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(next), nil
+}
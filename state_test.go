@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// withStateDir gives a test its own file state store
+func withStateDir(t *testing.T) string {
+	t.Helper()
+	origBackend := stateBackend
+	t.Cleanup(func() { stateBackend = origBackend })
+	dir := t.TempDir()
+	stateBackend = &fileState{dir: dir}
+	return dir
+}
+
+// testStateStore checks the versioning contract every backend must keep
+func testStateStore(t *testing.T, store stateStore) {
+	ctx := context.Background()
+	data, version, err := store.Load(ctx, "test.json")
+	assert.NoError(t, err, "a missing document is not an error")
+	assert.Nil(t, data)
+	assert.Empty(t, version)
+
+	v1, err := store.Save(ctx, "test.json", []byte(`["a"]`), "")
+	assert.NoError(t, err)
+	_, err = store.Save(ctx, "test.json", []byte(`["b"]`), "")
+	assert.ErrorIs(t, err, errStateConflict, "the document exists already")
+
+	v2, err := store.Save(ctx, "test.json", []byte(`["a","b"]`), v1)
+	assert.NoError(t, err)
+	assert.NotEqual(t, v1, v2)
+	_, err = store.Save(ctx, "test.json", []byte(`["c"]`), v1)
+	assert.ErrorIs(t, err, errStateConflict, "stale version")
+
+	data, version, err = store.Load(ctx, "test.json")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `["a","b"]`, string(data))
+	assert.Equal(t, v2, version)
+}
+
+// TestStateStores checks the memory, file and S3 state stores
+func TestStateStores(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		testStateStore(t, newMemoryState())
+	})
+
+	t.Run("File", func(t *testing.T) {
+		tmpDir, err := os.MkdirTemp("", "gomusic-state-*")
+		assert.NoError(t, err)
+		defer os.RemoveAll(tmpDir)
+		dir := filepath.Join(tmpDir, "state")
+		testStateStore(t, &fileState{dir: dir})
+
+		entries, _ := os.ReadDir(dir)
+		assert.Len(t, entries, 1, "no temporary files are left behind")
+	})
+
+	t.Run("S3", func(t *testing.T) {
+		fake := newFakeS3(t, map[string][]byte{})
+		testStateStore(t, &s3State{client: s3Client, bucket: fake.bucket, prefix: DEFAULT_STATE_PREFIX})
+		_, ok := fake.objects[DEFAULT_STATE_PREFIX+"test.json"]
+		assert.True(t, ok)
+	})
+}
+
+// TestStateDynamoDB runs the store contract against DynamoDB Local when
+// DYNAMODB_ENDPOINT is set (e.g. http://localhost:8000)
+func TestStateDynamoDB(t *testing.T) {
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_ENDPOINT not set")
+	}
+	client := dynamodb.New(dynamodb.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(endpoint),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "local", SecretAccessKey: "local"}, nil
+		}),
+	})
+	table := fmt.Sprintf("gomusic-test-%d", time.Now().UnixNano())
+	ctx := context.Background()
+	_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName:            aws.String(table),
+		AttributeDefinitions: []ddbtypes.AttributeDefinition{{AttributeName: aws.String("name"), AttributeType: ddbtypes.ScalarAttributeTypeS}},
+		KeySchema:            []ddbtypes.KeySchemaElement{{AttributeName: aws.String("name"), KeyType: ddbtypes.KeyTypeHash}},
+		BillingMode:          ddbtypes.BillingModePayPerRequest,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _, _ = client.DeleteTable(ctx, &dynamodb.DeleteTableInput{TableName: aws.String(table)}) }()
+	testStateStore(t, &dynamoState{client: client, table: table})
+}
+
+// TestStateDoc checks cached reads and concurrent updates
+func TestStateDoc(t *testing.T) {
+	origBackend := stateBackend
+	defer func() { stateBackend = origBackend }()
+	stateBackend = newMemoryState()
+
+	doc := &stateDoc[[]int]{name: "numbers.json"}
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := doc.update(func(v *[]int) error {
+				*v = append(*v, i)
+				return nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	got, err := doc.get()
+	assert.NoError(t, err)
+	assert.Len(t, got, 20)
+
+	// Another instance writing the same store is retried, not overwritten.
+	other := &stateDoc[[]int]{name: "numbers.json"}
+	_, err = other.get()
+	assert.NoError(t, err)
+	_, err = doc.update(func(v *[]int) error {
+		if len(*v) == 20 {
+			_, err := other.update(func(v *[]int) error { *v = append(*v, 100); return nil })
+			assert.NoError(t, err)
+		}
+		*v = append(*v, 200)
+		return nil
+	})
+	assert.NoError(t, err)
+	var stored []int
+	_, err = loadState("numbers.json", &stored)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{100, 200}, stored[20:])
+
+	cached, _ := other.get()
+	assert.Len(t, cached, 21, "reads are cached for STATE_REFRESH")
+	refreshed, _ := other.refresh()
+	assert.Len(t, refreshed, 22)
+}
@@ -7,6 +7,28 @@ var browserCurDir = '';
 var browserCurDirs = [];
 var browserDirs = [];
 var browserTitles = [];
+var browserPlaylists = [];
+// Server-side playlists: the open one, the list and the last saved tracks.
+var currentPlaylist = null;
+var savedPlaylists = [];
+var syncedTracks = '[]';
+var savePlaylistTimer = null;
+// The play being reported to the play history.
+var playReport = null;
+// Resume state: this device, the last known save and the last synced queue.
+var deviceId = getDeviceId();
+var playStateUpdated = '';
+var playStateSuperseded = false;
+var syncedQueue = '[]';
+var lastPlayStateSave = 0;
+var PLAY_STATE_INTERVAL = 15000; // ms between saves while playing
+var remoteSocket = null;
+var remoteDevices = [];
+var remoteRetry = 1000;
+var lastRemoteState = 0;
+var REMOTE_STATE_INTERVAL = 5000; // ms between state updates while playing
+// Star and rating of the playing track, from getRatings.
+var trackRating = null;
 var playing = 0;
 var playingTrack = '';
 var lastProgress = -1;
@@ -50,6 +72,11 @@ async function fetchAPI(functionName, data) {
             })
         });
 
+        if (response.status === 401) {
+            // Session expired: sign in again and come back to the player.
+            window.location.href = '/login?next=/';
+            return { status: 'error', message: 'Authentication required' };
+        }
         if (!response.ok) {
             throw new Error(`HTTP error! status: ${response.status}`);
         }
@@ -82,6 +109,7 @@ function getBrowserData(data) {
         }
         browserDirs = data.dirs || [];
         browserTitles = data.files || [];
+        browserPlaylists = data.playlists || [];
         updateBrowser();
     } else {
         alert(data.message || 'Error loading directory');
@@ -96,6 +124,9 @@ function init() {
     window.onbeforeunload = function () {
         return 'Quit player?';
     };
+    window.onpagehide = function () {
+        savePlayState(false, true);
+    };
     showTab(1);
     markPlayingTab('');
     player = gebi('player');
@@ -111,14 +142,27 @@ function init() {
         changeTrack(1);
     }
     player.onpause = function () {
+        savePlayState(false);
+        sendRemoteState();
         gebi('buttonPlay').innerHTML = '<svg width="24" height="24" viewBox="0 0 24 24" fill="currentColor"><path d="M8 5v14l11-7z"/></svg>';
     }
     player.onplaying = function () {
+        startPlayReport();
+        savePlayState(true);
+        sendRemoteState();
         gebi('buttonPlay').innerHTML = '<svg width="24" height="24" viewBox="0 0 24 24" fill="currentColor"><path d="M6 19h4V5H6v14zm8-14v14h4V5h-4z"/></svg>';
     }
     player.ontimeupdate = function () {
         updateProgressBar();
+        trackPlayReport();
+        if (!player.paused && Date.now() - lastPlayStateSave > PLAY_STATE_INTERVAL) savePlayState(false);
+        if (!player.paused && Date.now() - lastRemoteState > REMOTE_STATE_INTERVAL) sendRemoteState();
+    }
+    player.onseeked = function () {
+        sendRemoteState();
     }
+    connectRemote();
+    watchLibrary();
     player.onloadedmetadata = function () {
         updateProgressBar();
     }
@@ -321,16 +365,423 @@ function getCookie(cname) {
 }
 
 
-function loadPlaylist() {
+// Load the saved playlists and the play state from the server, and resume
+// where the user left off on this or another device. A playlist left in the
+// old cookie is moved to the server the first time.
+async function loadPlaylist() {
+    var id = '';
     var playlistCookie = getCookie('playlist');
     if (playlistCookie != '') {
-        playlistTracks = playlistCookie.split('|');
+        const created = await fetchAPI('createPlaylist', JSON.stringify({ name: 'My playlist', tracks: playlistCookie.split('|') }));
+        if (created.status === 'ok') {
+            setCookie('playlist', '', -1);
+            id = created.playlist.id;
+        }
+    }
+    const data = await fetchAPI('listPlaylists', '');
+    savedPlaylists = data.playlists || [];
+    const stateData = await fetchAPI('getPlayState', '');
+    var state = stateData.status === 'ok' ? stateData.state : null;
+    if (!id && state) {
+        id = state.playlistId || '';
+    }
+    if (!savedPlaylists.some(function (p) { return p.id === id; })) {
+        id = savedPlaylists.length > 0 ? savedPlaylists[0].id : '';
+    }
+    await openPlaylist(id);
+    if (state) {
+        restorePlayState(state);
+    }
+}
+
+
+// Resume: the play state (queue, track and position) is saved on the
+// server while playing, so another device can pick up from there. Starting
+// playback takes over; a device whose periodic save finds that another
+// device took over pauses.
+function getDeviceId() {
+    var id = localStorage.getItem('deviceId');
+    if (!id) {
+        id = Math.random().toString(36).slice(2) + Date.now().toString(36);
+        localStorage.setItem('deviceId', id);
+    }
+    return id;
+}
+
+
+function getDeviceName() {
+    var ua = navigator.userAgent;
+    var os = /Android/.test(ua) ? 'Android' : /iPhone|iPad/.test(ua) ? 'iOS' : /Mac/.test(ua) ? 'Mac' : /Windows/.test(ua) ? 'Windows' : /Linux/.test(ua) ? 'Linux' : 'Browser';
+    var browser = /Edg\//.test(ua) ? 'Edge' : /Firefox\//.test(ua) ? 'Firefox' : /Chrome\//.test(ua) ? 'Chrome' : /Safari\//.test(ua) ? 'Safari' : '';
+    return browser ? browser + ' on ' + os : os;
+}
+
+
+function restorePlayState(state) {
+    playStateUpdated = state.updated;
+    syncedQueue = JSON.stringify(state.queue || []);
+    if (state.shuffle !== shuffle) shuffleToggle();
+    if (!state.track) return;
+    var queue = state.queue || [];
+    if (state.source === 'browser' && queue.length > 0) {
+        browserPlaylistDir = state.track.substring(0, state.track.lastIndexOf('/') + 1);
+        browserPlaylistTitles = queue.map(function (t) { return t.substring(browserPlaylistDir.length); });
+        playing = queue[state.index] === state.track ? state.index : Math.max(queue.indexOf(state.track), 0);
+        markPlayingTab('browser');
+    } else {
+        playing = playlistTracks[state.index] === state.track ? state.index : Math.max(playlistTracks.indexOf(state.track), 0);
+        markPlayingTab('list');
+    }
+    setAndPlayTrack(state.track, state.position);
+    if (state.device !== deviceId) {
+        showToast('Resumed from ' + (state.deviceName || 'another device'));
+    }
+}
+
+
+function currentQueue() {
+    if (playingFrom === 'browser') {
+        return browserPlaylistTitles.map(function (t) { return browserPlaylistDir + t; });
+    }
+    return playlistTracks;
+}
+
+
+// Save the play state. takeOver marks a user action on this device, which
+// wins over other devices; other saves are refused once another device
+// has taken over.
+function savePlayState(takeOver, beacon) {
+    if (!takeOver && (playStateSuperseded || !playingTrack)) return;
+    playStateSuperseded = false;
+    lastPlayStateSave = Date.now();
+    var queue = currentQueue();
+    var queueJSON = JSON.stringify(queue);
+    var state = {
+        device: deviceId,
+        deviceName: getDeviceName(),
+        source: playingFrom === 'browser' ? 'browser' : 'list',
+        playlistId: currentPlaylist ? currentPlaylist.id : '',
+        index: Math.max(playing, 0),
+        track: playingTrack,
+        position: player.currentTime || 0,
+        playing: !player.paused,
+        shuffle: shuffle,
+        updated: new Date().toISOString()
+    };
+    if (queueJSON !== syncedQueue) state.queue = queue;
+    if (!takeOver && playStateUpdated) state.since = playStateUpdated;
+    var body = JSON.stringify({ function: 'savePlayState', data: JSON.stringify(state) });
+    if (beacon) {
+        navigator.sendBeacon('/api', new Blob([body], { type: 'application/json' }));
+        return;
+    }
+    fetch('/api', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: body })
+        .then(res => res.ok ? res.json() : null)
+        .then(function (data) {
+            if (!data) return;
+            if (data.status === 'ok') {
+                playStateUpdated = data.state.updated;
+                syncedQueue = JSON.stringify(data.state.queue || []);
+            } else if (data.code === 'stale') {
+                playStateSuperseded = true;
+                playStateUpdated = data.state.updated;
+                if (!player.paused) player.pause();
+                showToast('Playback continued on ' + (data.state.deviceName || 'another device'));
+            }
+        })
+        .catch(() => null);
+}
+
+
+// Library changes arrive as Server-Sent Events; the browser view reloads
+// when the directory it shows changed. EventSource reconnects by itself and
+// sends Last-Event-ID, so no change is missed.
+function watchLibrary() {
+    if (!window.EventSource) return;
+    var source = new EventSource('/events');
+    ['added', 'removed', 'rescanned'].forEach(function (type) {
+        source.addEventListener(type, function (e) {
+            var ev = JSON.parse(e.data);
+            var gone = (ev.dirs || []).some(function (d) { return browserCurDir.indexOf(d) === 0; });
+            if (type === 'removed' && gone) {
+                refreshBrowser(ev.dir);
+            } else if (ev.dir === browserCurDir) {
+                refreshBrowser(browserCurDir);
+            }
+        });
+    });
+    source.addEventListener('reset', function () {
+        refreshBrowser(browserCurDir);
+    });
+}
+
+
+async function refreshBrowser(dir) {
+    if (searchInDirActive || loading) return;
+    const data = await fetchAPI('dir', dir);
+    if (data.status === 'ok') getBrowserData(data);
+}
+
+
+// Remote control: the player registers as a device on /remote, reports what
+// it plays and follows commands from the user's other sessions. The
+// connection is reopened with a growing delay when it drops.
+function connectRemote() {
+    if (!window.WebSocket) return;
+    var proto = location.protocol === 'https:' ? 'wss://' : 'ws://';
+    var ws = new WebSocket(proto + location.host + '/remote?device=' + encodeURIComponent(deviceId) + '&name=' + encodeURIComponent(getDeviceName()));
+    remoteSocket = ws;
+    ws.onmessage = function (e) {
+        var msg = JSON.parse(e.data);
+        switch (msg.type) {
+            case 'hello':
+                remoteRetry = 1000;
+                sendRemoteState();
+                break;
+            case 'devices':
+                remoteDevices = msg.devices || [];
+                updateRemoteDevices();
+                break;
+            case 'state':
+                remoteDevices.forEach(function (d) { if (d.id === msg.from) d.state = msg.state; });
+                updateRemoteDevices();
+                break;
+            case 'command':
+                applyRemoteCommand(msg.command);
+                break;
+            case 'ping':
+                ws.send(JSON.stringify({ type: 'pong' }));
+                break;
+            case 'error':
+                showToast('Remote: ' + msg.message);
+                break;
+        }
+    };
+    ws.onclose = function () {
+        if (remoteSocket !== ws) return;
+        remoteSocket = null;
+        remoteDevices = [];
+        updateRemoteDevices();
+        setTimeout(connectRemote, remoteRetry);
+        remoteRetry = Math.min(remoteRetry * 2, 30000);
+    };
+}
+
+
+function sendRemote(msg) {
+    if (remoteSocket && remoteSocket.readyState === WebSocket.OPEN) {
+        remoteSocket.send(JSON.stringify(msg));
+    }
+}
+
+
+function sendRemoteState() {
+    lastRemoteState = Date.now();
+    sendRemote({
+        type: 'state', state: {
+            track: playingTrack,
+            position: player.currentTime || 0,
+            duration: player.duration || 0,
+            playing: !player.paused,
+            shuffle: shuffle,
+            queue: currentQueue(),
+            index: Math.max(playing, 0)
+        }
+    });
+}
+
+
+function remoteCommand(to, command) {
+    sendRemote({ type: 'command', to: to, command: command });
+}
+
+
+function applyRemoteCommand(cmd) {
+    switch (cmd.action) {
+        case 'play':
+            if (playingTrack) player.play();
+            break;
+        case 'pause':
+            player.pause();
+            break;
+        case 'toggle':
+            if (player.paused) { if (playingTrack) player.play(); } else player.pause();
+            break;
+        case 'next':
+        case 'previous':
+            changeTrack(cmd.action === 'next' ? 1 : -1);
+            break;
+        case 'seek':
+            player.currentTime = cmd.position || 0;
+            break;
+        case 'queue':
+            // Played like a folder, so the saved playlist is left alone.
+            browserPlaylistDir = '';
+            browserPlaylistTitles = cmd.queue;
+            playing = cmd.index || 0;
+            markPlayingTab('browser');
+            if (cmd.position) {
+                player.addEventListener('canplay', function () { player.play(); }, { once: true });
+                setAndPlayTrack(cmd.queue[playing], cmd.position);
+            } else {
+                setAndPlayTrack(cmd.queue[playing]);
+            }
+            break;
+    }
+}
+
+
+// Send this player's queue and position to another device, which takes
+// over playback.
+function sendPlaybackTo(id) {
+    var queue = currentQueue();
+    if (!playingTrack || queue.length === 0) return;
+    remoteCommand(id, { action: 'queue', queue: queue, index: Math.max(queue.indexOf(playingTrack), 0), position: player.currentTime || 0 });
+    player.pause();
+}
+
+
+// Take over what another device is playing.
+function playHereFrom(id) {
+    var d = remoteDevices.find(function (d) { return d.id === id; });
+    if (!d || !d.state || !d.state.track) return;
+    var queue = d.state.queue && d.state.queue.length ? d.state.queue : [d.state.track];
+    applyRemoteCommand({ action: 'queue', queue: queue, index: Math.max(queue.indexOf(d.state.track), 0), position: d.state.position });
+    remoteCommand(id, { action: 'pause' });
+}
+
+
+function updateRemoteDevices() {
+    var el = gebi('remoteDevices');
+    var others = remoteDevices.filter(function (d) { return d.id !== deviceId; });
+    el.hidden = others.length === 0;
+    el.innerHTML = others.map(function (d) {
+        var id = escapeHtml(JSON.stringify(d.id));
+        var st = d.state || {};
+        var now = st.track ? (st.playing ? ' \u25B6 ' : ' \u275A\u275A ') + escapeHtml(getTrackTitle(st.track)) : '';
+        return '<div class="remote-device"><span class="remote-device-name" title="' + escapeHtml(d.name) + '">' + escapeHtml(d.name) + now + '</span>' +
+            '<button class="remote-btn" onClick=\'remoteCommand(' + id + ',{action:"previous"})\' title="Previous">&#9198;</button>' +
+            '<button class="remote-btn" onClick=\'remoteCommand(' + id + ',{action:"toggle"})\' title="Play/Pause">&#9199;</button>' +
+            '<button class="remote-btn" onClick=\'remoteCommand(' + id + ',{action:"next"})\' title="Next">&#9197;</button>' +
+            '<button class="remote-btn" onClick=\'sendPlaybackTo(' + id + ')\' title="Continue on this device">Send</button>' +
+            '<button class="remote-btn" onClick=\'playHereFrom(' + id + ')\' title="Continue here">Play here</button></div>';
+    }).join('');
+}
+
+
+function selectPlaylist(id) {
+    openPlaylist(id).then(function () { savePlayState(true); });
+}
+
+
+async function openPlaylist(id) {
+    var p = { id: '', name: '', tracks: [], version: 0 };
+    if (id) {
+        const data = await fetchAPI('getPlaylist', JSON.stringify({ id: id }));
+        if (data.status === 'ok') {
+            p = data.playlist;
+        }
     }
+    showSavedPlaylist(p);
 }
 
 
+function showSavedPlaylist(p) {
+    currentPlaylist = { id: p.id, name: p.name, version: p.version };
+    syncedTracks = JSON.stringify(p.tracks);
+    playlistTracks = p.tracks.slice();
+    updatePlaylist();
+}
+
+
+// Save playlist changes to the server shortly after they are made.
 function savePlaylist() {
-    setCookie('playlist', playlistTracks.join('|'), 365);
+    if (currentPlaylist === null || JSON.stringify(playlistTracks) === syncedTracks) {
+        return;
+    }
+    clearTimeout(savePlaylistTimer);
+    savePlaylistTimer = setTimeout(syncPlaylist, 500);
+}
+
+
+async function syncPlaylist() {
+    var tracks = playlistTracks.slice();
+    var data;
+    if (!currentPlaylist.id) {
+        data = await fetchAPI('createPlaylist', JSON.stringify({ name: 'My playlist', tracks: tracks }));
+    } else {
+        data = await fetchAPI('setPlaylistTracks', JSON.stringify({ id: currentPlaylist.id, version: currentPlaylist.version, tracks: tracks }));
+    }
+    if (data.status === 'ok') {
+        var wasNew = !currentPlaylist.id;
+        currentPlaylist = { id: data.playlist.id, name: data.playlist.name, version: data.playlist.version };
+        syncedTracks = JSON.stringify(tracks);
+        if (wasNew) {
+            refreshPlaylistList();
+        }
+        savePlaylist();
+    } else if (data.code === 'conflict') {
+        showToast('Playlist was changed on another device');
+        showSavedPlaylist(data.playlist);
+    } else if (data.code === 'notFound') {
+        showSavedPlaylist({ id: '', name: '', tracks: playlistTracks, version: 0 });
+        syncedTracks = '';
+        savePlaylist();
+    }
+}
+
+
+async function refreshPlaylistList() {
+    const data = await fetchAPI('listPlaylists', '');
+    savedPlaylists = data.playlists || [];
+    updatePlaylist();
+}
+
+
+async function playlistCommand(fn, data) {
+    const result = await fetchAPI(fn, JSON.stringify(data));
+    if (result.status !== 'ok') {
+        alert(result.message || 'Playlist update failed');
+        return null;
+    }
+    await refreshPlaylistList();
+    return result;
+}
+
+
+async function newPlaylist() {
+    var name = prompt('New playlist name', '');
+    if (!name) return;
+    const result = await playlistCommand('createPlaylist', { name: name });
+    if (result) showSavedPlaylist(result.playlist);
+}
+
+
+async function renameCurrentPlaylist() {
+    var name = prompt('Rename playlist', currentPlaylist.name);
+    if (!name) return;
+    const result = await playlistCommand('renamePlaylist', { id: currentPlaylist.id, version: currentPlaylist.version, name: name });
+    if (result) {
+        currentPlaylist.version = result.playlist.version;
+        currentPlaylist.name = result.playlist.name;
+        updatePlaylist();
+    }
+}
+
+
+async function duplicateCurrentPlaylist() {
+    const result = await playlistCommand('duplicatePlaylist', { id: currentPlaylist.id });
+    if (result) showSavedPlaylist(result.playlist);
+}
+
+
+function deleteCurrentPlaylist() {
+    showConfirmDialog('Delete Playlist?', 'Delete the playlist "' + currentPlaylist.name + '"?', async function () {
+        const result = await playlistCommand('deletePlaylist', { id: currentPlaylist.id, version: currentPlaylist.version });
+        if (result) {
+            selectPlaylist(savedPlaylists.length > 0 ? savedPlaylists[0].id : '');
+        }
+    });
 }
 
 
@@ -487,18 +938,26 @@ function updateAllLists() {
 }
 
 
-function setAndPlayTrack(track) {
+// setAndPlayTrack plays track, or with resumeAt loads it paused at that
+// position.
+function setAndPlayTrack(track, resumeAt) {
     var trackTitle = getTrackTitle(track);
     var trackDir = getTrackDir(track);
     var trackNameEl = gebi('trackName');
     trackNameEl.innerHTML = '<div class="track-title">' + escapeHtml(trackTitle) + '</div><div class="track-path">' + escapeHtml(trackDir) + '</div>';
     playingTrack = track;
-    // Fetch the pre-signed S3 URL from the backend and set it as the audio src
-    fetch('/audio/' + track)
+    playReport = { track: track, id: '', started: false, completed: false, listened: 0, lastTime: 0 };
+    showTrackRating(track);
+    // Fetch the playback URL (pre-signed or proxied) and set it as the audio src
+    fetch('/audio/' + track, { headers: { 'Accept': 'application/json' } })
         .then(res => res.json())
         .then(data => {
             player.src = data.url;
-            player.play();
+            if (resumeAt === undefined) {
+                player.play();
+            } else {
+                player.currentTime = resumeAt;
+            }
         })
         .catch(err => {
             alert('Failed to load audio: ' + err);
@@ -507,6 +966,84 @@ function setAndPlayTrack(track) {
 }
 
 
+// Play history: report the start of a play, and its completion once half
+// the track (or four minutes) has been heard. Tracks under 30 seconds are
+// not completed, as with scrobbling.
+function startPlayReport() {
+    if (!playReport || playReport.started) return;
+    playReport.started = true;
+    var report = playReport;
+    sendPlayEvent({ event: 'start', path: report.track }).then(function (data) {
+        if (data && data.id) report.id = data.id;
+    });
+}
+
+
+function trackPlayReport() {
+    var report = playReport;
+    if (!report || !report.started || report.completed) return;
+    var delta = player.currentTime - report.lastTime;
+    report.lastTime = player.currentTime;
+    // Count only normal playback, not seeks.
+    if (delta > 0 && delta < 2) report.listened += delta;
+    var duration = player.duration;
+    if (!(duration >= 30) || report.listened < Math.min(duration / 2, 240)) return;
+    report.completed = true;
+    sendPlayEvent({ event: 'complete', id: report.id, path: report.track, played: Math.round(report.listened), duration: Math.round(duration) });
+}
+
+
+function sendPlayEvent(event) {
+    return fetch('/api', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ function: 'playEvent', data: JSON.stringify(event) })
+    }).then(res => res.ok ? res.json() : null).catch(() => null);
+}
+
+
+// Favorites and ratings of the playing track.
+async function showTrackRating(track) {
+    var box = gebi('trackRating');
+    const data = await fetchAPI('getRatings', JSON.stringify({ paths: [track] }));
+    if (track !== playingTrack) return;
+    if (data.status !== 'ok' || !data.ratings || !data.ratings.length) {
+        box.hidden = true;
+        return;
+    }
+    trackRating = data.ratings[0];
+    var starred = !!trackRating.kind;
+    var btn = gebi('starButton');
+    btn.innerHTML = starred ? '&#9733;' : '&#9734;';
+    btn.classList.toggle('starred', starred);
+    btn.title = starred ? 'Unstar' : 'Star';
+    var stars = '';
+    for (var i = 1; i <= 5; i++) {
+        stars += '<span class="rating-star' + (i <= trackRating.rating ? ' on' : '') + '" onClick="rateTrack(' + i + ')" title="' + i + '">&#9733;</span>';
+    }
+    gebi('ratingStars').innerHTML = stars;
+    box.hidden = false;
+}
+
+
+async function toggleStar() {
+    if (!trackRating) return;
+    var track = playingTrack;
+    await fetchAPI(trackRating.kind ? 'unstar' : 'star', JSON.stringify({ paths: [track] }));
+    showTrackRating(track);
+}
+
+
+async function rateTrack(rating) {
+    if (!trackRating) return;
+    var track = playingTrack;
+    // Clicking the current rating clears it.
+    if (rating === trackRating.rating) rating = 0;
+    await fetchAPI('setRating', JSON.stringify({ path: track, rating: rating }));
+    showTrackRating(track);
+}
+
+
 function getTrackTitle(track) {
     var name = track.split('/').pop();
     name = name.replace(new RegExp('_', 'g'), ' ');
@@ -550,6 +1087,9 @@ function updateBrowser() {
             list += '<div class="breadcrumb-item-wrapper">';
             list += '<div class="breadcrumb-item" onClick="browseDirFromBreadCrumbBar(' + i + ')">' + escapeHtml(browserCurDirs[i]) + '</div>';
             list += '<button class="breadcrumb-add-btn" onClick="event.stopPropagation();addCurrentDirToPlaylist()" title="Add all songs from current directory">＋</button>';
+            list += '<button class="breadcrumb-add-btn" onClick="event.stopPropagation();downloadCurrentDir()" title="Download current directory as ZIP">⤓</button>';
+            list += '<button class="breadcrumb-add-btn" onClick="event.stopPropagation();copyFeedUrl()" title="Copy podcast feed URL">RSS</button>';
+            list += '<button class="breadcrumb-add-btn" onClick="event.stopPropagation();shareCurrentDir()" title="Create a share link for this directory">Share</button>';
             list += '</div>';
         } else {
             list += '<div class="breadcrumb-item" onClick="browseDirFromBreadCrumbBar(' + i + ')">' + escapeHtml(browserCurDirs[i]) + '</div>';
@@ -601,6 +1141,19 @@ function updateBrowser() {
         }
     }
 
+    // Playlist files (.m3u/.m3u8) stored in the library
+    for (var i = 0; i < browserPlaylists.length; i++) {
+        if (!filterLower || browserPlaylists[i].toLowerCase().indexOf(filterLower) >= 0) {
+            list += '<div class="list-item playlist-file" onClick="addLibraryPlaylist(' + i + ')" title="Add playlist tracks">';
+            list += '<div class="item-content">';
+            list += '<div class="item-title"><svg width="16" height="16" viewBox="0 0 24 24" fill="currentColor" style="vertical-align: middle; margin-right: 4px;"><path d="M15 6H3v2h12V6zm0 4H3v2h12v-2zM3 16h8v-2H3v2zM17 6v8.18c-.31-.11-.65-.18-1-.18-1.66 0-3 1.34-3 3s1.34 3 3 3 3-1.34 3-3V8h3V6h-5z"/></svg> ' + escapeHtml(getTrackTitle(browserPlaylists[i])) + '</div>';
+            list += '<div class="item-subtitle">' + escapeHtml(getTrackDir(browserCurDir)) + '</div>';
+            list += '</div>';
+            list += '<div class="item-action" onClick="event.stopPropagation();addLibraryPlaylist(' + i + ')" title="Add playlist tracks">＋</div>';
+            list += '</div>';
+        }
+    }
+
     // Music files
     var playlistCount;
     for (var i = 0; i < browserTitles.length; i++) {
@@ -641,6 +1194,36 @@ function updatePlaylist() {
         list += '<div class="info-banner">Playlist is empty - Add tracks from Browser or Search</div>';
     }
 
+    // Saved playlists
+    list += '<div class="playlist-tools">';
+    list += '<select class="playlist-select" onChange="selectPlaylist(this.value)" title="Saved playlists">';
+    if (currentPlaylist && !currentPlaylist.id) {
+        list += '<option value="" selected>Unsaved playlist</option>';
+    }
+    for (var i = 0; i < savedPlaylists.length; i++) {
+        var selected = currentPlaylist && currentPlaylist.id === savedPlaylists[i].id;
+        list += '<option value="' + escapeHtml(savedPlaylists[i].id) + '"' + (selected ? ' selected' : '') + '>' + escapeHtml(savedPlaylists[i].name) + '</option>';
+    }
+    list += '</select>';
+    list += '<button class="playlist-tool-btn" onClick="newPlaylist()" title="New playlist">New</button>';
+    if (currentPlaylist && currentPlaylist.id) {
+        list += '<button class="playlist-tool-btn" onClick="renameCurrentPlaylist()" title="Rename playlist">Rename</button>';
+        list += '<button class="playlist-tool-btn" onClick="duplicateCurrentPlaylist()" title="Duplicate playlist">Copy</button>';
+        list += '<button class="playlist-tool-btn" onClick="deleteCurrentPlaylist()" title="Delete playlist">Delete</button>';
+    }
+    list += '</div>';
+
+    // Export / import playlist files (M3U8, PLS, XSPF)
+    list += '<div class="playlist-tools">';
+    if (playlistTracks.length > 0) {
+        list += '<button class="playlist-tool-btn" onClick="exportPlaylist(\'m3u8\')" title="Export as M3U8">M3U8</button>';
+        list += '<button class="playlist-tool-btn" onClick="exportPlaylist(\'pls\')" title="Export as PLS">PLS</button>';
+        list += '<button class="playlist-tool-btn" onClick="exportPlaylist(\'xspf\')" title="Export as XSPF">XSPF</button>';
+        list += '<button class="playlist-tool-btn" onClick="downloadPlaylistZip()" title="Download tracks as ZIP">ZIP</button>';
+    }
+    list += '<label class="playlist-tool-btn" title="Import M3U/M3U8, PLS or XSPF">Import<input type="file" accept=".m3u,.m3u8,.pls,.xspf" style="display:none" onChange="importPlaylistFile(this)"></label>';
+    list += '</div>';
+
     // (Removed) Add all MP3 files button — functionality available via directory '+' controls in Browser
 
     // Playlist tracks
@@ -1188,3 +1771,122 @@ function removeSearchInDirTrackFromPlaylist(i) {
     updatePlaylist();
     getSearchInDirData({ status: 'ok', matches: searchInDirMatches });
 }
+
+// Download the current playlist as an M3U8, PLS or XSPF file.
+async function exportPlaylist(format) {
+    try {
+        const response = await fetch('/playlist/export?format=' + encodeURIComponent(format), {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ name: 'playlist', tracks: playlistTracks })
+        });
+        if (!response.ok) {
+            throw new Error(`HTTP error! status: ${response.status}`);
+        }
+        const blob = await response.blob();
+        var link = document.createElement('a');
+        link.href = URL.createObjectURL(blob);
+        link.download = 'playlist.' + format;
+        document.body.appendChild(link);
+        link.click();
+        document.body.removeChild(link);
+        setTimeout(function () { URL.revokeObjectURL(link.href); }, 1000);
+    } catch (error) {
+        alert('Export failed: ' + error.message);
+    }
+}
+
+// Download the current playlist as a ZIP. A regular form post lets the browser
+// stream the archive to disk instead of buffering it in memory.
+function downloadPlaylistZip() {
+    var form = document.createElement('form');
+    form.method = 'POST';
+    form.action = '/download';
+    for (var i = 0; i < playlistTracks.length; i++) {
+        var input = document.createElement('input');
+        input.type = 'hidden';
+        input.name = 'tracks';
+        input.value = playlistTracks[i];
+        form.appendChild(input);
+    }
+    document.body.appendChild(form);
+    form.submit();
+    document.body.removeChild(form);
+}
+
+// Download every track below the current browser directory as a ZIP.
+function downloadCurrentDir() {
+    var dirPath = (browserCurDir || '').split('/').map(encodeURIComponent).join('/');
+    window.location.href = '/download/' + dirPath;
+}
+
+// Copy the podcast feed URL of the current browser directory.
+async function copyFeedUrl() {
+    const data = await fetchAPI('feedUrl', browserCurDir || '');
+    if (data.status !== 'ok') {
+        alert(data.message || 'Failed to get feed URL');
+        return;
+    }
+    try {
+        await navigator.clipboard.writeText(data.url);
+        showToast('Feed URL copied');
+    } catch (e) {
+        prompt('Feed URL', data.url);
+    }
+}
+
+// Create an expiring share link for the current directory and copy it.
+async function shareCurrentDir() {
+    var expires = prompt('Share link expires in (e.g. 24h or 7d)', '7d');
+    if (expires === null) return;
+    const data = await fetchAPI('createShare', JSON.stringify({ path: browserCurDir || '', expires: expires }));
+    if (data.status !== 'ok') {
+        alert(data.message || 'Failed to create share link');
+        return;
+    }
+    try {
+        await navigator.clipboard.writeText(data.share.url);
+        showToast('Share link copied');
+    } catch (e) {
+        prompt('Share link', data.share.url);
+    }
+}
+
+// Read a playlist file chosen by the user and add the tracks the server could resolve.
+function importPlaylistFile(input) {
+    if (!input.files || !input.files.length) return;
+    var file = input.files[0];
+    var reader = new FileReader();
+    reader.onload = async function () {
+        const data = await fetchAPI('importPlaylist', JSON.stringify({ content: String(reader.result) }));
+        if (data.status !== 'ok') {
+            alert(data.message || 'Import failed');
+            return;
+        }
+        addFilesToPlaylist(data.files);
+        var text = String(data.files.length) + ' tracks imported';
+        if (data.missing && data.missing.length) {
+            text += ', ' + data.missing.length + ' not found';
+        }
+        showToast(text);
+    };
+    reader.readAsText(file);
+    input.value = '';
+}
+
+// Resolve a playlist file from the library and add its tracks to the playlist.
+async function addLibraryPlaylist(id) {
+    var path = browserCurDir + browserPlaylists[id];
+    markLoading('browser');
+    const data = await fetchAPI('resolvePlaylist', path);
+    if (data.status !== 'ok') {
+        alert(data.message || 'Failed to load playlist');
+        return;
+    }
+    addFilesToPlaylist(data.files);
+    var text = getTrackTitle(browserPlaylists[id]) + ': ' + data.files.length + ' tracks added';
+    if (data.missing && data.missing.length) {
+        text += ', ' + data.missing.length + ' missing';
+    }
+    showToast(text);
+}
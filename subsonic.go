@@ -0,0 +1,597 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SUBSONIC_API_VERSION    = "1.16.1"
+	SUBSONIC_XMLNS          = "http://subsonic.org/restapi"
+	SUBSONIC_FOLDER_ID      = "1"
+	SUBSONIC_IGNORED_PREFIX = "The El La Los Las Le Les"
+
+	// Subsonic error codes
+	SUBSONIC_ERR_GENERIC       = 0
+	SUBSONIC_ERR_MISSING_PARAM = 10
+	SUBSONIC_ERR_AUTH          = 40
+	SUBSONIC_ERR_NOT_FOUND     = 70
+)
+
+// Subsonic credentials (SUBSONIC_USER / SUBSONIC_PASSWORD). When no user is
+// configured any credentials are accepted, like the rest of the app.
+var (
+	subsonicUser     = os.Getenv("SUBSONIC_USER")
+	subsonicPassword = os.Getenv("SUBSONIC_PASSWORD")
+)
+
+// coverArtNames are preferred album art file names, in order.
+var coverArtNames = []string{"cover", "folder", "front", "album", "albumart"}
+
+// Subsonic ids encode the library path with a one-letter kind prefix.
+const (
+	subsonicDirID      = 'd'
+	subsonicSongID     = 's'
+	subsonicPlaylistID = 'p'
+)
+
+// subsonicResponse is the envelope shared by the XML and JSON encodings.
+type subsonicResponse struct {
+	XMLName       xml.Name `xml:"subsonic-response" json:"-"`
+	Xmlns         string   `xml:"xmlns,attr" json:"-"`
+	Status        string   `xml:"status,attr" json:"status"`
+	Version       string   `xml:"version,attr" json:"version"`
+	Type          string   `xml:"type,attr" json:"type"`
+	ServerVersion string   `xml:"serverVersion,attr" json:"serverVersion"`
+	OpenSubsonic  bool     `xml:"openSubsonic,attr" json:"openSubsonic"`
+
+	Error         *subsonicError        `xml:"error,omitempty" json:"error,omitempty"`
+	License       *subsonicLicense      `xml:"license,omitempty" json:"license,omitempty"`
+	MusicFolders  *subsonicMusicFolders `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Indexes       *subsonicIndexes      `xml:"indexes,omitempty" json:"indexes,omitempty"`
+	Directory     *subsonicDirectory    `xml:"directory,omitempty" json:"directory,omitempty"`
+	SearchResult3 *subsonicSearchResult `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+	Playlists     *subsonicPlaylists    `xml:"playlists,omitempty" json:"playlists,omitempty"`
+	Playlist      *subsonicPlaylist     `xml:"playlist,omitempty" json:"playlist,omitempty"`
+}
+
+type subsonicError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type subsonicLicense struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type subsonicMusicFolders struct {
+	MusicFolder []subsonicMusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type subsonicMusicFolder struct {
+	ID   string `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type subsonicIndexes struct {
+	LastModified    int64           `xml:"lastModified,attr" json:"lastModified"`
+	IgnoredArticles string          `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index           []subsonicIndex `xml:"index" json:"index,omitempty"`
+	Child           []subsonicChild `xml:"child" json:"child,omitempty"`
+}
+
+type subsonicIndex struct {
+	Name   string           `xml:"name,attr" json:"name"`
+	Artist []subsonicArtist `xml:"artist" json:"artist"`
+}
+
+type subsonicArtist struct {
+	ID   string `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type subsonicDirectory struct {
+	ID     string          `xml:"id,attr" json:"id"`
+	Parent string          `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	Name   string          `xml:"name,attr" json:"name"`
+	Child  []subsonicChild `xml:"child" json:"child,omitempty"`
+}
+
+// subsonicChild is a directory entry: either a sub-directory or a song.
+type subsonicChild struct {
+	ID          string `xml:"id,attr" json:"id"`
+	Parent      string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir       bool   `xml:"isDir,attr" json:"isDir"`
+	Title       string `xml:"title,attr" json:"title"`
+	Album       string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist      string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	CoverArt    string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Suffix      string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	ContentType string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Path        string `xml:"path,attr,omitempty" json:"path,omitempty"`
+	Type        string `xml:"type,attr,omitempty" json:"type,omitempty"`
+}
+
+type subsonicSearchResult struct {
+	Artist []subsonicArtist `xml:"artist" json:"artist,omitempty"`
+	Album  []subsonicChild  `xml:"album" json:"album,omitempty"`
+	Song   []subsonicChild  `xml:"song" json:"song,omitempty"`
+}
+
+type subsonicPlaylists struct {
+	Playlist []subsonicPlaylist `xml:"playlist" json:"playlist"`
+}
+
+type subsonicPlaylist struct {
+	ID        string          `xml:"id,attr" json:"id"`
+	Name      string          `xml:"name,attr" json:"name"`
+	Owner     string          `xml:"owner,attr,omitempty" json:"owner,omitempty"`
+	Public    bool            `xml:"public,attr" json:"public"`
+	SongCount int             `xml:"songCount,attr" json:"songCount"`
+	Duration  int             `xml:"duration,attr" json:"duration"`
+	Entry     []subsonicChild `xml:"entry" json:"entry,omitempty"`
+}
+
+// subsonicMethod handles one endpoint. It returns the response to encode, or
+// nil when it has already written the response (e.g. streaming audio).
+type subsonicMethod func(c *gin.Context) *subsonicResponse
+
+var subsonicMethods = map[string]subsonicMethod{
+	"ping":              func(c *gin.Context) *subsonicResponse { return subsonicOK() },
+	"getLicense":        subsonicGetLicense,
+	"getMusicFolders":   subsonicGetMusicFolders,
+	"getIndexes":        subsonicGetIndexes,
+	"getMusicDirectory": subsonicGetMusicDirectory,
+	"search3":           subsonicSearch3,
+	"stream":            subsonicStream,
+	"download":          subsonicDownload,
+	"getCoverArt":       subsonicGetCoverArt,
+	"getPlaylists":      subsonicGetPlaylists,
+	"getPlaylist":       subsonicGetPlaylist,
+}
+
+// subsonicHandler serves /rest/<method>[.view] for Subsonic clients.
+func subsonicHandler(c *gin.Context) {
+	name := strings.TrimSuffix(path.Base(c.Param("method")), ".view")
+	method, ok := subsonicMethods[name]
+	if !ok {
+		writeSubsonic(c, subsonicFailure(SUBSONIC_ERR_NOT_FOUND, "Unknown method: "+name))
+		return
+	}
+	if failure := subsonicAuth(c); failure != nil {
+		writeSubsonic(c, failure)
+		return
+	}
+	if resp := method(c); resp != nil {
+		writeSubsonic(c, resp)
+	}
+}
+
+// subsonicAuth checks token (t = md5(password + s)) or password (p, plain or
+// "enc:" hex) authentication.
+func subsonicAuth(c *gin.Context) *subsonicResponse {
+	if subsonicUser == "" {
+		return nil
+	}
+	user, token, salt, pass := subsonicParam(c, "u"), subsonicParam(c, "t"), subsonicParam(c, "s"), subsonicParam(c, "p")
+	if user == "" || (pass == "" && (token == "" || salt == "")) {
+		return subsonicFailure(SUBSONIC_ERR_MISSING_PARAM, "Required parameter is missing")
+	}
+	var ok bool
+	if token != "" && salt != "" {
+		sum := md5.Sum([]byte(subsonicPassword + salt))
+		ok = subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(token))) == 1
+	} else {
+		if enc, found := strings.CutPrefix(pass, "enc:"); found {
+			b, err := hex.DecodeString(enc)
+			if err != nil {
+				return subsonicFailure(SUBSONIC_ERR_AUTH, "Wrong username or password")
+			}
+			pass = string(b)
+		}
+		ok = subtle.ConstantTimeCompare([]byte(pass), []byte(subsonicPassword)) == 1
+	}
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(subsonicUser)) != 1 {
+		return subsonicFailure(SUBSONIC_ERR_AUTH, "Wrong username or password")
+	}
+	// An account of the same name supplies the groups for access control.
+	if u, found := authUsers[subsonicUser]; found {
+		c.Set(AUTH_USER_KEY, u)
+	}
+	return nil
+}
+
+// subsonicParam reads a parameter from the query string or a POSTed form.
+func subsonicParam(c *gin.Context, name string) string {
+	if v, ok := c.GetQuery(name); ok {
+		return v
+	}
+	return c.PostForm(name)
+}
+
+func subsonicOK() *subsonicResponse {
+	return &subsonicResponse{
+		Xmlns:         SUBSONIC_XMLNS,
+		Status:        "ok",
+		Version:       SUBSONIC_API_VERSION,
+		Type:          "go-music",
+		ServerVersion: Version,
+		OpenSubsonic:  true,
+	}
+}
+
+func subsonicFailure(code int, message string) *subsonicResponse {
+	resp := subsonicOK()
+	resp.Status = "failed"
+	resp.Error = &subsonicError{Code: code, Message: message}
+	return resp
+}
+
+// writeSubsonic encodes resp as XML (default), JSON or JSONP according to
+// the f parameter. Subsonic reports errors in the body with HTTP 200.
+func writeSubsonic(c *gin.Context, resp *subsonicResponse) {
+	switch subsonicParam(c, "f") {
+	case "json":
+		c.JSON(http.StatusOK, gin.H{"subsonic-response": resp})
+	case "jsonp":
+		c.JSONP(http.StatusOK, gin.H{"subsonic-response": resp})
+	default:
+		out, err := xml.Marshal(resp)
+		if err != nil {
+			log.Printf("Subsonic XML encode error: %v", err)
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		c.Data(http.StatusOK, "text/xml; charset=utf-8", append([]byte(xml.Header), out...))
+	}
+}
+
+func subsonicID(kind byte, p string) string {
+	return string(kind) + base64.RawURLEncoding.EncodeToString([]byte(p))
+}
+
+// parseSubsonicID decodes an id of the given kind back into a library path.
+func parseSubsonicID(id string, kind byte) (string, bool) {
+	if len(id) < 2 || id[0] != kind {
+		return "", false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(id[1:])
+	if err != nil {
+		return "", false
+	}
+	p := string(b)
+	if strings.Contains(p, "..") || strings.HasPrefix(p, "/") {
+		return "", false
+	}
+	return p, true
+}
+
+func subsonicGetLicense(c *gin.Context) *subsonicResponse {
+	resp := subsonicOK()
+	resp.License = &subsonicLicense{Valid: true}
+	return resp
+}
+
+func subsonicGetMusicFolders(c *gin.Context) *subsonicResponse {
+	resp := subsonicOK()
+	resp.MusicFolders = &subsonicMusicFolders{MusicFolder: []subsonicMusicFolder{{ID: SUBSONIC_FOLDER_ID, Name: "Music"}}}
+	return resp
+}
+
+// subsonicGetIndexes lists the top-level directories grouped by initial.
+func subsonicGetIndexes(c *gin.Context) *subsonicResponse {
+	listing, err := listDirEntries("")
+	if err != nil {
+		log.Printf("Subsonic getIndexes error: %v", err)
+		return subsonicFailure(SUBSONIC_ERR_GENERIC, TXT_ACC_DIR)
+	}
+	listing = accessFor(c).filterListing("", listing)
+	groups := map[string][]subsonicArtist{}
+	for _, d := range listing.Dirs {
+		key := subsonicIndexKey(d)
+		groups[key] = append(groups[key], subsonicArtist{ID: subsonicID(subsonicDirID, d), Name: d})
+	}
+	indexes := &subsonicIndexes{LastModified: time.Now().UnixMilli(), IgnoredArticles: SUBSONIC_IGNORED_PREFIX}
+	for key, artists := range groups {
+		sort.Slice(artists, func(i, j int) bool { return strings.ToLower(artists[i].Name) < strings.ToLower(artists[j].Name) })
+		indexes.Index = append(indexes.Index, subsonicIndex{Name: key, Artist: artists})
+	}
+	sort.Slice(indexes.Index, func(i, j int) bool { return indexes.Index[i].Name < indexes.Index[j].Name })
+	sort.Strings(listing.Files)
+	for _, f := range listing.Files {
+		indexes.Child = append(indexes.Child, subsonicSong(f))
+	}
+	resp := subsonicOK()
+	resp.Indexes = indexes
+	return resp
+}
+
+// subsonicIndexKey is the upper-case initial of name, or "#".
+func subsonicIndexKey(name string) string {
+	if r, _ := utf8.DecodeRuneInString(name); unicode.IsLetter(r) {
+		return strings.ToUpper(string(r))
+	}
+	return "#"
+}
+
+func subsonicGetMusicDirectory(c *gin.Context) *subsonicResponse {
+	dir, ok := parseSubsonicID(subsonicParam(c, "id"), subsonicDirID)
+	access := accessFor(c)
+	if !ok || !access.dirVisible(dir) {
+		return subsonicFailure(SUBSONIC_ERR_NOT_FOUND, "Directory not found")
+	}
+	listing, err := listDirEntries(dir + "/")
+	if err != nil {
+		return subsonicFailure(SUBSONIC_ERR_NOT_FOUND, "Directory not found")
+	}
+	listing = access.filterListing(dir, listing)
+	sort.Strings(listing.Dirs)
+	sort.Strings(listing.Files)
+
+	d := &subsonicDirectory{ID: subsonicID(subsonicDirID, dir), Name: path.Base(dir)}
+	if parent := path.Dir(dir); parent != "." {
+		d.Parent = subsonicID(subsonicDirID, parent)
+	}
+	for _, sub := range listing.Dirs {
+		d.Child = append(d.Child, subsonicDirChild(path.Join(dir, sub)))
+	}
+	for _, f := range listing.Files {
+		d.Child = append(d.Child, subsonicSong(path.Join(dir, f)))
+	}
+	resp := subsonicOK()
+	resp.Directory = d
+	return resp
+}
+
+func subsonicDirChild(dir string) subsonicChild {
+	child := subsonicChild{ID: subsonicID(subsonicDirID, dir), IsDir: true, Title: path.Base(dir), CoverArt: subsonicID(subsonicDirID, dir)}
+	if parent := path.Dir(dir); parent != "." {
+		child.Parent = subsonicID(subsonicDirID, parent)
+		child.Artist = path.Base(parent)
+	}
+	return child
+}
+
+// subsonicSong describes a track. Without tags the title comes from the file
+// name ("Artist - Title" is split) and the album from the directory.
+func subsonicSong(key string) subsonicChild {
+	title := trackTitle(key)
+	song := subsonicChild{
+		ID:          subsonicID(subsonicSongID, key),
+		Title:       title,
+		Suffix:      strings.TrimPrefix(strings.ToLower(path.Ext(key)), "."),
+		ContentType: s3ContentType(key, ""),
+		Path:        key,
+		Type:        "music",
+	}
+	if artist, name, found := strings.Cut(title, " - "); found {
+		song.Artist, song.Title = strings.TrimSpace(artist), strings.TrimSpace(name)
+	}
+	if dir := path.Dir(key); dir != "." {
+		song.Parent = subsonicID(subsonicDirID, dir)
+		song.CoverArt = song.Parent
+		song.Album = path.Base(dir)
+	}
+	return song
+}
+
+// subsonicSearch3 matches songs by path and albums by directory name. An
+// empty query ("" as sent by syncing clients) returns the whole library.
+func subsonicSearch3(c *gin.Context) *subsonicResponse {
+	query := strings.Trim(strings.TrimSpace(subsonicParam(c, "query")), `"*`)
+	var files, dirs []string
+	var err error
+	if query == "" {
+		files, err = listAllAudioFiles("")
+	} else {
+		files, err = searchFiles(query)
+		if err == nil {
+			dirs, err = searchDirs(query)
+		}
+	}
+	if err != nil {
+		log.Printf("Subsonic search3 error: %v", err)
+		return subsonicFailure(SUBSONIC_ERR_GENERIC, "Search failed")
+	}
+	access := accessFor(c)
+	files, dirs = access.filterFiles(files), access.filterDirs(dirs)
+
+	result := &subsonicSearchResult{}
+	for i := range files {
+		files[i] = strings.ReplaceAll(files[i], `\`, "/")
+	}
+	sort.Strings(files)
+	for _, f := range subsonicPage(c, files, "song") {
+		result.Song = append(result.Song, subsonicSong(f))
+	}
+	for i := range dirs {
+		dirs[i] = strings.TrimSuffix(strings.ReplaceAll(dirs[i], `\`, "/"), "/")
+	}
+	sort.Strings(dirs)
+	for _, d := range subsonicPage(c, dirs, "album") {
+		if d != "" {
+			result.Album = append(result.Album, subsonicDirChild(d))
+		}
+	}
+	resp := subsonicOK()
+	resp.SearchResult3 = result
+	return resp
+}
+
+// subsonicPage applies the <kind>Count (default 20) and <kind>Offset params.
+func subsonicPage(c *gin.Context, items []string, kind string) []string {
+	count, err := strconv.Atoi(subsonicParam(c, kind+"Count"))
+	if err != nil || count < 0 {
+		count = 20
+	}
+	offset, err := strconv.Atoi(subsonicParam(c, kind+"Offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	if offset >= len(items) {
+		return nil
+	}
+	items = items[offset:]
+	if count < len(items) {
+		items = items[:count]
+	}
+	return items
+}
+
+// subsonicSongKey returns the track named by the id parameter. Only audio
+// files are songs, so other objects in the library are not served.
+func subsonicSongKey(c *gin.Context) (string, bool) {
+	key, ok := parseSubsonicID(subsonicParam(c, "id"), subsonicSongID)
+	return key, ok && isAudioFile(key)
+}
+
+func subsonicStream(c *gin.Context) *subsonicResponse {
+	key, ok := subsonicSongKey(c)
+	if !ok {
+		return subsonicFailure(SUBSONIC_ERR_NOT_FOUND, "Song not found")
+	}
+	serveAudio(c, key)
+	return nil
+}
+
+func subsonicDownload(c *gin.Context) *subsonicResponse {
+	key, ok := subsonicSongKey(c)
+	if !ok {
+		return subsonicFailure(SUBSONIC_ERR_NOT_FOUND, "Song not found")
+	}
+	c.Header("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(path.Base(key)))
+	serveAudio(c, key)
+	return nil
+}
+
+// subsonicGetCoverArt serves the album art image of a directory or song.
+func subsonicGetCoverArt(c *gin.Context) *subsonicResponse {
+	id := subsonicParam(c, "id")
+	dir, ok := parseSubsonicID(id, subsonicDirID)
+	if !ok {
+		song, isSong := parseSubsonicID(id, subsonicSongID)
+		if !isSong {
+			return subsonicFailure(SUBSONIC_ERR_NOT_FOUND, "Cover art not found")
+		}
+		dir = path.Dir(song)
+	}
+	key, ok := findCoverArt(dir)
+	if !ok {
+		return subsonicFailure(SUBSONIC_ERR_NOT_FOUND, "Cover art not found")
+	}
+	serveAudio(c, key)
+	return nil
+}
+
+// findCoverArt returns the preferred image in dir: a well-known name such as
+// cover.jpg or folder.png, otherwise the first image.
+func findCoverArt(dir string) (string, bool) {
+	prefix := ""
+	if dir != "" && dir != "." {
+		prefix = dir + "/"
+	}
+	listing, err := listDirEntries(prefix)
+	if err != nil || len(listing.Images) == 0 {
+		return "", false
+	}
+	sort.Strings(listing.Images)
+	for _, want := range coverArtNames {
+		for _, img := range listing.Images {
+			if strings.EqualFold(strings.TrimSuffix(img, path.Ext(img)), want) {
+				return prefix + img, true
+			}
+		}
+	}
+	return prefix + listing.Images[0], true
+}
+
+func subsonicGetPlaylists(c *gin.Context) *subsonicResponse {
+	files, err := listAllPlaylists()
+	if err != nil {
+		log.Printf("Subsonic getPlaylists error: %v", err)
+		return subsonicFailure(SUBSONIC_ERR_GENERIC, TXT_ACC_DIR)
+	}
+	files = accessFor(c).filterFiles(files)
+	sort.Strings(files)
+	playlists := &subsonicPlaylists{Playlist: []subsonicPlaylist{}}
+	for _, f := range files {
+		f = strings.ReplaceAll(f, `\`, "/")
+		playlists.Playlist = append(playlists.Playlist, subsonicPlaylist{
+			ID:    subsonicID(subsonicPlaylistID, f),
+			Name:  trackTitle(f),
+			Owner: subsonicParam(c, "u"),
+		})
+	}
+	resp := subsonicOK()
+	resp.Playlists = playlists
+	return resp
+}
+
+func subsonicGetPlaylist(c *gin.Context) *subsonicResponse {
+	key, ok := parseSubsonicID(subsonicParam(c, "id"), subsonicPlaylistID)
+	access := accessFor(c)
+	if !ok || !isPlaylistFile(key) || !access.allowed(key) {
+		return subsonicFailure(SUBSONIC_ERR_NOT_FOUND, "Playlist not found")
+	}
+	files, _, err := resolveLibraryPlaylist(c.Request.Context(), key, access)
+	if err != nil {
+		log.Printf("Subsonic getPlaylist error (%s): %v", key, err)
+		return subsonicFailure(SUBSONIC_ERR_NOT_FOUND, "Playlist not found")
+	}
+	pl := &subsonicPlaylist{
+		ID:        subsonicID(subsonicPlaylistID, key),
+		Name:      trackTitle(key),
+		Owner:     subsonicParam(c, "u"),
+		SongCount: len(files),
+	}
+	for _, f := range files {
+		pl.Entry = append(pl.Entry, subsonicSong(f))
+	}
+	resp := subsonicOK()
+	resp.Playlist = pl
+	return resp
+}
+
+// serveAudio sends a library file to the client: directly from disk, streamed
+// from S3 in proxy mode, or as a redirect to a signed URL.
+func serveAudio(c *gin.Context, key string) {
+	if aclDenied(c, key) {
+		return
+	}
+	if usingLocal() {
+		absPath, err := localAbsPath(key)
+		if err != nil {
+			localPathError(c, err)
+			return
+		}
+		c.File(absPath)
+		return
+	}
+	if s3ProxyMode {
+		s3StreamHandler(c, key)
+		return
+	}
+	u, err := signedAudioURL(c, key)
+	if err != nil {
+		log.Printf("S3 presign error for key [%s]: %v", key, err)
+		c.String(http.StatusNotFound, "Audio not found")
+		return
+	}
+	c.Redirect(http.StatusFound, u)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// subsonicCall performs a Subsonic request and returns the recorder
+func subsonicCall(method string, params url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/rest/"+method+"?"+params.Encode(), nil))
+	return w
+}
+
+// subsonicJSON performs a Subsonic request with f=json and decodes the envelope
+func subsonicJSON(t *testing.T, method string, params url.Values) map[string]interface{} {
+	t.Helper()
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("f", "json")
+	w := subsonicCall(method, params)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var body map[string]map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return body["subsonic-response"]
+}
+
+// TestSubsonicAuth checks password and token/salt authentication
+func TestSubsonicAuth(t *testing.T) {
+	origUser, origPass := subsonicUser, subsonicPassword
+	defer func() { subsonicUser, subsonicPassword = origUser, origPass }()
+	subsonicUser, subsonicPassword = "alice", "sesame"
+
+	sum := md5.Sum([]byte("sesame" + "c19b2d"))
+	tests := []struct {
+		name   string
+		params url.Values
+		code   float64 // 0 = success
+	}{
+		{"Plain password", url.Values{"u": {"alice"}, "p": {"sesame"}}, 0},
+		{"Hex password", url.Values{"u": {"alice"}, "p": {"enc:" + hex.EncodeToString([]byte("sesame"))}}, 0},
+		{"Token and salt", url.Values{"u": {"alice"}, "t": {hex.EncodeToString(sum[:])}, "s": {"c19b2d"}}, 0},
+		{"Wrong token", url.Values{"u": {"alice"}, "t": {"00"}, "s": {"c19b2d"}}, SUBSONIC_ERR_AUTH},
+		{"Wrong user", url.Values{"u": {"bob"}, "p": {"sesame"}}, SUBSONIC_ERR_AUTH},
+		{"Missing credentials", url.Values{"u": {"alice"}}, SUBSONIC_ERR_MISSING_PARAM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := subsonicJSON(t, "ping.view", tt.params)
+			if tt.code == 0 {
+				assert.Equal(t, "ok", resp["status"])
+				return
+			}
+			assert.Equal(t, "failed", resp["status"])
+			assert.Equal(t, tt.code, resp["error"].(map[string]interface{})["code"])
+		})
+	}
+}
+
+// TestSubsonicBrowsing checks folders, indexes, directories, search and playlists
+func TestSubsonicBrowsing(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origLocalMusicDir := localMusicDir
+	defer func() {
+		localMusicDir = origLocalMusicDir
+	}()
+	localMusicDir = tmpDir
+
+	os.MkdirAll(filepath.Join(tmpDir, "Abba", "Gold"), 0755)
+	os.MkdirAll(filepath.Join(tmpDir, "beatles"), 0755)
+	os.MkdirAll(filepath.Join(tmpDir, "1990s"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Abba", "Gold", "Abba - Dancing Queen.mp3"), []byte("queen"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Abba", "Gold", "Folder.JPG"), []byte("jpeg"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Abba", "Gold", "back.png"), []byte("png"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "loose.mp3"), []byte("loose"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Abba", "hits.m3u"), []byte("Gold/Abba - Dancing Queen.mp3\n"), 0644)
+
+	t.Run("XML envelope", func(t *testing.T) {
+		w := subsonicCall("getMusicFolders", url.Values{})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Type"), "text/xml")
+		var resp struct {
+			XMLName xml.Name `xml:"subsonic-response"`
+			Status  string   `xml:"status,attr"`
+			Folders []struct {
+				ID string `xml:"id,attr"`
+			} `xml:"musicFolders>musicFolder"`
+		}
+		assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "ok", resp.Status)
+		assert.Len(t, resp.Folders, 1)
+		assert.Contains(t, w.Body.String(), `xmlns="http://subsonic.org/restapi"`)
+	})
+
+	t.Run("Indexes and directories", func(t *testing.T) {
+		resp := subsonicJSON(t, "getIndexes", nil)
+		indexes := resp["indexes"].(map[string]interface{})
+		index := indexes["index"].([]interface{})
+		assert.Len(t, index, 3) // "#", "A", "B"
+		assert.Equal(t, "#", index[0].(map[string]interface{})["name"])
+		artist := index[1].(map[string]interface{})["artist"].([]interface{})[0].(map[string]interface{})
+		assert.Equal(t, "Abba", artist["name"])
+		assert.Len(t, indexes["child"], 1)
+
+		resp = subsonicJSON(t, "getMusicDirectory", url.Values{"id": {artist["id"].(string)}})
+		dir := resp["directory"].(map[string]interface{})
+		assert.Equal(t, "Abba", dir["name"])
+		album := dir["child"].([]interface{})[0].(map[string]interface{})
+		assert.Equal(t, true, album["isDir"])
+		assert.Equal(t, "Gold", album["title"])
+
+		resp = subsonicJSON(t, "getMusicDirectory", url.Values{"id": {album["id"].(string)}})
+		dir = resp["directory"].(map[string]interface{})
+		assert.Equal(t, artist["id"], dir["parent"])
+		song := dir["child"].([]interface{})[0].(map[string]interface{})
+		assert.Equal(t, "Dancing Queen", song["title"])
+		assert.Equal(t, "Abba", song["artist"])
+		assert.Equal(t, "Gold", song["album"])
+		assert.Equal(t, "mp3", song["suffix"])
+		assert.Equal(t, "audio/mpeg", song["contentType"])
+
+		resp = subsonicJSON(t, "getMusicDirectory", url.Values{"id": {subsonicID(subsonicDirID, "../etc")}})
+		assert.Equal(t, "failed", resp["status"])
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		resp := subsonicJSON(t, "search3", url.Values{"query": {"gold"}})
+		result := resp["searchResult3"].(map[string]interface{})
+		assert.Len(t, result["song"], 1)
+		assert.Len(t, result["album"], 1)
+
+		resp = subsonicJSON(t, "search3", url.Values{"query": {`""`}, "songCount": {"1"}, "songOffset": {"1"}})
+		result = resp["searchResult3"].(map[string]interface{})
+		songs := result["song"].([]interface{})
+		assert.Len(t, songs, 1)
+		assert.Equal(t, "loose", songs[0].(map[string]interface{})["title"])
+	})
+
+	t.Run("Stream, download and cover art", func(t *testing.T) {
+		songID := subsonicID(subsonicSongID, "Abba/Gold/Abba - Dancing Queen.mp3")
+		w := subsonicCall("stream", url.Values{"id": {songID}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "queen", w.Body.String())
+
+		w = subsonicCall("download.view", url.Values{"id": {songID}})
+		assert.Equal(t, "queen", w.Body.String())
+		assert.Contains(t, w.Header().Get("Content-Disposition"), "Dancing%20Queen.mp3")
+
+		w = subsonicCall("getCoverArt", url.Values{"id": {songID}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "jpeg", w.Body.String())
+
+		resp := subsonicJSON(t, "getCoverArt", url.Values{"id": {subsonicID(subsonicDirID, "beatles")}})
+		assert.Equal(t, SUBSONIC_ERR_NOT_FOUND, int(resp["error"].(map[string]interface{})["code"].(float64)))
+
+		for _, key := range []string{"Abba/Gold/Folder.JPG", "Abba/hits.m3u"} {
+			for _, method := range []string{"stream", "download"} {
+				resp = subsonicJSON(t, method, url.Values{"id": {subsonicID(subsonicSongID, key)}})
+				assert.Equal(t, SUBSONIC_ERR_NOT_FOUND, int(resp["error"].(map[string]interface{})["code"].(float64)), method+" "+key)
+			}
+		}
+	})
+
+	t.Run("Playlists", func(t *testing.T) {
+		resp := subsonicJSON(t, "getPlaylists", nil)
+		playlists := resp["playlists"].(map[string]interface{})["playlist"].([]interface{})
+		assert.Len(t, playlists, 1)
+		pl := playlists[0].(map[string]interface{})
+		assert.Equal(t, "hits", pl["name"])
+
+		resp = subsonicJSON(t, "getPlaylist", url.Values{"id": {pl["id"].(string)}})
+		playlist := resp["playlist"].(map[string]interface{})
+		assert.Equal(t, float64(1), playlist["songCount"])
+		assert.Equal(t, "Abba/Gold/Abba - Dancing Queen.mp3", playlist["entry"].([]interface{})[0].(map[string]interface{})["path"])
+	})
+
+	t.Run("JSONP and unknown methods", func(t *testing.T) {
+		w := subsonicCall("ping", url.Values{"f": {"jsonp"}, "callback": {"cb"}})
+		assert.True(t, strings.HasPrefix(w.Body.String(), "cb("))
+
+		resp := subsonicJSON(t, "getAlbumList9", nil)
+		assert.Equal(t, "failed", resp["status"])
+	})
+}
+
+// TestSubsonicStreamS3 checks streaming redirects to a signed URL in S3 mode
+func TestSubsonicStreamS3(t *testing.T) {
+	newFakeS3(t, map[string][]byte{"Rock/song.mp3": []byte("abc")})
+	origCache := signedURLs
+	defer func() { signedURLs = origCache }()
+	signedURLs = newURLCache(SIGNED_URL_CACHE_SIZE)
+
+	w := subsonicCall("stream", url.Values{"id": {subsonicID(subsonicSongID, "Rock/song.mp3")}})
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "/music/Rock/song.mp3")
+}
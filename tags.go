@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Track tags are read from the head of the file: ID3v2 for MP3 (and any
+// file carrying an ID3v2 header) and Vorbis comments for FLAC. Ratings come
+// from POPM frames and FMPS_Rating user texts or comments. Files
+// without tags fall back to the names used elsewhere: "Artist - Title"
+// file names, the album from the directory and the artist from the
+// directory above it.
+
+const (
+	TAGS_MAX_BYTES  = 1 << 20 // largest tag read; bigger frames are skipped
+	TAGS_MAX_FRAME  = 64 << 10
+	ID3_HEADER_SIZE = 10
+)
+
+var errNoTags = errors.New("no tags")
+
+// trackTags are the tags of a track. Duration is in seconds, 0 if unknown,
+// and Rating is 1 to 5 stars, 0 if unrated.
+type trackTags struct {
+	Title       string `json:"title"`
+	Artist      string `json:"artist,omitempty"`
+	Album       string `json:"album,omitempty"`
+	TrackNumber int    `json:"trackNumber,omitempty"`
+	Duration    int    `json:"duration,omitempty"`
+	Rating      int    `json:"rating,omitempty"`
+	Genre       string `json:"genre,omitempty"`
+	Year        int    `json:"year,omitempty"`
+}
+
+// trackMeta returns the tags of key with the file-name fallbacks applied.
+func trackMeta(ctx context.Context, key string) trackTags {
+	tags, _ := readTags(ctx, key)
+	if tags.Title == "" {
+		title := trackTitle(key)
+		if artist, name, found := strings.Cut(title, " - "); found {
+			title = strings.TrimSpace(name)
+			if tags.Artist == "" {
+				tags.Artist = strings.TrimSpace(artist)
+			}
+		}
+		tags.Title = title
+	}
+	if tags.Artist == "" {
+		tags.Artist = trackArtist(key)
+	}
+	if dir := path.Dir(key); tags.Album == "" && dir != "." {
+		tags.Album = path.Base(dir)
+	}
+	return tags
+}
+
+// readTags reads the tags stored in key.
+func readTags(ctx context.Context, key string) (trackTags, error) {
+	obj, err := openAudio(ctx, key)
+	if err != nil {
+		return trackTags{}, err
+	}
+	defer func() { _ = obj.Close() }()
+	return parseTags(io.LimitReader(obj, TAGS_MAX_BYTES))
+}
+
+// parseTags detects and parses the tag format at the start of r.
+func parseTags(r io.Reader) (trackTags, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return trackTags{}, errNoTags
+	}
+	switch {
+	case string(magic[:3]) == "ID3":
+		return parseID3v2(io.MultiReader(bytes.NewReader(magic[:]), r))
+	case string(magic[:]) == "fLaC":
+		return parseFLAC(r)
+	}
+	return trackTags{}, errNoTags
+}
+
+// --- ID3v2 ---
+
+// parseID3v2 reads the text frames of an ID3v2.2, 2.3 or 2.4 tag.
+func parseID3v2(r io.Reader) (trackTags, error) {
+	var hdr [ID3_HEADER_SIZE]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil || string(hdr[:3]) != "ID3" {
+		return trackTags{}, errNoTags
+	}
+	version, flags := hdr[3], hdr[5]
+	if version < 2 || version > 4 {
+		return trackTags{}, errNoTags
+	}
+	tag := io.LimitReader(r, int64(syncsafe(hdr[6:10])))
+	if flags&0x40 != 0 && version > 2 {
+		if err := skipExtendedHeader(tag, version); err != nil {
+			return trackTags{}, err
+		}
+	}
+	var tags trackTags
+	for {
+		id, data, err := readID3Frame(tag, version)
+		if err != nil {
+			break
+		}
+		applyID3Frame(&tags, id, data)
+	}
+	return tags, nil
+}
+
+func skipExtendedHeader(r io.Reader, version byte) error {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return err
+	}
+	n := int64(binary.BigEndian.Uint32(size[:]))
+	if version == 4 {
+		n = int64(syncsafe(size[:])) - 4
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
+
+// readID3Frame returns the next frame. Frames larger than TAGS_MAX_FRAME
+// (such as cover art) are skipped and returned without data.
+func readID3Frame(r io.Reader, version byte) (string, []byte, error) {
+	idLen, hdrLen := 4, 10
+	if version == 2 {
+		idLen, hdrLen = 3, 6
+	}
+	hdr := make([]byte, hdrLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return "", nil, err
+	}
+	if hdr[0] == 0 {
+		return "", nil, io.EOF // padding
+	}
+	id := string(hdr[:idLen])
+	var size int64
+	switch version {
+	case 2:
+		size = int64(hdr[3])<<16 | int64(hdr[4])<<8 | int64(hdr[5])
+	case 3:
+		size = int64(binary.BigEndian.Uint32(hdr[4:8]))
+	default:
+		size = int64(syncsafe(hdr[4:8]))
+	}
+	if size > TAGS_MAX_FRAME {
+		_, err := io.CopyN(io.Discard, r, size)
+		return id, nil, err
+	}
+	data := make([]byte, size)
+	_, err := io.ReadFull(r, data)
+	return id, data, err
+}
+
+func applyID3Frame(tags *trackTags, id string, data []byte) {
+	switch id {
+	case "TIT2", "TT2":
+		tags.Title = id3Text(data)
+	case "TPE1", "TP1":
+		tags.Artist = id3Text(data)
+	case "TALB", "TAL":
+		tags.Album = id3Text(data)
+	case "TRCK", "TRK":
+		tags.TrackNumber = leadingNumber(id3Text(data))
+	case "TCON", "TCO":
+		tags.Genre = id3Genre(id3Text(data))
+	case "TYER", "TYE", "TDRC":
+		tags.Year = leadingNumber(id3Text(data))
+	case "TLEN", "TLE":
+		tags.Duration = leadingNumber(id3Text(data)) / 1000
+	case "POPM", "POP":
+		if tags.Rating == 0 {
+			tags.Rating = popmStars(data)
+		}
+	case "TXXX", "TXX":
+		if desc, value := id3UserText(data); strings.EqualFold(desc, "FMPS_Rating") && fmpsStars(value) > 0 {
+			tags.Rating = fmpsStars(value)
+		}
+	}
+}
+
+// id3GenreRef matches the ID3v1 genre references of "(17)Rock" genres.
+var id3GenreRef = regexp.MustCompile(`^(\(\d+\))+`)
+
+// id3Genre drops genre references that precede a genre name.
+func id3Genre(s string) string {
+	if name := strings.TrimSpace(id3GenreRef.ReplaceAllString(s, "")); name != "" {
+		return name
+	}
+	return s
+}
+
+// popmStars converts the 0-255 rating of a POPM frame (email, rating,
+// play counter) to stars using the ranges common taggers write.
+func popmStars(data []byte) int {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || i+1 >= len(data) || data[i+1] == 0 {
+		return 0
+	}
+	return (int(data[i+1])+32)/64 + 1
+}
+
+// fmpsStars converts an FMPS rating (0.0 to 1.0) to stars.
+func fmpsStars(value string) int {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || f <= 0 || f > 1 {
+		return 0
+	}
+	return max(int(f*5+0.5), 1)
+}
+
+// id3UserText splits a TXXX frame into its description and value.
+func id3UserText(data []byte) (string, string) {
+	if len(data) == 0 {
+		return "", ""
+	}
+	desc, value, _ := strings.Cut(decodeID3String(data[0], data[1:]), "\x00")
+	value, _, _ = strings.Cut(strings.TrimPrefix(value, "\ufeff"), "\x00")
+	return strings.TrimSpace(desc), strings.TrimSpace(value)
+}
+
+// id3Text decodes a text frame and returns its first value.
+func id3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	text := decodeID3String(data[0], data[1:])
+	text, _, _ = strings.Cut(text, "\x00")
+	return strings.TrimSpace(text)
+}
+
+// decodeID3String decodes b in the ID3 text encoding enc.
+func decodeID3String(enc byte, b []byte) string {
+	switch enc {
+	case 1, 2:
+		bigEndian := enc == 2
+		if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+			bigEndian, b = true, b[2:]
+		} else if len(b) >= 2 && b[0] == 0xFF && b[1] == 0xFE {
+			bigEndian, b = false, b[2:]
+		}
+		u := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			if bigEndian {
+				u = append(u, binary.BigEndian.Uint16(b[i:]))
+			} else {
+				u = append(u, binary.LittleEndian.Uint16(b[i:]))
+			}
+		}
+		return string(utf16.Decode(u))
+	case 3:
+		return string(b)
+	}
+	// ISO-8859-1 maps byte for byte onto the first Unicode code points.
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7f)<<21 | uint32(b[1]&0x7f)<<14 | uint32(b[2]&0x7f)<<7 | uint32(b[3]&0x7f)
+}
+
+// leadingNumber parses the number at the start of s, as in "3/12".
+func leadingNumber(s string) int {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	n, _ := strconv.Atoi(s[:end])
+	return n
+}
+
+// --- FLAC ---
+
+// parseFLAC reads the stream info and Vorbis comment metadata blocks that
+// follow the "fLaC" marker.
+func parseFLAC(r io.Reader) (trackTags, error) {
+	var tags trackTags
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return tags, nil
+		}
+		last, kind := hdr[0]&0x80 != 0, hdr[0]&0x7f
+		size := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		if (kind != 0 && kind != 4) || size > TAGS_MAX_FRAME {
+			if _, err := io.CopyN(io.Discard, r, size); err != nil {
+				return tags, nil
+			}
+		} else {
+			block := make([]byte, size)
+			if _, err := io.ReadFull(r, block); err != nil {
+				return tags, nil
+			}
+			if kind == 0 {
+				tags.Duration = flacDuration(block)
+			} else {
+				applyVorbisComments(&tags, vorbisComments(block))
+			}
+		}
+		if last {
+			return tags, nil
+		}
+	}
+}
+
+// flacDuration computes the length from a STREAMINFO block.
+func flacDuration(block []byte) int {
+	if len(block) < 18 {
+		return 0
+	}
+	rate := uint64(block[10])<<12 | uint64(block[11])<<4 | uint64(block[12])>>4
+	samples := uint64(block[13]&0x0f)<<32 | uint64(binary.BigEndian.Uint32(block[14:18]))
+	if rate == 0 {
+		return 0
+	}
+	return int(samples / rate)
+}
+
+// vorbisComments returns the comments of a VORBIS_COMMENT block keyed by
+// upper-case field name; repeated fields keep their first value.
+func vorbisComments(block []byte) map[string]string {
+	out := map[string]string{}
+	next := func() ([]byte, bool) {
+		if len(block) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(block)
+		if uint64(n) > uint64(len(block)-4) {
+			return nil, false
+		}
+		v := block[4 : 4+n]
+		block = block[4+n:]
+		return v, true
+	}
+	if _, ok := next(); !ok { // vendor string
+		return out
+	}
+	if len(block) < 4 {
+		return out
+	}
+	count := binary.LittleEndian.Uint32(block)
+	block = block[4:]
+	for range count {
+		c, ok := next()
+		if !ok {
+			break
+		}
+		if k, v, found := strings.Cut(string(c), "="); found {
+			k = strings.ToUpper(k)
+			if _, seen := out[k]; !seen {
+				out[k] = strings.TrimSpace(v)
+			}
+		}
+	}
+	return out
+}
+
+func applyVorbisComments(tags *trackTags, c map[string]string) {
+	tags.Title, tags.Artist, tags.Album = c["TITLE"], c["ARTIST"], c["ALBUM"]
+	tags.TrackNumber = leadingNumber(c["TRACKNUMBER"])
+	tags.Genre, tags.Year = c["GENRE"], leadingNumber(c["DATE"])
+	tags.Rating = fmpsStars(c["FMPS_RATING"])
+}
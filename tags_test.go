@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// id3Frame builds an ID3v2.3 text frame
+func id3Frame(id, text string) []byte {
+	data := append([]byte{3}, text...)
+	frame := append([]byte(id), 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(data)))
+	return append(frame, data...)
+}
+
+// popmFrame builds an ID3v2.3 POPM frame with the given rating
+func popmFrame(rating byte) []byte {
+	data := []byte("Windows Media Player 9 Series\x00")
+	data = append(data, rating, 0, 0, 0, 1)
+	frame := append([]byte("POPM"), 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(data)))
+	return append(frame, data...)
+}
+
+// id3Tag wraps frames in an ID3v2 header of the given version
+func id3Tag(version byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	body = append(body, make([]byte, 16)...) // padding
+	n := len(body)
+	hdr := []byte{'I', 'D', '3', version, 0, 0, byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+	return append(hdr, body...)
+}
+
+// flacFile builds a FLAC header with STREAMINFO and Vorbis comments
+func flacFile(rate, samples uint64, comments ...string) []byte {
+	info := make([]byte, 34)
+	info[10], info[11], info[12] = byte(rate>>12), byte(rate>>4), byte(rate<<4)
+	info[13] = byte(samples >> 32 & 0x0f)
+	binary.BigEndian.PutUint32(info[14:18], uint32(samples))
+
+	var vc bytes.Buffer
+	le := func(n int) { _ = binary.Write(&vc, binary.LittleEndian, uint32(n)) }
+	le(len("test"))
+	vc.WriteString("test")
+	le(len(comments))
+	for _, c := range comments {
+		le(len(c))
+		vc.WriteString(c)
+	}
+
+	out := []byte("fLaC")
+	out = append(out, 0, 0, 0, 34)
+	out = append(out, info...)
+	n := vc.Len()
+	out = append(out, 0x80|4, byte(n>>16), byte(n>>8), byte(n))
+	return append(out, vc.Bytes()...)
+}
+
+// TestParseTags checks reading ID3v2 and FLAC tags
+func TestParseTags(t *testing.T) {
+	tags, err := parseTags(bytes.NewReader(id3Tag(3,
+		id3Frame("TIT2", "So What"),
+		id3Frame("TPE1", "Miles Davis"),
+		id3Frame("TALB", "Kind of Blue"),
+		id3Frame("TRCK", "1/5"),
+		id3Frame("TLEN", "545000"),
+	)))
+	assert.NoError(t, err)
+	assert.Equal(t, trackTags{Title: "So What", Artist: "Miles Davis", Album: "Kind of Blue", TrackNumber: 1, Duration: 545}, tags)
+
+	// UTF-16 with BOM, as written by many taggers.
+	utf16Frame := []byte("TIT2\x00\x00\x00\x09\x00\x00\x01\xff\xfeC\x00a\x00f\x00")
+	tags, err = parseTags(bytes.NewReader(id3Tag(3, utf16Frame)))
+	assert.NoError(t, err)
+	assert.Equal(t, "Caf", tags.Title)
+
+	// Latin-1
+	assert.Equal(t, "Café", id3Text([]byte{0, 'C', 'a', 'f', 0xe9}))
+
+	tags, err = parseTags(bytes.NewReader(flacFile(44100, 44100*200, "TITLE=Blue in Green", "artist=Miles Davis", "ALBUM=Kind of Blue", "TRACKNUMBER=3")))
+	assert.NoError(t, err)
+	assert.Equal(t, trackTags{Title: "Blue in Green", Artist: "Miles Davis", Album: "Kind of Blue", TrackNumber: 3, Duration: 200}, tags)
+
+	tags, err = parseTags(bytes.NewReader(flacFile(44100, 0, "FMPS_RATING=0.6")))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, tags.Rating)
+
+	tags, err = parseTags(bytes.NewReader(id3Tag(3, id3Frame("TCON", "(8)Jazz"), id3Frame("TYER", "1959"))))
+	assert.NoError(t, err)
+	assert.Equal(t, "Jazz", tags.Genre)
+	assert.Equal(t, 1959, tags.Year)
+
+	tags, err = parseTags(bytes.NewReader(flacFile(44100, 0, "GENRE=Jazz", "DATE=1959-08-17")))
+	assert.NoError(t, err)
+	assert.Equal(t, "Jazz", tags.Genre)
+	assert.Equal(t, 1959, tags.Year)
+
+	_, err = parseTags(bytes.NewReader([]byte("RIFF....WAVE")))
+	assert.ErrorIs(t, err, errNoTags)
+}
+
+// TestTagRatings checks reading POPM and FMPS ratings
+func TestTagRatings(t *testing.T) {
+	for rating, stars := range map[byte]int{1: 1, 64: 2, 128: 3, 196: 4, 255: 5} {
+		tags, err := parseTags(bytes.NewReader(id3Tag(3, popmFrame(rating))))
+		assert.NoError(t, err)
+		assert.Equal(t, stars, tags.Rating, "POPM %d", rating)
+	}
+	tags, _ := parseTags(bytes.NewReader(id3Tag(3, popmFrame(0))))
+	assert.Zero(t, tags.Rating, "unrated")
+
+	// FMPS_Rating in a TXXX frame takes precedence over POPM.
+	tags, _ = parseTags(bytes.NewReader(id3Tag(4, id3Frame("TXXX", "FMPS_Rating\x000.2"), popmFrame(255))))
+	assert.Equal(t, 1, tags.Rating)
+	assert.Equal(t, 0, fmpsStars("1.5"))
+}
+
+// TestTrackMeta checks the file name fallbacks
+func TestTrackMeta(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "gomusic-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	origLocalMusicDir := localMusicDir
+	defer func() { localMusicDir = origLocalMusicDir }()
+	localMusicDir = tmpDir
+	os.MkdirAll(filepath.Join(tmpDir, "Miles Davis", "Kind of Blue"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "Miles Davis", "Kind of Blue", "01 So What.mp3"), []byte("no tags"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "Coltrane - Naima.mp3"), id3Tag(4, id3Frame("TALB", "Giant Steps")), 0644)
+
+	ctx := context.Background()
+	meta := trackMeta(ctx, "Miles Davis/Kind of Blue/01 So What.mp3")
+	assert.Equal(t, "Miles Davis", meta.Artist)
+	assert.Equal(t, "Kind of Blue", meta.Album)
+	assert.NotEmpty(t, meta.Title)
+
+	meta = trackMeta(ctx, "Coltrane - Naima.mp3")
+	assert.Equal(t, trackTags{Title: "Naima", Artist: "Coltrane", Album: "Giant Steps"}, meta)
+}